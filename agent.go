@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cheolhuikim/egress-probe/pkg/probe"
+)
+
+// runRequest is the body a coordinator POSTs to an agent's /run endpoint.
+// Targets are sent structured rather than as target strings so that an agent
+// can never be asked to run an exec plugin or to read a client certificate
+// file: it presents its own CLIENT_CERT, if any.
+type runRequest struct {
+	Targets    []runTarget `json:"targets"`
+	Timeout    string      `json:"timeout,omitempty"`     // per-phase timeout; agent default if empty
+	RunTimeout string      `json:"run_timeout,omitempty"` // deadline for the whole run
+	Profile    string      `json:"profile,omitempty"`     // PROFILE to run with; agent default if empty
+}
+
+type runTarget struct {
+	Host     string            `json:"host"`
+	Port     int               `json:"port"`
+	Type     string            `json:"type"` // "allow" or "deny"
+	SkipTLS  bool              `json:"skip_tls"`
+	Issuer   string            `json:"issuer,omitempty"`
+	Phases   string            `json:"phases,omitempty"`
+	Expect   string            `json:"expect,omitempty"`
+	Method   string            `json:"method,omitempty"`
+	Path     string            `json:"path,omitempty"`
+	Timeout  string            `json:"timeout,omitempty"`
+	Family   string            `json:"family,omitempty"`
+	Priority int               `json:"priority,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+func toRunTargets(targets []probe.Target) []runTarget {
+	out := make([]runTarget, len(targets))
+	for i, t := range targets {
+		typ := "allow"
+		if t.ExpectErr {
+			typ = "deny"
+		}
+		out[i] = runTarget{Host: t.Host, Port: t.Port, Type: typ, SkipTLS: t.SkipTLS, Issuer: t.Issuer, Phases: t.Phases, Expect: t.Expect, Method: t.Method, Path: t.Path, Family: t.Family, Priority: t.Priority, Metadata: t.Metadata}
+		if t.Timeout > 0 {
+			out[i].Timeout = t.Timeout.String()
+		}
+	}
+	return out
+}
+
+func (req runRequest) probeTargets() ([]probe.Target, error) {
+	if len(req.Targets) == 0 {
+		return nil, errors.New("no targets")
+	}
+	targets := make([]probe.Target, len(req.Targets))
+	for i, rt := range req.Targets {
+		if rt.Host == "" || rt.Port <= 0 || rt.Port > 65535 {
+			return nil, fmt.Errorf("target %d: invalid host or port", i)
+		}
+		if rt.Type != "allow" && rt.Type != "deny" {
+			return nil, fmt.Errorf("target %d: type must be allow or deny", i)
+		}
+		if err := probe.ValidatePhases(rt.Phases); err != nil {
+			return nil, fmt.Errorf("target %d: %v", i, err)
+		}
+		if err := probe.ValidateExpect(rt.Expect); err != nil {
+			return nil, fmt.Errorf("target %d: %v", i, err)
+		}
+		if rt.Family != "" && rt.Family != "ipv4" && rt.Family != "ipv6" {
+			return nil, fmt.Errorf("target %d: family must be ipv4 or ipv6", i)
+		}
+		targets[i] = probe.Target{Host: rt.Host, Port: rt.Port, SkipTLS: rt.SkipTLS, ExpectErr: rt.Type == "deny", Issuer: rt.Issuer, Phases: rt.Phases, Expect: rt.Expect, Method: rt.Method, Path: rt.Path, Family: rt.Family, Priority: rt.Priority, Metadata: rt.Metadata}
+		if rt.Timeout != "" {
+			d, err := time.ParseDuration(rt.Timeout)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("target %d: invalid timeout %q", i, rt.Timeout)
+			}
+			targets[i].Timeout = d
+		}
+	}
+	return targets, nil
+}
+
+// agent probes target lists on behalf of a coordinator, one run at a time so
+// that concurrent requests don't defeat the sequential DNS phase.
+type agent struct {
+	cfg Config
+	mu  sync.Mutex
+}
+
+// runAgent serves POST /run until ctx is cancelled. Each request carries the
+// targets to probe and is answered with a report from this agent's network.
+func runAgent(ctx context.Context, cfg Config) {
+	a := &agent{cfg: cfg}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /run", a.handleRun)
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok\n")
+	})
+
+	srv := &http.Server{Addr: cfg.ListenAddr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	if cfg.AgentToken == "" {
+		logf("agent mode: AGENT_TOKEN is not set; any client that can reach %s can trigger runs", cfg.ListenAddr)
+	}
+	logf("agent mode: %s listening on %s", cfg.NodeName, cfg.ListenAddr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logf("agent: %v", err)
+		return
+	}
+	logf("shutting down")
+}
+
+// authorized reports whether r carries token as its bearer token. Without a
+// token, every request is.
+func authorized(r *http.Request, token string) bool {
+	if token == "" {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) == 1
+}
+
+func (a *agent) handleRun(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r, a.cfg.AgentToken) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req runRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxReportBytes)).Decode(&req); err != nil {
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	targets, err := req.probeTargets()
+	if err != nil {
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !validProfile(req.Profile) {
+		http.Error(w, "invalid request: unknown profile "+req.Profile, http.StatusBadRequest)
+		return
+	}
+	cfg := a.cfg
+	if req.Profile != "" {
+		cfg.Profile = req.Profile
+	}
+	if d, err := time.ParseDuration(req.Timeout); err == nil && d > 0 {
+		cfg.Timeout = d
+	}
+	if d, err := time.ParseDuration(req.RunTimeout); err == nil && d > 0 {
+		cfg.RunTimeout = d
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ctx := r.Context()
+	if cfg.RunTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.RunTimeout)
+		defer cancel()
+	}
+	start := time.Now()
+	probe.WarmupDNS(ctx, cfg.Timeout)
+	results, _ := probe.Run(ctx, targets, probeOptions(cfg))
+	out := buildJSON(results, cfg.Timeout, time.Since(start))
+	scoreHealth(out.Results, cfg.LatencySLO)
+	logf("run from %s: %d/%d passed", r.RemoteAddr, out.Summary.Passed, out.Summary.Total)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(nodeReport{
+		Node:        a.cfg.NodeName,
+		Time:        start,
+		Summary:     out.Summary,
+		Environment: currentEnvironment(ctx),
+		Results:     out.Results,
+	})
+}
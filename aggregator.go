@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	defaultListenAddr = ":8080"
+	// Nodes that stop reporting (scaled down, drained) are dropped from the
+	// matrix after this long, so it only shows the current fleet.
+	aggregatorNodeTTL = 30 * time.Minute
+	maxReportBytes    = 4 << 20
+)
+
+// nodeReport is what each probe pushes to the aggregator: the regular JSON
+// report tagged with the node it ran on.
+type nodeReport struct {
+	Node        string       `json:"node"`
+	Time        time.Time    `json:"time"`
+	Summary     jsonSummary  `json:"summary"`
+	Environment *environment `json:"environment,omitempty"`
+	Results     []jsonResult `json:"results"`
+}
+
+// pushReport POSTs a report to the aggregator at baseURL, with token as a
+// bearer token if set.
+func pushReport(ctx context.Context, baseURL, token string, report nodeReport) error {
+	data, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	url := strings.TrimRight(baseURL, "/") + "/report"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("aggregator returned %s", resp.Status)
+	}
+	return nil
+}
+
+// aggregator keeps the latest report from every node.
+type aggregator struct {
+	token   string // AGGREGATOR_TOKEN: required of reports, if set
+	mu      sync.Mutex
+	reports map[string]nodeReport
+}
+
+// runAggregator serves the per-node × per-target matrix built from the
+// reports pushed by probes running with AGGREGATOR_URL set.
+func runAggregator(ctx context.Context, cfg Config) {
+	agg := &aggregator{token: cfg.AggregatorToken, reports: make(map[string]nodeReport)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /report", agg.handleReport)
+	mux.HandleFunc("GET /matrix", agg.handleMatrix)
+	mux.HandleFunc("GET /matrix.json", agg.handleMatrixJSON)
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok\n")
+	})
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/matrix", http.StatusFound)
+	})
+
+	srv := &http.Server{Addr: cfg.ListenAddr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	if cfg.AggregatorToken == "" {
+		logf("aggregator mode: AGGREGATOR_TOKEN is not set; any client that can reach %s can post or overwrite any node's report", cfg.ListenAddr)
+	}
+	logf("aggregator mode: listening on %s", cfg.ListenAddr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logf("aggregator: %v", err)
+		return
+	}
+	logf("shutting down")
+}
+
+func (a *aggregator) handleReport(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r, a.token) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var report nodeReport
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxReportBytes)).Decode(&report); err != nil {
+		http.Error(w, "invalid report: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if report.Node == "" {
+		http.Error(w, "invalid report: missing node", http.StatusBadRequest)
+		return
+	}
+	// Trust our own clock over the node's for expiry and display.
+	report.Time = time.Now()
+
+	a.mu.Lock()
+	a.reports[report.Node] = report
+	a.mu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// snapshot returns the live reports sorted by node name, dropping expired ones.
+func (a *aggregator) snapshot() []nodeReport {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var out []nodeReport
+	for node, rep := range a.reports {
+		if time.Since(rep.Time) > aggregatorNodeTTL {
+			delete(a.reports, node)
+			continue
+		}
+		out = append(out, rep)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Node < out[j].Node })
+	return out
+}
+
+type matrixNode struct {
+	Name       string    `json:"name"`
+	LastReport time.Time `json:"last_report"`
+	OK         bool      `json:"ok"`
+}
+
+type matrixRow struct {
+	Target     string            `json:"target"` // e.g. "allow github.com:443"
+	Host       string            `json:"host"`
+	Port       int               `json:"port"`
+	Type       string            `json:"type"`
+	Family     string            `json:"family,omitempty"` // a target pinned to "ipv4" or "ipv6"
+	Method     string            `json:"method,omitempty"` // a target with its own HTTP request
+	Path       string            `json:"path,omitempty"`   // likewise
+	Results    map[string]string `json:"results"`          // node → pass, fail or incomplete
+	Consistent bool              `json:"consistent"`       // same outcome on every node that probed it
+}
+
+type matrix struct {
+	Nodes   []matrixNode `json:"nodes"`
+	Targets []matrixRow  `json:"targets"`
+}
+
+// buildMatrix pivots node reports into one row per target. Targets keep the
+// order in which they first appear; a node that did not probe a target has no
+// entry for it.
+func buildMatrix(reports []nodeReport) matrix {
+	m := matrix{Nodes: []matrixNode{}, Targets: []matrixRow{}}
+	rows := make(map[string]int)
+
+	for _, rep := range reports {
+		m.Nodes = append(m.Nodes, matrixNode{Name: rep.Node, LastReport: rep.Time, OK: rep.Summary.OK})
+		for _, jr := range rep.Results {
+			key := jr.Type + " " + net.JoinHostPort(jr.Host, strconv.Itoa(jr.Port)) + requestSuffix(jr.Method, jr.Path) + familySuffix(jr.Family)
+			idx, ok := rows[key]
+			if !ok {
+				idx = len(m.Targets)
+				rows[key] = idx
+				m.Targets = append(m.Targets, matrixRow{
+					Target:  key,
+					Host:    jr.Host,
+					Port:    jr.Port,
+					Type:    jr.Type,
+					Family:  jr.Family,
+					Method:  jr.Method,
+					Path:    jr.Path,
+					Results: make(map[string]string),
+				})
+			}
+			outcome := "fail"
+			switch {
+			case jr.Incomplete:
+				outcome = "incomplete"
+			case jr.Passed:
+				outcome = "pass"
+			}
+			m.Targets[idx].Results[rep.Node] = outcome
+		}
+	}
+
+	for i := range m.Targets {
+		row := &m.Targets[i]
+		row.Consistent = true
+		first := ""
+		for _, outcome := range row.Results {
+			if outcome == "incomplete" {
+				continue
+			}
+			if first == "" {
+				first = outcome
+			} else if outcome != first {
+				row.Consistent = false
+			}
+		}
+	}
+	return m
+}
+
+func (a *aggregator) handleMatrixJSON(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(buildMatrix(a.snapshot()))
+}
+
+func (a *aggregator) handleMatrix(w http.ResponseWriter, r *http.Request) {
+	m := buildMatrix(a.snapshot())
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	if len(m.Nodes) == 0 {
+		io.WriteString(w, "No reports yet.\n")
+		return
+	}
+	writeMatrix(w, m, "nodes")
+	for _, n := range m.Nodes {
+		fmt.Fprintf(w, "  %s: last report %s ago\n", n.Name, time.Since(n.LastReport).Round(time.Second))
+	}
+}
+
+// writeMatrix renders m as a plain-text table with one column per node;
+// columns names what a node is (nodes, agents) in the summary line. Rows
+// whose outcome differs between columns are marked with '*'.
+func writeMatrix(w io.Writer, m matrix, columns string) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprint(tw, "TARGET")
+	for _, n := range m.Nodes {
+		fmt.Fprintf(tw, "\t%s", n.Name)
+	}
+	fmt.Fprintln(tw, "\t")
+
+	inconsistent := 0
+	for _, row := range m.Targets {
+		fmt.Fprint(tw, row.Target)
+		for _, n := range m.Nodes {
+			cell := "—"
+			switch row.Results[n.Name] {
+			case "pass":
+				cell = "PASS"
+			case "fail":
+				cell = "FAIL"
+			case "incomplete":
+				cell = "SKIP"
+			}
+			fmt.Fprintf(tw, "\t%s", cell)
+		}
+		mark := ""
+		if !row.Consistent {
+			mark = "*"
+			inconsistent++
+		}
+		fmt.Fprintf(tw, "\t%s\n", mark)
+	}
+	tw.Flush()
+
+	fmt.Fprintf(w, "\n%d %s, %d targets", len(m.Nodes), columns, len(m.Targets))
+	if inconsistent > 0 {
+		fmt.Fprintf(w, ", %d differ between %s (*)", inconsistent, columns)
+	}
+	fmt.Fprintln(w)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	pagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+	defaultOpsgenieURL = "https://api.opsgenie.com"
+)
+
+// alertState is which targets have an open incident, in daemon mode. It is
+// shared across cycles.
+type alertState struct {
+	open    map[string]bool // by alertKey
+	started bool            // a cycle has been alerted on
+}
+
+func newAlertState() *alertState {
+	return &alertState{open: make(map[string]bool)}
+}
+
+// critical reports whether a target is tagged critical: ";critical" or
+// ";critical=true".
+func critical(r jsonResult) bool {
+	return isCritical(r.Metadata)
+}
+
+// isCritical reports whether target metadata carries the critical tag.
+func isCritical(metadata map[string]string) bool {
+	v, ok := metadata["critical"]
+	if !ok {
+		return false
+	}
+	on, err := strconv.ParseBool(v)
+	return v == "" || (err == nil && on)
+}
+
+// alertKey is the deduplication key of a target's incident, e.g.
+// "egress-probe/allow api.stripe.com:443". It leaves the node out, so that
+// a DaemonSet pages once per target rather than once per node.
+func alertKey(r jsonResult) string {
+	return "egress-probe/" + r.Type + " " + net.JoinHostPort(r.Host, strconv.Itoa(r.Port)) + requestSuffix(r.Method, r.Path)
+}
+
+// sendAlerts opens an incident on PagerDuty and/or Opsgenie for every
+// critical target that failed. In daemon mode (cfg.Alerts set), incidents
+// are resolved once their target passes again. The first cycle resolves
+// every passing critical target, closing incidents left open by a previous
+// Pod. Incomplete targets neither open nor resolve anything. Failures are
+// logged: alerting never fails a run.
+func sendAlerts(ctx context.Context, cfg Config, out jsonOutput) {
+	if cfg.PagerDutyKey == "" && cfg.OpsgenieKey == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	state := cfg.Alerts
+	for _, r := range out.Results {
+		if !critical(r) || r.Incomplete {
+			continue
+		}
+		key := alertKey(r)
+		switch {
+		case !r.Passed:
+			if err := triggerAlert(ctx, cfg, key, r); err != nil {
+				logf("alerting on %s: %v", key, err)
+				continue
+			}
+			if state != nil {
+				state.open[key] = true
+			}
+		case state != nil && (state.open[key] || !state.started):
+			if err := resolveAlert(ctx, cfg, key); err != nil {
+				logf("resolving the alert on %s: %v", key, err)
+				continue
+			}
+			delete(state.open, key)
+		}
+	}
+	if state != nil {
+		state.started = true
+	}
+}
+
+// triggerAlert opens (or, with the same key, updates) the incident of a
+// failing target.
+func triggerAlert(ctx context.Context, cfg Config, key string, r jsonResult) error {
+	summary := fmt.Sprintf("Egress %s %s:%d failed: %s", r.Type, r.Host, r.Port, failureDetail(r))
+	if cfg.NodeName != "" {
+		summary += " (node " + cfg.NodeName + ")"
+	}
+	details := map[string]string{"node": cfg.NodeName, "detail": failureDetail(r)}
+	for k, v := range r.Metadata {
+		details[k] = v
+	}
+
+	if cfg.PagerDutyKey != "" {
+		event := map[string]any{
+			"routing_key":  cfg.PagerDutyKey,
+			"event_action": "trigger",
+			"dedup_key":    key,
+			"payload": map[string]any{
+				"summary":        summary,
+				"source":         cfg.NodeName,
+				"severity":       "critical",
+				"component":      net.JoinHostPort(r.Host, strconv.Itoa(r.Port)),
+				"class":          "egress",
+				"custom_details": details,
+			},
+		}
+		if err := alertRequest(ctx, http.MethodPost, pagerDutyEventsURL, "", event); err != nil {
+			return fmt.Errorf("pagerduty: %w", err)
+		}
+	}
+	if cfg.OpsgenieKey != "" {
+		alert := map[string]any{
+			"message":     truncate(summary, 130),
+			"alias":       key,
+			"description": summary,
+			"priority":    "P1",
+			"source":      "egress-probe",
+			"tags":        []string{"egress-probe", r.Type},
+			"details":     details,
+		}
+		if err := alertRequest(ctx, http.MethodPost, cfg.OpsgenieURL+"/v2/alerts", cfg.OpsgenieKey, alert); err != nil {
+			return fmt.Errorf("opsgenie: %w", err)
+		}
+	}
+	return nil
+}
+
+// resolveAlert resolves the incident of a target that passes again.
+func resolveAlert(ctx context.Context, cfg Config, key string) error {
+	if cfg.PagerDutyKey != "" {
+		event := map[string]any{"routing_key": cfg.PagerDutyKey, "event_action": "resolve", "dedup_key": key}
+		if err := alertRequest(ctx, http.MethodPost, pagerDutyEventsURL, "", event); err != nil {
+			return fmt.Errorf("pagerduty: %w", err)
+		}
+	}
+	if cfg.OpsgenieKey != "" {
+		u := cfg.OpsgenieURL + "/v2/alerts/" + url.PathEscape(key) + "/close?identifierType=alias"
+		if err := alertRequest(ctx, http.MethodPost, u, cfg.OpsgenieKey, map[string]string{"source": "egress-probe"}); err != nil {
+			return fmt.Errorf("opsgenie: %w", err)
+		}
+	}
+	return nil
+}
+
+// alertRequest sends body as JSON, authenticated with an Opsgenie API key
+// if genieKey is set.
+func alertRequest(ctx context.Context, method, u, genieKey string, body any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if genieKey != "" {
+		req.Header.Set("Authorization", "GenieKey "+genieKey)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	answer, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(answer)))
+	}
+	return nil
+}
+
+// truncate shortens s to at most n runes.
+func truncate(s string, n int) string {
+	if r := []rune(s); len(r) > n {
+		return string(r[:n-1]) + "…"
+	}
+	return s
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// archiveTimeout bounds one upload, credentials included.
+const archiveTimeout = 30 * time.Second
+
+// bucketRef is where RESULTS_BUCKET archives reports: "s3://bucket/prefix",
+// "gs://bucket/prefix" or "azblob://account/container/prefix".
+type bucketRef struct {
+	scheme  string // "s3", "gs" or "azblob"
+	account string // azblob: the storage account
+	bucket  string // the bucket, or the azblob container
+	prefix  string // prepended to every object name, without slashes around it
+}
+
+// parseBucket parses a RESULTS_BUCKET value.
+func parseBucket(raw string) (*bucketRef, error) {
+	scheme, rest, ok := strings.Cut(raw, "://")
+	if !ok || (scheme != "s3" && scheme != "gs" && scheme != "azblob") {
+		return nil, fmt.Errorf("invalid RESULTS_BUCKET %q: expected s3://bucket, gs://bucket or azblob://account/container, optionally followed by /prefix", raw)
+	}
+	b := &bucketRef{scheme: scheme}
+	if scheme == "azblob" {
+		b.account, rest, _ = strings.Cut(rest, "/")
+	}
+	b.bucket, b.prefix, _ = strings.Cut(rest, "/")
+	b.prefix = strings.Trim(b.prefix, "/")
+	if b.bucket == "" || (scheme == "azblob" && b.account == "") {
+		return nil, fmt.Errorf("invalid RESULTS_BUCKET %q: missing the bucket name", raw)
+	}
+	return b, nil
+}
+
+// archiveResults uploads out to RESULTS_BUCKET as
+// <prefix>/<yyyy>/<mm>/<dd>/<node>-<start>.json, so that the reports of
+// every scheduled run are kept in one place for audits. Credentials come
+// from the Pod's workload identity: IRSA or EKS Pod Identity, GKE Workload
+// Identity, or Azure Workload Identity. Failures are logged: archiving never
+// fails a run.
+func archiveResults(ctx context.Context, cfg Config, out jsonOutput, start time.Time) {
+	b := cfg.ResultsBucket
+	if b == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, archiveTimeout)
+	defer cancel()
+
+	data, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		logf("RESULTS_BUCKET: %v", err)
+		return
+	}
+	start = start.UTC()
+	name := path.Join(b.prefix, start.Format("2006/01/02"), objectSafe(cfg.NodeName)+"-"+start.Format("20060102T150405Z")+".json")
+
+	switch b.scheme {
+	case "s3":
+		err = uploadS3(ctx, b.bucket, name, data)
+	case "gs":
+		err = uploadGCS(ctx, b.bucket, name, data)
+	case "azblob":
+		err = uploadAzureBlob(ctx, b.account, b.bucket, name, data)
+	}
+	if err != nil {
+		logf("RESULTS_BUCKET: uploading %s: %v", name, err)
+	}
+}
+
+// objectSafe replaces the characters of s that need escaping in object names.
+func objectSafe(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// uploadGCS writes an object with a token of the GKE Workload Identity
+// service account, from the metadata server.
+func uploadGCS(ctx context.Context, bucket, name string, data []byte) error {
+	token, err := cloudToken(ctx, "gcp", gcpToken)
+	if err != nil {
+		return err
+	}
+	u := "https://storage.googleapis.com/upload/storage/v1/b/" + url.PathEscape(bucket) + "/o?uploadType=media&name=" + url.QueryEscape(name)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	return doUpload(req, "gcs")
+}
+
+// uploadAzureBlob writes a block blob with an Entra ID token of the Pod's
+// Azure Workload Identity, or of the node's managed identity.
+func uploadAzureBlob(ctx context.Context, account, container, name string, data []byte) error {
+	token, err := azureBearer(ctx, azureStorageResource)
+	if err != nil {
+		return err
+	}
+	u := "https://" + account + ".blob.core.windows.net/" + url.PathEscape(container) + "/" + (&url.URL{Path: name}).EscapedPath()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("x-ms-blob-type", "BlockBlob")
+	req.Header.Set("x-ms-version", "2021-08-06")
+	return doUpload(req, "azure blob storage")
+}
+
+// doUpload sends req and turns a non-2xx answer into an error.
+func doUpload(req *http.Request, service string) error {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s returned %s: %s", service, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
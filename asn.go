@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// rdapBootstrap redirects an IP query to the registry that holds it.
+	rdapBootstrap = "https://rdap.org/ip/"
+	// maxOwnerLookups caps the RDAP queries per run; the public servers
+	// rate-limit.
+	maxOwnerLookups = 50
+	// maxOwnedAddrs caps how many resolved addresses per target are looked up.
+	maxOwnedAddrs = 4
+)
+
+// ipOwner is who announces (ASN) and who holds (organization) an address.
+type ipOwner struct {
+	IP      string `json:"ip"`
+	ASN     int    `json:"asn,omitempty"`
+	Org     string `json:"org,omitempty"`
+	Network string `json:"network,omitempty"` // the registry's name for the block, RDAP only
+}
+
+func (o ipOwner) String() string {
+	var parts []string
+	if o.ASN != 0 {
+		parts = append(parts, fmt.Sprintf("AS%d", o.ASN))
+	}
+	if o.Org != "" {
+		parts = append(parts, o.Org)
+	}
+	if len(parts) == 0 {
+		return o.IP + " (unknown)"
+	}
+	return o.IP + " (" + strings.Join(parts, " ") + ")"
+}
+
+// ASN tables and RDAP answers are kept for the life of the process: daemon
+// mode looks up the same addresses every cycle.
+var (
+	asnMu     sync.Mutex
+	asnTables = make(map[string]*asnTable)
+	rdapCache = make(map[netip.Addr]ipOwner)
+)
+
+// addOwners looks up the owner of each target's resolved addresses from
+// source, "rdap" or the path of an ASN table, and records them on results.
+// Lookup failures are logged once and leave the addresses out.
+func addOwners(ctx context.Context, source string, results []jsonResult) {
+	var table *asnTable
+	if source != "rdap" {
+		var err error
+		if table, err = loadASNTable(source); err != nil {
+			logf("ASN_LOOKUP: %v", err)
+			return
+		}
+	}
+
+	lookups, skipped := 0, 0
+	var firstErr error
+	for i := range results {
+		for _, addr := range resolvedAddrs(results[i]) {
+			var owner ipOwner
+			var err error
+			if table != nil {
+				owner = table.lookup(addr)
+			} else {
+				if lookups == maxOwnerLookups {
+					skipped++
+					continue
+				}
+				owner, err = lookupRDAP(ctx, addr, &lookups)
+			}
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+			results[i].Owners = append(results[i].Owners, owner)
+		}
+	}
+	if firstErr != nil {
+		logf("ASN_LOOKUP: %v", firstErr)
+	}
+	if skipped > 0 {
+		logf("ASN_LOOKUP: stopped after %d RDAP queries; %d addresses are looked up on later runs", maxOwnerLookups, skipped)
+	}
+}
+
+// resolvedAddrs returns the addresses a result's DNS phase resolved.
+func resolvedAddrs(r jsonResult) []netip.Addr {
+	var addrs []netip.Addr
+	for _, a := range r.Addresses {
+		if addr, err := netip.ParseAddr(a.Address); err == nil && len(addrs) < maxOwnedAddrs {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// asnRange is one line of an ASN table.
+type asnRange struct {
+	start, end netip.Addr
+	asn        int
+	org        string
+}
+
+// asnTable maps address ranges to their ASN, in the tab-separated format of
+// iptoasn.com: range start, range end, ASN, country, description.
+type asnTable struct {
+	ranges []asnRange // sorted by start
+}
+
+func loadASNTable(path string) (*asnTable, error) {
+	asnMu.Lock()
+	defer asnMu.Unlock()
+	if t, ok := asnTables[path]; ok {
+		return t, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	t := &asnTable{}
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		fields := strings.Split(sc.Text(), "\t")
+		if len(fields) < 5 {
+			continue
+		}
+		start, err1 := netip.ParseAddr(fields[0])
+		end, err2 := netip.ParseAddr(fields[1])
+		asn, err3 := strconv.Atoi(fields[2])
+		if err1 != nil || err2 != nil || err3 != nil {
+			return nil, fmt.Errorf("%s:%d: expected range start, range end, ASN, country and description separated by tabs", path, n)
+		}
+		if asn == 0 { // not routed
+			continue
+		}
+		t.ranges = append(t.ranges, asnRange{start: start, end: end, asn: asn, org: fields[4]})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(t.ranges, func(i, j int) bool { return t.ranges[i].start.Less(t.ranges[j].start) })
+	asnTables[path] = t
+	return t, nil
+}
+
+func (t *asnTable) lookup(addr netip.Addr) ipOwner {
+	owner := ipOwner{IP: addr.String()}
+	i := sort.Search(len(t.ranges), func(i int) bool { return addr.Less(t.ranges[i].start) }) - 1
+	if i >= 0 && t.ranges[i].end.Compare(addr) >= 0 {
+		owner.ASN, owner.Org = t.ranges[i].asn, t.ranges[i].org
+	}
+	return owner
+}
+
+// rdapNetwork is the part of an RDAP IP network response used here.
+type rdapNetwork struct {
+	Name     string `json:"name"`
+	Entities []struct {
+		Roles      []string `json:"roles"`
+		VCardArray []any    `json:"vcardArray"`
+	} `json:"entities"`
+	// ARIN's extension with the ASNs that originate the block.
+	OriginASNs []int `json:"arin_originas0_originautnums"`
+}
+
+// lookupRDAP asks the registry that holds addr who it belongs to, counting
+// the queries it sends in lookups. RDAP names the holder; only some
+// registries also give the originating ASN.
+func lookupRDAP(ctx context.Context, addr netip.Addr, lookups *int) (ipOwner, error) {
+	asnMu.Lock()
+	owner, ok := rdapCache[addr]
+	asnMu.Unlock()
+	if ok {
+		return owner, nil
+	}
+
+	*lookups++
+	ctx, cancel := context.WithTimeout(ctx, clusterTargetsTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rdapBootstrap+addr.String(), nil)
+	if err != nil {
+		return ipOwner{}, err
+	}
+	req.Header.Set("Accept", "application/rdap+json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return ipOwner{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return ipOwner{}, fmt.Errorf("RDAP lookup of %s: %s", addr, resp.Status)
+	}
+	var n rdapNetwork
+	if err := json.NewDecoder(resp.Body).Decode(&n); err != nil {
+		return ipOwner{}, fmt.Errorf("RDAP lookup of %s: %w", addr, err)
+	}
+
+	owner = ipOwner{IP: addr.String(), Network: n.Name}
+	if len(n.OriginASNs) > 0 {
+		owner.ASN = n.OriginASNs[0]
+	}
+	for _, e := range n.Entities {
+		for _, role := range e.Roles {
+			if role == "registrant" && owner.Org == "" {
+				owner.Org = vcardName(e.VCardArray)
+			}
+		}
+	}
+	if owner.Org == "" {
+		owner.Org = n.Name
+	}
+	asnMu.Lock()
+	rdapCache[addr] = owner
+	asnMu.Unlock()
+	return owner, nil
+}
+
+// vcardName returns the formatted name ("fn") of a jCard:
+// ["vcard", [["fn", {}, "text", "Microsoft Corporation"], ...]].
+func vcardName(card []any) string {
+	if len(card) < 2 {
+		return ""
+	}
+	props, _ := card[1].([]any)
+	for _, p := range props {
+		prop, _ := p.([]any)
+		if len(prop) >= 4 && prop[0] == "fn" {
+			name, _ := prop[3].(string)
+			return name
+		}
+	}
+	return ""
+}
+
+// printOwners lists who owns the addresses each target resolved to.
+func printOwners(results []jsonResult) {
+	header := false
+	for _, r := range results {
+		if len(r.Owners) == 0 {
+			continue
+		}
+		if !header {
+			fmt.Printf("  %sAddress owners%s\n", colorBold, colorReset)
+			header = true
+		}
+		owners := make([]string, len(r.Owners))
+		for i, o := range r.Owners {
+			owners[i] = o.String()
+		}
+		fmt.Printf("    %s:%d  %s%s%s\n", r.Host, r.Port, colorDim, strings.Join(owners, ", "), colorReset)
+	}
+	if header {
+		fmt.Println()
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// awsCredentials are temporary AWS credentials.
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Expires         time.Time // zero for static keys
+}
+
+// cachedAWSCredentials are the credentials of the last request, reused by
+// the next daemon cycles until shortly before they expire.
+var cachedAWSCredentials struct {
+	mu    sync.Mutex
+	creds *awsCredentials
+}
+
+// awsRegion returns the region requests go to and are signed for.
+func awsRegion() string {
+	for _, name := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+		if r := os.Getenv(name); r != "" {
+			return r
+		}
+	}
+	return "us-east-1"
+}
+
+// signAWS adds an AWS Signature Version 4 for service to req.
+func signAWS(req *http.Request, payload []byte, creds *awsCredentials, region, service string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	payloadHash := sha256Hex(payload)
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	signed := []string{"content-type", "host", "x-amz-content-sha256", "x-amz-date"}
+	if creds.SessionToken != "" {
+		req.Header.Set("x-amz-security-token", creds.SessionToken)
+		signed = append(signed, "x-amz-security-token")
+	}
+
+	var canonicalHeaders strings.Builder
+	for _, h := range signed {
+		v := req.Header.Get(h)
+		if h == "host" {
+			v = req.URL.Host
+		}
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", h, strings.TrimSpace(v))
+	}
+	signedHeaders := strings.Join(signed, ";")
+	canonical := strings.Join([]string{req.Method, req.URL.EscapedPath(), req.URL.RawQuery, canonicalHeaders.String(), signedHeaders, payloadHash}, "\n")
+
+	scope := day + "/" + region + "/" + service + "/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonical))
+	key := []byte("AWS4" + creds.SecretAccessKey)
+	for _, part := range []string{day, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(s))
+	return m.Sum(nil)
+}
+
+// loadAWSCredentials returns cached credentials, or new ones from, in order:
+// static keys (AWS_ACCESS_KEY_ID), EKS Pod Identity
+// (AWS_CONTAINER_CREDENTIALS_FULL_URI) and IRSA (AWS_WEB_IDENTITY_TOKEN_FILE
+// with AWS_ROLE_ARN).
+func loadAWSCredentials(ctx context.Context) (*awsCredentials, error) {
+	if id := os.Getenv("AWS_ACCESS_KEY_ID"); id != "" {
+		return &awsCredentials{AccessKeyID: id, SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"), SessionToken: os.Getenv("AWS_SESSION_TOKEN")}, nil
+	}
+
+	cachedAWSCredentials.mu.Lock()
+	defer cachedAWSCredentials.mu.Unlock()
+	if c := cachedAWSCredentials.creds; c != nil && time.Until(c.Expires) > 5*time.Minute {
+		return c, nil
+	}
+	var creds *awsCredentials
+	var err error
+	switch {
+	case os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI") != "":
+		creds, err = podIdentityCredentials(ctx)
+	case os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE") != "":
+		creds, err = webIdentityCredentials(ctx)
+	default:
+		return nil, fmt.Errorf("no AWS credentials: set up IRSA or EKS Pod Identity for the Pod's service account")
+	}
+	if err != nil {
+		return nil, err
+	}
+	cachedAWSCredentials.creds = creds
+	return creds, nil
+}
+
+// podIdentityCredentials gets credentials from the EKS Pod Identity agent.
+func podIdentityCredentials(ctx context.Context) (*awsCredentials, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI"), nil)
+	if err != nil {
+		return nil, err
+	}
+	if f := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"); f != "" {
+		token, err := os.ReadFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("reading AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE: %w", err)
+		}
+		req.Header.Set("Authorization", strings.TrimSpace(string(token)))
+	}
+	body, err := fetchCredentials(req, "the EKS Pod Identity agent")
+	if err != nil {
+		return nil, err
+	}
+	var c struct {
+		AccessKeyID     string `json:"AccessKeyId"`
+		SecretAccessKey string
+		Token           string
+		Expiration      time.Time
+	}
+	if err := json.Unmarshal(body, &c); err != nil || c.AccessKeyID == "" {
+		return nil, fmt.Errorf("getting credentials from the EKS Pod Identity agent: unexpected answer")
+	}
+	return &awsCredentials{AccessKeyID: c.AccessKeyID, SecretAccessKey: c.SecretAccessKey, SessionToken: c.Token, Expires: c.Expiration}, nil
+}
+
+// webIdentityCredentials exchanges the service account token projected by
+// IRSA for credentials of AWS_ROLE_ARN, with the regional STS endpoint.
+func webIdentityCredentials(ctx context.Context) (*awsCredentials, error) {
+	token, err := os.ReadFile(os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"))
+	if err != nil {
+		return nil, fmt.Errorf("reading AWS_WEB_IDENTITY_TOKEN_FILE: %w", err)
+	}
+	form := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {os.Getenv("AWS_ROLE_ARN")},
+		"RoleSessionName":  {"egress-probe"},
+		"WebIdentityToken": {strings.TrimSpace(string(token))},
+	}
+	u := "https://sts." + awsRegion() + ".amazonaws.com/"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	body, err := fetchCredentials(req, "STS")
+	if err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Credentials struct {
+			AccessKeyID     string `xml:"AccessKeyId"`
+			SecretAccessKey string
+			SessionToken    string
+			Expiration      time.Time
+		} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+	}
+	if err := xml.Unmarshal(body, &resp); err != nil || resp.Credentials.AccessKeyID == "" {
+		return nil, fmt.Errorf("getting credentials from STS: unexpected answer")
+	}
+	c := resp.Credentials
+	return &awsCredentials{AccessKeyID: c.AccessKeyID, SecretAccessKey: c.SecretAccessKey, SessionToken: c.SessionToken, Expires: c.Expiration}, nil
+}
+
+// fetchCredentials sends req and returns the body of a 2xx answer.
+func fetchCredentials(req *http.Request, source string) ([]byte, error) {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("getting credentials from %s: %w", source, err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("getting credentials from %s: %s: %s", source, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
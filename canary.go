@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/cheolhuikim/egress-probe/pkg/probe"
+)
+
+// canaryCount is how many popular domains CANARY=true picks per run.
+const canaryCount = 5
+
+// canaryDomains are popular destinations that no workload's allow list has
+// a reason to include. Any of them being reachable means traffic to
+// arbitrary destinations is let through.
+var canaryDomains = []string{
+	"wikipedia.org",
+	"reddit.com",
+	"twitch.tv",
+	"netflix.com",
+	"spotify.com",
+	"pinterest.com",
+	"tumblr.com",
+	"imdb.com",
+	"ebay.com",
+	"bbc.co.uk",
+	"espn.com",
+	"weather.com",
+	"yelp.com",
+	"duckduckgo.com",
+	"archive.org",
+	"stackoverflow.com",
+	"nytimes.com",
+	"booking.com",
+	"zoom.us",
+	"wordpress.org",
+}
+
+// canaryPick is the random choice of canaryDomains, made once per process
+// so that daemon mode doesn't see its targets change on every reload.
+var canaryPick = sync.OnceValue(func() []string {
+	var domains []string
+	for _, i := range rand.Perm(len(canaryDomains))[:canaryCount] {
+		domains = append(domains, canaryDomains[i])
+	}
+	return domains
+})
+
+// canaryTargets returns the deny targets of CANARY: "true" picks a few
+// popular domains at random, so that an exception for one of them doesn't
+// hide a permissive rule run after run; anything else is a target list.
+func canaryTargets(raw string) ([]probe.Target, error) {
+	if on, err := strconv.ParseBool(raw); err == nil {
+		if !on {
+			return nil, nil
+		}
+		return probe.ParseTargetList(strings.Join(canaryPick(), ","), true), nil
+	}
+	targets := probe.ParseTargetList(raw, true)
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("invalid CANARY %q: expected true, false or a list of targets", raw)
+	}
+	return targets, nil
+}
+
+// canaryKey identifies a canary by where it connects to, whichever list
+// it is in.
+func canaryKey(host string, port int) string {
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// markCanaries flags the results of canary targets.
+func markCanaries(results []jsonResult, canaries map[string]bool) {
+	for i, r := range results {
+		if canaries[canaryKey(r.Host, r.Port)] {
+			results[i].Canary = true
+		}
+	}
+}
+
+// printCanaries says whether default deny held for the canary targets.
+func printCanaries(results []jsonResult) {
+	var total int
+	var reachable []string
+	for _, r := range results {
+		if !r.Canary || r.Incomplete {
+			continue
+		}
+		total++
+		if !r.Passed {
+			reachable = append(reachable, fmt.Sprintf("%s:%d", r.Host, r.Port))
+		}
+	}
+	switch {
+	case total == 0:
+		return
+	case len(reachable) == 0:
+		fmt.Fprintf(tableOut, "  %sDefault deny%s %s✓ in force%s %s(%d canaries blocked)%s\n\n", colorBold, colorReset, colorGreen, colorReset, colorDim, total, colorReset)
+	default:
+		fmt.Fprintf(tableOut, "  %sDefault deny%s %s✗ not in force%s: %d of %d canaries are reachable: %s\n\n", colorBold, colorReset, colorRed, colorReset, len(reachable), total, strings.Join(reachable, ", "))
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/cheolhuikim/egress-probe/pkg/probe"
+)
+
+// maxKnownCerts caps how many certificates are remembered per target. A
+// target behind a CDN may serve a few different ones in turn.
+const maxKnownCerts = 8
+
+// certChange is a server certificate that changed unexpectedly between two
+// daemon cycles (CERT_WATCH).
+type certChange struct {
+	Target              string    `json:"target"`
+	Kind                string    `json:"kind"` // "issuer" or "certificate"
+	PreviousIssuer      string    `json:"previous_issuer"`
+	Issuer              string    `json:"issuer"`
+	PreviousFingerprint string    `json:"previous_fingerprint_sha256"`
+	Fingerprint         string    `json:"fingerprint_sha256"`
+	PreviousSince       time.Time `json:"previous_since"` // when the previous certificate was first seen
+	SelfSigned          bool      `json:"self_signed"`
+}
+
+// knownCert is a certificate a target has presented before.
+type knownCert struct {
+	fingerprint string
+	issuer      string
+	notAfter    time.Time
+	since       time.Time
+}
+
+// certHistory remembers the certificates each target presented in earlier
+// daemon cycles. It is shared across cycles.
+type certHistory struct {
+	known map[string][]knownCert // by targetKey, oldest first
+}
+
+func newCertHistory() *certHistory {
+	return &certHistory{known: make(map[string][]knownCert)}
+}
+
+// observe compares the certificates in results with the ones seen before and
+// returns the unexpected changes. A certificate seen before is never a
+// change, nor is a renewal: a new certificate from a known issuer that
+// expires later than any seen so far. A new issuer, or a new certificate
+// that expires earlier, is — sudden changes like these on a stable endpoint
+// usually mean interception or a hijacked endpoint. The first certificate of
+// a target is only remembered.
+func (h *certHistory) observe(results []probe.Result, now time.Time) []certChange {
+	var changes []certChange
+	for _, r := range results {
+		c := r.Cert
+		if c == nil || c.Fingerprint == "" {
+			continue
+		}
+		key := targetKey(r.Target)
+		known := h.known[key]
+		if len(known) == 0 {
+			h.remember(key, c, now)
+			continue
+		}
+
+		var seen, seenIssuer bool
+		var latest time.Time
+		for _, k := range known {
+			if k.fingerprint == c.Fingerprint {
+				seen = true
+			}
+			if k.issuer == c.Issuer {
+				seenIssuer = true
+				if k.notAfter.After(latest) {
+					latest = k.notAfter
+				}
+			}
+		}
+		if seen {
+			continue
+		}
+
+		prev := known[len(known)-1]
+		h.remember(key, c, now)
+		kind := ""
+		switch {
+		case !seenIssuer:
+			kind = "issuer"
+		case !c.NotAfter.After(latest):
+			kind = "certificate"
+		default:
+			logf("CERT_WATCH: %s: certificate renewed by %q, valid until %s", key, c.Issuer, c.NotAfter.Format(time.DateOnly))
+			continue
+		}
+		ch := certChange{
+			Target:              key,
+			Kind:                kind,
+			PreviousIssuer:      prev.issuer,
+			Issuer:              c.Issuer,
+			PreviousFingerprint: prev.fingerprint,
+			Fingerprint:         c.Fingerprint,
+			PreviousSince:       prev.since,
+			SelfSigned:          c.SelfSigned,
+		}
+		logf("CERT_WATCH: %s", ch.describe())
+		changes = append(changes, ch)
+	}
+	return changes
+}
+
+// remember records c as the most recent certificate of the target key,
+// dropping the oldest once maxKnownCerts are known.
+func (h *certHistory) remember(key string, c *probe.CertInfo, now time.Time) {
+	known := append(h.known[key], knownCert{fingerprint: c.Fingerprint, issuer: c.Issuer, notAfter: c.NotAfter, since: now})
+	if len(known) > maxKnownCerts {
+		known = known[len(known)-maxKnownCerts:]
+	}
+	h.known[key] = known
+}
+
+// describe summarizes the change on one line.
+func (c certChange) describe() string {
+	if c.Kind == "issuer" {
+		return fmt.Sprintf("%s: issuer changed from %q to %q (certificate %.12s… → %.12s…)",
+			c.Target, c.PreviousIssuer, c.Issuer, c.PreviousFingerprint, c.Fingerprint)
+	}
+	return fmt.Sprintf("%s: certificate changed to %.12s… from %q, expiring no later than the one it replaced",
+		c.Target, c.Fingerprint, c.Issuer)
+}
+
+// printCertChanges lists the unexpected certificate changes of a cycle.
+func printCertChanges(changes []certChange) {
+	if len(changes) == 0 {
+		return
+	}
+	fmt.Printf("  %sCertificate changes%s\n", colorBold, colorReset)
+	for _, c := range changes {
+		note := ""
+		if c.SelfSigned {
+			note = " — now self-signed"
+		}
+		fmt.Fprintf(tableOut, "    %s✗ %s%s%s\n", colorRed, c.describe(), note, colorReset)
+	}
+	fmt.Printf("    %sA sudden change on a stable endpoint usually means TLS interception or a hijacked endpoint.%s\n\n", colorDim, colorReset)
+}
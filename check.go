@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cheolhuikim/egress-probe/pkg/probe"
+)
+
+// runCheck implements "egress-probe check <target>": a one-off run of the
+// full phase pipeline (as with PROFILE=deep) against a single target, printed
+// step by step with the addresses and certificate involved. It returns the
+// process exit code.
+func runCheck(ctx context.Context, args []string) int {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	deny := fs.Bool("deny", false, "expect the target to be blocked")
+	timeout := fs.Duration("timeout", envDuration("TIMEOUT", probe.DefaultTimeout), "timeout for each phase")
+	fips := fs.Bool("fips", os.Getenv("FIPS_TLS") == "true", "allow only FIPS-approved TLS parameters")
+	dnsTrace := fs.Bool("dns-trace", os.Getenv("DNS_TRACE") == "true", "show the DNS lookup query by query, like dig")
+	caFile := fs.String("ca-file", os.Getenv("CA_FILE"), "PEM bundle of CAs to trust besides the system roots")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s check [flags] <target>\n\nTarget uses the ALLOW_TARGETS syntax, e.g. github.com, https://mcr.microsoft.com or tcp://10.0.0.1:5432.\n\nFlags:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return exitFailed
+	}
+
+	t := probe.ParseTarget(fs.Arg(0))
+	t.ExpectErr = *deny
+	if t.Host == "" {
+		fmt.Fprintf(os.Stderr, "Error: invalid target %q\n", fs.Arg(0))
+		return exitFailed
+	}
+	if err := probe.ValidatePhases(t.Phases); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: invalid phases: %v\n", err)
+		return exitFailed
+	}
+	if err := probe.ValidateExpect(t.Expect); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: invalid expect: %v\n", err)
+		return exitFailed
+	}
+
+	var roots *x509.CertPool
+	if *caFile != "" {
+		var err error
+		if roots, err = customRootCAs(nil, *caFile, ""); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return exitFailed
+		}
+	}
+
+	typ := "allow"
+	if t.ExpectErr {
+		typ = "deny"
+	}
+	fmt.Printf("\n  Checking %s%s:%d%s (%s, timeout %s per phase)\n\n", colorBold, t.Host, t.Port, colorReset, typ, *timeout)
+
+	// Print each phase as the next one starts, so that a hanging phase is
+	// visible while it hangs.
+	printed := 0
+	phases := checkPhases(t)
+	opts := probe.Options{Timeout: *timeout, HTTP: true, CertInfo: true, DataCheck: true, RootCAs: roots, FIPS: *fips, DNSTrace: *dnsTrace}
+	opts.OnPhase = func(_ int, phase string, partial probe.Result) {
+		for ; printed < len(phases) && phases[printed].name != phase; printed++ {
+			printCheckPhase(phases[printed], partial)
+		}
+	}
+	results, _ := probe.Run(ctx, []probe.Target{t}, opts)
+	r := results[0]
+	for ; printed < len(phases); printed++ {
+		printCheckPhase(phases[printed], r)
+	}
+	if r.Timings != nil {
+		fmt.Printf("\n  Timings:  %s%s%s\n", colorDim, formatTimings(r.Timings), colorReset)
+	}
+	if len(r.Assertions) > 0 {
+		fmt.Println()
+		for _, a := range r.Assertions {
+			glyph := colorGreen + padRight(passGlyph, 2) + colorReset
+			if !a.Passed {
+				glyph = colorRed + padRight(failGlyph, 2) + colorReset
+			}
+			fmt.Printf("  %s %-20s %s\n", glyph, a.Expr, a.Detail)
+		}
+	}
+	printDNSTrace(results)
+
+	fmt.Println()
+	switch {
+	case r.Incomplete:
+		fmt.Printf("  Result:   %s%sSKIP%s (run interrupted)\n\n", colorBold, colorYellow, colorReset)
+	case r.Passed && t.ExpectErr:
+		fmt.Printf("  Result:   %s%sOK%s (blocked, as expected)\n\n", colorBold, colorGreen, colorReset)
+	case r.Passed:
+		fmt.Printf("  Result:   %s%sOK%s (reachable)\n\n", colorBold, colorGreen, colorReset)
+	case t.ExpectErr && r.Blocked:
+		fmt.Printf("  Result:   %s%sFAIL%s (blocked, but %s)\n\n", colorBold, colorRed, colorReset, failureReason(r))
+	case t.ExpectErr:
+		fmt.Printf("  Result:   %s%sFAIL%s (reachable, but expected to be blocked)\n\n", colorBold, colorRed, colorReset)
+	default:
+		fmt.Printf("  Result:   %s%sFAIL%s (%s)\n\n", colorBold, colorRed, colorReset, failureReason(r))
+	}
+	return exitCode(results)
+}
+
+// formatTimings lists the steps of t that were taken, e.g.
+// "dns 2.1ms → connect 11.0ms → tls 24.3ms → ttfb 38.2ms = 75.6ms".
+func formatTimings(t *probe.Timings) string {
+	ms := func(d time.Duration) string {
+		return strconv.FormatFloat(float64(d.Microseconds())/1000, 'f', 1, 64) + "ms"
+	}
+	steps := []string{"dns " + ms(t.DNS), "connect " + ms(t.Connect)}
+	if t.TLS > 0 {
+		steps = append(steps, "tls "+ms(t.TLS))
+	}
+	if t.TTFB > 0 {
+		steps = append(steps, "ttfb "+ms(t.TTFB))
+	}
+	return strings.Join(steps, " → ") + " = " + ms(t.Total)
+}
+
+type checkPhase struct {
+	name  string // as reported by probe.Options.OnPhase
+	title string
+	get   func(probe.Result) probe.PhaseResult
+}
+
+func checkPhases(t probe.Target) []checkPhase {
+	phases := []checkPhase{
+		{"DNS", "DNS", func(r probe.Result) probe.PhaseResult { return r.DNS }},
+		{"TCP", "TCP", func(r probe.Result) probe.PhaseResult { return r.TCP }},
+		{"TLS", "TLS/SNI", func(r probe.Result) probe.PhaseResult { return r.TLS }},
+		{"HTTP", "HTTP", func(r probe.Result) probe.PhaseResult { return r.HTTP }},
+	}
+	if t.Exec != "" {
+		phases = append(phases, checkPhase{"EXEC", "EXEC", func(r probe.Result) probe.PhaseResult { return r.Exec }})
+	}
+	return phases
+}
+
+func printCheckPhase(ph checkPhase, r probe.Result) {
+	p := ph.get(r)
+	status := fmt.Sprintf("%s%s %5dms%s", colorGreen, padRight(passGlyph, 2), p.Duration.Milliseconds(), colorReset)
+	switch {
+	case p.Aborted || strings.HasPrefix(p.Detail, "skipped"):
+		status = fmt.Sprintf("%s—%s       ", colorDim, colorReset)
+	case !p.Success:
+		status = fmt.Sprintf("%s%s %5dms%s", colorRed, padRight(failGlyph, 2), p.Duration.Milliseconds(), colorReset)
+	}
+	fmt.Printf("  %-8s  %s   %s\n", ph.title, status, p.Detail)
+
+	if ph.name == "TCP" && p.Addr != "" {
+		fmt.Printf("  %-8s  %sremote address %s%s\n", "", colorDim, p.Addr, colorReset)
+	}
+	if ph.name == "TLS" && r.Cert != nil {
+		c := r.Cert
+		days := c.DaysLeft(time.Now())
+		fmt.Printf("  %-8s  %scertificate %s, issuer %s%s\n", "", colorDim, c.Subject, c.Issuer, colorReset)
+		fmt.Fprintf(tableOut, "  %-8s  %svalid %s → %s (%d days left)%s\n", "", colorDim,
+			c.NotBefore.Format("2006-01-02"), c.NotAfter.Format("2006-01-02"), days, colorReset)
+		if len(c.DNSNames) > 0 {
+			fmt.Printf("  %-8s  %sSANs: %s%s\n", "", colorDim, strings.Join(c.DNSNames, ", "), colorReset)
+		}
+		if c.SelfSigned {
+			fmt.Printf("  %-8s  %sself-signed%s\n", "", colorYellow, colorReset)
+		}
+	}
+	if ph.name == "TLS" && r.Intercepted != "" {
+		fmt.Printf("  %-8s  %sanswered by a local mesh proxy, not the destination: %s%s\n", "", colorYellow, r.Intercepted, colorReset)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ciOutput reports whether cfg asks for CI reporting: OUTPUT=gha (GitHub
+// Actions) or azdo (Azure Pipelines). Both print the usual table too.
+func ciOutput(cfg Config) bool {
+	return cfg.Output == "gha" || cfg.Output == "azdo"
+}
+
+// printCIReport surfaces a run in the CI system's UI: an error annotation
+// per failing target, and a Markdown summary on the run's page. GitHub
+// Actions takes workflow commands on stdout and the summary appended to
+// $GITHUB_STEP_SUMMARY. Azure Pipelines takes ##vso logging commands, and a
+// summary file it is told to upload.
+func printCIReport(cfg Config, out jsonOutput) {
+	verdict := fmt.Sprintf("%d/%d targets passed", out.Summary.Passed, out.Summary.Total)
+	if !out.Summary.OK {
+		verdict = fmt.Sprintf("%d of %d targets failed", out.Summary.Failed, out.Summary.Total)
+	}
+	for _, r := range out.Results {
+		if r.Passed || r.Incomplete {
+			continue
+		}
+		title := fmt.Sprintf("Egress %s %s", r.Type, net.JoinHostPort(r.Host, strconv.Itoa(r.Port)))
+		msg := failureDetail(r)
+		if owner := r.Metadata["owner"]; owner != "" {
+			msg += " (owner: " + owner + ")"
+		}
+		if cfg.Output == "gha" {
+			fmt.Printf("::error title=%s::%s\n", ghaEscapeProperty(title), ghaEscape(msg))
+		} else {
+			fmt.Printf("##vso[task.logissue type=error]%s\n", azdoEscape(title+": "+msg))
+		}
+	}
+	if cfg.Output == "gha" && out.Summary.OK {
+		fmt.Printf("::notice title=Egress probe::%s\n", ghaEscape(verdict))
+	}
+
+	summary := ciSummary(out, verdict)
+	if cfg.Output == "gha" {
+		path := os.Getenv("GITHUB_STEP_SUMMARY")
+		if path == "" {
+			logf("OUTPUT=gha: GITHUB_STEP_SUMMARY is not set; skipping the job summary")
+			return
+		}
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			logf("OUTPUT=gha: %v", err)
+			return
+		}
+		defer f.Close()
+		if _, err := f.WriteString(summary); err != nil {
+			logf("OUTPUT=gha: %v", err)
+		}
+		return
+	}
+
+	dir := os.Getenv("AGENT_TEMPDIRECTORY")
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	path := filepath.Join(dir, "egress-probe-summary.md")
+	if err := os.WriteFile(path, []byte(summary), 0o644); err != nil {
+		logf("OUTPUT=azdo: %v", err)
+		return
+	}
+	fmt.Printf("##vso[task.uploadsummary]%s\n", path)
+}
+
+// ciSummary renders a run as a Markdown summary: the verdict, a table of
+// the targets, failures first, and the likely causes.
+func ciSummary(out jsonOutput, verdict string) string {
+	var b strings.Builder
+	icon := passGlyph
+	if !out.Summary.OK {
+		icon = failGlyph
+	}
+	fmt.Fprintf(&b, "## Egress probe\n\n%s %s\n\n", icon, verdict)
+	if len(out.Results) > 0 {
+		b.WriteString("| | Target | Type | Health | Detail |\n|---|---|---|---|---|\n")
+		for _, failed := range []bool{true, false} {
+			for _, r := range out.Results {
+				if (!r.Passed && !r.Incomplete) != failed {
+					continue
+				}
+				status, detail := passGlyph, ""
+				switch {
+				case r.Incomplete:
+					status, detail = "⏱", "incomplete"
+				case !r.Passed:
+					status, detail = failGlyph, failureDetail(r)
+				}
+				score := ""
+				if r.Health != nil {
+					score = strconv.Itoa(r.Health.Score)
+				}
+				fmt.Fprintf(&b, "| %s | `%s` | %s | %s | %s |\n", status, net.JoinHostPort(r.Host, strconv.Itoa(r.Port)), r.Type, score, markdownCell(detail))
+			}
+		}
+		b.WriteString("\n")
+	}
+	if len(out.Diagnoses) > 0 {
+		b.WriteString("### Likely causes\n\n")
+		for i, d := range out.Diagnoses {
+			fmt.Fprintf(&b, "%d. **%s** (%s): %s: %s\n", i+1, markdownCell(d.Cause), d.Confidence, markdownCell(d.Evidence), markdownCell(strings.Join(d.Targets, ", ")))
+			for _, step := range d.NextSteps {
+				fmt.Fprintf(&b, "   - %s\n", markdownCell(step))
+			}
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// markdownCell keeps s on one line and out of the table's column syntax.
+func markdownCell(s string) string {
+	return strings.NewReplacer("|", `\|`, "\r", " ", "\n", " ").Replace(s)
+}
+
+// ghaEscape escapes the message of a GitHub Actions workflow command.
+func ghaEscape(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(s)
+}
+
+// ghaEscapeProperty escapes a property of a GitHub Actions workflow command.
+func ghaEscapeProperty(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A", ":", "%3A", ",", "%2C").Replace(s)
+}
+
+// azdoEscape escapes the message of an Azure Pipelines logging command.
+func azdoEscape(s string) string {
+	return strings.NewReplacer("%", "%AZP25", "\r", "%0D", "\n", "%0A").Replace(s)
+}
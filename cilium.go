@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/cheolhuikim/egress-probe/pkg/probe"
+)
+
+// CiliumNetworkPolicy and CiliumClusterwideNetworkPolicy (cilium.io/v2),
+// reduced to the egress side. A policy carries either one rule in spec or
+// several in specs.
+type ciliumPolicy struct {
+	Metadata objectMeta   `json:"metadata"`
+	Spec     *ciliumRule  `json:"spec"`
+	Specs    []ciliumRule `json:"specs"`
+}
+
+type ciliumPolicyList struct {
+	Items []ciliumPolicy `json:"items"`
+}
+
+type ciliumRule struct {
+	EndpointSelector  *labelSelector     `json:"endpointSelector"`
+	Egress            []ciliumEgressRule `json:"egress"`
+	EgressDeny        []ciliumEgressRule `json:"egressDeny"`
+	EnableDefaultDeny struct {
+		Egress *bool `json:"egress"`
+	} `json:"enableDefaultDeny"`
+}
+
+type ciliumEgressRule struct {
+	ToCIDR    []string `json:"toCIDR"`
+	ToCIDRSet []struct {
+		CIDR   string   `json:"cidr"`
+		Except []string `json:"except"`
+	} `json:"toCIDRSet"`
+	ToEntities []string `json:"toEntities"`
+	ToFQDNs    []struct {
+		MatchName    string `json:"matchName"`
+		MatchPattern string `json:"matchPattern"`
+	} `json:"toFQDNs"`
+	ToEndpoints []labelSelector `json:"toEndpoints"`
+	ToServices  []any           `json:"toServices"`
+	ToPorts     []struct {
+		Ports []struct {
+			Port     string `json:"port"`
+			EndPort  int    `json:"endPort"`
+			Protocol string `json:"protocol"`
+		} `json:"ports"`
+		Rules any `json:"rules"`
+	} `json:"toPorts"`
+}
+
+// ciliumNamespaceLabel is the label Cilium gives every endpoint for its
+// namespace; endpoint selectors commonly use it.
+const ciliumNamespaceLabel = "io.kubernetes.pod.namespace"
+
+// rules returns the policy's rules whose endpoint selector matches labels.
+func (p ciliumPolicy) rules(labels map[string]string) []ciliumRule {
+	all := p.Specs
+	if p.Spec != nil {
+		all = append([]ciliumRule{*p.Spec}, all...)
+	}
+	var matched []ciliumRule
+	for _, r := range all {
+		if r.EndpointSelector != nil && ciliumSelector(*r.EndpointSelector).matches(labels) {
+			matched = append(matched, r)
+		}
+	}
+	return matched
+}
+
+// ciliumSelector strips the label source prefixes ("k8s:", "any:") Cilium
+// allows in selector keys, which Pod labels don't carry.
+func ciliumSelector(s labelSelector) labelSelector {
+	trim := func(k string) string {
+		for _, prefix := range []string{"k8s:", "any:"} {
+			k = strings.TrimPrefix(k, prefix)
+		}
+		return k
+	}
+	out := labelSelector{MatchLabels: make(map[string]string, len(s.MatchLabels))}
+	for k, v := range s.MatchLabels {
+		out.MatchLabels[trim(k)] = v
+	}
+	for _, e := range s.MatchExpressions {
+		e.Key = trim(e.Key)
+		out.MatchExpressions = append(out.MatchExpressions, e)
+	}
+	return out
+}
+
+// defaultDeny reports whether the rule puts the endpoints it selects into
+// default-deny for egress.
+func (r ciliumRule) defaultDeny() bool {
+	if r.EnableDefaultDeny.Egress != nil {
+		return *r.EnableDefaultDeny.Egress
+	}
+	return len(r.Egress) > 0 || len(r.EgressDeny) > 0
+}
+
+// matches reports whether the egress rule selects a TCP connection to
+// ip:port of host. A rule with only toPorts selects every destination.
+// toEndpoints and toServices only select cluster endpoints, so they never
+// match the external addresses egress-probe is about.
+func (r ciliumEgressRule) matches(host string, ip net.IP, port int) (bool, string) {
+	note := ""
+	if len(r.ToPorts) > 0 {
+		ok := false
+		for _, tp := range r.ToPorts {
+			for _, p := range tp.Ports {
+				if ciliumPortMatches(p.Port, p.EndPort, p.Protocol, port) {
+					ok = true
+					if tp.Rules != nil {
+						note = "; L7 rules not evaluated"
+					}
+				}
+			}
+		}
+		if !ok {
+			return false, ""
+		}
+	}
+
+	l3 := len(r.ToCIDR) + len(r.ToCIDRSet) + len(r.ToEntities) + len(r.ToFQDNs) + len(r.ToEndpoints) + len(r.ToServices)
+	if l3 == 0 {
+		return true, note
+	}
+	for _, c := range r.ToCIDR {
+		if cidrContains(c, ip) {
+			return true, "toCIDR " + c + note
+		}
+	}
+	for _, set := range r.ToCIDRSet {
+		if !cidrContains(set.CIDR, ip) {
+			continue
+		}
+		excluded := false
+		for _, ex := range set.Except {
+			excluded = excluded || cidrContains(ex, ip)
+		}
+		if !excluded {
+			return true, "toCIDRSet " + set.CIDR + note
+		}
+	}
+	for _, e := range r.ToEntities {
+		// Whether an address is outside the cluster can't be told from
+		// here; egress-probe targets are assumed to be.
+		switch e {
+		case "all", "world", "world-ipv4", "world-ipv6":
+			return true, "toEntities " + e + note
+		}
+	}
+	name := strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, f := range r.ToFQDNs {
+		switch {
+		case f.MatchName != "" && strings.ToLower(strings.TrimSuffix(f.MatchName, ".")) == name:
+			return true, "toFQDNs " + f.MatchName + note
+		case f.MatchPattern != "" && fqdnPattern(f.MatchPattern).MatchString(name):
+			return true, "toFQDNs " + f.MatchPattern + note
+		}
+	}
+	return false, ""
+}
+
+// cidrContains reports whether ip is in cidr, which may also be a bare
+// address.
+func cidrContains(cidr string, ip net.IP) bool {
+	if a := net.ParseIP(cidr); a != nil {
+		return a.Equal(ip)
+	}
+	_, n, err := net.ParseCIDR(cidr)
+	return err == nil && n.Contains(ip)
+}
+
+func ciliumPortMatches(spec string, endPort int, protocol string, port int) bool {
+	switch strings.ToUpper(protocol) {
+	case "", "TCP", "ANY":
+	default:
+		return false
+	}
+	if spec == "" || spec == "0" {
+		return true
+	}
+	n, err := strconv.Atoi(spec)
+	if err != nil {
+		return false // named ports only resolve against Pods
+	}
+	if endPort > 0 {
+		return port >= n && port <= endPort
+	}
+	return port == n
+}
+
+// fqdnPattern compiles a toFQDNs matchPattern, in which "*" stands for any
+// run of DNS characters within one label, and a lone "*" for every name.
+func fqdnPattern(pattern string) *regexp.Regexp {
+	pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+	if pattern == "*" {
+		return regexp.MustCompile(`^.*$`)
+	}
+	quoted := regexp.QuoteMeta(pattern)
+	return regexp.MustCompile("^" + strings.ReplaceAll(quoted, `\*`, `[-a-z0-9_]*`) + "$")
+}
+
+// podCiliumPolicies holds the Cilium policy rules that select the probe's
+// own Pod, each with the name of its policy.
+type podCiliumPolicies struct {
+	pod   string // namespace/name
+	rules []namedCiliumRule
+}
+
+type namedCiliumRule struct {
+	policy string // "namespace/name", or "name" for cluster-wide policies
+	ciliumRule
+}
+
+// loadCiliumPolicies reads the CiliumNetworkPolicies of the probe's
+// namespace and the CiliumClusterwideNetworkPolicies, and keeps the rules
+// that select its Pod. Cluster-wide policies are skipped, after logging
+// why, if they can't be listed.
+func loadCiliumPolicies(ctx context.Context) (*podCiliumPolicies, error) {
+	client, err := newInClusterClient()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, clusterTargetsTimeout)
+	defer cancel()
+	pod, err := ownPod(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	var namespaced ciliumPolicyList
+	if err := client.get(ctx, "/apis/cilium.io/v2/namespaces/"+pod.Namespace+"/ciliumnetworkpolicies", &namespaced); err != nil {
+		if isNotFound(err) {
+			return nil, fmt.Errorf("the CiliumNetworkPolicy CRD is not installed")
+		}
+		return nil, fmt.Errorf("listing ciliumnetworkpolicies in %s: %w", pod.Namespace, err)
+	}
+	var clusterwide ciliumPolicyList
+	if err := client.get(ctx, "/apis/cilium.io/v2/ciliumclusterwidenetworkpolicies", &clusterwide); err != nil {
+		logf("Cilium policy check: cluster-wide policies not evaluated: %v", err)
+	}
+
+	return selectCiliumRules(pod, namespaced.Items, clusterwide.Items), nil
+}
+
+// selectCiliumRules keeps the rules of the Pod's namespaced and the
+// cluster-wide policies that select it.
+func selectCiliumRules(pod objectMeta, namespaced, clusterwide []ciliumPolicy) *podCiliumPolicies {
+	labels := map[string]string{ciliumNamespaceLabel: pod.Namespace}
+	for k, v := range pod.Labels {
+		labels[k] = v
+	}
+	cp := &podCiliumPolicies{pod: pod.Namespace + "/" + pod.Name}
+	for _, p := range namespaced {
+		for _, r := range p.rules(labels) {
+			cp.rules = append(cp.rules, namedCiliumRule{pod.Namespace + "/" + p.Metadata.Name, r})
+		}
+	}
+	for _, p := range clusterwide {
+		for _, r := range p.rules(labels) {
+			cp.rules = append(cp.rules, namedCiliumRule{p.Metadata.Name, r})
+		}
+	}
+	return cp
+}
+
+// evaluate computes the expected outcome of r the way Cilium does: a
+// matching egressDeny rule wins, then a matching egress rule allows, and
+// otherwise the target is denied if any rule puts the Pod in default-deny.
+// The reason names the rule responsible.
+func (cp *podCiliumPolicies) evaluate(r probe.Result) policyVerdict {
+	v := policyVerdict{Expected: "unknown", Observed: observedVerdict(r)}
+	ip := resultIP(r)
+	if ip == nil {
+		v.Reason = "target did not resolve"
+		return v
+	}
+
+	var allowedBy string
+	var enforcing []string
+	for _, nr := range cp.rules {
+		for i, rule := range nr.EgressDeny {
+			if ok, why := rule.matches(r.Target.Host, ip, r.Target.Port); ok {
+				v.Expected, v.Reason = "deny", ruleName(nr.policy, "egressDeny", i, why)
+				v.Mismatch = v.Observed != "" && v.Observed != v.Expected
+				return v
+			}
+		}
+		for i, rule := range nr.Egress {
+			if ok, why := rule.matches(r.Target.Host, ip, r.Target.Port); ok && allowedBy == "" {
+				allowedBy = ruleName(nr.policy, "egress", i, why)
+			}
+		}
+		if nr.defaultDeny() && !slices.Contains(enforcing, nr.policy) {
+			enforcing = append(enforcing, nr.policy)
+		}
+	}
+
+	switch {
+	case allowedBy != "":
+		v.Expected, v.Reason = "allow", allowedBy
+	case len(enforcing) == 0:
+		v.Expected, v.Reason = "allow", "no Cilium policy puts this Pod in default-deny for egress"
+	default:
+		v.Expected = "deny"
+		v.Reason = fmt.Sprintf("default deny: no egress rule of %s allows %s", strings.Join(enforcing, ", "),
+			net.JoinHostPort(ip.String(), strconv.Itoa(r.Target.Port)))
+	}
+	v.Mismatch = v.Observed != "" && v.Observed != v.Expected
+	return v
+}
+
+func ruleName(policy, section string, i int, why string) string {
+	if why == "" {
+		return fmt.Sprintf("%s %s[%d]", policy, section, i)
+	}
+	return fmt.Sprintf("%s %s[%d]: %s", policy, section, i, strings.TrimPrefix(why, "; "))
+}
+
+// checkCiliumPolicies evaluates every result against the Cilium policies
+// selecting the Pod. It returns nil, after logging why, if they can't be
+// read.
+func checkCiliumPolicies(ctx context.Context, results []probe.Result) []policyVerdict {
+	cp, err := loadCiliumPolicies(ctx)
+	if err != nil {
+		logf("Cilium policy check skipped: %v", err)
+		return nil
+	}
+	logf("Cilium policy check: %d rules select pod %s", len(cp.rules), cp.pod)
+	verdicts := make([]policyVerdict, len(results))
+	for i, r := range results {
+		verdicts[i] = cp.evaluate(r)
+	}
+	return verdicts
+}
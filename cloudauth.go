@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cachedToken is a bearer token, reused by the next daemon cycles until
+// shortly before it expires.
+type cachedToken struct {
+	value   string
+	expires time.Time
+}
+
+var cachedTokens = struct {
+	mu     sync.Mutex
+	tokens map[string]cachedToken // by the key given to cloudToken
+}{tokens: make(map[string]cachedToken)}
+
+// cloudToken returns the cached token for key, or a new one from fetch.
+func cloudToken(ctx context.Context, key string, fetch func(context.Context) (string, time.Time, error)) (string, error) {
+	cachedTokens.mu.Lock()
+	defer cachedTokens.mu.Unlock()
+	if t := cachedTokens.tokens[key]; t.value != "" && time.Until(t.expires) > 5*time.Minute {
+		return t.value, nil
+	}
+	value, expires, err := fetch(ctx)
+	if err != nil {
+		return "", err
+	}
+	cachedTokens.tokens[key] = cachedToken{value: value, expires: expires}
+	return value, nil
+}
+
+// oauthToken is the answer of the GCP metadata server, Entra ID and the
+// Azure instance metadata service. expires_in is a number from the first
+// two and a string from the last.
+type oauthToken struct {
+	AccessToken string          `json:"access_token"`
+	ExpiresIn   json.RawMessage `json:"expires_in"`
+}
+
+// fetchOAuthToken sends req and decodes the token it answers with.
+func fetchOAuthToken(req *http.Request, source string) (string, time.Time, error) {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("getting a token from %s: %w", source, err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode/100 != 2 {
+		return "", time.Time{}, fmt.Errorf("getting a token from %s: %s: %s", source, resp.Status, strings.TrimSpace(string(body)))
+	}
+	var tok oauthToken
+	if err := json.Unmarshal(body, &tok); err != nil || tok.AccessToken == "" {
+		return "", time.Time{}, fmt.Errorf("getting a token from %s: unexpected answer", source)
+	}
+	var secs int64
+	fmt.Sscan(strings.Trim(string(tok.ExpiresIn), `"`), &secs)
+	return tok.AccessToken, time.Now().Add(time.Duration(secs) * time.Second), nil
+}
+
+// gcpToken gets a token for the Pod's service account from the GKE metadata
+// server, which Workload Identity maps to a Google service account.
+func gcpToken(ctx context.Context) (string, time.Time, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token", nil)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	return fetchOAuthToken(req, "the GCP metadata server")
+}
+
+// Audiences of Azure tokens.
+const (
+	azureStorageResource = "https://storage.azure.com/"
+	azureMonitorResource = "https://monitor.azure.com/"
+)
+
+// azureBearer returns a cached token for resource, or a new one from
+// azureToken.
+func azureBearer(ctx context.Context, resource string) (string, error) {
+	return cloudToken(ctx, "azure "+resource, func(ctx context.Context) (string, time.Time, error) {
+		return azureToken(ctx, resource)
+	})
+}
+
+// azureToken exchanges the federated token that Azure Workload Identity
+// projects into the Pod (AZURE_FEDERATED_TOKEN_FILE) for a token for
+// resource. Without it, the managed identity of the node is asked through
+// the instance metadata service, with AZURE_CLIENT_ID picking a
+// user-assigned one.
+func azureToken(ctx context.Context, resource string) (string, time.Time, error) {
+	clientID := os.Getenv("AZURE_CLIENT_ID")
+	tokenFile := os.Getenv("AZURE_FEDERATED_TOKEN_FILE")
+	if tokenFile == "" {
+		q := url.Values{"api-version": {"2018-02-01"}, "resource": {resource}}
+		if clientID != "" {
+			q.Set("client_id", clientID)
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://169.254.169.254/metadata/identity/oauth2/token?"+q.Encode(), nil)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		req.Header.Set("Metadata", "true")
+		return fetchOAuthToken(req, "the Azure instance metadata service")
+	}
+
+	assertion, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("reading AZURE_FEDERATED_TOKEN_FILE: %w", err)
+	}
+	authority := os.Getenv("AZURE_AUTHORITY_HOST")
+	if authority == "" {
+		authority = "https://login.microsoftonline.com/"
+	}
+	form := url.Values{
+		"client_id":             {clientID},
+		"scope":                 {resource + ".default"},
+		"grant_type":            {"client_credentials"},
+		"client_assertion_type": {"urn:ietf:params:oauth:client-assertion-type:jwt-bearer"},
+		"client_assertion":      {strings.TrimSpace(string(assertion))},
+	}
+	u := strings.TrimRight(authority, "/") + "/" + os.Getenv("AZURE_TENANT_ID") + "/oauth2/v2.0/token"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return fetchOAuthToken(req, "Entra ID")
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// CloudEvents types emitted with CLOUDEVENTS_SINK.
+const (
+	eventRunCompleted    = "io.egressprobe.run.completed"
+	eventTargetFailed    = "io.egressprobe.target.failed"
+	eventTargetRecovered = "io.egressprobe.target.recovered"
+)
+
+// targetStates is whether each target passed in the previous daemon cycle,
+// for emitting state changes. It is shared across cycles.
+type targetStates struct {
+	passed map[string]bool // by targetKey
+}
+
+func newTargetStates() *targetStates {
+	return &targetStates{passed: make(map[string]bool)}
+}
+
+// targetEvent is the data of the target events.
+type targetEvent struct {
+	Node   string     `json:"node,omitempty"`
+	Detail string     `json:"detail,omitempty"` // why it failed
+	Result jsonResult `json:"result"`
+}
+
+// emitCloudEvents sends a run to CLOUDEVENTS_SINK as CloudEvents in binary
+// content mode: one io.egressprobe.run.completed event carrying the
+// OUTPUT=json report, then one io.egressprobe.target.failed for every target
+// that starts failing and one io.egressprobe.target.recovered for every one
+// that passes again. Without daemon mode's memory of the previous cycle,
+// every failing target counts as starting to fail. Incomplete targets don't
+// change state. Failures are logged: emitting never fails a run.
+func emitCloudEvents(ctx context.Context, cfg Config, out jsonOutput) {
+	if cfg.CloudEventsSink == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	source := "/egress-probe/" + cfg.NodeName
+	if err := sendCloudEvent(ctx, cfg.CloudEventsSink, eventRunCompleted, source, "", out); err != nil {
+		logf("CLOUDEVENTS_SINK: %v", err)
+		return
+	}
+
+	states := cfg.TargetStates
+	for _, r := range out.Results {
+		if r.Incomplete {
+			continue
+		}
+		key := r.Type + " " + net.JoinHostPort(r.Host, strconv.Itoa(r.Port))
+		var typ string
+		var prev, known bool
+		if states != nil {
+			prev, known = states.passed[key]
+			states.passed[key] = r.Passed
+		}
+		switch {
+		case !r.Passed && (!known || prev):
+			typ = eventTargetFailed
+		case r.Passed && known && !prev:
+			typ = eventTargetRecovered
+		default:
+			continue
+		}
+		data := targetEvent{Node: cfg.NodeName, Result: r}
+		if !r.Passed {
+			data.Detail = failureDetail(r)
+		}
+		if err := sendCloudEvent(ctx, cfg.CloudEventsSink, typ, source, key, data); err != nil {
+			logf("CLOUDEVENTS_SINK: %v", err)
+		}
+	}
+}
+
+// sendCloudEvent POSTs one event with its attributes as ce-* headers and data
+// as the JSON body.
+func sendCloudEvent(ctx context.Context, sink, typ, source, subject string, data any) error {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sink, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("ce-specversion", "1.0")
+	req.Header.Set("ce-id", hex.EncodeToString(id))
+	req.Header.Set("ce-type", typ)
+	req.Header.Set("ce-source", source)
+	req.Header.Set("ce-time", time.Now().UTC().Format(time.RFC3339Nano))
+	if subject != "" {
+		req.Header.Set("ce-subject", subject)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	answer, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("sending %s: sink returned %s: %s", typ, resp.Status, bytes.TrimSpace(answer))
+	}
+	return nil
+}
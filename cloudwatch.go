@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCloudWatchNamespace = "EgressProbe"
+	maxMetricDataPerRequest    = 500
+)
+
+// cloudWatchStreams are the log streams created so far, by group.
+var cloudWatchStreams struct {
+	mu      sync.Mutex
+	created map[string]bool
+}
+
+// cloudWatchDatum is one MetricDatum of PutMetricData.
+type cloudWatchDatum struct {
+	name       string
+	unit       string
+	value      float64
+	dimensions [][2]string
+}
+
+// sendCloudWatch publishes a run to CloudWatch with the Pod's IRSA or EKS
+// Pod Identity credentials: with CLOUDWATCH_METRICS, per-target metrics in
+// CLOUDWATCH_NAMESPACE; with CLOUDWATCH_LOG_GROUP, one structured event per
+// target in a log stream named after the node. Incomplete targets are left
+// out. Failures are logged: publishing never fails a run.
+func sendCloudWatch(ctx context.Context, cfg Config, out jsonOutput, end time.Time) {
+	if !cfg.CloudWatchMetrics && cfg.CloudWatchLogGroup == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	creds, err := loadAWSCredentials(ctx)
+	if err != nil {
+		logf("CloudWatch: %v", err)
+		return
+	}
+	if cfg.CloudWatchMetrics {
+		if err := putMetricData(ctx, cfg.CloudWatchNamespace, creds, cloudWatchData(out)); err != nil {
+			logf("CLOUDWATCH_METRICS: %v", err)
+		}
+	}
+	if cfg.CloudWatchLogGroup != "" {
+		if err := putLogEvents(ctx, cfg, creds, out, end); err != nil {
+			logf("CLOUDWATCH_LOG_GROUP: %v", err)
+		}
+	}
+}
+
+// cloudWatchData turns a run into metrics. They have no node dimension, so
+// that a DaemonSet doesn't multiply the number of metrics, which CloudWatch
+// bills, by the number of nodes: the nodes' data points add up instead.
+func cloudWatchData(out jsonOutput) []cloudWatchDatum {
+	var data []cloudWatchDatum
+	for _, r := range out.Results {
+		if r.Incomplete {
+			continue
+		}
+		target := [2]string{"Target", r.Type + " " + net.JoinHostPort(r.Host, strconv.Itoa(r.Port))}
+		failed := 0.0
+		if !r.Passed {
+			failed = 1
+		}
+		data = append(data, cloudWatchDatum{name: "TargetFailed", unit: "Count", value: failed, dimensions: [][2]string{target}})
+		if r.Health != nil {
+			data = append(data, cloudWatchDatum{name: "HealthScore", unit: "None", value: float64(r.Health.Score), dimensions: [][2]string{target}})
+		}
+		phases := []struct {
+			name string
+			p    *jsonPhase
+		}{{"DNS", &r.DNS}, {"TCP", &r.TCP}, {"TLS", &r.TLS}, {"HTTP", r.HTTP}, {"EXEC", r.Exec}}
+		for _, ph := range phases {
+			if ph.p == nil || ph.p.Start == nil {
+				continue
+			}
+			data = append(data, cloudWatchDatum{name: "PhaseDuration", unit: "Milliseconds", value: float64(ph.p.DurationUs) / 1000,
+				dimensions: [][2]string{target, {"Phase", ph.name}}})
+		}
+	}
+	data = append(data, cloudWatchDatum{name: "FailedTargets", unit: "Count", value: float64(out.Summary.Failed)})
+	return data
+}
+
+// putMetricData sends data through the CloudWatch query API, in batches.
+func putMetricData(ctx context.Context, namespace string, creds *awsCredentials, data []cloudWatchDatum) error {
+	for len(data) > 0 {
+		batch := data[:min(len(data), maxMetricDataPerRequest)]
+		data = data[len(batch):]
+
+		form := url.Values{"Action": {"PutMetricData"}, "Version": {"2010-08-01"}, "Namespace": {namespace}}
+		for i, d := range batch {
+			p := "MetricData.member." + strconv.Itoa(i+1) + "."
+			form.Set(p+"MetricName", d.name)
+			form.Set(p+"Unit", d.unit)
+			form.Set(p+"Value", strconv.FormatFloat(d.value, 'f', -1, 64))
+			for j, dim := range d.dimensions {
+				dp := p + "Dimensions.member." + strconv.Itoa(j+1) + "."
+				form.Set(dp+"Name", dim[0])
+				form.Set(dp+"Value", dim[1])
+			}
+		}
+		body := []byte(form.Encode())
+		if err := awsRequest(ctx, creds, "monitoring", "application/x-www-form-urlencoded", "", body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cloudWatchEvent is the message of a log event.
+type cloudWatchEvent struct {
+	Node   string     `json:"node"`
+	Target string     `json:"target"`
+	Detail string     `json:"detail,omitempty"` // why it failed
+	Result jsonResult `json:"result"`
+}
+
+// putLogEvents writes one event per target into the node's log stream of
+// CLOUDWATCH_LOG_GROUP, creating the stream on first use. The group must
+// exist.
+func putLogEvents(ctx context.Context, cfg Config, creds *awsCredentials, out jsonOutput, end time.Time) error {
+	group, stream := cfg.CloudWatchLogGroup, objectSafe(cfg.NodeName)
+
+	cloudWatchStreams.mu.Lock()
+	defer cloudWatchStreams.mu.Unlock()
+	if !cloudWatchStreams.created[group+"\x00"+stream] {
+		body, _ := json.Marshal(map[string]string{"logGroupName": group, "logStreamName": stream})
+		err := awsRequest(ctx, creds, "logs", "application/x-amz-json-1.1", "Logs_20140328.CreateLogStream", body)
+		if err != nil && !strings.Contains(err.Error(), "ResourceAlreadyExistsException") {
+			return err
+		}
+		if cloudWatchStreams.created == nil {
+			cloudWatchStreams.created = make(map[string]bool)
+		}
+		cloudWatchStreams.created[group+"\x00"+stream] = true
+	}
+
+	type logEvent struct {
+		Timestamp int64  `json:"timestamp"`
+		Message   string `json:"message"`
+	}
+	var events []logEvent
+	for _, r := range out.Results {
+		if r.Incomplete {
+			continue
+		}
+		ev := cloudWatchEvent{Node: cfg.NodeName, Target: r.Type + " " + net.JoinHostPort(r.Host, strconv.Itoa(r.Port)), Result: r}
+		if !r.Passed {
+			ev.Detail = failureDetail(r)
+		}
+		msg, err := json.Marshal(ev)
+		if err != nil {
+			return err
+		}
+		events = append(events, logEvent{Timestamp: end.UnixMilli(), Message: string(msg)})
+	}
+	if len(events) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(map[string]any{"logGroupName": group, "logStreamName": stream, "logEvents": events})
+	if err != nil {
+		return err
+	}
+	return awsRequest(ctx, creds, "logs", "application/x-amz-json-1.1", "Logs_20140328.PutLogEvents", body)
+}
+
+// awsRequest POSTs a signed request to the regional endpoint of service.
+// target is the X-Amz-Target of JSON APIs.
+func awsRequest(ctx context.Context, creds *awsCredentials, service, contentType, target string, body []byte) error {
+	region := awsRegion()
+	u := "https://" + service + "." + region + ".amazonaws.com/"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if target != "" {
+		req.Header.Set("X-Amz-Target", target)
+	}
+	signAWS(req, body, creds, region, service, time.Now())
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	answer, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s returned %s: %s", service, resp.Status, strings.TrimSpace(string(answer)))
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cheolhuikim/egress-probe/pkg/probe"
+)
+
+// clusterTargetsTimeout bounds fetching a target list from the API server.
+const clusterTargetsTimeout = 30 * time.Second
+
+type configMap struct {
+	Metadata objectMeta        `json:"metadata"`
+	Data     map[string]string `json:"data"`
+}
+
+// checkAPITarget rejects the options of a target read from the Kubernetes
+// API that act on the Pod probing it: exec runs a command, and client_cert
+// and client_key read files. Whoever can edit the object needn't be able to
+// do either.
+func checkAPITarget(t probe.Target) error {
+	switch {
+	case t.Exec != "":
+		return fmt.Errorf("target %s:%d: exec is not allowed in targets from the Kubernetes API", t.Host, t.Port)
+	case t.ClientCert != "" || t.ClientKey != "":
+		return fmt.Errorf("target %s:%d: client_cert and client_key are not allowed in targets from the Kubernetes API", t.Host, t.Port)
+	}
+	return nil
+}
+
+// loadConfigMapTargets fetches targets from the ConfigMap ref ("namespace/name",
+// or a bare name in the Pod's namespace). Its "allow" and "deny" keys hold
+// target lists in the ALLOW_TARGETS_FILE format.
+func loadConfigMapTargets(ref string) ([]probe.Target, error) {
+	client, err := newInClusterClient()
+	if err != nil {
+		return nil, fmt.Errorf("TARGETS_CONFIGMAP: %w", err)
+	}
+	ns, name, err := splitNamespacedName(ref, client.namespace)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TARGETS_CONFIGMAP: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), clusterTargetsTimeout)
+	defer cancel()
+	var cm configMap
+	if err := client.get(ctx, "/api/v1/namespaces/"+ns+"/configmaps/"+name, &cm); err != nil {
+		if isNotFound(err) {
+			return nil, fmt.Errorf("TARGETS_CONFIGMAP: configmap %s/%s not found", ns, name)
+		}
+		return nil, fmt.Errorf("TARGETS_CONFIGMAP: reading configmap %s/%s: %w", ns, name, err)
+	}
+
+	allow, deny := cm.Data["allow"], cm.Data["deny"]
+	if strings.TrimSpace(allow) == "" && strings.TrimSpace(deny) == "" {
+		return nil, fmt.Errorf("TARGETS_CONFIGMAP: configmap %s/%s has no allow or deny key", ns, name)
+	}
+	var targets []probe.Target
+	targets = append(targets, probe.ParseTargetList(parseTargetsText(allow), false)...)
+	targets = append(targets, probe.ParseTargetList(parseTargetsText(deny), true)...)
+	for _, t := range targets {
+		if err := checkAPITarget(t); err != nil {
+			return nil, fmt.Errorf("TARGETS_CONFIGMAP: configmap %s/%s: %w", ns, name, err)
+		}
+	}
+	return targets, nil
+}
+
+// loadEgressProbeTargets fetches the allow and deny lists from the spec of
+// the EgressProbe resource ref, so that one resource can drive the operator
+// and plain Jobs or DaemonSets alike. Its other settings are not applied.
+func loadEgressProbeTargets(ref string) ([]probe.Target, error) {
+	client, err := newInClusterClient()
+	if err != nil {
+		return nil, fmt.Errorf("TARGETS_EGRESSPROBE: %w", err)
+	}
+	ns, name, err := splitNamespacedName(ref, client.namespace)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TARGETS_EGRESSPROBE: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), clusterTargetsTimeout)
+	defer cancel()
+	var ep egressProbe
+	if err := client.get(ctx, egressProbeAPI+"/namespaces/"+ns+"/egressprobes/"+name, &ep); err != nil {
+		if isNotFound(err) {
+			return nil, fmt.Errorf("TARGETS_EGRESSPROBE: egressprobe %s/%s not found", ns, name)
+		}
+		return nil, fmt.Errorf("TARGETS_EGRESSPROBE: reading egressprobe %s/%s: %w", ns, name, err)
+	}
+
+	var targets []probe.Target
+	for _, s := range ep.Spec.Allow {
+		targets = append(targets, probe.ParseTargetList(s, false)...)
+	}
+	for _, s := range ep.Spec.Deny {
+		targets = append(targets, probe.ParseTargetList(s, true)...)
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("TARGETS_EGRESSPROBE: egressprobe %s/%s has an empty spec.allow and spec.deny", ns, name)
+	}
+	for _, t := range targets {
+		if err := checkAPITarget(t); err != nil {
+			return nil, fmt.Errorf("TARGETS_EGRESSPROBE: egressprobe %s/%s: %w", ns, name, err)
+		}
+	}
+	return targets, nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+// compareOutput is the JSON form of "egress-probe compare".
+type compareOutput struct {
+	Reports []mergeCluster  `json:"reports"`
+	Targets []compareTarget `json:"targets"`
+}
+
+// compareTarget is one target across the compared reports.
+type compareTarget struct {
+	Target         string                   `json:"target"` // e.g. "allow github.com:443"
+	OutcomeDiffers bool                     `json:"outcome_differs"`
+	LatencyDiffers bool                     `json:"latency_differs"`
+	Results        map[string]compareResult `json:"results"` // report name → how the target fared there
+}
+
+type compareResult struct {
+	Outcome string `json:"outcome"`           // pass, fail or incomplete
+	Latency string `json:"latency,omitempty"` // reachable targets: fast, moderate or slow
+	TotalMs int64  `json:"total_ms,omitempty"`
+	Detail  string `json:"detail,omitempty"` // why it failed
+}
+
+// runCompare implements "egress-probe compare": like merge, it lines up
+// OUTPUT=json reports from several environments, or from before and after a
+// change, but only reports what diverges: targets whose outcome differs,
+// then targets reachable everywhere whose latency class differs. It returns
+// exitFailed if an outcome differs.
+func runCompare(args []string) int {
+	fs := flag.NewFlagSet("compare", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the comparison as JSON")
+	all := fs.Bool("all", false, "list every target, not only those that differ")
+	fast := fs.Duration("fast", 100*time.Millisecond, "targets reached in less than this are fast")
+	slow := fs.Duration("slow", 500*time.Millisecond, "targets reached in this or more are slow; those in between are moderate")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s compare [flags] [name=]results.json...\n\nEach report is named after its file unless given as name=file, e.g.\n  %s compare before=before.json after=after.json\n\nFlags:\n", os.Args[0], os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() < 2 {
+		fs.Usage()
+		return exitFailed
+	}
+	if *fast <= 0 || *slow < *fast {
+		fmt.Fprintf(os.Stderr, "Error: -slow must be at least -fast, and both above zero\n")
+		return exitFailed
+	}
+
+	clusters, reports, err := readLabeledReports(fs.Args())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitFailed
+	}
+
+	class := func(d time.Duration) string {
+		switch {
+		case d < *fast:
+			return "fast"
+		case d < *slow:
+			return "moderate"
+		}
+		return "slow"
+	}
+	var targets []compareTarget
+	code, outcomes, latencies := 0, 0, 0
+	rows := buildMatrix(reports).Targets
+	for _, row := range rows {
+		t := compareTarget{Target: row.Target, OutcomeDiffers: !row.Consistent, Results: make(map[string]compareResult)}
+		latency, reachedEverywhere := "", true
+		for _, rep := range reports {
+			r, ok := findResult(rep.Results, row)
+			if !ok {
+				reachedEverywhere = false
+				continue
+			}
+			cr := compareResult{Outcome: row.Results[rep.Node]}
+			if !r.Passed && !r.Incomplete {
+				cr.Detail = failureDetail(r)
+			}
+			if !r.Incomplete && !r.Blocked {
+				total := resultLatency(r)
+				cr.Latency, cr.TotalMs = class(total), total.Milliseconds()
+				if latency != "" && latency != cr.Latency {
+					t.LatencyDiffers = true
+				}
+				latency = cr.Latency
+			} else {
+				reachedEverywhere = false
+			}
+			t.Results[rep.Node] = cr
+		}
+		// Latency only means something where the target was reached.
+		t.LatencyDiffers = t.LatencyDiffers && reachedEverywhere && !t.OutcomeDiffers
+		if t.OutcomeDiffers {
+			code = exitFailed
+			outcomes++
+		}
+		if t.LatencyDiffers {
+			latencies++
+		}
+		if *all || t.OutcomeDiffers || t.LatencyDiffers {
+			targets = append(targets, t)
+		}
+	}
+
+	if *asJSON {
+		if targets == nil {
+			targets = []compareTarget{}
+		}
+		writeJSON(Config{}, compareOutput{Reports: clusters, Targets: targets})
+		return code
+	}
+
+	names := make([]string, len(reports))
+	width := 0
+	for i, rep := range reports {
+		names[i] = rep.Node
+		width = max(width, len(rep.Node))
+	}
+	total := len(rows)
+	fmt.Printf("\n  Comparing %s: %d targets\n", joinNames(names), total)
+	for _, section := range []struct {
+		title string
+		match func(compareTarget) bool
+	}{
+		{"Outcome differs", func(t compareTarget) bool { return t.OutcomeDiffers }},
+		{"Latency differs", func(t compareTarget) bool { return t.LatencyDiffers }},
+		{"Same everywhere", func(t compareTarget) bool { return !t.OutcomeDiffers && !t.LatencyDiffers }},
+	} {
+		header := false
+		for _, t := range targets {
+			if !section.match(t) {
+				continue
+			}
+			if !header {
+				fmt.Printf("\n  %s%s%s\n", colorBold, section.title, colorReset)
+				header = true
+			}
+			fmt.Printf("\n    %s\n", t.Target)
+			for _, name := range names {
+				cr, ok := t.Results[name]
+				switch {
+				case !ok:
+					fmt.Printf("      %s%-*s  not probed%s\n", colorDim, width, name, colorReset)
+				case cr.Outcome == "incomplete":
+					fmt.Printf("      %s%-*s  SKIP%s\n", colorDim, width, name, colorReset)
+				case cr.Outcome == "fail":
+					fmt.Printf("      %s%-*s  FAIL  %s%s\n", colorRed, width, name, cr.Detail, colorReset)
+				case cr.Latency != "":
+					fmt.Printf("      %s%-*s  PASS  %-8s %dms%s\n", colorGreen, width, name, cr.Latency, cr.TotalMs, colorReset)
+				default:
+					fmt.Printf("      %s%-*s  PASS  blocked%s\n", colorGreen, width, name, colorReset)
+				}
+			}
+		}
+	}
+
+	fmt.Println()
+	if outcomes == 0 && latencies == 0 {
+		fmt.Fprintf(tableOut, "  %s%s✓ Every target behaves the same in all %d reports%s\n\n", colorBold, colorGreen, len(reports), colorReset)
+		return code
+	}
+	fmt.Printf("  %d differ in outcome, %d in latency, %d the same everywhere\n\n", outcomes, latencies, total-outcomes-latencies)
+	return code
+}
+
+// resultLatency is how long reaching r took: its connection's total, or
+// else the sum of the phases that ran.
+func resultLatency(r jsonResult) time.Duration {
+	if r.Timings != nil {
+		return time.Duration(r.Timings.TotalUs) * time.Microsecond
+	}
+	var us int64
+	for _, p := range []*jsonPhase{&r.DNS, &r.TCP, &r.TLS, r.HTTP, r.Exec} {
+		if p != nil && p.Start != nil {
+			us += p.DurationUs
+		}
+	}
+	return time.Duration(us) * time.Microsecond
+}
+
+// joinNames lists names as "a, b and c".
+func joinNames(names []string) string {
+	s := ""
+	for i, n := range names {
+		switch {
+		case i == 0:
+		case i == len(names)-1:
+			s += " and "
+		default:
+			s += ", "
+		}
+		s += n
+	}
+	return s
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/cheolhuikim/egress-probe/pkg/probe"
+)
+
+// configSettings are the settings of CONFIG_FILE, by environment variable
+// name, as of the last parseConfig.
+var configSettings map[string]string
+
+// getenv reads the setting name: the environment variable, or else its value
+// in CONFIG_FILE.
+func getenv(name string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return configSettings[name]
+}
+
+// configFile is what CONFIG_FILE holds: settings under the names of their
+// environment variables, and the allow and deny targets.
+type configFile struct {
+	settings map[string]string
+	targets  []probe.Target
+}
+
+// loadConfigFile reads the configuration file path, in JSON or YAML:
+//
+//	timeout: 10s
+//	preset: [go, pypi]
+//	allow:
+//	  - github.com
+//	  - host: registry-1.docker.io
+//	    method: GET
+//	    path: /v2/
+//	    owner: platform-team
+//	deny:
+//	  - 169.254.169.254:80
+//
+// Setting names are case-insensitive, and a list is joined with commas.
+// Targets are written as in ALLOW_TARGETS, or as a mapping of "host" or
+// "target", an optional "port", and per-target options. An empty path is
+// an empty configuration.
+func loadConfigFile(path string) (configFile, error) {
+	if path == "" {
+		return configFile{}, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return configFile{}, fmt.Errorf("reading CONFIG_FILE: %w", err)
+	}
+	var tree any
+	if ext := filepath.Ext(path); ext == ".json" || (ext != ".yaml" && ext != ".yml" && strings.HasPrefix(strings.TrimSpace(string(data)), "{")) {
+		err = json.Unmarshal(data, &tree)
+	} else {
+		tree, err = parseYAML(string(data))
+	}
+	if err != nil {
+		return configFile{}, fmt.Errorf("invalid CONFIG_FILE %s: %w", path, err)
+	}
+	cf, err := toConfigFile(tree)
+	if err != nil {
+		return configFile{}, fmt.Errorf("invalid CONFIG_FILE %s: %w", path, err)
+	}
+	return cf, nil
+}
+
+// toConfigFile interprets the parsed file.
+func toConfigFile(tree any) (configFile, error) {
+	root, ok := tree.(map[string]any)
+	if !ok {
+		if tree == nil {
+			return configFile{}, nil
+		}
+		return configFile{}, fmt.Errorf("expected a mapping of settings and targets")
+	}
+	cf := configFile{settings: make(map[string]string)}
+	for _, key := range sortedKeys(root) {
+		value := root[key]
+		name := strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+		switch name {
+		case "ALLOW", "DENY":
+			entries, ok := value.([]any)
+			if !ok && value != nil {
+				return configFile{}, fmt.Errorf("%s: expected a list of targets", key)
+			}
+			for i, entry := range entries {
+				t, err := configTarget(entry)
+				if err != nil {
+					return configFile{}, fmt.Errorf("%s[%d]: %v", key, i, err)
+				}
+				t.ExpectErr = name == "DENY"
+				cf.targets = append(cf.targets, t)
+			}
+		case "CONFIG_FILE":
+			return configFile{}, fmt.Errorf("%s: a configuration file cannot name another", key)
+		default:
+			s, err := configValue(value, ",")
+			if err != nil {
+				return configFile{}, fmt.Errorf("%s: %v", key, err)
+			}
+			cf.settings[name] = s
+		}
+	}
+	return cf, nil
+}
+
+// configTarget converts a target of the file: a string as in ALLOW_TARGETS,
+// or a mapping.
+func configTarget(entry any) (probe.Target, error) {
+	if s, ok := scalar(entry); ok {
+		if strings.TrimSpace(s) == "" {
+			return probe.Target{}, fmt.Errorf("empty target")
+		}
+		return probe.ParseTarget(s), nil
+	}
+	m, ok := entry.(map[string]any)
+	if !ok {
+		return probe.Target{}, fmt.Errorf("expected a target or a mapping with host")
+	}
+	fields := make(map[string]string, len(m))
+	for key, value := range m {
+		sep := ","
+		if strings.EqualFold(key, "expect") {
+			sep = " " // assertions are separated by spaces
+		}
+		s, err := configValue(value, sep)
+		if err != nil {
+			return probe.Target{}, fmt.Errorf("%s: %v", key, err)
+		}
+		fields[strings.ToLower(key)] = s
+	}
+
+	addr := fields["target"]
+	switch host, port := fields["host"], fields["port"]; {
+	case (addr == "") == (host == ""):
+		return probe.Target{}, fmt.Errorf("expected one of host or target")
+	case port != "" && host == "":
+		return probe.Target{}, fmt.Errorf("port goes with host, not target")
+	case port != "":
+		addr = net.JoinHostPort(host, port)
+	case host != "":
+		addr = host
+	}
+	spec := addr
+	for _, key := range sortedKeys(fields) {
+		if key == "target" || key == "host" || key == "port" {
+			continue
+		}
+		if strings.ContainsRune(fields[key], ';') {
+			return probe.Target{}, fmt.Errorf("%s: a value cannot contain ';'", key)
+		}
+		spec += ";" + key + "=" + fields[key]
+	}
+	return probe.ParseTarget(spec), nil
+}
+
+// configValue converts a setting or option to the string its environment
+// variable would hold, joining lists with sep.
+func configValue(v any, sep string) (string, error) {
+	if s, ok := scalar(v); ok {
+		return s, nil
+	}
+	list, ok := v.([]any)
+	if !ok {
+		return "", fmt.Errorf("expected a value or a list of values")
+	}
+	parts := make([]string, len(list))
+	for i, item := range list {
+		s, ok := scalar(item)
+		if !ok {
+			return "", fmt.Errorf("expected a list of values")
+		}
+		parts[i] = s
+	}
+	return strings.Join(parts, sep), nil
+}
+
+// scalar formats a value of the parsed file that isn't a list or mapping.
+func scalar(v any) (string, bool) {
+	switch v := v.(type) {
+	case nil:
+		return "", true
+	case string:
+		return v, true
+	case bool:
+		return strconv.FormatBool(v), true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	}
+	return "", false
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// yamlLine is a line of a YAML document with its indentation.
+type yamlLine struct {
+	n      int // line number
+	indent int
+	text   string
+}
+
+// parseYAML parses the subset of YAML a configuration file needs: block
+// mappings and sequences nested by indentation, flow sequences such as
+// [a, b], plain and quoted scalars, and comments. Scalars are strings.
+func parseYAML(text string) (any, error) {
+	var lines []yamlLine
+	for i, raw := range strings.Split(text, "\n") {
+		raw = strings.TrimRight(stripComment(raw), " \t\r")
+		content := strings.TrimLeft(raw, " ")
+		if content == "" || raw == "---" {
+			continue
+		}
+		if strings.HasPrefix(content, "\t") {
+			return nil, fmt.Errorf("line %d: indented with a tab", i+1)
+		}
+		lines = append(lines, yamlLine{n: i + 1, indent: len(raw) - len(content), text: content})
+	}
+	if len(lines) == 0 {
+		return nil, nil
+	}
+	p := &yamlParser{lines: lines}
+	v, err := p.node(lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.i < len(lines) {
+		return nil, fmt.Errorf("line %d: unexpected indentation", lines[p.i].n)
+	}
+	return v, nil
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	i     int
+}
+
+// node parses the mapping or sequence starting at the current line, whose
+// entries are indented by indent.
+func (p *yamlParser) node(indent int) (any, error) {
+	if isItem(p.lines[p.i].text) {
+		return p.sequence(indent)
+	}
+	if _, _, ok := splitKey(p.lines[p.i].text); ok {
+		return p.mapping(indent)
+	}
+	l := p.lines[p.i]
+	p.i++
+	return yamlScalar(l.text, l.n)
+}
+
+func (p *yamlParser) sequence(indent int) (any, error) {
+	var list []any
+	for p.i < len(p.lines) && p.lines[p.i].indent == indent && isItem(p.lines[p.i].text) {
+		l := p.lines[p.i]
+		rest := strings.TrimLeft(l.text[1:], " ")
+		switch {
+		case rest == "":
+			p.i++
+			if p.i < len(p.lines) && p.lines[p.i].indent > indent {
+				v, err := p.node(p.lines[p.i].indent)
+				if err != nil {
+					return nil, err
+				}
+				list = append(list, v)
+			} else {
+				list = append(list, nil)
+			}
+		default:
+			// "- host: a" starts a mapping indented as far as "host".
+			if _, _, ok := splitKey(rest); ok && !strings.HasPrefix(rest, "[") {
+				p.lines[p.i] = yamlLine{n: l.n, indent: indent + len(l.text) - len(rest), text: rest}
+				v, err := p.mapping(p.lines[p.i].indent)
+				if err != nil {
+					return nil, err
+				}
+				list = append(list, v)
+				continue
+			}
+			v, err := yamlScalar(rest, l.n)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+			p.i++
+		}
+	}
+	return list, nil
+}
+
+func (p *yamlParser) mapping(indent int) (any, error) {
+	m := make(map[string]any)
+	for p.i < len(p.lines) && p.lines[p.i].indent == indent && !isItem(p.lines[p.i].text) {
+		l := p.lines[p.i]
+		key, rest, ok := splitKey(l.text)
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key: value", l.n)
+		}
+		if _, dup := m[key]; dup {
+			return nil, fmt.Errorf("line %d: %s given twice", l.n, key)
+		}
+		p.i++
+		if rest != "" {
+			v, err := yamlScalar(rest, l.n)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = v
+			continue
+		}
+		// The value is the block below, or a sequence at the key's own
+		// indentation.
+		switch next := p.i; {
+		case next < len(p.lines) && p.lines[next].indent > indent,
+			next < len(p.lines) && p.lines[next].indent == indent && isItem(p.lines[next].text):
+			v, err := p.node(p.lines[next].indent)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = v
+		default:
+			m[key] = nil
+		}
+	}
+	if p.i < len(p.lines) && p.lines[p.i].indent > indent {
+		return nil, fmt.Errorf("line %d: unexpected indentation", p.lines[p.i].n)
+	}
+	return m, nil
+}
+
+// isItem reports whether a line is an entry of a block sequence.
+func isItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// splitKey splits "key: value" at the first colon followed by a space or
+// ending the line. "github.com:443" is not a key; a quoted key may hold
+// anything.
+func splitKey(text string) (key, rest string, ok bool) {
+	from := 0
+	if text != "" && (text[0] == '"' || text[0] == '\'') {
+		end := strings.IndexByte(text[1:], text[0])
+		if end < 0 {
+			return "", "", false
+		}
+		from = end + 2
+	}
+	for i := from; i < len(text); i++ {
+		if text[i] == ':' && (i+1 == len(text) || text[i+1] == ' ') {
+			k, err := yamlScalar(strings.TrimSpace(text[:i]), 0)
+			s, _ := k.(string)
+			if err != nil || s == "" {
+				return "", "", false
+			}
+			return s, strings.TrimSpace(text[i+1:]), true
+		}
+	}
+	return "", "", false
+}
+
+// yamlScalar parses a scalar or a flow sequence, e.g. [dns, tcp].
+func yamlScalar(s string, n int) (any, error) {
+	switch {
+	case strings.HasPrefix(s, "["):
+		if !strings.HasSuffix(s, "]") {
+			return nil, fmt.Errorf("line %d: unterminated [", n)
+		}
+		list := []any{}
+		for _, item := range splitFlow(s[1 : len(s)-1]) {
+			if item = strings.TrimSpace(item); item == "" {
+				continue
+			}
+			v, err := yamlScalar(item, n)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		return list, nil
+	case strings.HasPrefix(s, "{"):
+		return nil, fmt.Errorf("line %d: flow mappings are not supported, write the mapping as a block", n)
+	case strings.HasPrefix(s, `"`):
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid quoted string %s", n, s)
+		}
+		return v, nil
+	case strings.HasPrefix(s, "'"):
+		if len(s) < 2 || !strings.HasSuffix(s, "'") {
+			return nil, fmt.Errorf("line %d: invalid quoted string %s", n, s)
+		}
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	case s == "~" || s == "null":
+		return nil, nil
+	}
+	return s, nil
+}
+
+// splitFlow splits the inside of a flow sequence at commas outside quotes.
+func splitFlow(s string) []string {
+	var parts []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ',':
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// stripComment removes a comment, which starts with # at the beginning of
+// the line or after a space, outside quotes.
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			if i == 0 || line[i-1] == ' ' || line[i-1] == '[' || line[i-1] == ',' {
+				quote = c
+			}
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
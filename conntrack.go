@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cheolhuikim/egress-probe/pkg/probe"
+)
+
+// conntrackSlowDNS flags a lookup that was probably retried: resolvers wait
+// 5s before resending a query whose packet was dropped.
+const conntrackSlowDNS = 4500 * time.Millisecond
+
+// conntrackProc is where the counters and table are read from. /proc/1/net
+// is the network namespace of PID 1: the node's with hostPID, or with
+// hostNetwork, where pod traffic is DNATed and tracked.
+const conntrackProc = "/proc/1/net"
+
+// maxUnrepliedDNS caps how many table entries are reported.
+const maxUnrepliedDNS = 10
+
+// conntrackCounters are the sums over all CPUs of the counters in
+// /proc/net/stat/nf_conntrack that reveal dropped packets.
+type conntrackCounters struct {
+	InsertFailed uint64 `json:"insert_failed"`
+	Drop         uint64 `json:"drop"`
+	EarlyDrop    uint64 `json:"early_drop"`
+}
+
+// conntrackCheck is what CONNTRACK_CHECK found after a run with failed or
+// slow DNS lookups.
+type conntrackCheck struct {
+	SlowDNS      []string          `json:"slow_dns"` // targets whose lookup failed or took ~5s
+	Counters     conntrackCounters `json:"counters"`
+	Delta        conntrackCounters `json:"delta"` // growth during the run
+	Entries      int               `json:"entries,omitempty"`
+	Max          int               `json:"max,omitempty"`
+	UnrepliedDNS []string          `json:"unreplied_dns,omitempty"` // UDP port 53 entries that never saw a reply
+	Findings     []string          `json:"findings"`
+	Error        string            `json:"error,omitempty"`
+}
+
+// readConntrackCounters sums the per-CPU counters. Their columns vary with
+// the kernel version, so they are found by name in the header.
+func readConntrackCounters() (conntrackCounters, error) {
+	var c conntrackCounters
+	f, err := os.Open(conntrackProc + "/stat/nf_conntrack")
+	if err != nil {
+		return c, err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	if !sc.Scan() {
+		return c, fmt.Errorf("%s/stat/nf_conntrack is empty", conntrackProc)
+	}
+	cols := make(map[string]int)
+	for i, name := range strings.Fields(sc.Text()) {
+		cols[name] = i
+	}
+	field := func(fields []string, name string) uint64 {
+		i, ok := cols[name]
+		if !ok || i >= len(fields) {
+			return 0
+		}
+		n, _ := strconv.ParseUint(fields[i], 16, 64)
+		return n
+	}
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		c.InsertFailed += field(fields, "insert_failed")
+		c.Drop += field(fields, "drop")
+		c.EarlyDrop += field(fields, "early_drop")
+	}
+	return c, sc.Err()
+}
+
+// slowDNSTargets lists the targets whose lookup failed or was slow enough to
+// have been retried. An NXDOMAIN is an answer, so it doesn't count; literal
+// IPs and cached answers are never slow.
+func slowDNSTargets(results []probe.Result) []string {
+	var slow []string
+	for _, r := range results {
+		if r.DNS.Aborted {
+			continue
+		}
+		switch {
+		case !r.DNS.Success && r.DNS.Detail != "" && r.DNS.Detail != "NXDOMAIN":
+			slow = append(slow, fmt.Sprintf("%s (%s)", r.Target.Host, r.DNS.Detail))
+		case r.DNS.Duration >= conntrackSlowDNS:
+			slow = append(slow, fmt.Sprintf("%s (%s)", r.Target.Host, r.DNS.Duration.Round(100*time.Millisecond)))
+		}
+	}
+	return slow
+}
+
+// checkConntrack gathers conntrack evidence after a run whose DNS lookups
+// failed or took about 5s, comparing the counters with before, taken before
+// the run. It returns nil if DNS was healthy.
+func checkConntrack(results []probe.Result, before conntrackCounters, beforeErr error) *conntrackCheck {
+	slow := slowDNSTargets(results)
+	if len(slow) == 0 {
+		return nil
+	}
+	c := &conntrackCheck{SlowDNS: slow}
+	if beforeErr != nil {
+		c.Error = fmt.Sprintf("reading conntrack counters: %v (needs hostNetwork or hostPID)", beforeErr)
+		return c
+	}
+	after, err := readConntrackCounters()
+	if err != nil {
+		c.Error = fmt.Sprintf("reading conntrack counters: %v", err)
+		return c
+	}
+	c.Counters = after
+	c.Delta = conntrackCounters{
+		InsertFailed: after.InsertFailed - before.InsertFailed,
+		Drop:         after.Drop - before.Drop,
+		EarlyDrop:    after.EarlyDrop - before.EarlyDrop,
+	}
+	c.Entries, c.UnrepliedDNS = readConntrackTable()
+	if data, err := os.ReadFile("/proc/sys/net/netfilter/nf_conntrack_max"); err == nil {
+		c.Max, _ = strconv.Atoi(strings.TrimSpace(string(data)))
+	}
+
+	switch {
+	case c.Delta.InsertFailed > 0:
+		c.Findings = append(c.Findings, fmt.Sprintf("%d conntrack insertions failed during this run: concurrent UDP packets of one socket raced for the same entry and were dropped, the race behind 5s DNS delays. Use NodeLocal DNSCache, or single-request-reopen / use-vc in dnsConfig.options", c.Delta.InsertFailed))
+	case c.Counters.InsertFailed > 0:
+		c.Findings = append(c.Findings, fmt.Sprintf("no insertions failed during this run, but %d have since boot: the UDP race happens on this node, if not this time", c.Counters.InsertFailed))
+	}
+	if c.Delta.Drop > 0 || c.Delta.EarlyDrop > 0 {
+		c.Findings = append(c.Findings, fmt.Sprintf("conntrack dropped %d packets during this run (%d early drops to make room)", c.Delta.Drop+c.Delta.EarlyDrop, c.Delta.EarlyDrop))
+	}
+	if c.Max > 0 && c.Entries >= c.Max*9/10 {
+		c.Findings = append(c.Findings, fmt.Sprintf("the conntrack table is %d%% full (%d of %d entries); new connections are dropped when it fills. Raise net.netfilter.nf_conntrack_max", 100*c.Entries/c.Max, c.Entries, c.Max))
+	}
+	if len(c.UnrepliedDNS) > 0 {
+		c.Findings = append(c.Findings, fmt.Sprintf("%d DNS flows never saw a reply: queries were lost on the way to the DNS server or back", len(c.UnrepliedDNS)))
+	}
+	if len(c.Findings) == 0 {
+		c.Findings = append(c.Findings, "no conntrack drops: look at the DNS servers themselves (CoreDNS load, upstream latency)")
+	}
+	return c
+}
+
+// readConntrackTable counts the entries of the conntrack table and returns
+// the UDP port 53 flows still marked [UNREPLIED]. The table is only readable
+// on kernels that provide /proc/net/nf_conntrack.
+func readConntrackTable() (int, []string) {
+	f, err := os.Open(conntrackProc + "/nf_conntrack")
+	if err != nil {
+		return 0, nil
+	}
+	defer f.Close()
+
+	entries := 0
+	var unreplied []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		entries++
+		line := sc.Text()
+		if !strings.Contains(line, " udp ") || !strings.Contains(line, "[UNREPLIED]") || len(unreplied) >= maxUnrepliedDNS {
+			continue
+		}
+		// The first src/dst/sport/dport are the original direction.
+		var src, dst, sport, dport string
+		for _, field := range strings.Fields(line) {
+			key, value, _ := strings.Cut(field, "=")
+			switch {
+			case key == "src" && src == "":
+				src = value
+			case key == "dst" && dst == "":
+				dst = value
+			case key == "sport" && sport == "":
+				sport = value
+			case key == "dport" && dport == "":
+				dport = value
+			}
+		}
+		if dport == "53" {
+			unreplied = append(unreplied, fmt.Sprintf("%s:%s → %s:53", src, sport, dst))
+		}
+	}
+	return entries, unreplied
+}
+
+// printConntrack prints the conntrack evidence below the results table.
+func printConntrack(c *conntrackCheck) {
+	if c == nil {
+		return
+	}
+	fmt.Printf("  %sConntrack%s %s(DNS failed or slow for %s)%s\n", colorBold, colorReset, colorDim, strings.Join(c.SlowDNS, ", "), colorReset)
+	if c.Error != "" {
+		fmt.Printf("    %s%s%s\n\n", colorYellow, c.Error, colorReset)
+		return
+	}
+	fmt.Printf("    insert_failed %d (+%d), drop %d (+%d), early_drop %d (+%d)",
+		c.Counters.InsertFailed, c.Delta.InsertFailed, c.Counters.Drop, c.Delta.Drop, c.Counters.EarlyDrop, c.Delta.EarlyDrop)
+	if c.Entries > 0 && c.Max > 0 {
+		fmt.Printf(", table %d/%d", c.Entries, c.Max)
+	}
+	fmt.Println()
+	for _, u := range c.UnrepliedDNS {
+		fmt.Printf("    %sunreplied %s%s\n", colorDim, u, colorReset)
+	}
+	for _, f := range c.Findings {
+		fmt.Fprintf(tableOut, "    %s→ %s%s\n", colorYellow, f, colorReset)
+	}
+	fmt.Println()
+}
@@ -0,0 +1,6 @@
+//go:build !windows
+
+package main
+
+// enableConsoleColors is a no-op: terminals here interpret escape sequences.
+func enableConsoleColors() {}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// enableVirtualTerminalProcessing makes the console interpret ANSI escape
+// sequences.
+const enableVirtualTerminalProcessing = 0x4
+
+var setConsoleMode = syscall.NewLazyDLL("kernel32.dll").NewProc("SetConsoleMode")
+
+// enableConsoleColors turns on escape sequence processing when stdout or
+// stderr is a console, which the Windows console leaves off by default.
+// Output to a pipe, such as a container's log, needs nothing.
+func enableConsoleColors() {
+	for _, f := range []*os.File{os.Stdout, os.Stderr} {
+		h := syscall.Handle(f.Fd())
+		var mode uint32
+		if syscall.GetConsoleMode(h, &mode) != nil {
+			continue
+		}
+		setConsoleMode.Call(uintptr(h), uintptr(mode|enableVirtualTerminalProcessing))
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// agentRef is one entry of AGENTS.
+type agentRef struct {
+	Name string
+	URL  string
+}
+
+// parseAgents parses AGENTS: a comma-separated list of "name=url" entries.
+// A bare URL is named after its host.
+func parseAgents(raw string) ([]agentRef, error) {
+	var agents []agentRef
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, rawURL, ok := strings.Cut(entry, "=")
+		if !ok || strings.Contains(name, "/") {
+			name, rawURL = "", entry
+		}
+		u, err := url.Parse(rawURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("AGENTS: invalid agent URL %q", rawURL)
+		}
+		if name == "" {
+			name = u.Host
+		}
+		agents = append(agents, agentRef{Name: name, URL: strings.TrimRight(rawURL, "/")})
+	}
+	return agents, nil
+}
+
+// agentOutcome is one agent's part of a coordinated run.
+type agentOutcome struct {
+	Name   string      `json:"name"`
+	URL    string      `json:"url"`
+	Error  string      `json:"error,omitempty"`
+	Report *nodeReport `json:"report,omitempty"`
+}
+
+type coordinatorOutput struct {
+	Agents []agentOutcome `json:"agents"`
+	Matrix matrix         `json:"matrix"`
+}
+
+// runCoordinator sends cfg.Targets to every agent in cfg.Agents in parallel
+// and prints one merged report with a column per agent. It returns the exit
+// code for the run.
+func runCoordinator(ctx context.Context, cfg Config) int {
+	jsonMode := machineOutput(cfg)
+	if !jsonMode {
+		printHeader(cfg, nil)
+		fmt.Printf("  Agents:   %d\n\n", len(cfg.Agents))
+	}
+
+	for _, t := range cfg.Targets {
+		if t.Exec != "" {
+			logf("%s: exec plugins only run locally and are not sent to agents", targetKey(t))
+		}
+		if t.ClientCert != "" || t.ClientKey != "" {
+			logf("%s: client_cert and client_key only apply locally; agents present their own CLIENT_CERT", targetKey(t))
+		}
+	}
+
+	req := runRequest{Targets: toRunTargets(cfg.Targets), Timeout: cfg.Timeout.String(), Profile: cfg.Profile}
+	if cfg.RunTimeout > 0 {
+		req.RunTimeout = cfg.RunTimeout.String()
+	}
+
+	outcomes := make([]agentOutcome, len(cfg.Agents))
+	var wg sync.WaitGroup
+	for i, ag := range cfg.Agents {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			outcomes[i] = agentOutcome{Name: ag.Name, URL: ag.URL}
+			report, err := requestRun(ctx, ag, req, cfg)
+			if err != nil {
+				outcomes[i].Error = err.Error()
+				return
+			}
+			report.Node = ag.Name
+			outcomes[i].Report = report
+		}()
+	}
+	wg.Wait()
+
+	// As in a local run, an incomplete run takes precedence over failures.
+	// An unreachable agent counts as a failure.
+	var reports []nodeReport
+	failed, incomplete := false, false
+	for _, o := range outcomes {
+		if o.Report == nil {
+			failed = true
+			continue
+		}
+		reports = append(reports, *o.Report)
+		incomplete = incomplete || o.Report.Summary.Incomplete > 0
+		failed = failed || o.Report.Summary.Failed > 0
+	}
+	code := 0
+	switch {
+	case incomplete:
+		code = exitIncomplete
+	case failed:
+		code = exitFailed
+	}
+	m := buildMatrix(reports)
+
+	if jsonMode {
+		writeJSON(cfg, coordinatorOutput{Agents: outcomes, Matrix: m})
+		return code
+	}
+
+	if len(reports) > 0 {
+		writeMatrix(os.Stdout, m, "agents")
+		fmt.Println()
+	}
+	for _, o := range outcomes {
+		if o.Report == nil {
+			fmt.Fprintf(tableOut, "  %s✗ %s: %s%s\n", colorRed, o.Name, o.Error, colorReset)
+			continue
+		}
+		for _, r := range o.Report.Results {
+			if !r.Passed && !r.Incomplete {
+				fmt.Fprintf(tableOut, "  %s✗ %s: %s %s:%d — %s%s\n", colorRed, o.Name, r.Type, r.Host, r.Port, failureDetail(r), colorReset)
+			}
+		}
+	}
+	if code == 0 {
+		fmt.Fprintf(tableOut, "  %s%s✓ All targets behave as expected on all %d agents%s\n\n", colorBold, colorGreen, len(outcomes), colorReset)
+	} else {
+		fmt.Println()
+	}
+	return code
+}
+
+// requestRun asks one agent to probe the targets in req.
+func requestRun(ctx context.Context, ag agentRef, req runRequest, cfg Config) (*nodeReport, error) {
+	// Leave the agent time to report partial results after RUN_TIMEOUT.
+	if cfg.RunTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.RunTimeout+10*time.Second)
+		defer cancel()
+	}
+
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, ag.URL+"/run", bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if cfg.AgentToken != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+cfg.AgentToken)
+	}
+
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("agent returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	var report nodeReport
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxReportBytes)).Decode(&report); err != nil {
+		return nil, fmt.Errorf("decoding agent report: %w", err)
+	}
+	return &report, nil
+}
+
+// failureDetail explains why a result did not match its expectation.
+func failureDetail(r jsonResult) string {
+	if r.Blocked == (r.Type == "deny") {
+		for _, a := range r.Assertions {
+			if !a.Passed {
+				return "expect " + a.Expr + ": " + a.Detail
+			}
+		}
+	}
+	if r.Type == "deny" {
+		return "reachable (expected blocked)"
+	}
+	phases := []struct {
+		name string
+		p    *jsonPhase
+	}{{"DNS", &r.DNS}, {"TCP", &r.TCP}, {"TLS", &r.TLS}, {"HTTP", r.HTTP}, {"EXEC", r.Exec}}
+	for _, ph := range phases {
+		if ph.p != nil && !ph.p.Success {
+			return ph.name + ": " + ph.p.Detail
+		}
+	}
+	if d := unexpectedLocation(r); d != "" {
+		return d
+	}
+	return "failed"
+}
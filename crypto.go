@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/fips140"
+	"runtime/debug"
+	"strings"
+)
+
+// cryptoInfo is the cryptography the probe's TLS runs on, which regulated
+// environments need to match their workloads'.
+type cryptoInfo struct {
+	Module string `json:"module"`              // "go", "boringcrypto" or "systemcrypto" (OpenSSL, CNG)
+	FIPS   bool   `json:"fips"`                // FIPS 140 mode is on
+	Frozen string `json:"gofips140,omitempty"` // the frozen Go module version built in with GOFIPS140
+}
+
+// currentCrypto reports which cryptographic module the binary was built
+// with and whether FIPS mode is on. Go's native module turns it on with
+// GODEBUG=fips140=on or a GOFIPS140 build; BoringCrypto and the system
+// crypto of Microsoft's Go builds are FIPS-validated modules themselves.
+func currentCrypto() cryptoInfo {
+	c := cryptoInfo{Module: "go", FIPS: fips140.Enabled()}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			switch s.Key {
+			case "GOEXPERIMENT":
+				for _, exp := range strings.Split(s.Value, ",") {
+					switch exp {
+					case "boringcrypto", "systemcrypto":
+						c.Module = exp
+					}
+				}
+			case "GOFIPS140":
+				if s.Value != "off" {
+					c.Frozen = s.Value
+				}
+			}
+		}
+	}
+	return c
+}
+
+func (c cryptoInfo) String() string {
+	s := "Go"
+	switch c.Module {
+	case "boringcrypto":
+		s = "BoringCrypto"
+	case "systemcrypto":
+		s = "system (OpenSSL or CNG)"
+	}
+	if c.Frozen != "" {
+		s += " " + c.Frozen
+	}
+	if c.FIPS {
+		return s + ", FIPS 140 mode"
+	}
+	return s + ", not in FIPS mode"
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/cheolhuikim/egress-probe/pkg/probe"
+)
+
+// runDaemon re-probes the configured targets every cfg.Interval (or on each
+// cfg.Schedule slot) until the process is stopped. Configuration is re-read
+// before each cycle so that edits to ALLOW_TARGETS_FILE / DENY_TARGETS_FILE
+// (typically a mounted ConfigMap) take effect without restarting the Pod.
+//
+// Unless DNS_FRESH is set, DNS answers are reused across cycles while their
+// TTL (capped at DNS_CACHE_MAX_TTL) lasts, which keeps the load on cluster
+// DNS flat however many targets are probed.
+//
+// With LEADER_ELECTION, replicas of a Deployment coordinate through a Lease
+// so that only the leader probes, or with SHARD_TARGETS each probes a share.
+//
+// With CERT_WATCH, the certificates each target presents are remembered
+// across cycles, and unexpected changes are reported.
+//
+// TIMEOUT, CONCURRENCY, INTERVAL and LOG_LEVEL can be changed without a
+// restart: in TUNING_FILE, re-read on SIGHUP, or through the endpoint on
+// ADMIN_ADDR.
+//
+// With METRICS_ADDR, the last cycle is served as Prometheus metrics.
+func runDaemon(ctx context.Context, cfg Config) {
+	var cache *probe.DNSCache
+	if !cfg.DNSFresh {
+		cache = probe.NewDNSCache(cfg.DNSCacheMaxTTL)
+	}
+	window := &grafanaWindow{}
+	alerts := newAlertState()
+	states := newTargetStates()
+	var certs *certHistory
+	if cfg.CertWatch {
+		certs = newCertHistory()
+	}
+
+	tune := newTuning()
+	if cfg.TuningFile != "" {
+		if err := tune.loadFile(cfg.TuningFile); err != nil {
+			logf("TUNING_FILE: %v", err)
+		} else if s := tune.String(); s != "none" {
+			logf("tuning overrides: %s", s)
+		}
+	}
+	tune.watchSIGHUP(ctx, cfg.TuningFile)
+	if cfg.AdminAddr != "" {
+		tune.serveAdmin(ctx, cfg.AdminAddr, cfg.AdminToken)
+	}
+	tune.apply(&cfg)
+
+	var metrics *metricsServer
+	if cfg.MetricsAddr != "" {
+		metrics = newMetricsServer()
+		metrics.serve(ctx, cfg.MetricsAddr)
+	}
+
+	var elect *elector
+	if cfg.LeaderElection != "" {
+		var err error
+		if elect, err = newElector(cfg); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(exitFailed)
+		}
+		elect.renew(ctx)
+		released := make(chan struct{})
+		go func() {
+			elect.run(ctx)
+			close(released)
+		}()
+		defer func() { <-released }()
+	}
+
+	if cfg.Schedule != nil {
+		logf("daemon mode: probing %d targets on schedule %q", len(cfg.Targets), getenv("SCHEDULE"))
+	} else {
+		logf("daemon mode: probing %d targets every %s", len(cfg.Targets), cfg.Interval)
+	}
+	if cfg.Schedule != nil && !waitForSlot(ctx, cfg.Schedule) {
+		logf("shutting down")
+		return
+	}
+
+	for {
+		cfg.DNSCache = cache
+		cfg.GrafanaWindow = window
+		cfg.Alerts = alerts
+		cfg.TargetStates = states
+		cfg.CertHistory = certs
+		cfg.Metrics = metrics
+		run, active := cfg, true
+		if elect != nil {
+			run.Targets, active = elect.assigned(cfg.Targets)
+		}
+		switch {
+		case !active:
+			logf("not the leader; skipping this cycle")
+		case len(cfg.Targets) == 0:
+			logf("no targets configured; waiting for the next cycle")
+		case len(run.Targets) == 0:
+			logf("no targets in this replica's shard; waiting for the next cycle")
+		default:
+			debugf("cycle: %d targets, timeout %s, concurrency %d", len(run.Targets), run.Timeout, run.Concurrency)
+			start := time.Now()
+			runOnce(ctx, run)
+			debugf("cycle done in %s", time.Since(start).Round(time.Millisecond))
+		}
+
+		var waited bool
+		if cfg.Schedule != nil {
+			waited = waitForSlot(ctx, cfg.Schedule)
+		} else {
+			waited = waitInterval(ctx, &cfg, tune)
+		}
+		if !waited {
+			logf("shutting down")
+			return
+		}
+
+		next, err := parseConfig()
+		if err != nil {
+			logf("config reload failed, keeping previous targets: %v", err)
+			continue
+		}
+		logTargetDiff(cfg.Targets, next.Targets)
+		// With a fixed interval, jitter only matters for the first cycle:
+		// replicas stay spread out because they all sleep the same interval.
+		// Cron slots re-align every replica, so keep jittering each time.
+		if next.Schedule == nil {
+			next.StartJitter = 0
+		}
+		tune.apply(&next)
+		cfg = next
+	}
+}
+
+// waitInterval sleeps for cfg.Interval. When the tuning changes meanwhile,
+// cfg is updated at once, and a new interval counts from the start of
+// the wait. It reports false if ctx was cancelled first.
+func waitInterval(ctx context.Context, cfg *Config, tune *tuning) bool {
+	start := time.Now()
+	for {
+		debugf("next cycle in %s", time.Until(start.Add(cfg.Interval)).Round(time.Second))
+		t := time.NewTimer(time.Until(start.Add(cfg.Interval)))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return false
+		case <-t.C:
+			return true
+		case <-tune.changed:
+			t.Stop()
+			*cfg = tune.current()
+		}
+	}
+}
+
+// waitForSlot sleeps until the next time matching sched. It reports false
+// if ctx was cancelled first.
+func waitForSlot(ctx context.Context, sched *cronSchedule) bool {
+	at := sched.next(time.Now())
+	if at.IsZero() {
+		logf("schedule never fires; exiting")
+		os.Exit(exitFailed)
+	}
+	logf("next run at %s", at.Format(time.RFC3339))
+	return sleepCtx(ctx, time.Until(at))
+}
+
+// logTargetDiff logs the targets added and removed between two configs.
+func logTargetDiff(prev, next []probe.Target) {
+	before := make(map[string]bool, len(prev))
+	for _, t := range prev {
+		before[targetKey(t)] = true
+	}
+	after := make(map[string]bool, len(next))
+	for _, t := range next {
+		after[targetKey(t)] = true
+	}
+
+	var added, removed []string
+	for _, t := range next {
+		if k := targetKey(t); !before[k] {
+			added = append(added, k)
+		}
+	}
+	for _, t := range prev {
+		if k := targetKey(t); !after[k] {
+			removed = append(removed, k)
+		}
+	}
+	if len(added) == 0 && len(removed) == 0 {
+		return
+	}
+
+	logf("config reloaded: %d targets (+%d / -%d)", len(next), len(added), len(removed))
+	for _, k := range added {
+		logf("  + %s", k)
+	}
+	for _, k := range removed {
+		logf("  - %s", k)
+	}
+}
+
+// targetKey identifies a target for diffing, e.g. "deny google.com:443".
+func targetKey(t probe.Target) string {
+	typ := "allow"
+	if t.ExpectErr {
+		typ = "deny"
+	}
+	return typ + " " + net.JoinHostPort(t.Host, strconv.Itoa(t.Port)) + requestSuffix(t.Method, t.Path) + familySuffix(t.Family)
+}
+
+// requestSuffix marks a target with its own HTTP request, e.g. " GET /v2/",
+// which tells it apart from the same address with another one.
+func requestSuffix(method, path string) string {
+	if method == "" && path == "" {
+		return ""
+	}
+	return " " + cmp.Or(method, "HEAD") + " " + cmp.Or(path, "/")
+}
+
+// logf writes a timestamped diagnostic line to stderr, keeping stdout free
+// for the report itself.
+func logf(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, "%s %s\n", time.Now().Format(time.RFC3339), fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,522 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// maxDiagnosisTargets caps how many targets the table lists per hypothesis.
+const maxDiagnosisTargets = 5
+
+// diagnosis is a root-cause hypothesis for some of a run's failures.
+type diagnosis struct {
+	Cause      string   `json:"cause"`
+	Confidence string   `json:"confidence"` // high: explains every failure, medium: several, low: one
+	Evidence   string   `json:"evidence"`
+	Targets    []string `json:"targets"`
+	NextSteps  []string `json:"next_steps"`
+}
+
+// diagnose correlates the phase results of out's failing targets into
+// root-cause hypotheses, ranked by how many failures each explains. A
+// failure is explained by the first rule that matches it, so the broad
+// causes (policy, DNS) are tried before the ones specific to a phase, and
+// failures of location (GEOIP_COUNTRIES) last.
+func diagnose(out jsonOutput) []diagnosis {
+	var failing, allow []jsonResult
+	for _, r := range out.Results {
+		if r.Type == "allow" && !r.Incomplete {
+			allow = append(allow, r)
+		}
+		if !r.Passed && !r.Incomplete {
+			failing = append(failing, r)
+		}
+	}
+	if len(failing) == 0 {
+		return nil
+	}
+
+	var ds []diagnosis
+	explained := make(map[int]bool)
+	rule := func(match func(jsonResult) bool, build func(hits []jsonResult) diagnosis) {
+		var hits []jsonResult
+		for i, r := range failing {
+			if !explained[i] && match(r) {
+				hits = append(hits, r)
+				explained[i] = true
+			}
+		}
+		if len(hits) == 0 {
+			return
+		}
+		d := build(hits)
+		for _, r := range hits {
+			d.Targets = append(d.Targets, fmt.Sprintf("%s:%d", r.Host, r.Port))
+		}
+		ds = append(ds, d)
+	}
+	// all reports whether every allow target whose phase ran failed it.
+	all := func(hits []jsonResult, ran func(jsonResult) bool) bool {
+		n := 0
+		for _, r := range allow {
+			if ran(r) {
+				n++
+			}
+		}
+		return len(hits) > 1 && len(hits) == n
+	}
+	named := func(r jsonResult) bool { return net.ParseIP(r.Host) == nil }
+	connected := func(r jsonResult) bool { return r.TCP.Success && !r.SkipTLS }
+
+	rule(func(r jsonResult) bool { return r.Canary }, func(hits []jsonResult) diagnosis {
+		return diagnosis{
+			Cause:    "default deny is not in force: a permissive fallback rule lets traffic to arbitrary destinations through",
+			Evidence: "canary destinations no allow list should cover are reachable",
+			NextSteps: []string{
+				"look for a catch-all allow rule (0.0.0.0/0, *, or an \"allow\" default action) in the egress policies and the firewall",
+				"check that a default-deny egress NetworkPolicy selects this Pod",
+			},
+		}
+	})
+
+	rule(func(r jsonResult) bool { return r.Type == "deny" }, func(hits []jsonResult) diagnosis {
+		d := diagnosis{NextSteps: []string{
+			"kubectl get networkpolicy -n <namespace>: check that a default-deny egress policy selects this Pod",
+		}}
+		if hits[0].Policy == nil && hits[0].Cilium == nil {
+			d.NextSteps = append(d.NextSteps, "rerun with NETPOL_CHECK=true (or CILIUM_CHECK=true) to see which rule lets them through")
+		}
+		if n := out.Summary.Deny; len(hits) == n && n > 1 {
+			d.Cause = "egress is not restricted: no policy blocks this Pod's traffic, or the CNI doesn't enforce NetworkPolicy"
+			d.Evidence = fmt.Sprintf("all %d deny targets are reachable", n)
+			d.NextSteps = append(d.NextSteps, "check that the CNI enforces NetworkPolicy (kubenet and plain Flannel don't)")
+		} else {
+			d.Cause = "the deny list has holes: an allow rule or firewall exception covers these destinations"
+			d.Evidence = fmt.Sprintf("%d of %d deny targets are reachable", len(hits), out.Summary.Deny)
+			d.NextSteps = append(d.NextSteps, "look for allow rules with broad CIDRs (0.0.0.0/0 with except) or FQDN wildcards that match them")
+		}
+		return d
+	})
+
+	if broken := brokenPreflight(out.Preflight); broken != nil {
+		rule(func(r jsonResult) bool { return r.Type == "allow" }, func(hits []jsonResult) diagnosis {
+			return diagnosis{
+				Cause:    "the Pod's own networking is broken: nothing it sends gets past the node",
+				Evidence: "preflight " + broken.Name + ": " + broken.Detail,
+				NextSteps: []string{
+					"kubectl describe pod: look for CNI errors in the events (FailedCreatePodSandBox)",
+					"check the CNI agent on this node: that it runs, and its logs",
+				},
+			}
+		})
+	}
+
+	rule(func(r jsonResult) bool { return policyDenies(r.Policy) || policyDenies(r.Cilium) }, func(hits []jsonResult) diagnosis {
+		return diagnosis{
+			Cause:    "a network policy of this Pod blocks them",
+			Evidence: "the policy check expects them to be denied: " + policyReason(hits[0]),
+			NextSteps: []string{
+				"add an egress rule for them to the policy, or correct the allow list if they should be blocked",
+			},
+		}
+	})
+
+	rule(func(r jsonResult) bool { return r.DeadlineExceeded }, func(hits []jsonResult) diagnosis {
+		return diagnosis{
+			Cause:    "these targets took longer than TARGET_TIMEOUT: slow phases, or retries that added up",
+			Evidence: "cut short by the per-target deadline: " + phaseCutShort(hits[0]),
+			NextSteps: []string{
+				"raise TARGET_TIMEOUT if the targets are slow but work, or lower TIMEOUT or RETRIES",
+				"run egress-probe check <target> to see how long each phase takes on its own",
+			},
+		}
+	})
+
+	rule(func(r jsonResult) bool { return r.Type == "allow" && r.DNSCheck != nil && r.DNSCheck.Disagree }, func(hits []jsonResult) diagnosis {
+		return diagnosis{
+			Cause:    "the nameservers give different answers for these names, so some Pods get addresses that don't work",
+			Evidence: fmt.Sprintf("%d different answers for %s", hits[0].DNSCheck.Sets, hits[0].Host),
+			NextSteps: []string{
+				"compare the answers of each nameserver in the Pod's /etc/resolv.conf and of each CoreDNS replica",
+				"restart or flush stale caches (CoreDNS cache plugin, NodeLocal DNSCache) and check the upstream's load balancing",
+			},
+		}
+	})
+
+	rule(func(r jsonResult) bool { return !r.DNS.Success && r.DNS.Detail == "timeout" }, func(hits []jsonResult) diagnosis {
+		if all(hits, named) {
+			return diagnosis{
+				Cause:    "cluster DNS is unreachable: DNS egress is blocked or CoreDNS is down",
+				Evidence: fmt.Sprintf("every DNS lookup timed out (%d targets)", len(hits)),
+				NextSteps: []string{
+					"check that the Pod's egress policy allows UDP and TCP port 53 to kube-dns in kube-system",
+					"kubectl -n kube-system get pods -l k8s-app=kube-dns: check that CoreDNS is running and ready",
+					"compare the nameserver in the Pod's /etc/resolv.conf with the kube-dns Service IP",
+				},
+			}
+		}
+		return diagnosis{
+			Cause:    "DNS lookups for some names time out: slow upstream resolvers or dropped DNS packets",
+			Evidence: "lookups timed out while other names resolved",
+			NextSteps: []string{
+				"rerun with CONNTRACK_CHECK=true to look for the conntrack race that drops DNS packets",
+				"check the CoreDNS logs for errors forwarding to upstream resolvers",
+			},
+		}
+	})
+
+	rule(func(r jsonResult) bool { return !r.DNS.Success && r.DNS.Detail == "NXDOMAIN" }, func(hits []jsonResult) diagnosis {
+		if all(hits, named) {
+			return diagnosis{
+				Cause:    "DNS answers but resolves nothing: CoreDNS can't forward to its upstream resolvers",
+				Evidence: fmt.Sprintf("every name returned NXDOMAIN (%d targets)", len(hits)),
+				NextSteps: []string{
+					"kubectl -n kube-system get configmap coredns -o yaml: check the forward plugin's upstream",
+					"check that the nodes' resolvers answer for public names",
+				},
+			}
+		}
+		return diagnosis{
+			Cause:    "these names don't exist for the cluster's resolver: a typo, or a private zone CoreDNS doesn't forward",
+			Evidence: "NXDOMAIN while other names resolved",
+			NextSteps: []string{
+				"check the spelling of the names",
+				"for private zones, add a stub domain (a server block with forward) to the CoreDNS ConfigMap",
+			},
+		}
+	})
+
+	rule(func(r jsonResult) bool {
+		return strings.HasPrefix(r.DNS.Detail, "no AAAA record") || (r.DNS.Success && net.ParseIP(r.Host).To4() != nil && r.TCP.Detail == "network is unreachable")
+	}, func(hits []jsonResult) diagnosis {
+		return diagnosis{
+			Cause:    "the Pod is IPv6-only and these destinations only have IPv4 addresses",
+			Evidence: fmt.Sprintf("DNS: %s, TCP: %s", hits[0].DNS.Detail, hits[0].TCP.Detail),
+			NextSteps: []string{
+				"reach them through DNS64 and NAT64: enable the dns64 plugin in CoreDNS and a NAT64 gateway for the cluster",
+				"or run the workload on a dual-stack node pool",
+			},
+		}
+	})
+
+	rule(func(r jsonResult) bool { return strings.HasPrefix(r.DNS.Detail, "no A record") }, func(hits []jsonResult) diagnosis {
+		return diagnosis{
+			Cause:    "these names only have IPv6 addresses, which this IPv4 Pod can't reach",
+			Evidence: "DNS: " + hits[0].DNS.Detail,
+			NextSteps: []string{
+				"run the workload on a dual-stack or IPv6 node pool, or rerun with IP_FAMILY=ipv6 from one",
+			},
+		}
+	})
+
+	proxyDenied := func(p *jsonPhase) bool { return p != nil && strings.HasPrefix(p.Detail, "proxy denied") }
+	rule(func(r jsonResult) bool { return proxyDenied(&r.TCP) || proxyDenied(r.HTTP) }, func(hits []jsonResult) diagnosis {
+		detail := hits[0].TCP.Detail
+		if !proxyDenied(&hits[0].TCP) {
+			detail = hits[0].HTTP.Detail
+		}
+		return diagnosis{
+			Cause:    "the egress proxy refuses these destinations",
+			Evidence: detail,
+			NextSteps: []string{
+				"add them to the proxy's allow list (e.g. a Squid dstdomain ACL)",
+				"a 407 means the proxy wants credentials: put them in the proxy URL",
+			},
+		}
+	})
+
+	rule(func(r jsonResult) bool { return strings.HasPrefix(r.TCP.Detail, "proxy ") }, func(hits []jsonResult) diagnosis {
+		return diagnosis{
+			Cause:    "the egress proxy is unreachable, so nothing behind it can be reached",
+			Evidence: "TCP: " + hits[0].TCP.Detail,
+			NextSteps: []string{
+				"check the proxy address and port, and that the Pod's egress policy allows traffic to the proxy",
+			},
+		}
+	})
+
+	rule(func(r jsonResult) bool { return r.DNS.Success && !r.TCP.Success && r.TCP.Detail == "timeout" }, func(hits []jsonResult) diagnosis {
+		d := diagnosis{NextSteps: []string{
+			"check the Pod's NetworkPolicies and the cloud firewall or security group rules for these destinations",
+		}}
+		if all(hits, func(r jsonResult) bool { return r.DNS.Success }) {
+			d.Cause = "all egress is dropped: a firewall drops it, or the nodes have no route or NAT to the outside"
+			d.Evidence = fmt.Sprintf("every TCP connection timed out after DNS resolved (%d targets)", len(hits))
+			d.NextSteps = append(d.NextSteps,
+				"check the subnet's route table and NAT gateway",
+				"compare with a hostNetwork Pod: if it connects, the block is in the Pod network (policy or CNI)")
+		} else {
+			d.Cause = "traffic to these destinations is dropped by a firewall or NetworkPolicy"
+			d.Evidence = "TCP connections timed out while others connected"
+			d.NextSteps = append(d.NextSteps, "look for a default-deny firewall with an allow list that misses them")
+		}
+		return d
+	})
+
+	rule(func(r jsonResult) bool {
+		return !r.TCP.Success && (r.TCP.Detail == "connection refused" || r.TCP.Detail == "connection reset")
+	}, func(hits []jsonResult) diagnosis {
+		return diagnosis{
+			Cause:    "connections are actively rejected: a firewall REJECT rule, or nothing listens on the port",
+			Evidence: fmt.Sprintf("TCP: %s", hits[0].TCP.Detail),
+			NextSteps: []string{
+				"check the port: a firewall that rejects rather than drops answers immediately",
+				"for in-cluster destinations, check that the Service has ready endpoints",
+			},
+		}
+	})
+
+	rule(func(r jsonResult) bool {
+		return strings.HasPrefix(r.TLS.Detail, "not FIPS-approved") || (r.HTTP != nil && strings.HasPrefix(r.HTTP.Detail, "not FIPS-approved"))
+	}, func(hits []jsonResult) diagnosis {
+		detail := hits[0].TLS.Detail
+		if !strings.HasPrefix(detail, "not FIPS-approved") {
+			detail = hits[0].HTTP.Detail
+		}
+		return diagnosis{
+			Cause:    "these destinations can't negotiate FIPS-approved TLS: workloads under the same crypto policy can't reach them either",
+			Evidence: detail,
+			NextSteps: []string{
+				"ask the destination's owner for TLS 1.2+ with AES-GCM and an RSA-2048+ or ECDSA P-256/P-384 certificate",
+				"if a TLS-inspecting proxy re-signs the traffic, check its certificate and cipher settings instead",
+			},
+		}
+	})
+
+	if ts := trustStoreOf(out); ts != nil && ts.Warning != "" {
+		rule(func(r jsonResult) bool { return r.TCP.Success && r.TLS.Detail == "cert: unknown authority" }, func(hits []jsonResult) diagnosis {
+			cause := "the image's CA bundle is out of date, so certificates from newer roots don't verify"
+			if ts.Roots == 0 {
+				cause = "the image has no CA certificates, so no server certificate can be verified"
+			}
+			return diagnosis{
+				Cause:    cause,
+				Evidence: "trust store: " + ts.Warning,
+				NextSteps: []string{
+					"install or update the ca-certificates package in the image, or copy a current CA bundle into it (e.g. /etc/ssl/certs/ca-certificates.crt)",
+					"or point SSL_CERT_FILE at a bundle mounted from a ConfigMap",
+				},
+			}
+		})
+	}
+
+	rule(func(r jsonResult) bool { return r.TCP.Success && r.TLS.Detail == "cert: unknown authority" }, func(hits []jsonResult) diagnosis {
+		d := diagnosis{
+			Cause:    "a TLS-inspecting proxy or firewall re-signs the traffic with its own CA",
+			Evidence: "certificates signed by an unknown authority",
+			NextSteps: []string{
+				"rerun with PROFILE=deep to see the issuer of the certificates",
+				"exempt these destinations from TLS inspection, or add the inspection CA to the workloads' trust store",
+				"if the inspection is intended, point CA_FILE at the inspection CA so that the probe trusts it too",
+			},
+		}
+		if c := hits[0].Cert; c != nil {
+			d.Evidence += ", e.g. issued by " + c.Issuer
+		}
+		return d
+	})
+
+	rule(func(r jsonResult) bool { return strings.HasPrefix(r.TLS.Detail, "cert: unexpected issuer") }, func(hits []jsonResult) diagnosis {
+		return diagnosis{
+			Cause:    "another CA than expected signed the certificates: a TLS-inspecting proxy with a trusted CA, or the name now points at a different endpoint",
+			Evidence: "TLS: " + hits[0].TLS.Detail,
+			NextSteps: []string{
+				"compare the addresses these names resolve to with the ones the service publishes",
+				"check whether a proxy or firewall inspects TLS for these destinations",
+				"if the service changed CAs, update the issuer= option",
+			},
+		}
+	})
+
+	rule(func(r jsonResult) bool { return r.TCP.Success && strings.HasPrefix(r.TLS.Detail, "cert") }, func(hits []jsonResult) diagnosis {
+		return diagnosis{
+			Cause:    "the servers' certificates are not valid: expired, for another name, or the node's clock is off",
+			Evidence: "TLS: " + hits[0].TLS.Detail,
+			NextSteps: []string{
+				"rerun with PROFILE=deep to see the certificates",
+				"check the node's clock (timedatectl, chrony)",
+			},
+		}
+	})
+
+	rule(func(r jsonResult) bool {
+		return strings.HasPrefix(r.TLS.Detail, "client certificate") || (r.HTTP != nil && strings.HasPrefix(r.HTTP.Detail, "client certificate"))
+	}, func(hits []jsonResult) diagnosis {
+		detail := "TLS: " + hits[0].TLS.Detail
+		if !strings.HasPrefix(hits[0].TLS.Detail, "client certificate") {
+			detail = "HTTP: " + hits[0].HTTP.Detail
+		}
+		return diagnosis{
+			Cause:    "these destinations require mutual TLS, and the probe's client certificate is missing, unreadable or not accepted",
+			Evidence: detail,
+			NextSteps: []string{
+				"set CLIENT_CERT and CLIENT_KEY, or the targets' client_cert= option, to a certificate the destination accepts",
+				"check that the certificate hasn't expired and is issued by a CA the destination trusts",
+			},
+		}
+	})
+
+	rule(func(r jsonResult) bool { return strings.HasPrefix(r.TLS.Detail, "data blocked") }, func(hits []jsonResult) diagnosis {
+		return diagnosis{
+			Cause:    "the firewall lets the TLS handshake through but blocks what follows: it filters on the HTTP request or the data",
+			Evidence: "TLS handshake completes, then " + strings.TrimPrefix(hits[0].TLS.Detail, "data blocked: "),
+			NextSteps: []string{
+				"check the firewall's application, URL or Host header rules, and its threat or data inspection profiles, for these destinations",
+				"compare with curl -v https://<host>/: a handshake followed by a reset or a hang confirms it",
+			},
+		}
+	})
+
+	rule(func(r jsonResult) bool { return connected(r) && !r.TLS.Success }, func(hits []jsonResult) diagnosis {
+		d := diagnosis{NextSteps: []string{
+			"check the firewall's application or FQDN rules: the connection is allowed, the name in the TLS handshake (SNI) is not",
+			"openssl s_client -connect <host>:<port> -servername <host>: compare with a name that works",
+		}}
+		if all(hits, connected) {
+			d.Cause = "every TLS handshake fails after connecting: a proxy or firewall on the path terminates TLS"
+			d.Evidence = fmt.Sprintf("TCP connects but TLS fails for all %d targets (%s)", len(hits), hits[0].TLS.Detail)
+			return d
+		}
+		d.Cause = "SNI filtering: the firewall lets the connection through but blocks the handshake for these names"
+		d.Evidence = fmt.Sprintf("TCP connects but TLS fails (%s) while it succeeds for other names", hits[0].TLS.Detail)
+		if suffix := commonDomain(hits); suffix != "" {
+			d.Evidence = fmt.Sprintf("TLS fails only for *.%s (%s) while it succeeds for others", suffix, hits[0].TLS.Detail)
+			d.NextSteps[0] = fmt.Sprintf("check the firewall's application or FQDN rules for *.%s", suffix)
+		}
+		return d
+	})
+
+	rule(func(r jsonResult) bool { return r.HTTP != nil && !r.HTTP.Success && r.TLS.Success }, func(hits []jsonResult) diagnosis {
+		return diagnosis{
+			Cause:    "the destinations are reachable but HTTP fails: a proxy in the path answers or cuts the request",
+			Evidence: "HTTP: " + hits[0].HTTP.Detail,
+			NextSteps: []string{
+				"check whether an egress proxy requires authentication or an explicit proxy setting (HTTPS_PROXY)",
+			},
+		}
+	})
+
+	rule(func(r jsonResult) bool { return r.Type == "allow" && unexpectedLocation(r) != "" }, func(hits []jsonResult) diagnosis {
+		return diagnosis{
+			Cause:    "egress terminates outside the approved countries: the names resolve to servers elsewhere",
+			Evidence: unexpectedLocation(hits[0]),
+			NextSteps: []string{
+				"use the provider's regional endpoint for an approved country, if it has one",
+				"check where the cluster's DNS forwarders are: geo-DNS answers for the resolver's location, not the Pod's",
+			},
+		}
+	})
+
+	for i := range ds {
+		switch n := len(ds[i].Targets); {
+		case n == len(failing):
+			ds[i].Confidence = "high"
+		case n > 1:
+			ds[i].Confidence = "medium"
+		default:
+			ds[i].Confidence = "low"
+		}
+	}
+	sort.SliceStable(ds, func(i, j int) bool { return len(ds[i].Targets) > len(ds[j].Targets) })
+	return ds
+}
+
+// brokenPreflight returns the first failed preflight check that breaks all
+// of the Pod's traffic, or nil. An odd MTU only breaks large packets.
+func brokenPreflight(p *preflight) *preflightCheck {
+	if p == nil {
+		return nil
+	}
+	for i, c := range p.Checks {
+		if !c.OK && c.Name != "MTU" {
+			return &p.Checks[i]
+		}
+	}
+	return nil
+}
+
+// phaseCutShort names the phase of r that the deadline ended, e.g. "TLS"
+// or "TCP, after 2 retries (timeout)".
+func phaseCutShort(r jsonResult) string {
+	phases := []struct {
+		name string
+		p    *jsonPhase
+	}{{"DNS", &r.DNS}, {"TCP", &r.TCP}, {"TLS", &r.TLS}, {"HTTP", r.HTTP}, {"EXEC", r.Exec}}
+	for _, ph := range phases {
+		if ph.p == nil || ph.p.Success || strings.HasPrefix(ph.p.Detail, "skipped") {
+			continue
+		}
+		s := ph.name
+		if ph.p.Retries > 0 {
+			s += fmt.Sprintf(", after %d retries", ph.p.Retries)
+		}
+		if ph.p.Detail != "deadline exceeded" {
+			s += " (" + ph.p.Detail + ")"
+		}
+		return s
+	}
+	return "before it started"
+}
+
+func trustStoreOf(out jsonOutput) *trustStore {
+	if out.Environment == nil {
+		return nil
+	}
+	return out.Environment.TrustStore
+}
+
+func policyDenies(p *jsonPolicy) bool {
+	return p != nil && p.Expected == "deny"
+}
+
+func policyReason(r jsonResult) string {
+	if policyDenies(r.Policy) {
+		return r.Policy.Reason
+	}
+	return r.Cilium.Reason
+}
+
+// commonDomain returns the domain, its last two labels, that the names of
+// hits share, or "" if they don't.
+func commonDomain(hits []jsonResult) string {
+	common := ""
+	for _, r := range hits {
+		if net.ParseIP(r.Host) != nil {
+			return ""
+		}
+		labels := strings.Split(strings.TrimSuffix(r.Host, "."), ".")
+		if len(labels) < 2 {
+			return ""
+		}
+		domain := strings.Join(labels[len(labels)-2:], ".")
+		if common != "" && domain != common {
+			return ""
+		}
+		common = domain
+	}
+	return common
+}
+
+// printDiagnoses prints the hypotheses, most likely first.
+func printDiagnoses(ds []diagnosis) {
+	if len(ds) == 0 {
+		return
+	}
+	fmt.Printf("  %sLikely causes%s\n", colorBold, colorReset)
+	for i, d := range ds {
+		fmt.Printf("    %d. %s%s%s %s(%s)%s\n", i+1, colorYellow, d.Cause, colorReset, colorDim, d.Confidence, colorReset)
+		targets := d.Targets
+		more := ""
+		if len(targets) > maxDiagnosisTargets {
+			more = fmt.Sprintf(" and %d more", len(targets)-maxDiagnosisTargets)
+			targets = targets[:maxDiagnosisTargets]
+		}
+		fmt.Printf("       %s%s: %s%s%s\n", colorDim, d.Evidence, strings.Join(targets, ", "), more, colorReset)
+		for _, step := range d.NextSteps {
+			fmt.Fprintf(tableOut, "       → %s\n", step)
+		}
+	}
+	fmt.Println()
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/cheolhuikim/egress-probe/pkg/probe"
+)
+
+// maxDropSites caps how many drop sites are reported.
+const maxDropSites = 10
+
+// dropSite is where, and why, packets were dropped in the node's network
+// stack during a run.
+type dropSite struct {
+	Layer    string `json:"layer"`            // netfilter, tc, routing, neighbour, qdisc, socket or other
+	Reason   string `json:"reason,omitempty"` // the kernel's drop reason (5.17+)
+	Location string `json:"location"`         // the kernel function that freed the packet
+	Count    int    `json:"count"`
+}
+
+// dropTrace is what DROP_TRACE found after a run in which targets failed to
+// connect.
+type dropTrace struct {
+	Failed  []string   `json:"failed"` // targets that failed at TCP or TLS
+	Drops   []dropSite `json:"drops"`  // most frequent first
+	Verdict string     `json:"verdict"`
+	Error   string     `json:"error,omitempty"`
+}
+
+// connectFailures returns the targets that were expected to connect but
+// failed at TCP or TLS: the failures a drop in the local stack can explain.
+func connectFailures(results []probe.Result) []string {
+	var failed []string
+	for _, r := range results {
+		if r.Target.ExpectErr || r.Passed || r.Incomplete || !r.DNS.Success {
+			continue
+		}
+		if !r.TCP.Success || !r.TLS.Success {
+			failed = append(failed, fmt.Sprintf("%s:%d", r.Target.Host, r.Target.Port))
+		}
+	}
+	return failed
+}
+
+// newDropTrace summarizes the kfree_skb events traced during a run.
+func newDropTrace(failed []string, events []string) *dropTrace {
+	t := &dropTrace{Failed: failed}
+	counts := make(map[dropSite]int)
+	for _, line := range events {
+		site, ok := parseKfreeSkb(line)
+		if ok {
+			counts[site]++
+		}
+	}
+	for site, n := range counts {
+		site.Count = n
+		t.Drops = append(t.Drops, site)
+	}
+	sort.Slice(t.Drops, func(i, j int) bool {
+		if t.Drops[i].Count != t.Drops[j].Count {
+			return t.Drops[i].Count > t.Drops[j].Count
+		}
+		return t.Drops[i].Location < t.Drops[j].Location
+	})
+	if len(t.Drops) > maxDropSites {
+		t.Drops = t.Drops[:maxDropSites]
+	}
+
+	if len(t.Drops) == 0 {
+		t.Verdict = "remote: no IP packets were dropped in this node's stack during the run, so they were lost beyond the node (cloud firewall, NAT gateway, the destination)"
+		return t
+	}
+	top := t.Drops[0]
+	t.Verdict = fmt.Sprintf("local: this node dropped IP packets during the run, most at %s (%s)", top.Layer, top.Location)
+	switch top.Layer {
+	case "netfilter":
+		t.Verdict += ": an iptables or nftables rule, e.g. from kube-proxy or a NetworkPolicy, is dropping them"
+	case "tc":
+		t.Verdict += ": a tc program, e.g. the CNI's eBPF datapath enforcing policy, is dropping them"
+	case "routing":
+		t.Verdict += ": the node has no route for them, or reverse-path filtering rejects the replies"
+	case "neighbour":
+		t.Verdict += ": the next hop doesn't answer ARP or neighbour discovery"
+	}
+	return t
+}
+
+// parseKfreeSkb parses one skb:kfree_skb trace line, e.g.
+//
+//	<idle>-0 [001] ..s1. 52.1: kfree_skb: skbaddr=00000000a1b2c3d4 rx_sk=0000000000000000 protocol=2048 location=nf_hook_slow+0x9a/0xf0 reason: NETFILTER_DROP
+//
+// keeping IPv4 and IPv6 packets dropped for a reason other than
+// NOT_SPECIFIED. Kernels before 5.17 give no reason; their drops are
+// attributed by location alone.
+func parseKfreeSkb(line string) (dropSite, bool) {
+	_, fields, ok := strings.Cut(line, "kfree_skb: ")
+	if !ok {
+		return dropSite{}, false
+	}
+	fields, reason, _ := strings.Cut(fields, " reason: ")
+	reason = strings.TrimSpace(reason)
+	var site dropSite
+	ip := false
+	for _, f := range strings.Fields(fields) {
+		key, value, _ := strings.Cut(f, "=")
+		switch key {
+		case "protocol":
+			ip = value == "2048" || value == "34525" // ETH_P_IP, ETH_P_IPV6
+		case "location":
+			// Trim the offset: nf_hook_slow+0x9a/0xf0.
+			site.Location, _, _ = strings.Cut(value, "+")
+		}
+	}
+	if !ip || site.Location == "" || reason == "NOT_SPECIFIED" {
+		return dropSite{}, false
+	}
+	site.Reason = reason
+	site.Layer = dropLayer(reason, site.Location)
+	return site, true
+}
+
+// dropLayer names the part of the stack a drop happened in, from its reason
+// or, without one, its location.
+func dropLayer(reason, location string) string {
+	switch {
+	case strings.HasPrefix(reason, "NETFILTER"), strings.HasPrefix(location, "nf_"), strings.HasPrefix(location, "nft_"):
+		return "netfilter"
+	case strings.HasPrefix(reason, "TC_"), strings.HasPrefix(location, "tcf_"), strings.HasPrefix(location, "sch_handle_"):
+		return "tc"
+	case strings.HasPrefix(reason, "IP_NOROUTE"), strings.HasPrefix(reason, "IP_OUTNOROUTES"), reason == "IP_RPFILTER",
+		strings.HasPrefix(location, "ip_route"), strings.HasPrefix(location, "ip_error"), strings.HasPrefix(location, "ip6_pkt_drop"):
+		return "routing"
+	case strings.HasPrefix(reason, "NEIGH_"), strings.HasPrefix(location, "neigh_"):
+		return "neighbour"
+	case reason == "QDISC_DROP", strings.HasPrefix(location, "__dev_queue_xmit"), strings.HasPrefix(location, "qdisc_"):
+		return "qdisc"
+	case strings.HasPrefix(reason, "TCP_"), strings.HasPrefix(reason, "SOCKET_"), reason == "NO_SOCKET", strings.HasPrefix(location, "tcp_"):
+		return "socket"
+	}
+	return "other"
+}
+
+func printDropTrace(t *dropTrace) {
+	if t == nil {
+		return
+	}
+	fmt.Printf("  %sDrop trace%s %s(TCP or TLS failed for %s)%s\n", colorBold, colorReset, colorDim, strings.Join(t.Failed, ", "), colorReset)
+	if t.Error != "" {
+		fmt.Printf("    %s%s%s\n\n", colorYellow, t.Error, colorReset)
+		return
+	}
+	for _, d := range t.Drops {
+		reason := d.Reason
+		if reason == "" {
+			reason = "no reason"
+		}
+		fmt.Printf("    %6d  %-9s  %s %s(%s)%s\n", d.Count, d.Layer, d.Location, colorDim, reason, colorReset)
+	}
+	fmt.Fprintf(tableOut, "    %s→ %s%s\n\n", colorYellow, t.Verdict, colorReset)
+}
+
+// finishDropTrace stops tracer and, if targets failed to connect, reports
+// the drops it recorded. startErr is why tracer couldn't be started, if it
+// couldn't.
+func finishDropTrace(results []probe.Result, tracer *dropTracer, startErr error) *dropTrace {
+	events, err := []string(nil), startErr
+	if tracer != nil {
+		events, err = tracer.stop()
+	}
+	failed := connectFailures(results)
+	if len(failed) == 0 {
+		return nil
+	}
+	if err != nil {
+		return &dropTrace{Failed: failed, Error: fmt.Sprintf("tracing dropped packets: %v", err)}
+	}
+	return newDropTrace(failed, events)
+}
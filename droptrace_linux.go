@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// tracefsRoots are where tracefs is looked for, newest layout first.
+var tracefsRoots = []string{"/sys/kernel/tracing", "/sys/kernel/debug/tracing"}
+
+// dropTracer records skb:kfree_skb events in a tracing instance of its own,
+// so that it neither disturbs nor is disturbed by other users of tracefs.
+type dropTracer struct {
+	dir string
+}
+
+// startDropTrace creates the tracing instance and starts recording the IPv4
+// and IPv6 packets the kernel frees as dropped.
+func startDropTrace() (*dropTracer, error) {
+	root := ""
+	for _, dir := range tracefsRoots {
+		if _, err := os.Stat(filepath.Join(dir, "instances")); err == nil {
+			root = dir
+			break
+		}
+	}
+	if root == "" {
+		return nil, errors.New("tracefs is not mounted at /sys/kernel/tracing (needs a privileged Pod with the host's /sys/kernel/tracing)")
+	}
+	t := &dropTracer{dir: filepath.Join(root, "instances", fmt.Sprintf("egress-probe-%d", os.Getpid()))}
+	if err := os.Mkdir(t.dir, 0o755); err != nil {
+		return nil, err
+	}
+	event := filepath.Join(t.dir, "events", "skb", "kfree_skb")
+	for _, w := range []struct{ path, value string }{
+		{filepath.Join(t.dir, "buffer_size_kb"), "2048"},
+		{filepath.Join(event, "filter"), "protocol == 2048 || protocol == 34525"},
+		{filepath.Join(event, "enable"), "1"},
+	} {
+		if err := os.WriteFile(w.path, []byte(w.value), 0); err != nil {
+			os.Remove(t.dir)
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// stop stops recording, removes the instance and returns the events
+// recorded, one trace line each.
+func (t *dropTracer) stop() ([]string, error) {
+	defer os.Remove(t.dir)
+	os.WriteFile(filepath.Join(t.dir, "events", "skb", "kfree_skb", "enable"), []byte("0"), 0)
+	data, err := os.ReadFile(filepath.Join(t.dir, "trace"))
+	if err != nil {
+		return nil, err
+	}
+	var events []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line != "" && !strings.HasPrefix(line, "#") {
+			events = append(events, line)
+		}
+	}
+	return events, nil
+}
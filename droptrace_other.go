@@ -0,0 +1,15 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+type dropTracer struct{}
+
+func startDropTrace() (*dropTracer, error) {
+	return nil, errors.New("only supported on Linux")
+}
+
+func (t *dropTracer) stop() ([]string, error) {
+	return nil, errors.New("only supported on Linux")
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// defaultEgressEchoURL answers with the caller's public address as plain
+// text.
+const defaultEgressEchoURL = "https://checkip.amazonaws.com"
+
+// egressIPCheck is the outcome of discovering the public source address.
+type egressIPCheck struct {
+	IP       string   `json:"ip,omitempty"`
+	Source   string   `json:"source"`
+	Expected []string `json:"expected,omitempty"`
+	OK       bool     `json:"ok"`
+	Error    string   `json:"error,omitempty"`
+	// Intercepted is set when the echo service is "egress-probe reflect"
+	// and the certificate the probe saw isn't the one it served.
+	Intercepted string `json:"intercepted,omitempty"`
+}
+
+// parseCIDRList parses a comma-separated list of CIDRs or bare addresses.
+func parseCIDRList(raw string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range strings.Split(raw, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if ip := net.ParseIP(s); ip != nil {
+			bits := 8 * len(ip.To4())
+			if bits == 0 {
+				bits = 128
+			}
+			s = fmt.Sprintf("%s/%d", s, bits)
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a CIDR", s)
+		}
+		nets = append(nets, n)
+	}
+	if len(nets) == 0 {
+		return nil, fmt.Errorf("no CIDRs given")
+	}
+	return nets, nil
+}
+
+// checkEgressIP asks echoURL for the address this Pod's traffic leaves the
+// network from and, if expected is set, whether it lies in one of its CIDRs.
+// Without expected the check only reports the address, and fails only if it
+// can't be discovered.
+func checkEgressIP(ctx context.Context, echoURL string, expected []*net.IPNet, timeout time.Duration) egressIPCheck {
+	c := egressIPCheck{Source: echoURL}
+	for _, n := range expected {
+		c.Expected = append(c.Expected, n.String())
+	}
+
+	ip, intercepted, err := discoverEgressIP(ctx, echoURL, timeout)
+	c.Intercepted = intercepted
+	if err != nil {
+		c.Error = err.Error()
+		return c
+	}
+	c.IP = ip.String()
+	c.OK = len(expected) == 0
+	for _, n := range expected {
+		c.OK = c.OK || n.Contains(ip)
+	}
+	return c
+}
+
+// discoverEgressIP returns the address echoURL saw, and evidence of TLS
+// interception if it is a reflector that says which certificate it served.
+func discoverEgressIP(ctx context.Context, echoURL string, timeout time.Duration) (net.IP, string, error) {
+	// The request goes through DNS, TCP, TLS and HTTP; allow each its timeout.
+	ctx, cancel := context.WithTimeout(ctx, 4*timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, echoURL, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Accept", "text/plain, application/json")
+	req.Header.Set("User-Agent", "egress-probe/"+currentBuild().Version)
+
+	// Like the probe itself, connect directly rather than through a proxy.
+	client := &http.Client{Transport: &http.Transport{}}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("%s: %s", echoURL, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return nil, "", err
+	}
+	intercepted := ""
+	if served := reflectedCert(body); served != "" && resp.TLS != nil && len(resp.TLS.PeerCertificates) > 0 {
+		seen := resp.TLS.PeerCertificates[0]
+		if sum := sha256.Sum256(seen.Raw); hex.EncodeToString(sum[:]) != served {
+			intercepted = fmt.Sprintf("the certificate received, issued by %q, is not the one the reflector served", seen.Issuer.CommonName)
+		}
+	}
+	if ip := parseEchoResponse(body); ip != nil {
+		return ip, intercepted, nil
+	}
+	return nil, intercepted, fmt.Errorf("%s: no IP address in the response", echoURL)
+}
+
+// parseEchoResponse finds the address in an echo service's answer: plain
+// text as from checkip.amazonaws.com or ifconfig.me, or JSON with an "ip"
+// (ipify, ipinfo) or "origin" (httpbin) field.
+func parseEchoResponse(body []byte) net.IP {
+	var fields struct {
+		IP     string `json:"ip"`
+		Origin string `json:"origin"`
+	}
+	if json.Unmarshal(body, &fields) == nil {
+		for _, s := range []string{fields.IP, fields.Origin} {
+			first, _, _ := strings.Cut(s, ",") // httpbin lists proxies after the client
+			if ip := net.ParseIP(strings.TrimSpace(first)); ip != nil {
+				return ip
+			}
+		}
+		return nil
+	}
+	return net.ParseIP(strings.TrimSpace(string(body)))
+}
+
+// reflectedCert returns the fingerprint of the certificate an
+// "egress-probe reflect" answer says was served, or "" for other services.
+func reflectedCert(body []byte) string {
+	var ref struct {
+		TLS struct {
+			CertSHA256 string `json:"cert_sha256"`
+		} `json:"tls"`
+	}
+	json.Unmarshal(body, &ref)
+	return ref.TLS.CertSHA256
+}
+
+// printEgressIP prints the check below the results table.
+func printEgressIP(c *egressIPCheck) {
+	if c == nil {
+		return
+	}
+	if c.Intercepted != "" {
+		fmt.Fprintf(tableOut, "  %sEgress IP:%s %s⚠ TLS interception: %s%s\n", colorBold, colorReset, colorYellow, c.Intercepted, colorReset)
+	}
+	switch {
+	case c.Error != "":
+		fmt.Fprintf(tableOut, "  %sEgress IP:%s %s✗ not discovered: %s%s\n\n", colorBold, colorReset, colorRed, c.Error, colorReset)
+	case len(c.Expected) == 0:
+		fmt.Printf("  %sEgress IP:%s %s %s(via %s)%s\n\n", colorBold, colorReset, c.IP, colorDim, c.Source, colorReset)
+	case c.OK:
+		fmt.Fprintf(tableOut, "  %sEgress IP:%s %s✓ %s%s, within %s\n\n", colorBold, colorReset, colorGreen, c.IP, colorReset, strings.Join(c.Expected, ", "))
+	default:
+		fmt.Fprintf(tableOut, "  %sEgress IP:%s %s✗ %s is outside %s%s — traffic is not leaving through the expected NAT gateway or egress IP\n\n",
+			colorBold, colorReset, colorRed, c.IP, strings.Join(c.Expected, ", "), colorReset)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// environment describes where the probe runs, so that results from an
+// unfamiliar cluster can be read in context.
+type environment struct {
+	CNI        string            `json:"cni"`                  // best effort; "unknown" if undetected
+	CNISource  string            `json:"cni_source,omitempty"` // what the CNI was inferred from
+	ClusterDNS []string          `json:"cluster_dns"`
+	Search     []string          `json:"search,omitempty"`
+	ResolvConf []string          `json:"resolv_conf"` // /etc/resolv.conf without comments
+	Kernel     string            `json:"kernel"`
+	IPFamily   string            `json:"ip_family,omitempty"` // the Pod's routes: "ipv4", "ipv6" or "dual-stack"
+	Proxy      map[string]string `json:"proxy,omitempty"`     // proxy variables, credentials redacted
+	Sidecar    string            `json:"sidecar,omitempty"`
+	NetNS      string            `json:"netns,omitempty"` // with NETNS: the process whose namespace was entered
+	TrustStore *trustStore       `json:"trust_store,omitempty"`
+
+	ProxyPAC string `json:"proxy_pac,omitempty"` // a proxy auto-config file WPAD serves
+	// TransparentProxy is the evidence that a proxy intercepts connections
+	// on the way.
+	TransparentProxy string `json:"transparent_proxy,omitempty"`
+}
+
+// cniDaemonSets maps the DaemonSet names CNI plugins install to the plugin.
+var cniDaemonSets = []struct{ prefix, cni string }{
+	{"cilium", "Cilium"},
+	{"anetd", "GKE Dataplane V2 (Cilium)"},
+	{"calico-node", "Calico"},
+	{"canal", "Canal"},
+	{"aws-node", "AWS VPC CNI"},
+	{"azure-cns", "Azure CNI"},
+	{"kube-flannel", "Flannel"},
+	{"weave-net", "Weave Net"},
+	{"antrea-agent", "Antrea"},
+	{"ovnkube-node", "OVN-Kubernetes"},
+	{"kube-router", "kube-router"},
+	{"kindnet", "kindnet"},
+}
+
+var proxyVars = []string{"HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY", "ALL_PROXY", "http_proxy", "https_proxy", "no_proxy", "all_proxy"}
+
+var (
+	envOnce sync.Once
+	envInfo *environment
+)
+
+// currentEnvironment fingerprints the environment once per process; none of
+// it changes while the probe runs.
+func currentEnvironment(ctx context.Context) *environment {
+	envOnce.Do(func() { envInfo = fingerprint(ctx) })
+	return envInfo
+}
+
+func fingerprint(ctx context.Context) *environment {
+	env := &environment{CNI: "unknown", Kernel: "unknown"}
+	if release := kernelRelease(); release != "" {
+		env.Kernel = release
+	}
+
+	env.ResolvConf, env.ClusterDNS, env.Search = readResolvConf()
+	env.IPFamily = detectIPFamily()
+
+	for _, name := range proxyVars {
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if env.Proxy == nil {
+			env.Proxy = make(map[string]string)
+		}
+		if u, err := url.Parse(v); err == nil && u.User != nil {
+			u.User = url.User("xxxxx")
+			v = u.String()
+		}
+		env.Proxy[name] = v
+	}
+
+	env.CNI, env.CNISource = detectCNI(ctx)
+	env.Sidecar, _ = detectSidecar(ctx)
+	detectProxyEnvironment(ctx, env)
+	env.NetNS = netnsDescription()
+	env.TrustStore = systemTrustStore()
+	return env
+}
+
+// detectCNI names the cluster's CNI plugin from its DaemonSet, which needs
+// permission to list DaemonSets cluster-wide. Without it, it falls back to
+// traces the common plugins leave on the Pod's interface.
+func detectCNI(ctx context.Context) (cni, source string) {
+	if client, err := newInClusterClient(); err == nil {
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		var list struct {
+			Items []struct {
+				Metadata objectMeta `json:"metadata"`
+			} `json:"items"`
+		}
+		if err := client.get(ctx, "/apis/apps/v1/daemonsets", &list); err == nil {
+			for _, ds := range list.Items {
+				for _, c := range cniDaemonSets {
+					if strings.HasPrefix(ds.Metadata.Name, c.prefix) {
+						return c.cni, fmt.Sprintf("daemonset %s/%s", ds.Metadata.Namespace, ds.Metadata.Name)
+					}
+				}
+			}
+		}
+	}
+
+	ifaces, _ := net.Interfaces()
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 || iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		switch {
+		case iface.HardwareAddr.String() == "ee:ee:ee:ee:ee:ee":
+			return "Calico", iface.Name + " MAC ee:ee:ee:ee:ee:ee"
+		case iface.MTU == 9001:
+			return "AWS VPC CNI (likely)", fmt.Sprintf("%s MTU %d", iface.Name, iface.MTU)
+		case iface.MTU == 1450:
+			return "VXLAN overlay, e.g. Flannel (likely)", fmt.Sprintf("%s MTU %d", iface.Name, iface.MTU)
+		}
+	}
+	return "unknown", ""
+}
+
+// printEnvironment prints the fingerprint as part of the header.
+func printEnvironment(env *environment) {
+	cni := env.CNI
+	if env.CNISource != "" {
+		cni += fmt.Sprintf(" %s(%s)%s", colorDim, env.CNISource, colorReset)
+	}
+	fmt.Printf("  CNI:      %s\n", cni)
+	dns := "none"
+	if len(env.ClusterDNS) > 0 {
+		dns = strings.Join(env.ClusterDNS, ", ")
+	}
+	if len(env.Search) > 0 {
+		dns += fmt.Sprintf(" %s(search %s)%s", colorDim, strings.Join(env.Search, " "), colorReset)
+	}
+	fmt.Printf("  DNS:      %s\n", dns)
+	fmt.Printf("  Kernel:   %s\n", env.Kernel)
+	if env.IPFamily != "" {
+		fmt.Printf("  IP:       %s\n", env.IPFamily)
+	}
+	if env.NetNS != "" {
+		fmt.Printf("  NetNS:    %s\n", env.NetNS)
+	}
+	if ts := env.TrustStore; ts != nil {
+		fmt.Printf("  Trust:    %s\n", ts)
+		if ts.Warning != "" {
+			fmt.Printf("            %s%s%s\n", colorYellow, ts.Warning, colorReset)
+		}
+	}
+	if env.Sidecar != "" {
+		fmt.Printf("  Mesh:     %s\n", env.Sidecar)
+	}
+	for _, name := range proxyVars {
+		if v, ok := env.Proxy[name]; ok {
+			fmt.Printf("  Proxy:    %s%s=%s%s\n", colorYellow, name, v, colorReset)
+		}
+	}
+	if env.ProxyPAC != "" {
+		fmt.Printf("  Proxy:    %sauto-config at %s%s\n", colorYellow, env.ProxyPAC, colorReset)
+	}
+	if env.TransparentProxy != "" {
+		fmt.Printf("  Proxy:    %stransparent (%s)%s\n", colorYellow, env.TransparentProxy, colorReset)
+	}
+}
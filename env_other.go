@@ -0,0 +1,40 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"strings"
+)
+
+// kernelRelease returns the node's kernel release, which containers share.
+func kernelRelease() string {
+	data, _ := os.ReadFile("/proc/sys/kernel/osrelease")
+	return strings.TrimSpace(string(data))
+}
+
+// readResolvConf returns the lines of /etc/resolv.conf without comments,
+// and the nameservers and search domains they configure.
+func readResolvConf() (lines, nameservers, search []string) {
+	data, err := os.ReadFile("/etc/resolv.conf")
+	if err != nil {
+		return nil, nil, nil
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		lines = append(lines, line)
+		fields := strings.Fields(line)
+		switch fields[0] {
+		case "nameserver":
+			if len(fields) > 1 {
+				nameservers = append(nameservers, fields[1])
+			}
+		case "search":
+			search = fields[1:]
+		}
+	}
+	return lines, nameservers, search
+}
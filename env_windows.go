@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const tcpipParameters = `SYSTEM\CurrentControlSet\Services\Tcpip\Parameters`
+
+// kernelRelease returns the Windows build, e.g. "Windows 10.0.20348.2527".
+// Process-isolated containers must run the node's build, so this is the
+// node's too.
+func kernelRelease() string {
+	k, err := openKey(`SOFTWARE\Microsoft\Windows NT\CurrentVersion`)
+	if err != nil {
+		return ""
+	}
+	defer syscall.RegCloseKey(k)
+	major, _ := regDWORD(k, "CurrentMajorVersionNumber")
+	minor, _ := regDWORD(k, "CurrentMinorVersionNumber")
+	build := regString(k, "CurrentBuildNumber")
+	if build == "" {
+		return ""
+	}
+	release := fmt.Sprintf("Windows %d.%d.%s", major, minor, build)
+	if ubr, ok := regDWORD(k, "UBR"); ok {
+		release += fmt.Sprintf(".%d", ubr)
+	}
+	return release
+}
+
+// readResolvConf returns the DNS servers and search list Windows configures
+// in the registry, where the network's DHCP or HNS sets them for a
+// container. Windows has no resolv.conf, so there are no lines.
+func readResolvConf() (lines, nameservers, search []string) {
+	params, err := openKey(tcpipParameters)
+	if err != nil {
+		return nil, nil, nil
+	}
+	defer syscall.RegCloseKey(params)
+	search = splitRegList(regString(params, "SearchList"))
+
+	ifaces, err := openKey(tcpipParameters + `\Interfaces`)
+	if err != nil {
+		return nil, nil, search
+	}
+	defer syscall.RegCloseKey(ifaces)
+	seen := make(map[string]bool)
+	for i := uint32(0); ; i++ {
+		name := make([]uint16, 256)
+		n := uint32(len(name))
+		if syscall.RegEnumKeyEx(ifaces, i, &name[0], &n, nil, nil, nil, nil) != nil {
+			break
+		}
+		iface, err := openKey(tcpipParameters + `\Interfaces\` + syscall.UTF16ToString(name[:n]))
+		if err != nil {
+			continue
+		}
+		// A static NameServer overrides the one DHCP handed out.
+		servers := regString(iface, "NameServer")
+		if servers == "" {
+			servers = regString(iface, "DhcpNameServer")
+		}
+		syscall.RegCloseKey(iface)
+		for _, ns := range splitRegList(servers) {
+			if !seen[ns] {
+				seen[ns] = true
+				nameservers = append(nameservers, ns)
+			}
+		}
+	}
+	return nil, nameservers, search
+}
+
+func openKey(path string) (syscall.Handle, error) {
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	var k syscall.Handle
+	err = syscall.RegOpenKeyEx(syscall.HKEY_LOCAL_MACHINE, p, 0, syscall.KEY_READ, &k)
+	return k, err
+}
+
+// regString reads a REG_SZ value, or returns "".
+func regString(k syscall.Handle, name string) string {
+	p, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return ""
+	}
+	var typ, n uint32
+	if syscall.RegQueryValueEx(k, p, nil, &typ, nil, &n) != nil || typ != syscall.REG_SZ || n < 2 {
+		return ""
+	}
+	buf := make([]uint16, n/2)
+	if syscall.RegQueryValueEx(k, p, nil, &typ, (*byte)(unsafe.Pointer(&buf[0])), &n) != nil {
+		return ""
+	}
+	return syscall.UTF16ToString(buf)
+}
+
+// regDWORD reads a REG_DWORD value.
+func regDWORD(k syscall.Handle, name string) (uint32, bool) {
+	p, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return 0, false
+	}
+	var typ, v uint32
+	n := uint32(unsafe.Sizeof(v))
+	if syscall.RegQueryValueEx(k, p, nil, &typ, (*byte)(unsafe.Pointer(&v)), &n) != nil || typ != syscall.REG_DWORD {
+		return 0, false
+	}
+	return v, true
+}
+
+// splitRegList splits the lists Windows stores in the registry, separated
+// by commas or spaces depending on who wrote them.
+func splitRegList(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' })
+}
@@ -0,0 +1,712 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cheolhuikim/egress-probe/pkg/probe"
+)
+
+// defaultGateSettle is how long the gate waits after applying a change to
+// the canary namespace, for the CNI to program it, before probing again.
+const defaultGateSettle = 5 * time.Second
+
+// policyChange is one object of a proposed policy change.
+type policyChange struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+	Action    string `json:"action"`         // "create", "update" or "ignored"
+	Note      string `json:"note,omitempty"` // why it was ignored, or not applied to the canary
+
+	raw    map[string]any
+	netpol *networkPolicy
+	cilium *ciliumPolicy
+}
+
+func (c policyChange) String() string {
+	if c.Namespace == "" {
+		return c.Kind + " " + c.Name
+	}
+	return c.Kind + " " + c.Namespace + "/" + c.Name
+}
+
+// gateOutput is the JSON form of "egress-probe gate".
+type gateOutput struct {
+	Pod     string         `json:"pod"`
+	Canary  string         `json:"canary,omitempty"`
+	Changes []policyChange `json:"changes"`
+	Targets []gateTarget   `json:"targets"`
+	Passed  bool           `json:"passed"`
+}
+
+// gateTarget is the gate's decision for one target: its outcome before the
+// change, its policy verdict now and with the change, and, with a canary,
+// its outcome after the change.
+type gateTarget struct {
+	Target     string      `json:"target"`
+	FromChange bool        `json:"from_change"` // derived from the change's egress rules
+	Before     jsonResult  `json:"before"`
+	Current    *jsonPolicy `json:"current"`
+	Proposed   *jsonPolicy `json:"proposed"`
+	After      *jsonResult `json:"after,omitempty"`
+	Decision   string      `json:"decision"` // "pass", "warn", "fail" or "incomplete"
+	Reason     string      `json:"reason,omitempty"`
+}
+
+// runGate implements "egress-probe gate": a pre-deploy check of a proposed
+// NetworkPolicy or Cilium policy change, meant for CI/CD. It probes the
+// configured targets, and those the change's egress rules name, from the
+// probe's Pod; predicts each target's verdict under the current and the
+// proposed policies; and, with -canary, applies the change to the Pod's
+// namespace, probes again and restores the previous policies. It returns
+// exitFailed if the change would block a target that should be reachable,
+// open one that should be blocked, or leave one it means to open blocked.
+func runGate(ctx context.Context, args []string) int {
+	fs := flag.NewFlagSet("gate", flag.ExitOnError)
+	canary := fs.String("canary", "", "apply the change to this `namespace`, which must be the probe's own, probe again, then restore its policies")
+	settle := fs.Duration("settle", defaultGateSettle, "with -canary, time for the CNI to program the change before probing again")
+	asJSON := fs.Bool("json", false, "print the decision as JSON")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s gate [flags] change.json...\n\nThe change is one or more NetworkPolicy, CiliumNetworkPolicy or CiliumClusterwideNetworkPolicy\nobjects (or Lists of them) in JSON; convert YAML with\n  kubectl create --dry-run=client -o json -f change.yaml > change.json\n\nTargets come from ALLOW_TARGETS and DENY_TARGETS, as for a normal run, plus the names and\naddresses the change's egress rules allow.\n\nFlags:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return exitFailed
+	}
+
+	cfg, err := parseConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitFailed
+	}
+	changes, err := readPolicyChange(fs.Args())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitFailed
+	}
+
+	client, err := newInClusterClient()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: gate must run in the cluster, in a Pod labelled like the workload the change is for: %v\n", err)
+		return exitFailed
+	}
+	state, err := loadGateState(ctx, client, changes)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitFailed
+	}
+	if *canary != "" && *canary != state.pod.Namespace {
+		fmt.Fprintf(os.Stderr, "Error: the probe runs in namespace %s; -canary must name the namespace it runs in, not %s\n", state.pod.Namespace, *canary)
+		return exitFailed
+	}
+	state.resolve(changes, *canary != "")
+
+	derived := changeTargets(state.pod, changes)
+	targets, fromChange := mergeGateTargets(cfg.Targets, derived)
+	if len(targets) == 0 {
+		fmt.Fprintln(os.Stderr, "Error: no targets: set ALLOW_TARGETS and/or DENY_TARGETS, or add egress rules naming hosts or addresses to the change")
+		return exitFailed
+	}
+	for _, c := range changes {
+		if c.Note != "" {
+			logf("%s: %s (%s)", c, c.Action, c.Note)
+		} else {
+			logf("%s: %s", c, c.Action)
+		}
+	}
+	logf("probing %d targets (%d from the change) from pod %s/%s", len(targets), len(derived), state.pod.Namespace, state.pod.Name)
+
+	before := gateRun(ctx, cfg, targets)
+	var after []probe.Result
+	if *canary != "" && ctx.Err() == nil {
+		after, err = state.canaryRun(ctx, cfg, changes, targets, *settle)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: canary: %v\n", err)
+			return exitFailed
+		}
+	}
+
+	out := gateOutput{Pod: state.pod.Namespace + "/" + state.pod.Name, Canary: *canary, Changes: changes, Passed: true}
+	incomplete := false
+	for i, r := range before {
+		current, proposed := state.current.evaluate(r), state.proposed.evaluate(r)
+		t := gateTarget{
+			Target:     targetKey(r.Target),
+			FromChange: fromChange[i],
+			Before:     toJSONResult(r),
+			Current:    toJSONPolicy(current),
+			Proposed:   toJSONPolicy(proposed),
+		}
+		var a *probe.Result
+		if after != nil {
+			a = &after[i]
+			ja := toJSONResult(*a)
+			t.After = &ja
+		}
+		t.Decision, t.Reason = gateDecision(r, a, current, proposed, fromChange[i])
+		switch t.Decision {
+		case "fail":
+			out.Passed = false
+		case "incomplete":
+			incomplete = true
+		}
+		out.Targets = append(out.Targets, t)
+	}
+
+	if *asJSON {
+		writeJSON(Config{}, out)
+	} else {
+		printGate(out)
+	}
+	switch {
+	case !out.Passed:
+		return exitFailed
+	case incomplete:
+		return exitIncomplete
+	}
+	return 0
+}
+
+// readPolicyChange reads the objects of a proposed change from JSON files,
+// each holding one or more objects or Lists.
+func readPolicyChange(paths []string) ([]policyChange, error) {
+	var changes []policyChange
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] != '{' {
+			return nil, fmt.Errorf("%s: not JSON; convert YAML with kubectl create --dry-run=client -o json -f <file>", path)
+		}
+		dec := json.NewDecoder(bytes.NewReader(data))
+		for {
+			var doc json.RawMessage
+			if err := dec.Decode(&doc); err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+			objs, err := listItems(doc)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+			for _, obj := range objs {
+				c, err := parsePolicyChange(obj)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %w", path, err)
+				}
+				changes = append(changes, c)
+			}
+		}
+	}
+	if len(changes) == 0 {
+		return nil, errors.New("the change has no objects")
+	}
+	return changes, nil
+}
+
+// listItems returns the items of a List, or doc itself.
+func listItems(doc json.RawMessage) ([]json.RawMessage, error) {
+	var list struct {
+		Kind  string            `json:"kind"`
+		Items []json.RawMessage `json:"items"`
+	}
+	if err := json.Unmarshal(doc, &list); err != nil {
+		return nil, err
+	}
+	if strings.HasSuffix(list.Kind, "List") {
+		return list.Items, nil
+	}
+	return []json.RawMessage{doc}, nil
+}
+
+func parsePolicyChange(obj json.RawMessage) (policyChange, error) {
+	var head struct {
+		APIVersion string     `json:"apiVersion"`
+		Kind       string     `json:"kind"`
+		Metadata   objectMeta `json:"metadata"`
+	}
+	if err := json.Unmarshal(obj, &head); err != nil {
+		return policyChange{}, err
+	}
+	c := policyChange{Kind: head.Kind, Namespace: head.Metadata.Namespace, Name: head.Metadata.Name}
+	if c.Name == "" {
+		return c, fmt.Errorf("%s without metadata.name", head.Kind)
+	}
+	if err := json.Unmarshal(obj, &c.raw); err != nil {
+		return c, err
+	}
+	switch {
+	case head.Kind == "NetworkPolicy" && head.APIVersion == "networking.k8s.io/v1":
+		c.netpol = new(networkPolicy)
+		err := json.Unmarshal(obj, c.netpol)
+		return c, err
+	case (head.Kind == "CiliumNetworkPolicy" || head.Kind == "CiliumClusterwideNetworkPolicy") && strings.HasPrefix(head.APIVersion, "cilium.io/"):
+		c.cilium = new(ciliumPolicy)
+		err := json.Unmarshal(obj, c.cilium)
+		return c, err
+	}
+	c.Action, c.Note = "ignored", "not a NetworkPolicy or Cilium policy"
+	return c, nil
+}
+
+// gateState holds the probe's Pod and the policies that apply to it, as they
+// are and as the change would leave them.
+type gateState struct {
+	pod objectMeta
+
+	netpols     []networkPolicy
+	namespaced  []ciliumPolicy // nil if Cilium is not installed
+	clusterwide []ciliumPolicy
+	hasCilium   bool
+
+	current, proposed gatePolicies
+}
+
+// gatePolicies evaluates a target against NetworkPolicies and, where Cilium
+// is installed, Cilium policies. Cilium enforces both, so a target is only
+// allowed if both allow it.
+type gatePolicies struct {
+	netpol *podNetworkPolicies
+	cilium *podCiliumPolicies
+}
+
+func (g gatePolicies) evaluate(r probe.Result) policyVerdict {
+	v := g.netpol.evaluate(r)
+	if g.cilium == nil {
+		return v
+	}
+	cv := g.cilium.evaluate(r)
+	switch {
+	case v.Expected == "deny":
+		return v
+	case cv.Expected == "deny", cv.Expected == "unknown":
+		return cv
+	case v.Expected == "unknown":
+		return v
+	}
+	v.Reason += "; " + cv.Reason
+	return v
+}
+
+func loadGateState(ctx context.Context, client *kubeClient, changes []policyChange) (*gateState, error) {
+	ctx, cancel := context.WithTimeout(ctx, clusterTargetsTimeout)
+	defer cancel()
+	pod, err := ownPod(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	s := &gateState{pod: pod}
+
+	var netpols networkPolicyList
+	if err := client.get(ctx, "/apis/networking.k8s.io/v1/namespaces/"+pod.Namespace+"/networkpolicies", &netpols); err != nil {
+		return nil, fmt.Errorf("listing networkpolicies in %s: %w", pod.Namespace, err)
+	}
+	s.netpols = netpols.Items
+
+	var namespaced ciliumPolicyList
+	err = client.get(ctx, "/apis/cilium.io/v2/namespaces/"+pod.Namespace+"/ciliumnetworkpolicies", &namespaced)
+	switch {
+	case err == nil:
+		s.hasCilium = true
+		s.namespaced = namespaced.Items
+		var clusterwide ciliumPolicyList
+		if err := client.get(ctx, "/apis/cilium.io/v2/ciliumclusterwidenetworkpolicies", &clusterwide); err != nil {
+			logf("gate: cluster-wide Cilium policies not evaluated: %v", err)
+		}
+		s.clusterwide = clusterwide.Items
+	case isNotFound(err):
+		for _, c := range changes {
+			if c.cilium != nil {
+				return nil, fmt.Errorf("the change has %s, but the CiliumNetworkPolicy CRD is not installed", c)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("listing ciliumnetworkpolicies in %s: %w", pod.Namespace, err)
+	}
+	return s, nil
+}
+
+// resolve decides what becomes of each change: objects for other namespaces
+// are ignored, unless canary is set, in which case the probe's namespace
+// stands in for theirs. It then computes the current and proposed policies.
+func (s *gateState) resolve(changes []policyChange, canary bool) {
+	netpols := append([]networkPolicy(nil), s.netpols...)
+	namespaced := append([]ciliumPolicy(nil), s.namespaced...)
+	clusterwide := append([]ciliumPolicy(nil), s.clusterwide...)
+
+	for i := range changes {
+		c := &changes[i]
+		if c.Action == "ignored" {
+			continue
+		}
+		clusterScoped := c.Kind == "CiliumClusterwideNetworkPolicy"
+		if !clusterScoped && c.Namespace != "" && c.Namespace != s.pod.Namespace {
+			if !canary {
+				c.Action, c.Note = "ignored", "not in the probe's namespace "+s.pod.Namespace
+				continue
+			}
+			c.Note = "applied in place of namespace " + c.Namespace
+		}
+		if !clusterScoped {
+			c.Namespace = s.pod.Namespace
+		}
+
+		c.Action = "create"
+		switch {
+		case c.netpol != nil:
+			c.netpol.Metadata.Name = c.Name
+			netpols, c.Action = replacePolicy(netpols, *c.netpol, func(p networkPolicy) string { return p.Metadata.Name })
+		case clusterScoped:
+			clusterwide, c.Action = replacePolicy(clusterwide, *c.cilium, func(p ciliumPolicy) string { return p.Metadata.Name })
+			if canary {
+				c.Note = "cluster-wide, so not applied to the canary"
+			}
+		default:
+			namespaced, c.Action = replacePolicy(namespaced, *c.cilium, func(p ciliumPolicy) string { return p.Metadata.Name })
+		}
+	}
+
+	s.current = gatePolicies{netpol: selectNetworkPolicies(s.pod, s.netpols)}
+	s.proposed = gatePolicies{netpol: selectNetworkPolicies(s.pod, netpols)}
+	if s.hasCilium {
+		s.current.cilium = selectCiliumRules(s.pod, s.namespaced, s.clusterwide)
+		s.proposed.cilium = selectCiliumRules(s.pod, namespaced, clusterwide)
+	}
+}
+
+// replacePolicy replaces the policy named like p, or adds p, and reports
+// which it did.
+func replacePolicy[T any](policies []T, p T, name func(T) string) ([]T, string) {
+	for i := range policies {
+		if name(policies[i]) == name(p) {
+			policies[i] = p
+			return policies, "update"
+		}
+	}
+	return append(policies, p), "create"
+}
+
+// changeTargets derives targets from the egress rules of the changed
+// policies that select the Pod: the names of toFQDNs matchName and the
+// single addresses of ipBlock, toCIDR and toCIDRSet, on each TCP port the
+// rule allows, or 443. Patterns and ranges can't be probed.
+func changeTargets(pod objectMeta, changes []policyChange) []probe.Target {
+	var targets []probe.Target
+	add := func(host string, ports []int) {
+		if len(ports) == 0 {
+			ports = []int{probe.DefaultPort}
+		}
+		for _, port := range ports {
+			targets = append(targets, probe.Target{Host: host, Port: port, SkipTLS: port != 443})
+		}
+	}
+	for _, c := range changes {
+		if c.Action == "ignored" {
+			continue
+		}
+		if c.netpol != nil {
+			if !c.netpol.restrictsEgress() || !c.netpol.Spec.PodSelector.matches(pod.Labels) {
+				continue
+			}
+			for _, rule := range c.netpol.Spec.Egress {
+				var ports []int
+				for _, p := range rule.Ports {
+					if n, err := strconv.Atoi(string(p.Port)); err == nil && (p.Protocol == "" || p.Protocol == "TCP") {
+						ports = append(ports, n)
+					}
+				}
+				for _, peer := range rule.To {
+					if peer.IPBlock != nil {
+						if addr := singleAddress(peer.IPBlock.CIDR); addr != "" {
+							add(addr, ports)
+						}
+					}
+				}
+			}
+			continue
+		}
+		for _, nr := range selectCiliumRules(pod, []ciliumPolicy{*c.cilium}, nil).rules {
+			for _, rule := range nr.Egress {
+				var ports []int
+				for _, tp := range rule.ToPorts {
+					for _, p := range tp.Ports {
+						if n, err := strconv.Atoi(p.Port); err == nil && (p.Protocol == "" || p.Protocol == "TCP" || p.Protocol == "ANY") {
+							ports = append(ports, n)
+						}
+					}
+				}
+				for _, f := range rule.ToFQDNs {
+					if f.MatchName != "" {
+						add(strings.TrimSuffix(f.MatchName, "."), ports)
+					}
+				}
+				for _, cidr := range rule.ToCIDR {
+					if addr := singleAddress(cidr); addr != "" {
+						add(addr, ports)
+					}
+				}
+				for _, set := range rule.ToCIDRSet {
+					if addr := singleAddress(set.CIDR); addr != "" {
+						add(addr, ports)
+					}
+				}
+			}
+		}
+	}
+	return targets
+}
+
+// singleAddress returns the address of a CIDR that holds just one, such as
+// 203.0.113.7/32, or of a bare address.
+func singleAddress(cidr string) string {
+	if ip := net.ParseIP(cidr); ip != nil {
+		return ip.String()
+	}
+	ip, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return ""
+	}
+	if ones, bits := n.Mask.Size(); ones != bits {
+		return ""
+	}
+	return ip.String()
+}
+
+// mergeGateTargets appends the derived targets not already configured, and
+// marks which targets came from the change.
+func mergeGateTargets(configured, derived []probe.Target) ([]probe.Target, []bool) {
+	targets := append([]probe.Target(nil), configured...)
+	fromChange := make([]bool, len(configured))
+	seen := make(map[string]bool)
+	for _, t := range configured {
+		seen[net.JoinHostPort(t.Host, strconv.Itoa(t.Port))] = true
+	}
+	for _, t := range derived {
+		key := net.JoinHostPort(t.Host, strconv.Itoa(t.Port))
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		targets = append(targets, t)
+		fromChange = append(fromChange, true)
+	}
+	return targets, fromChange
+}
+
+func gateRun(ctx context.Context, cfg Config, targets []probe.Target) []probe.Result {
+	probe.WarmupDNS(ctx, cfg.Timeout)
+	results, _ := probe.Run(ctx, targets, probeOptions(cfg))
+	return results
+}
+
+// canaryRun applies the change to the probe's namespace, waits for it to
+// settle, probes the targets again, and restores the previous policies,
+// even if the run is interrupted.
+func (s *gateState) canaryRun(ctx context.Context, cfg Config, changes []policyChange, targets []probe.Target, settle time.Duration) ([]probe.Result, error) {
+	client, err := newInClusterClient()
+	if err != nil {
+		return nil, err
+	}
+	var undo []func(context.Context) error
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), clusterTargetsTimeout)
+		defer cancel()
+		for i := len(undo) - 1; i >= 0; i-- {
+			if err := undo[i](ctx); err != nil {
+				logf("canary: restoring: %v", err)
+			}
+		}
+		if len(undo) > 0 {
+			logf("canary: restored the policies of %s", s.pod.Namespace)
+		}
+	}()
+
+	for _, c := range changes {
+		if c.Action == "ignored" || c.Kind == "CiliumClusterwideNetworkPolicy" {
+			continue
+		}
+		fn, err := applyPolicy(ctx, client, c)
+		if err != nil {
+			return nil, fmt.Errorf("applying %s: %w", c, err)
+		}
+		undo = append(undo, fn)
+	}
+	logf("canary: change applied to %s; probing again in %s", s.pod.Namespace, settle)
+	sleepCtx(ctx, settle)
+	return gateRun(ctx, cfg, targets), nil
+}
+
+// policyPath is the API path of the collection c belongs to.
+func policyPath(c policyChange) string {
+	if c.netpol != nil {
+		return "/apis/networking.k8s.io/v1/namespaces/" + c.Namespace + "/networkpolicies"
+	}
+	return "/apis/cilium.io/v2/namespaces/" + c.Namespace + "/ciliumnetworkpolicies"
+}
+
+// applyPolicy creates or replaces c's object and returns the function that
+// undoes it: deleting the object, or putting the previous one back.
+func applyPolicy(ctx context.Context, client *kubeClient, c policyChange) (func(context.Context) error, error) {
+	path := policyPath(c) + "/" + c.Name
+	obj := c.raw
+	meta, _ := obj["metadata"].(map[string]any)
+	for _, k := range []string{"resourceVersion", "uid", "creationTimestamp", "generation", "managedFields"} {
+		delete(meta, k)
+	}
+	meta["namespace"] = c.Namespace
+
+	var previous map[string]any
+	err := client.get(ctx, path, &previous)
+	switch {
+	case isNotFound(err):
+		if err := client.do(ctx, http.MethodPost, policyPath(c), "application/json", obj, nil); err != nil {
+			return nil, err
+		}
+		return func(ctx context.Context) error {
+			return client.do(ctx, http.MethodDelete, path, "", nil, nil)
+		}, nil
+	case err != nil:
+		return nil, err
+	}
+
+	meta["resourceVersion"] = previous["metadata"].(map[string]any)["resourceVersion"]
+	if err := client.do(ctx, http.MethodPut, path, "application/json", obj, nil); err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context) error {
+		var now map[string]any
+		if err := client.get(ctx, path, &now); err != nil {
+			return err
+		}
+		prev, _ := previous["metadata"].(map[string]any)
+		prev["resourceVersion"] = now["metadata"].(map[string]any)["resourceVersion"]
+		return client.do(ctx, http.MethodPut, path, "application/json", previous, nil)
+	}, nil
+}
+
+// gateDecision decides whether a target passes the gate. before and after
+// are its outcomes without and with the change (after is nil without a
+// canary); current and proposed its policy verdicts.
+func gateDecision(before probe.Result, after *probe.Result, current, proposed policyVerdict, fromChange bool) (string, string) {
+	want := "allow"
+	if before.Target.ExpectErr {
+		want = "deny"
+	}
+	if before.Incomplete || (after != nil && after.Incomplete) {
+		return "incomplete", "run interrupted"
+	}
+
+	if after != nil {
+		switch {
+		case before.Passed && !after.Passed && want == "deny":
+			return "fail", "reachable once the change is applied"
+		case before.Passed && !after.Passed:
+			return "fail", "blocked once the change is applied: " + failureReason(*after)
+		case fromChange && !after.Passed:
+			return "fail", "the change allows it, but it is still blocked with the change applied: " + failureReason(*after)
+		}
+	}
+
+	switch {
+	case proposed.Expected == "unknown":
+		return "warn", "no policy verdict: " + proposed.Reason
+	case proposed.Expected != want && current.Expected == want && want == "deny":
+		return "fail", "the change allows it: " + proposed.Reason
+	case proposed.Expected != want && current.Expected == want:
+		return "fail", "the change blocks it: " + proposed.Reason
+	case proposed.Expected != want && fromChange:
+		return "fail", "the change means to allow it, but the policies still deny it: " + proposed.Reason
+	case proposed.Expected != want:
+		return "warn", "already " + map[string]string{"allow": "allowed", "deny": "denied"}[current.Expected] + " by policy, and the change keeps it so: " + proposed.Reason
+	}
+
+	// The policies will do what they should. What they can't tell is a
+	// block beyond them, such as the firewall.
+	if after == nil && !before.Passed && current.Expected == want && want == "allow" {
+		return "warn", "policy allows it, yet it is blocked: " + failureReason(before) + "; the change alone won't make it reachable"
+	}
+	if after != nil && !after.Passed {
+		return "warn", "still failing with the change applied: " + failureReason(*after)
+	}
+	if current.Expected != want {
+		return "pass", "fixed by the change: " + proposed.Reason
+	}
+	return "pass", ""
+}
+
+// printGate prints the gate's decision, one line per target.
+func printGate(out gateOutput) {
+	fmt.Printf("\n  %sPolicy change gate%s for pod %s", colorBold, colorReset, out.Pod)
+	if out.Canary != "" {
+		fmt.Printf(", canary namespace %s", out.Canary)
+	}
+	fmt.Printf("\n\n")
+	for _, c := range out.Changes {
+		note := ""
+		if c.Note != "" {
+			note = " (" + c.Note + ")"
+		}
+		fmt.Printf("    %s%s: %s%s%s\n", colorDim, c, c.Action, note, colorReset)
+	}
+	fmt.Println()
+
+	width := 0
+	for _, t := range out.Targets {
+		width = max(width, len(t.Target))
+	}
+	outcome := func(r jsonResult) string {
+		switch {
+		case r.Incomplete:
+			return "SKIP"
+		case r.Passed:
+			return "PASS"
+		}
+		return "FAIL"
+	}
+	failed := 0
+	for _, t := range out.Targets {
+		mark, color := "✓", colorGreen
+		switch t.Decision {
+		case "fail":
+			mark, color = "✗", colorRed
+			failed++
+		case "warn":
+			mark, color = "!", colorYellow
+		case "incomplete":
+			mark, color = "?", colorDim
+		}
+		fmt.Fprintf(tableOut, "    %s%s %-*s  before %s  policy %s → %s", color, mark, width, t.Target, outcome(t.Before), t.Current.Expected, t.Proposed.Expected)
+		if t.After != nil {
+			fmt.Printf("  after %s", outcome(*t.After))
+		}
+		if t.FromChange {
+			fmt.Printf("  (from the change)")
+		}
+		fmt.Printf("%s\n", colorReset)
+		if t.Reason != "" {
+			fmt.Printf("      %s%s%s\n", colorDim, t.Reason, colorReset)
+		}
+	}
+	fmt.Println()
+	if out.Passed {
+		fmt.Printf("  Gate: %s%sPASSED%s\n\n", colorBold, colorGreen, colorReset)
+	} else {
+		fmt.Fprintf(tableOut, "  Gate: %s%sFAILED%s — %d of %d targets\n\n", colorBold, colorRed, colorReset, failed, len(out.Targets))
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/cheolhuikim/egress-probe/pkg/probe"
+)
+
+// geoLocation is where a GeoIP database places an address.
+type geoLocation struct {
+	IP          string `json:"ip"`
+	Country     string `json:"country,omitempty"` // ISO 3166-1 code
+	CountryName string `json:"country_name,omitempty"`
+	Region      string `json:"region,omitempty"`
+	Unexpected  bool   `json:"unexpected,omitempty"` // outside GEOIP_COUNTRIES
+}
+
+func (l geoLocation) String() string {
+	switch {
+	case l.Country == "":
+		return l.IP + " (unknown)"
+	case l.Region != "":
+		return fmt.Sprintf("%s (%s, %s)", l.IP, l.Country, l.Region)
+	}
+	return fmt.Sprintf("%s (%s)", l.IP, l.Country)
+}
+
+// GeoIP databases are opened once per process: daemon mode re-reads its
+// configuration every cycle, and a city database is tens of megabytes.
+var (
+	geoMu  sync.Mutex
+	geoDBs = make(map[string]*mmdb)
+)
+
+func openGeoIP(path string) (*mmdb, error) {
+	geoMu.Lock()
+	defer geoMu.Unlock()
+	if db, ok := geoDBs[path]; ok {
+		return db, nil
+	}
+	db, err := openMMDB(path)
+	if err != nil {
+		return nil, err
+	}
+	geoDBs[path] = db
+	return db, nil
+}
+
+// locateResults looks up where each allow target's resolved addresses are,
+// returning the locations by result. With countries set, an allow target
+// that passed but resolves to an address located elsewhere is failed:
+// traffic to it leaves the approved geographies. Addresses the database
+// doesn't know, such as private ones, are never unexpected.
+func locateResults(cfg Config, results []probe.Result) [][]geoLocation {
+	db, err := openGeoIP(cfg.GeoIPDB)
+	if err != nil {
+		logf("GEOIP_DB: %v", err)
+		return nil
+	}
+	locations := make([][]geoLocation, len(results))
+	for i, r := range results {
+		if r.Target.ExpectErr {
+			continue
+		}
+		for _, addr := range resolvedAddrs(jsonResult{Addresses: toJSONAddresses(r)}) {
+			loc := geoLocation{IP: addr.String()}
+			record, err := db.lookup(addr)
+			if err != nil {
+				logf("GEOIP_DB: %s: %v", addr, err)
+				continue
+			}
+			loc.Country, loc.CountryName, loc.Region = geoFields(record)
+			if loc.Country != "" && len(cfg.GeoIPCountries) > 0 && !slices.Contains(cfg.GeoIPCountries, loc.Country) {
+				loc.Unexpected = true
+				results[i].Passed = false
+			}
+			locations[i] = append(locations[i], loc)
+		}
+	}
+	return locations
+}
+
+// geoFields reads the country and first subdivision of a GeoIP2 or
+// GeoLite2 Country or City record.
+func geoFields(record any) (country, countryName, region string) {
+	m, _ := record.(map[string]any)
+	c, _ := m["country"].(map[string]any)
+	if c == nil {
+		// Anycast and satellite ranges only have a registered country.
+		c, _ = m["registered_country"].(map[string]any)
+	}
+	country, _ = c["iso_code"].(string)
+	countryName = englishName(c)
+	if subs, _ := m["subdivisions"].([]any); len(subs) > 0 {
+		sub, _ := subs[0].(map[string]any)
+		region = englishName(sub)
+	}
+	return country, countryName, region
+}
+
+func englishName(m map[string]any) string {
+	names, _ := m["names"].(map[string]any)
+	name, _ := names["en"].(string)
+	return name
+}
+
+// unexpectedLocation describes why a target failed only for its location,
+// or returns "".
+func unexpectedLocation(r jsonResult) string {
+	var outside []string
+	for _, l := range r.Locations {
+		if l.Unexpected {
+			outside = append(outside, l.String())
+		}
+	}
+	if len(outside) == 0 {
+		return ""
+	}
+	return "outside GEOIP_COUNTRIES: " + strings.Join(outside, ", ")
+}
+
+// printLocations lists where each target's addresses are, flagging the ones
+// outside the approved countries.
+func printLocations(results []jsonResult, countries []string) {
+	header := false
+	for _, r := range results {
+		if len(r.Locations) == 0 {
+			continue
+		}
+		if !header {
+			fmt.Printf("  %sLocations%s", colorBold, colorReset)
+			if len(countries) > 0 {
+				fmt.Printf(" %s(approved: %s)%s", colorDim, strings.Join(countries, ", "), colorReset)
+			}
+			fmt.Println()
+			header = true
+		}
+		locs := make([]string, len(r.Locations))
+		for i, l := range r.Locations {
+			if l.Unexpected {
+				locs[i] = colorRed + "✗ " + l.String() + colorReset
+			} else {
+				locs[i] = l.String()
+			}
+		}
+		fmt.Fprintf(tableOut, "    %s:%d  %s\n", r.Host, r.Port, strings.Join(locs, ", "))
+	}
+	if header {
+		fmt.Println()
+	}
+}
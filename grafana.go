@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxAnnotationFailures caps how many failing targets an annotation lists.
+const maxAnnotationFailures = 10
+
+// grafanaAnnotation is the body of Grafana's annotations API.
+type grafanaAnnotation struct {
+	DashboardUID string   `json:"dashboardUID,omitempty"`
+	Time         int64    `json:"time,omitempty"` // Unix milliseconds
+	TimeEnd      int64    `json:"timeEnd,omitempty"`
+	Tags         []string `json:"tags,omitempty"`
+	Text         string   `json:"text"`
+}
+
+// grafanaWindow tracks the failure window annotated in daemon mode, from the
+// first failing cycle to the first one that passes again. It is shared
+// across cycles.
+type grafanaWindow struct {
+	id    int64 // annotation of the open window, 0 = none
+	since time.Time
+}
+
+// annotateGrafana records a run on the Grafana dashboards at
+// GRAFANA_URL. A one-shot run is annotated with its summary. In daemon mode,
+// where a run every minute would bury the dashboards, only failures are: one
+// region annotation per failure window, extended by every failing cycle and
+// closed by the first one that passes. Interrupted runs are left out.
+// Failures are logged: annotating never fails a run.
+func annotateGrafana(ctx context.Context, cfg Config, out jsonOutput, start, end time.Time) {
+	if cfg.GrafanaURL == "" || out.Summary.Incomplete > 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	tags := append([]string{"egress-probe"}, cfg.GrafanaTags...)
+	if cfg.NodeName != "" {
+		tags = append(tags, "node:"+cfg.NodeName)
+	}
+	w := cfg.GrafanaWindow
+	if w == nil {
+		state := "ok"
+		if !out.Summary.OK {
+			state = "failed"
+		}
+		a := grafanaAnnotation{
+			DashboardUID: cfg.GrafanaDashboard,
+			Time:         start.UnixMilli(),
+			TimeEnd:      end.UnixMilli(),
+			Tags:         append(tags, state),
+			Text:         annotationText(out),
+		}
+		if _, err := grafanaRequest(ctx, cfg, http.MethodPost, "/api/annotations", a); err != nil {
+			logf("GRAFANA_URL: %v", err)
+		}
+		return
+	}
+
+	switch {
+	case !out.Summary.OK && w.id == 0:
+		a := grafanaAnnotation{
+			DashboardUID: cfg.GrafanaDashboard,
+			Time:         start.UnixMilli(),
+			TimeEnd:      end.UnixMilli(),
+			Tags:         append(tags, "failed"),
+			Text:         annotationText(out),
+		}
+		id, err := grafanaRequest(ctx, cfg, http.MethodPost, "/api/annotations", a)
+		if err != nil {
+			logf("GRAFANA_URL: opening failure window: %v", err)
+			return
+		}
+		w.id, w.since = id, start
+	case !out.Summary.OK:
+		a := grafanaAnnotation{TimeEnd: end.UnixMilli(), Text: annotationText(out)}
+		if _, err := grafanaRequest(ctx, cfg, http.MethodPatch, fmt.Sprintf("/api/annotations/%d", w.id), a); err != nil {
+			logf("GRAFANA_URL: extending failure window: %v", err)
+		}
+	case w.id != 0:
+		text := fmt.Sprintf("Egress recovered after %s: %d/%d targets OK", start.Sub(w.since).Round(time.Second), out.Summary.Passed, out.Summary.Total)
+		a := grafanaAnnotation{TimeEnd: start.UnixMilli(), Text: text}
+		if _, err := grafanaRequest(ctx, cfg, http.MethodPatch, fmt.Sprintf("/api/annotations/%d", w.id), a); err != nil {
+			logf("GRAFANA_URL: closing failure window: %v", err)
+			return
+		}
+		w.id = 0
+	}
+}
+
+// annotationText summarizes out, listing the failing targets.
+func annotationText(out jsonOutput) string {
+	var b strings.Builder
+	if out.Summary.OK {
+		fmt.Fprintf(&b, "Egress OK: %d/%d targets", out.Summary.Passed, out.Summary.Total)
+		return b.String()
+	}
+	fmt.Fprintf(&b, "Egress failing: %d/%d targets failed", out.Summary.Failed, out.Summary.Total)
+	listed := 0
+	for _, r := range out.Results {
+		if r.Passed || r.Incomplete {
+			continue
+		}
+		if listed == maxAnnotationFailures {
+			fmt.Fprintf(&b, "\n… and %d more", out.Summary.Failed-listed)
+			break
+		}
+		fmt.Fprintf(&b, "\n%s %s:%d — %s", r.Type, r.Host, r.Port, failureDetail(r))
+		if owner := r.Metadata["owner"]; owner != "" {
+			fmt.Fprintf(&b, " (owner: %s)", owner)
+		}
+		listed++
+	}
+	if e := out.EgressIP; e != nil && !e.OK {
+		switch {
+		case e.Error != "":
+			fmt.Fprintf(&b, "\nEgress IP: %s", e.Error)
+		default:
+			fmt.Fprintf(&b, "\nEgress IP: %s is outside %s", e.IP, strings.Join(e.Expected, ", "))
+		}
+	}
+	return b.String()
+}
+
+// grafanaRequest sends an annotation to the Grafana API and returns the ID
+// Grafana gave it, for POSTs.
+func grafanaRequest(ctx context.Context, cfg Config, method, path string, a grafanaAnnotation) (int64, error) {
+	data, err := json.Marshal(a)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimRight(cfg.GrafanaURL, "/")+path, bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if cfg.GrafanaToken != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.GrafanaToken)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode/100 != 2 {
+		return 0, fmt.Errorf("grafana returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var created struct {
+		ID int64 `json:"id"`
+	}
+	json.Unmarshal(body, &created)
+	return created.ID, nil
+}
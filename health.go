@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// defaultLatencySLO is the LATENCY_SLO used when none is set.
+const defaultLatencySLO = time.Second
+
+// health is a target's 0–100 health score, with what was deducted from a
+// full score and why. It tells a target that passes but is degrading from
+// one that passes comfortably.
+type health struct {
+	Score      int      `json:"score"`
+	Deductions []string `json:"deductions,omitempty"`
+}
+
+// scoreHealth scores every complete result. A failed target scores 0 and a
+// passed deny target 100. A passed allow target starts at 100 and loses up
+// to 30 points for extra connection attempts, 40 for latency against slo
+// and 30 for a certificate close to expiry.
+func scoreHealth(results []jsonResult, slo time.Duration) {
+	for i, r := range results {
+		switch {
+		case r.Incomplete:
+			continue
+		case !r.Passed:
+			results[i].Health = &health{Score: 0, Deductions: []string{"failed (-100)"}}
+			continue
+		case r.Type == "deny":
+			results[i].Health = &health{Score: 100}
+			continue
+		}
+
+		h := &health{Score: 100}
+		deduct := func(points int, format string, args ...any) {
+			if points > 0 {
+				h.Score -= points
+				h.Deductions = append(h.Deductions, fmt.Sprintf(format+" (-%d)", append(args, points)...))
+			}
+		}
+
+		// Attempts beyond the first are addresses that didn't connect
+		// before one did.
+		if n := len(r.TCP.Attempts); n > 1 {
+			deduct(min(10*(n-1), 30), "%d connection attempts", n)
+		}
+
+		latency := time.Duration(r.DNS.DurationMs+r.TCP.DurationMs+r.TLS.DurationMs) * time.Millisecond
+		if r.HTTP != nil {
+			latency += time.Duration(r.HTTP.DurationMs) * time.Millisecond
+		}
+		// Up to half the SLO is free; the rest of it costs up to 10 points
+		// and exceeding it up to 30 more, reached at twice the SLO.
+		ratio := float64(latency) / float64(slo)
+		switch {
+		case ratio > 1:
+			deduct(10+int(30*min(ratio-1, 1)), "latency %s over the %s SLO", latency, slo)
+		case ratio > 0.5:
+			deduct(int(20*(ratio-0.5)), "latency %s near the %s SLO", latency, slo)
+		}
+
+		if c := r.Cert; c != nil {
+			switch {
+			case c.DaysLeft <= 7:
+				deduct(30, "certificate expires in %d days", c.DaysLeft)
+			case c.DaysLeft <= 14:
+				deduct(20, "certificate expires in %d days", c.DaysLeft)
+			case c.DaysLeft <= 30:
+				deduct(10, "certificate expires in %d days", c.DaysLeft)
+			}
+		}
+		results[i].Health = h
+	}
+}
+
+// printHealth lists the passing targets that lost points.
+func printHealth(results []jsonResult) {
+	header := false
+	for _, r := range results {
+		if !r.Passed || r.Health == nil || r.Health.Score == 100 {
+			continue
+		}
+		if !header {
+			fmt.Printf("  %sHealth%s %s(passing targets that are degrading)%s\n", colorBold, colorReset, colorDim, colorReset)
+			header = true
+		}
+		color := colorYellow
+		if r.Health.Score < 50 {
+			color = colorRed
+		}
+		fmt.Printf("    %s%3d%s  %s:%d  %s", color, r.Health.Score, colorReset, r.Host, r.Port, colorDim)
+		for i, d := range r.Health.Deductions {
+			if i > 0 {
+				fmt.Print(", ")
+			}
+			fmt.Print(d)
+		}
+		fmt.Printf("%s\n", colorReset)
+	}
+	if header {
+		fmt.Println()
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/cheolhuikim/egress-probe/pkg/probe"
+)
+
+const defaultHookTimeout = 30 * time.Second
+
+// runFailureHooks runs cmdline once for every target whose outcome did not
+// match its expectation. Incomplete targets are not failures and are skipped.
+// Like exec plugins, the command is split on whitespace and run directly;
+// its output goes to stderr so it never mixes with the report on stdout.
+func runFailureHooks(ctx context.Context, cmdline string, timeout time.Duration, results []probe.Result) {
+	args := strings.Fields(cmdline)
+	if len(args) == 0 {
+		return
+	}
+	for _, r := range results {
+		if r.Passed || r.Incomplete {
+			continue
+		}
+		hctx, cancel := context.WithTimeout(ctx, timeout)
+		cmd := exec.CommandContext(hctx, args[0], args[1:]...)
+		cmd.Env = append(os.Environ(), hookEnv(r)...)
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			logf("on-failure hook for %s: %v", targetKey(r.Target), err)
+		}
+		cancel()
+	}
+}
+
+// hookEnv describes a result as EGRESS_PROBE_* environment variables.
+func hookEnv(r probe.Result) []string {
+	typ := "allow"
+	if r.Target.ExpectErr {
+		typ = "deny"
+	}
+	env := []string{
+		"EGRESS_PROBE_HOST=" + r.Target.Host,
+		"EGRESS_PROBE_PORT=" + strconv.Itoa(r.Target.Port),
+		"EGRESS_PROBE_TYPE=" + typ,
+		"EGRESS_PROBE_BLOCKED=" + strconv.FormatBool(r.Blocked),
+	}
+	phases := []struct {
+		name string
+		p    probe.PhaseResult
+	}{{"DNS", r.DNS}, {"TCP", r.TCP}, {"TLS", r.TLS}}
+	if r.HTTP.Detail != "" {
+		phases = append(phases, struct {
+			name string
+			p    probe.PhaseResult
+		}{"HTTP", r.HTTP})
+	}
+	if r.Target.Exec != "" {
+		phases = append(phases, struct {
+			name string
+			p    probe.PhaseResult
+		}{"EXEC", r.Exec})
+	}
+	// Metadata keys become variable names: owner → EGRESS_PROBE_META_OWNER.
+	for k, v := range r.Target.Metadata {
+		name := strings.Map(func(c rune) rune {
+			if 'a' <= c && c <= 'z' || '0' <= c && c <= '9' {
+				return unicode.ToUpper(c)
+			}
+			return '_'
+		}, k)
+		env = append(env, "EGRESS_PROBE_META_"+name+"="+v)
+	}
+	for _, ph := range phases {
+		env = append(env,
+			"EGRESS_PROBE_"+ph.name+"_SUCCESS="+strconv.FormatBool(ph.p.Success),
+			"EGRESS_PROBE_"+ph.name+"_DURATION_MS="+strconv.FormatInt(ph.p.Duration.Milliseconds(), 10),
+			"EGRESS_PROBE_"+ph.name+"_DETAIL="+ph.p.Detail,
+		)
+	}
+	return env
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"net"
+
+	"github.com/cheolhuikim/egress-probe/pkg/probe"
+)
+
+// detectIPFamily tells whether the Pod has an IPv4 route, an IPv6 route or
+// both: "ipv4", "ipv6", "dual-stack", or "" with neither. Connecting a UDP
+// socket only looks up the route; nothing is sent.
+func detectIPFamily() string {
+	routed := func(network, addr string) bool {
+		conn, err := net.Dial(network, addr)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}
+	v4 := routed("udp4", "8.8.8.8:53")
+	v6 := routed("udp6", "[2001:4860:4860::8888]:53")
+	switch {
+	case v4 && v6:
+		return "dual-stack"
+	case v4:
+		return "ipv4"
+	case v6:
+		return "ipv6"
+	}
+	return ""
+}
+
+// resolveIPFamily turns IP_FAMILY into whether lookups should ask for AAAA
+// records, or with dual, whether targets are probed over both families.
+// "auto" asks for AAAA records only in IPv6-only Pods: dual-stack Pods keep
+// A records, which every destination has.
+func resolveIPFamily(raw string) (ipv6, dual bool, err error) {
+	switch raw {
+	case "", "auto":
+		if detectIPFamily() == "ipv6" {
+			logf("no IPv4 route: IPv6-only Pod, resolving AAAA records")
+			return true, false, nil
+		}
+		return false, false, nil
+	case "ipv4":
+		return false, false, nil
+	case "ipv6":
+		return true, false, nil
+	case "dual":
+		if family := detectIPFamily(); family != "dual-stack" {
+			logf("IP_FAMILY=dual: the Pod has no route for one of the families (%s), so every target fails over it", cmp.Or(family, "neither"))
+		}
+		return false, true, nil
+	}
+	return false, false, fmt.Errorf("invalid IP_FAMILY %q: expected auto, ipv4, ipv6 or dual", raw)
+}
+
+// splitFamilies returns targets with each named one probed twice, once
+// pinned to IPv4 and once to IPv6, for IP_FAMILY=dual. Addresses, Services
+// and targets given a family of their own are kept as they are.
+func splitFamilies(targets []probe.Target) []probe.Target {
+	var out []probe.Target
+	for _, t := range targets {
+		if t.Family != "" || t.Service != "" || net.ParseIP(t.Host) != nil {
+			out = append(out, t)
+			continue
+		}
+		v4, v6 := t, t
+		v4.Family, v6.Family = "ipv4", "ipv6"
+		out = append(out, v4, v6)
+	}
+	return out
+}
+
+// familySuffix marks a target pinned to an address family, e.g. " (ipv6)".
+func familySuffix(family string) string {
+	if family == "" {
+		return ""
+	}
+	return " (" + family + ")"
+}
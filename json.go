@@ -0,0 +1,413 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/netip"
+	"os"
+	"time"
+
+	"github.com/cheolhuikim/egress-probe/pkg/probe"
+)
+
+type jsonOutput struct {
+	Summary     jsonSummary     `json:"summary"`
+	Environment *environment    `json:"environment,omitempty"`
+	Preflight   *preflight      `json:"preflight,omitempty"`
+	EgressIP    *egressIPCheck  `json:"egress_ip,omitempty"`
+	Conntrack   *conntrackCheck `json:"conntrack,omitempty"`
+	DropTrace   *dropTrace      `json:"drop_trace,omitempty"`
+	Captures    []capture       `json:"captures,omitempty"`
+	Results     []jsonResult    `json:"results"`
+	Diagnoses   []diagnosis     `json:"diagnoses,omitempty"`    // likely causes of the failures, most likely first
+	CertChanges []certChange    `json:"cert_changes,omitempty"` // daemon mode with CERT_WATCH
+}
+
+type jsonSummary struct {
+	Total      int       `json:"total"`
+	Allow      int       `json:"allow"`
+	Deny       int       `json:"deny"`
+	Passed     int       `json:"passed"`
+	Failed     int       `json:"failed"`
+	Incomplete int       `json:"incomplete"`
+	OK         bool      `json:"ok"`
+	Timeout    string    `json:"timeout"`
+	Elapsed    string    `json:"elapsed"`
+	Build      buildInfo `json:"build"`
+}
+
+type jsonPhase struct {
+	Success    bool          `json:"success"`
+	DurationMs int64         `json:"duration_ms"`
+	DurationUs int64         `json:"duration_us"`
+	Start      *time.Time    `json:"start,omitempty"` // nil if the phase never ran
+	End        *time.Time    `json:"end,omitempty"`
+	Detail     string        `json:"detail"`
+	Status     int           `json:"status,omitempty"`   // HTTP: the response's status code
+	Attempts   []jsonAttempt `json:"attempts,omitempty"` // TCP, TLS and HTTP: the connections tried
+	Retries    int           `json:"retries,omitempty"`  // with RETRIES: the result is from try retries+1
+	TCPInfo    *jsonTCPInfo  `json:"tcp_info,omitempty"` // TCP and TLS, on Linux: the kernel's view of the connection
+}
+
+// jsonTCPInfo is probe.TCPInfo, with times in microseconds.
+type jsonTCPInfo struct {
+	RTTUs        int64  `json:"rtt_us"`
+	RTTVarUs     int64  `json:"rttvar_us"`
+	Retransmits  uint32 `json:"retransmits"`
+	Lost         uint32 `json:"lost"`
+	DeliveryRate uint64 `json:"delivery_rate_bps,omitempty"` // bytes per second
+}
+
+// jsonAddress is one resolved address of a target.
+type jsonAddress struct {
+	Address string `json:"address"`
+	Family  string `json:"family"` // "ipv4" or "ipv6"
+	Dialed  bool   `json:"dialed"` // the address the TCP phase connected to
+}
+
+// jsonAttempt is the tuple a firewall logs a connection under, for finding
+// the attempt in its logs.
+type jsonAttempt struct {
+	Time     time.Time `json:"time"`
+	Protocol string    `json:"protocol"`
+	Local    string    `json:"local,omitempty"`
+	Remote   string    `json:"remote"`
+}
+
+type jsonResult struct {
+	Host        string            `json:"host"`
+	Port        int               `json:"port"`
+	Type        string            `json:"type"`
+	SkipTLS     bool              `json:"skip_tls"`
+	Service     string            `json:"service,omitempty"`   // svc:// targets and their endpoints: "namespace/name"
+	Family      string            `json:"family,omitempty"`    // a target pinned to "ipv4" or "ipv6", e.g. by IP_FAMILY=dual
+	Method      string            `json:"method,omitempty"`    // the target's own HTTP request, if it has one
+	Path        string            `json:"path,omitempty"`      // likewise, e.g. "/v2/"
+	Metadata    map[string]string `json:"metadata,omitempty"`  // the target's own options, e.g. owner and note
+	Canary      bool              `json:"canary,omitempty"`    // a CANARY target: reachable means default deny isn't in force
+	Owners      []ipOwner         `json:"owners,omitempty"`    // with ASN_LOOKUP: who the resolved addresses belong to
+	Locations   []geoLocation     `json:"locations,omitempty"` // with GEOIP_DB: where the resolved addresses are
+	Addresses   []jsonAddress     `json:"addresses,omitempty"` // what DNS resolved, and which of it was dialed
+	DNS         jsonPhase         `json:"dns"`
+	DNSCheck    *jsonDNSCheck     `json:"dns_consistency,omitempty"` // with DNS_CONSISTENCY: whether repeated answers agree
+	DNSTrace    []jsonDNSExchange `json:"dns_trace,omitempty"`       // with DNS_TRACE: the lookup, query by query
+	Timings     *jsonTimings      `json:"timings,omitempty"`         // reachable targets: one connection, step by step
+	TCP         jsonPhase         `json:"tcp"`
+	TLS         jsonPhase         `json:"tls"`
+	HTTP        *jsonPhase        `json:"http,omitempty"`
+	Exec        *jsonPhase        `json:"exec,omitempty"`
+	Cert        *jsonCert         `json:"cert,omitempty"`
+	Intercepted string            `json:"intercepted,omitempty"` // a local mesh proxy answered TLS
+	Policy      *jsonPolicy       `json:"policy,omitempty"`
+	Cilium      *jsonPolicy       `json:"cilium,omitempty"`
+	Mesh        *jsonMesh         `json:"mesh,omitempty"`
+	Health      *health           `json:"health,omitempty"`     // 0–100; omitted for incomplete targets
+	Assertions  []jsonAssertion   `json:"assertions,omitempty"` // the target's expect option, assertion by assertion
+	Passed      bool              `json:"passed"`
+	Blocked     bool              `json:"blocked"`
+	Incomplete  bool              `json:"incomplete"`
+	// DeadlineExceeded marks a target TARGET_TIMEOUT cut short.
+	DeadlineExceeded bool `json:"deadline_exceeded,omitempty"`
+}
+
+// jsonTimings is probe.Timings in microseconds. Unlike curl's -w timings,
+// each step is timed on its own rather than from the start.
+type jsonTimings struct {
+	DNSUs     int64 `json:"dns_us"`
+	ConnectUs int64 `json:"connect_us"`
+	TLSUs     int64 `json:"tls_us,omitempty"`
+	TTFBUs    int64 `json:"ttfb_us,omitempty"`
+	TotalUs   int64 `json:"total_us"`
+}
+
+type jsonDNSCheck struct {
+	MinAddrs int             `json:"min_addresses"`
+	MaxAddrs int             `json:"max_addresses"`
+	Sets     int             `json:"distinct_answers"`
+	Rotated  bool            `json:"rotated"`
+	Disagree bool            `json:"servers_disagree"`
+	Answers  []jsonDNSAnswer `json:"answers"`
+}
+
+type jsonDNSAnswer struct {
+	Server string   `json:"server"`
+	Addrs  []string `json:"addresses,omitempty"`
+	Error  string   `json:"error,omitempty"`
+}
+
+type jsonDNSExchange struct {
+	Server     string   `json:"server"`
+	Transport  string   `json:"transport"`
+	Name       string   `json:"name"`
+	Type       string   `json:"type"`
+	DurationUs int64    `json:"duration_us"`
+	Error      string   `json:"error,omitempty"`
+	Rcode      string   `json:"rcode,omitempty"`
+	Flags      []string `json:"flags,omitempty"`
+	Size       int      `json:"size,omitempty"`
+	Answer     []string `json:"answer,omitempty"`
+	Authority  []string `json:"authority,omitempty"`
+	Additional []string `json:"additional,omitempty"`
+}
+
+type jsonAssertion struct {
+	Expr   string `json:"expr"`
+	Passed bool   `json:"passed"`
+	Detail string `json:"detail"`
+}
+
+type jsonCert struct {
+	Subject     string    `json:"subject"`
+	Issuer      string    `json:"issuer"`
+	DNSNames    []string  `json:"dns_names,omitempty"`
+	NotBefore   time.Time `json:"not_before"`
+	NotAfter    time.Time `json:"not_after"`
+	DaysLeft    int       `json:"days_left"`
+	SelfSigned  bool      `json:"self_signed"`
+	Fingerprint string    `json:"fingerprint_sha256,omitempty"`
+	Expiring    bool      `json:"expiring,omitempty"` // expires within CERT_EXPIRY_WARN days
+
+	Chain []jsonChainCert `json:"chain,omitempty"` // every certificate presented, the leaf first
+}
+
+type jsonChainCert struct {
+	Subject     string    `json:"subject"`
+	Issuer      string    `json:"issuer"`
+	SANs        []string  `json:"sans,omitempty"`
+	Serial      string    `json:"serial"`
+	NotBefore   time.Time `json:"not_before"`
+	NotAfter    time.Time `json:"not_after"`
+	Fingerprint string    `json:"fingerprint_sha256"`
+}
+
+// jsonPolicy is the expected outcome of a target under the cluster's network
+// policies, compared with what was observed (NETPOL_CHECK, CILIUM_CHECK).
+type jsonPolicy struct {
+	Expected string `json:"expected"`
+	Reason   string `json:"reason"`
+	Observed string `json:"observed,omitempty"`
+	Mismatch bool   `json:"mismatch"`
+}
+
+// addPolicyVerdicts attaches NetworkPolicy and Cilium verdicts, if any, to
+// the matching results.
+func addPolicyVerdicts(results []jsonResult, netpol, cilium []policyVerdict) {
+	for i, v := range netpol {
+		results[i].Policy = toJSONPolicy(v)
+	}
+	for i, v := range cilium {
+		results[i].Cilium = toJSONPolicy(v)
+	}
+}
+
+func toJSONPolicy(v policyVerdict) *jsonPolicy {
+	return &jsonPolicy{Expected: v.Expected, Reason: v.Reason, Observed: v.Observed, Mismatch: v.Mismatch}
+}
+
+func toJSONPhase(p probe.PhaseResult) jsonPhase {
+	jp := jsonPhase{
+		Success:    p.Success,
+		DurationMs: p.Duration.Milliseconds(),
+		DurationUs: p.Duration.Microseconds(),
+		Detail:     p.Detail,
+		Status:     p.Status,
+		Retries:    p.Retries,
+	}
+	if !p.Start.IsZero() {
+		start := p.Start.UTC().Truncate(time.Microsecond)
+		end := start.Add(p.Duration.Truncate(time.Microsecond))
+		jp.Start, jp.End = &start, &end
+	}
+	for _, a := range p.Attempts {
+		jp.Attempts = append(jp.Attempts, jsonAttempt{Time: a.Time.UTC(), Protocol: a.Protocol, Local: a.Local, Remote: a.Remote})
+	}
+	if t := p.TCPInfo; t != nil {
+		jp.TCPInfo = &jsonTCPInfo{RTTUs: t.RTT.Microseconds(), RTTVarUs: t.RTTVar.Microseconds(), Retransmits: t.Retransmits, Lost: t.Lost, DeliveryRate: t.DeliveryRate}
+	}
+	return jp
+}
+
+// toJSONAddresses lists the addresses r's DNS phase resolved, marking the
+// one its TCP phase connected to.
+func toJSONAddresses(r probe.Result) []jsonAddress {
+	host, _, _ := net.SplitHostPort(r.TCP.Addr)
+	dialed, _ := netip.ParseAddr(host)
+	var addrs []jsonAddress
+	for _, s := range r.DNS.Addrs {
+		a, err := netip.ParseAddr(s)
+		if err != nil {
+			continue
+		}
+		family := "ipv4"
+		if a.Unmap().Is6() {
+			family = "ipv6"
+		}
+		addrs = append(addrs, jsonAddress{Address: s, Family: family, Dialed: dialed.IsValid() && dialed.WithZone("") == a})
+	}
+	return addrs
+}
+
+// toJSONResult converts one result into its JSON form.
+func toJSONResult(r probe.Result) jsonResult {
+	typ := "allow"
+	if r.Target.ExpectErr {
+		typ = "deny"
+	}
+	jr := jsonResult{
+		Host:             r.Target.Host,
+		Port:             r.Target.Port,
+		Type:             typ,
+		SkipTLS:          r.Target.SkipTLS,
+		Service:          r.Target.Service,
+		Family:           r.Target.Family,
+		Method:           r.Target.Method,
+		Path:             r.Target.Path,
+		Metadata:         r.Target.Metadata,
+		Addresses:        toJSONAddresses(r),
+		DNS:              toJSONPhase(r.DNS),
+		TCP:              toJSONPhase(r.TCP),
+		TLS:              toJSONPhase(r.TLS),
+		Intercepted:      r.Intercepted,
+		Passed:           r.Passed,
+		Blocked:          r.Blocked,
+		Incomplete:       r.Incomplete,
+		DeadlineExceeded: r.DeadlineExceeded,
+	}
+	if r.HTTP.Detail != "" {
+		http := toJSONPhase(r.HTTP)
+		jr.HTTP = &http
+	}
+	if r.Target.Exec != "" {
+		exec := toJSONPhase(r.Exec)
+		jr.Exec = &exec
+	}
+	for _, a := range r.Assertions {
+		jr.Assertions = append(jr.Assertions, jsonAssertion(a))
+	}
+	if t := r.Timings; t != nil {
+		jr.Timings = &jsonTimings{
+			DNSUs:     t.DNS.Microseconds(),
+			ConnectUs: t.Connect.Microseconds(),
+			TLSUs:     t.TLS.Microseconds(),
+			TTFBUs:    t.TTFB.Microseconds(),
+			TotalUs:   t.Total.Microseconds(),
+		}
+	}
+	if c := r.DNSCheck; c != nil {
+		jr.DNSCheck = &jsonDNSCheck{MinAddrs: c.MinAddrs, MaxAddrs: c.MaxAddrs, Sets: c.Sets, Rotated: c.Rotated, Disagree: c.Disagree}
+		for _, a := range c.Answers {
+			jr.DNSCheck.Answers = append(jr.DNSCheck.Answers, jsonDNSAnswer{Server: a.Server, Addrs: a.Addrs, Error: a.Err})
+		}
+	}
+	for _, x := range r.DNSTrace {
+		jr.DNSTrace = append(jr.DNSTrace, jsonDNSExchange{
+			Server:     x.Server,
+			Transport:  x.Transport,
+			Name:       x.Name,
+			Type:       x.Type,
+			DurationUs: x.Duration.Microseconds(),
+			Error:      x.Err,
+			Rcode:      x.Rcode,
+			Flags:      x.Flags,
+			Size:       x.Size,
+			Answer:     x.Answer,
+			Authority:  x.Authority,
+			Additional: x.Additional,
+		})
+	}
+	if c := r.Cert; c != nil {
+		jr.Cert = &jsonCert{
+			Subject:     c.Subject,
+			Issuer:      c.Issuer,
+			DNSNames:    c.DNSNames,
+			NotBefore:   c.NotBefore,
+			NotAfter:    c.NotAfter,
+			DaysLeft:    c.DaysLeft(time.Now()),
+			SelfSigned:  c.SelfSigned,
+			Fingerprint: c.Fingerprint,
+			Expiring:    r.CertExpiring,
+		}
+		for _, cc := range c.Chain {
+			jr.Cert.Chain = append(jr.Cert.Chain, jsonChainCert(cc))
+		}
+	}
+	return jr
+}
+
+func printJSON(out jsonOutput) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(out)
+}
+
+// machineOutput reports whether cfg asks for JSON (OUTPUT=json or ndjson)
+// rather than the table.
+func machineOutput(cfg Config) bool {
+	return cfg.Output == "json" || cfg.Output == "ndjson"
+}
+
+// writeJSON prints v to stdout: indented for OUTPUT=json, on a single line
+// for OUTPUT=ndjson.
+func writeJSON(cfg Config, v any) {
+	enc := json.NewEncoder(os.Stdout)
+	if cfg.Output != "ndjson" {
+		enc.SetIndent("", "  ")
+	}
+	enc.Encode(v)
+}
+
+// ndjsonOut encodes the lines of OUTPUT=ndjson. Results are printed one at
+// a time, as targets finish, so one encoder serves the whole run.
+var ndjsonOut = json.NewEncoder(os.Stdout)
+
+// printNDJSONResult prints one result as a line of OUTPUT=ndjson. The run
+// ends with a {"summary": ...} line from printNDJSONSummary.
+func printNDJSONResult(r probe.Result) {
+	ndjsonOut.Encode(toJSONResult(r))
+}
+
+func printNDJSONSummary(results []probe.Result, timeout, elapsed time.Duration) {
+	ndjsonOut.Encode(struct {
+		Summary jsonSummary `json:"summary"`
+	}{buildJSON(results, timeout, elapsed).Summary})
+}
+
+// buildJSON converts results into the JSON report model shared by OUTPUT=json
+// and every other consumer of machine-readable results.
+func buildJSON(results []probe.Result, timeout, elapsed time.Duration) jsonOutput {
+	var allowCount, denyCount, passed, failed, incomplete int
+	jResults := make([]jsonResult, len(results))
+
+	for i, r := range results {
+		if r.Target.ExpectErr {
+			denyCount++
+		} else {
+			allowCount++
+		}
+		switch {
+		case r.Incomplete:
+			incomplete++
+		case r.Passed:
+			passed++
+		default:
+			failed++
+		}
+		jResults[i] = toJSONResult(r)
+	}
+
+	return jsonOutput{
+		Summary: jsonSummary{
+			Total:      len(results),
+			Allow:      allowCount,
+			Deny:       denyCount,
+			Passed:     passed,
+			Failed:     failed,
+			Incomplete: incomplete,
+			OK:         failed == 0 && incomplete == 0,
+			Timeout:    timeout.String(),
+			Elapsed:    elapsed.Round(time.Millisecond).String(),
+			Build:      currentBuild(),
+		},
+		Results: jResults,
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// kubeClient is a minimal Kubernetes API client that authenticates with the
+// Pod's service account. It covers the handful of REST calls egress-probe
+// needs without pulling in client-go.
+type kubeClient struct {
+	baseURL   string
+	tokenPath string
+	http      *http.Client
+	namespace string // namespace the Pod runs in
+}
+
+// kubeStatusError is returned for non-2xx API responses.
+type kubeStatusError struct {
+	Code    int
+	Message string
+}
+
+func (e *kubeStatusError) Error() string {
+	return fmt.Sprintf("kubernetes API: %d %s", e.Code, e.Message)
+}
+
+// newInClusterClient builds a client from the standard in-cluster
+// environment: KUBERNETES_SERVICE_HOST/PORT and the mounted service account.
+func newInClusterClient() (*kubeClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in a cluster (KUBERNETES_SERVICE_HOST is not set)")
+	}
+
+	caPEM, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("reading service account CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, errors.New("service account CA contains no certificates")
+	}
+
+	ns, _ := os.ReadFile(serviceAccountDir + "/namespace")
+
+	return &kubeClient{
+		baseURL:   "https://" + net.JoinHostPort(host, port),
+		tokenPath: serviceAccountDir + "/token",
+		namespace: strings.TrimSpace(string(ns)),
+		http: &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: pool},
+			},
+		},
+	}, nil
+}
+
+// do sends a request to path (e.g. "/api/v1/namespaces/default/configmaps")
+// and decodes a JSON response into out, if out is non-nil. A *[]byte out
+// receives the raw body instead, as for pod logs. in, if non-nil, is sent as
+// the body with the given content type.
+func (c *kubeClient) do(ctx context.Context, method, path, contentType string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+	// Projected service account tokens are rotated on disk, so re-read the
+	// token for every request instead of caching it.
+	token, err := os.ReadFile(c.tokenPath)
+	if err != nil {
+		return fmt.Errorf("reading service account token: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	if _, raw := out.(*[]byte); raw {
+		req.Header.Set("Accept", "*/*")
+	} else {
+		req.Header.Set("Accept", "application/json")
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		var status struct {
+			Message string `json:"message"`
+		}
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		if json.Unmarshal(data, &status) != nil || status.Message == "" {
+			status.Message = strings.TrimSpace(string(data))
+		}
+		return &kubeStatusError{Code: resp.StatusCode, Message: status.Message}
+	}
+	switch out := out.(type) {
+	case nil:
+		return nil
+	case *[]byte:
+		*out, err = io.ReadAll(io.LimitReader(resp.Body, maxReportBytes))
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (c *kubeClient) get(ctx context.Context, path string, out any) error {
+	return c.do(ctx, http.MethodGet, path, "", nil, out)
+}
+
+// mergePatch applies a JSON merge patch (RFC 7386) to the object at path.
+func (c *kubeClient) mergePatch(ctx context.Context, path string, patch, out any) error {
+	return c.do(ctx, http.MethodPatch, path, "application/merge-patch+json", patch, out)
+}
+
+// objectMeta is the subset of metadata egress-probe reads and writes.
+type objectMeta struct {
+	Name            string            `json:"name"`
+	Namespace       string            `json:"namespace,omitempty"`
+	Generation      int64             `json:"generation,omitempty"`
+	ResourceVersion string            `json:"resourceVersion,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+}
+
+// kubeCondition mirrors metav1.Condition.
+type kubeCondition struct {
+	Type               string `json:"type"`
+	Status             string `json:"status"`
+	ObservedGeneration int64  `json:"observedGeneration,omitempty"`
+	LastTransitionTime string `json:"lastTransitionTime"`
+	Reason             string `json:"reason"`
+	Message            string `json:"message"`
+}
+
+// setCondition returns conds with c added or replaced. LastTransitionTime is
+// only moved when the condition's status actually changes.
+func setCondition(conds []kubeCondition, c kubeCondition) []kubeCondition {
+	for i, existing := range conds {
+		if existing.Type != c.Type {
+			continue
+		}
+		if existing.Status == c.Status && existing.LastTransitionTime != "" {
+			c.LastTransitionTime = existing.LastTransitionTime
+		}
+		conds[i] = c
+		return conds
+	}
+	return append(conds, c)
+}
+
+// splitNamespacedName splits "namespace/name". A bare name is taken to be in
+// namespace def.
+func splitNamespacedName(ref, def string) (ns, name string, err error) {
+	ns, name, ok := strings.Cut(ref, "/")
+	if !ok {
+		ns, name = def, ref
+	}
+	if ns == "" || name == "" || strings.Contains(name, "/") {
+		return "", "", fmt.Errorf("%q: expected namespace/name", ref)
+	}
+	return ns, name, nil
+}
+
+// isNotFound reports whether err is a 404 from the API server.
+func isNotFound(err error) bool {
+	var se *kubeStatusError
+	return errors.As(err, &se) && se.Code == 404
+}
+
+// isConflict reports whether err is a 409 from the API server, as returned
+// for an update with a stale resourceVersion.
+func isConflict(err error) bool {
+	var se *kubeStatusError
+	return errors.As(err, &se) && se.Code == 409
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/cheolhuikim/egress-probe/pkg/probe"
+)
+
+const (
+	leaseAPI             = "/apis/coordination.k8s.io/v1"
+	defaultLeaseDuration = 15 * time.Second
+	shardGroupLabel      = "egress-probe.io/shard-group"
+)
+
+// lease mirrors the parts of a coordination.k8s.io/v1 Lease the probe uses.
+type lease struct {
+	Metadata objectMeta `json:"metadata"`
+	Spec     leaseSpec  `json:"spec"`
+}
+
+type leaseSpec struct {
+	HolderIdentity       string `json:"holderIdentity"`
+	LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+	AcquireTime          string `json:"acquireTime,omitempty"`
+	RenewTime            string `json:"renewTime,omitempty"`
+	LeaseTransitions     int    `json:"leaseTransitions"`
+}
+
+// expired reports whether the holder has let l lapse by now.
+func (l *lease) expired(now time.Time) bool {
+	if l.Spec.HolderIdentity == "" {
+		return true
+	}
+	renewed, err := time.Parse(time.RFC3339Nano, l.Spec.RenewTime)
+	if err != nil {
+		return true
+	}
+	return now.After(renewed.Add(time.Duration(l.Spec.LeaseDurationSeconds) * time.Second))
+}
+
+// microTime formats t the way the API server expects a MicroTime.
+func microTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000000Z07:00")
+}
+
+// elector takes part in LEADER_ELECTION. By default the replicas compete for
+// a single Lease and only its holder probes. With SHARD_TARGETS each replica
+// instead renews a Lease of its own, labelled with the group, and probes the
+// share of the targets its rank among the live members assigns it.
+type elector struct {
+	client    *kubeClient
+	namespace string
+	name      string // the Lease, or with sharding the group
+	identity  string
+	duration  time.Duration
+	shard     bool
+
+	mu      sync.Mutex
+	until   time.Time // leadership (or membership) holds until then
+	holder  string    // the current leader, as last seen
+	members []string  // sharding: live members, sorted
+}
+
+// newElector prepares to take part in the election named by cfg.LeaderElection.
+// The identity is the Pod name, falling back to the hostname.
+func newElector(cfg Config) (*elector, error) {
+	client, err := newInClusterClient()
+	if err != nil {
+		return nil, fmt.Errorf("LEADER_ELECTION: %w", err)
+	}
+	ns, name, err := splitNamespacedName(cfg.LeaderElection, client.namespace)
+	if err != nil {
+		return nil, fmt.Errorf("invalid LEADER_ELECTION: %w", err)
+	}
+	identity := os.Getenv("POD_NAME")
+	if identity == "" {
+		identity, _ = os.Hostname()
+	}
+	return &elector{
+		client:    client,
+		namespace: ns,
+		name:      name,
+		identity:  identity,
+		duration:  cfg.LeaseDuration,
+		shard:     cfg.ShardTargets,
+	}, nil
+}
+
+// run renews the Lease every third of its duration until ctx is cancelled,
+// then gives it up so that another replica takes over without waiting for
+// it to expire. The caller makes the first attempt with renew, so that the
+// first cycle already knows whether to probe.
+func (e *elector) run(ctx context.Context) {
+	for sleepCtx(ctx, e.duration/3) {
+		e.renew(ctx)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	e.release(ctx)
+}
+
+func (e *elector) renew(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, e.duration/3)
+	defer cancel()
+	var err error
+	if e.shard {
+		err = e.renewMember(ctx)
+	} else {
+		err = e.renewLeader(ctx)
+	}
+	if err != nil {
+		logf("leader election: %v", err)
+	}
+}
+
+// renewLeader acquires the Lease if it is free or has expired, or renews it
+// if this replica holds it. Concurrent writers are serialized by the Lease's
+// resourceVersion: the loser gets a conflict and stays a follower.
+func (e *elector) renewLeader(ctx context.Context) error {
+	now := time.Now()
+	path := leaseAPI + "/namespaces/" + e.namespace + "/leases/" + e.name
+	var l lease
+	err := e.client.get(ctx, path, &l)
+	switch {
+	case isNotFound(err):
+		l = lease{Metadata: objectMeta{Name: e.name, Namespace: e.namespace}}
+	case err != nil:
+		return fmt.Errorf("reading lease %s/%s: %w", e.namespace, e.name, err)
+	}
+
+	if l.Spec.HolderIdentity != e.identity && !l.expired(now) {
+		e.follow(l.Spec.HolderIdentity)
+		return nil
+	}
+	if l.Spec.HolderIdentity != e.identity {
+		l.Spec.AcquireTime = microTime(now)
+		if l.Spec.HolderIdentity != "" || l.Metadata.ResourceVersion != "" {
+			l.Spec.LeaseTransitions++
+		}
+	}
+	l.Spec.HolderIdentity = e.identity
+	l.Spec.LeaseDurationSeconds = int(e.duration / time.Second)
+	l.Spec.RenewTime = microTime(now)
+
+	if l.Metadata.ResourceVersion == "" {
+		err = e.client.do(ctx, http.MethodPost, leaseAPI+"/namespaces/"+e.namespace+"/leases", "application/json", l, nil)
+	} else {
+		err = e.client.do(ctx, http.MethodPut, path, "application/json", l, nil)
+	}
+	if isConflict(err) {
+		return nil // another replica got there first; it shows up as holder next time
+	}
+	if err != nil {
+		return fmt.Errorf("writing lease %s/%s: %w", e.namespace, e.name, err)
+	}
+	e.lead(now)
+	return nil
+}
+
+// renewMember renews this replica's own Lease in the shard group and
+// refreshes the list of live members.
+func (e *elector) renewMember(ctx context.Context) error {
+	now := time.Now()
+	name := e.name + "-" + e.identity
+	path := leaseAPI + "/namespaces/" + e.namespace + "/leases/" + name
+	l := lease{
+		Metadata: objectMeta{Name: name, Namespace: e.namespace, Labels: map[string]string{shardGroupLabel: e.name}},
+		Spec: leaseSpec{
+			HolderIdentity:       e.identity,
+			LeaseDurationSeconds: int(e.duration / time.Second),
+			RenewTime:            microTime(now),
+		},
+	}
+	err := e.client.mergePatch(ctx, path, map[string]any{"spec": l.Spec}, nil)
+	if isNotFound(err) {
+		l.Spec.AcquireTime = l.Spec.RenewTime
+		err = e.client.do(ctx, http.MethodPost, leaseAPI+"/namespaces/"+e.namespace+"/leases", "application/json", l, nil)
+	}
+	if err != nil {
+		return fmt.Errorf("writing lease %s/%s: %w", e.namespace, name, err)
+	}
+
+	var list struct {
+		Items []lease `json:"items"`
+	}
+	selector := url.QueryEscape(shardGroupLabel + "=" + e.name)
+	if err := e.client.get(ctx, leaseAPI+"/namespaces/"+e.namespace+"/leases?labelSelector="+selector, &list); err != nil {
+		return fmt.Errorf("listing leases of group %s: %w", e.name, err)
+	}
+	var members []string
+	for _, m := range list.Items {
+		if !m.expired(now) || m.Spec.HolderIdentity == e.identity {
+			members = append(members, m.Spec.HolderIdentity)
+		}
+	}
+	slices.Sort(members)
+	members = slices.Compact(members)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !slices.Equal(members, e.members) {
+		logf("shard group %s: %d live members", e.name, len(members))
+	}
+	e.members = members
+	e.until = now.Add(e.duration)
+	return nil
+}
+
+// release gives up the Lease: the leader clears the holder, a shard member
+// deletes its own Lease.
+func (e *elector) release(ctx context.Context) {
+	if e.shard {
+		path := leaseAPI + "/namespaces/" + e.namespace + "/leases/" + e.name + "-" + e.identity
+		if err := e.client.do(ctx, http.MethodDelete, path, "", nil, nil); err != nil && !isNotFound(err) {
+			logf("leader election: leaving group %s: %v", e.name, err)
+		}
+		return
+	}
+	if !e.leading() {
+		return
+	}
+	path := leaseAPI + "/namespaces/" + e.namespace + "/leases/" + e.name
+	var l lease
+	if err := e.client.get(ctx, path, &l); err != nil || l.Spec.HolderIdentity != e.identity {
+		return
+	}
+	l.Spec.HolderIdentity = ""
+	if err := e.client.do(ctx, http.MethodPut, path, "application/json", l, nil); err != nil {
+		logf("leader election: releasing lease %s/%s: %v", e.namespace, e.name, err)
+		return
+	}
+	logf("released lease %s/%s", e.namespace, e.name)
+}
+
+func (e *elector) lead(now time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.holder != e.identity || !now.Before(e.until) {
+		logf("became leader (lease %s/%s)", e.namespace, e.name)
+	}
+	e.holder = e.identity
+	e.until = now.Add(e.duration)
+}
+
+func (e *elector) follow(holder string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.holder != holder {
+		logf("lease %s/%s held by %s; standing by", e.namespace, e.name, holder)
+	}
+	e.holder = holder
+	e.until = time.Time{}
+}
+
+// leading reports whether this replica holds the Lease. Leadership is given
+// up locally as soon as the Lease could have expired, even if the API server
+// can't be reached to say so.
+func (e *elector) leading() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.holder == e.identity && time.Now().Before(e.until)
+}
+
+// assigned returns the targets this replica should probe this cycle, and
+// false if it should sit the cycle out.
+func (e *elector) assigned(targets []probe.Target) ([]probe.Target, bool) {
+	if !e.shard {
+		return targets, e.leading()
+	}
+	e.mu.Lock()
+	members, until := e.members, e.until
+	e.mu.Unlock()
+	rank := slices.Index(members, e.identity)
+	if rank < 0 || !time.Now().Before(until) {
+		return nil, false
+	}
+	share := shardTargets(targets, rank, len(members))
+	logf("shard %d of %d: probing %d of %d targets", rank+1, len(members), len(share), len(targets))
+	return share, true
+}
+
+// shardTargets returns the targets that fall to shard i of n. Targets are
+// assigned by a hash of their key, so a target stays with the same shard as
+// long as the group doesn't change size.
+func shardTargets(targets []probe.Target, i, n int) []probe.Target {
+	var share []probe.Target
+	for _, t := range targets {
+		h := fnv.New32a()
+		h.Write([]byte(targetKey(t)))
+		if int(h.Sum32()%uint32(n)) == i {
+			share = append(share, t)
+		}
+	}
+	return share
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cheolhuikim/egress-probe/pkg/probe"
+)
+
+const (
+	liveRefresh = 100 * time.Millisecond
+	// liveMaxRows bounds the height of the live table. Longer target lists
+	// only show the targets in flight; the final table still lists them all.
+	liveMaxRows = 40
+)
+
+var spinnerFrames = []rune("⠋⠙⠹⠸⠼⠴⠦⠧⠇⠏")
+
+// liveColumn is a phase column of the live table, keyed by the phase name
+// that probe.Options.OnPhase reports.
+type liveColumn struct {
+	tableColumn
+	phase string
+}
+
+type liveState int
+
+const (
+	liveQueued liveState = iota
+	liveRunning
+	liveDone
+)
+
+type liveRow struct {
+	state      liveState
+	phase      string    // phase in progress while running
+	phaseStart time.Time // when phase started
+	result     probe.Result
+}
+
+// liveView redraws the results table in place while a run is in progress
+// (OUTPUT=live): finished phases show their outcome, the phase in progress a
+// spinner and a timer, and phases still to come a dot.
+type liveView struct {
+	mu      sync.Mutex
+	targets []probe.Target
+	columns []liveColumn
+	rows    []liveRow
+	start   time.Time
+	frame   int
+	drawn   int // lines drawn by the previous frame
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newLiveView(targets []probe.Target, opts probe.Options) *liveView {
+	columns := []liveColumn{
+		{tableColumn{"DNS", func(r probe.Result) probe.PhaseResult { return r.DNS }}, "DNS"},
+		{tableColumn{"TCP", func(r probe.Result) probe.PhaseResult { return r.TCP }}, "TCP"},
+		{tableColumn{"TLS/SNI", func(r probe.Result) probe.PhaseResult { return r.TLS }}, "TLS"},
+	}
+	if opts.HTTP || slices.ContainsFunc(targets, func(t probe.Target) bool { return probe.RunsHTTP(t, opts) }) {
+		columns = append(columns, liveColumn{tableColumn{"HTTP", func(r probe.Result) probe.PhaseResult { return r.HTTP }}, "HTTP"})
+	}
+	for _, t := range targets {
+		if t.Exec != "" {
+			columns = append(columns, liveColumn{tableColumn{"EXEC", func(r probe.Result) probe.PhaseResult { return r.Exec }}, "EXEC"})
+			break
+		}
+	}
+	return &liveView{
+		targets: targets,
+		columns: columns,
+		rows:    make([]liveRow, len(targets)),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// attach hooks the view up to the progress callbacks of opts.
+func (v *liveView) attach(opts *probe.Options) {
+	opts.OnPhase = v.onPhase
+	opts.OnResult = v.onResult
+}
+
+func (v *liveView) onPhase(i int, phase string, partial probe.Result) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.rows[i] = liveRow{state: liveRunning, phase: phase, phaseStart: time.Now(), result: partial}
+}
+
+func (v *liveView) onResult(i int, r probe.Result) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.rows[i] = liveRow{state: liveDone, result: r}
+}
+
+// run starts redrawing until finish is called.
+func (v *liveView) run() {
+	v.start = time.Now()
+	fmt.Print("\033[?25l") // hide the cursor while redrawing
+	go func() {
+		defer close(v.done)
+		ticker := time.NewTicker(liveRefresh)
+		defer ticker.Stop()
+		for {
+			v.draw()
+			select {
+			case <-v.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// finish stops redrawing and erases the live table, leaving the terminal
+// ready for the final report.
+func (v *liveView) finish() {
+	close(v.stop)
+	<-v.done
+	if v.drawn > 0 {
+		fmt.Printf("\033[%dA\r\033[J", v.drawn)
+	}
+	fmt.Print("\033[?25h")
+}
+
+func (v *liveView) draw() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.frame++
+
+	maxHostLen := 4
+	for _, t := range v.targets {
+		maxHostLen = max(maxHostLen, displayWidth(t.Host))
+	}
+	maxHostLen = min(maxHostLen, 40)
+	hostCol, portCol, phaseCol, resultCol := maxHostLen+2, 6, 16, 8
+
+	var b strings.Builder
+	if v.drawn > 0 {
+		fmt.Fprintf(&b, "\033[%dA\r", v.drawn)
+	}
+	lines := 0
+	line := func(format string, args ...any) {
+		b.WriteString("\033[2K")
+		fmt.Fprintf(&b, format, args...)
+		b.WriteByte('\n')
+		lines++
+	}
+
+	header := fmt.Sprintf(" %-*s %-*s", hostCol, "FQDN", portCol, "PORT")
+	for _, c := range v.columns {
+		header += fmt.Sprintf(" %-*s", phaseCol, c.title)
+	}
+	line("%s%s %-*s%s", colorBold, header, resultCol, "RESULT", colorReset)
+
+	var finished, failed, hidden int
+	shown := 0
+	for i, row := range v.rows {
+		if row.state == liveDone {
+			finished++
+			if !row.result.Passed && !row.result.Incomplete {
+				failed++
+			}
+		}
+		if len(v.rows) > liveMaxRows && (row.state != liveRunning || shown == liveMaxRows) {
+			hidden++
+			continue
+		}
+		shown++
+
+		host := truncateWidth(v.targets[i].Host, maxHostLen)
+		cells := fmt.Sprintf(" %s %-*s", padRight(host, hostCol), portCol, fmt.Sprint(v.targets[i].Port))
+		current := len(v.columns) // columns before current have finished
+		if row.state != liveDone {
+			current = 0
+		}
+		for j, c := range v.columns {
+			if row.state == liveRunning && c.phase == row.phase {
+				current = j
+			}
+		}
+		for j, c := range v.columns {
+			var cell string
+			switch {
+			case j < current:
+				cell = liveCell(c.get(row.result), phaseCol)
+			case j == current && row.state == liveRunning:
+				cell = fmt.Sprintf(" %s%c %.1fs%s", colorCyan, v.spinner(), time.Since(row.phaseStart).Seconds(), colorReset)
+			default:
+				cell = fmt.Sprintf(" %s·%s", colorDim, colorReset)
+			}
+			cells += padRight(cell, phaseCol+1)
+		}
+		line("%s %s", cells, liveVerdict(row))
+	}
+	if hidden > 0 {
+		line("  %s… %d more targets not shown%s", colorDim, hidden, colorReset)
+	}
+
+	footer := fmt.Sprintf("  %s%c%s %d/%d done", colorCyan, v.spinner(), colorReset, finished, len(v.rows))
+	if failed > 0 {
+		footer += fmt.Sprintf(" · %s%d failed%s", colorRed, failed, colorReset)
+	}
+	footer += fmt.Sprintf(" · %s", time.Since(v.start).Round(100*time.Millisecond))
+	line("")
+	line("%s", footer)
+
+	// A frame shorter than the previous one leaves stale lines behind.
+	for lines < v.drawn {
+		line("")
+	}
+	v.drawn = lines
+	fmt.Print(b.String())
+}
+
+func (v *liveView) spinner() rune {
+	return spinnerFrames[v.frame%len(spinnerFrames)]
+}
+
+// liveCell renders a finished phase like the final table does, but cuts
+// failure details to the column width so that rows never wrap — a wrapped
+// row would throw off the redraw.
+func liveCell(p probe.PhaseResult, width int) string {
+	if !p.Success && !p.Aborted && p.Detail != "" && !strings.HasPrefix(p.Detail, "skipped") {
+		detail := truncateWidth(p.Detail, width-2-displayWidth(failGlyph))
+		return fmt.Sprintf(" %s%s %s%s", colorRed, failGlyph, detail, colorReset)
+	}
+	return formatPhaseCell(p)
+}
+
+func liveVerdict(row liveRow) string {
+	switch {
+	case row.state == liveQueued:
+		return colorDim + "queued" + colorReset
+	case row.state == liveRunning:
+		return colorDim + "…" + colorReset
+	case row.result.Incomplete:
+		return colorBold + colorYellow + "SKIP" + colorReset
+	case row.result.Passed:
+		return colorBold + colorGreen + "OK" + colorReset
+	default:
+		return colorBold + colorRed + "FAIL" + colorReset
+	}
+}
+
+// isTerminal reports whether f is attached to a terminal, where the live
+// view can redraw in place.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
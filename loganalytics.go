@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultLogAnalyticsStream = "Custom-EgressProbe_CL"
+
+// logAnalyticsRecord is one row of the EgressProbe_CL table: a target's
+// outcome in one run.
+type logAnalyticsRecord struct {
+	TimeGenerated time.Time         `json:"TimeGenerated"`
+	Node          string            `json:"Node"`
+	Target        string            `json:"Target"` // e.g. "allow github.com:443"
+	Host          string            `json:"Host"`
+	Port          int               `json:"Port"`
+	Type          string            `json:"Type"` // "allow" or "deny"
+	Passed        bool              `json:"Passed"`
+	Blocked       bool              `json:"Blocked"`
+	Detail        string            `json:"Detail,omitempty"` // why it failed
+	DNSMs         *int64            `json:"DnsMs,omitempty"`
+	TCPMs         *int64            `json:"TcpMs,omitempty"`
+	TLSMs         *int64            `json:"TlsMs,omitempty"`
+	HTTPMs        *int64            `json:"HttpMs,omitempty"`
+	HealthScore   *int              `json:"HealthScore,omitempty"`
+	Owner         string            `json:"Owner,omitempty"`
+	Metadata      map[string]string `json:"Metadata,omitempty"`
+}
+
+// sendLogAnalytics posts a run to a Log Analytics workspace through the
+// Logs Ingestion API: one record per complete target to the stream
+// LOG_ANALYTICS_STREAM of the data collection rule LOG_ANALYTICS_DCR, at
+// the data collection endpoint LOG_ANALYTICS_ENDPOINT. The token is the
+// Pod's Azure Workload Identity or the node's managed identity, which needs
+// the Monitoring Metrics Publisher role on the rule. Failures are logged:
+// sending never fails a run.
+func sendLogAnalytics(ctx context.Context, cfg Config, out jsonOutput, end time.Time) {
+	if cfg.LogAnalyticsEndpoint == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	var records []logAnalyticsRecord
+	for _, r := range out.Results {
+		if r.Incomplete {
+			continue
+		}
+		rec := logAnalyticsRecord{
+			TimeGenerated: end.UTC(),
+			Node:          cfg.NodeName,
+			Target:        r.Type + " " + net.JoinHostPort(r.Host, strconv.Itoa(r.Port)),
+			Host:          r.Host,
+			Port:          r.Port,
+			Type:          r.Type,
+			Passed:        r.Passed,
+			Blocked:       r.Blocked,
+			Owner:         r.Metadata["owner"],
+			Metadata:      r.Metadata,
+		}
+		if !r.Passed {
+			rec.Detail = failureDetail(r)
+		}
+		for _, ph := range []struct {
+			p  *jsonPhase
+			ms **int64
+		}{{&r.DNS, &rec.DNSMs}, {&r.TCP, &rec.TCPMs}, {&r.TLS, &rec.TLSMs}, {r.HTTP, &rec.HTTPMs}} {
+			if ph.p != nil && ph.p.Start != nil {
+				ms := ph.p.DurationMs
+				*ph.ms = &ms
+			}
+		}
+		if r.Health != nil {
+			rec.HealthScore = &r.Health.Score
+		}
+		records = append(records, rec)
+	}
+	if len(records) == 0 {
+		return
+	}
+
+	if err := postLogAnalytics(ctx, cfg, records); err != nil {
+		logf("LOG_ANALYTICS_ENDPOINT: %v", err)
+	}
+}
+
+func postLogAnalytics(ctx context.Context, cfg Config, records []logAnalyticsRecord) error {
+	token, err := azureBearer(ctx, azureMonitorResource)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	u := strings.TrimRight(cfg.LogAnalyticsEndpoint, "/") + "/dataCollectionRules/" + url.PathEscape(cfg.LogAnalyticsDCR) +
+		"/streams/" + url.PathEscape(cfg.LogAnalyticsStream) + "?api-version=2023-01-01"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("logs ingestion returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
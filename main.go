@@ -3,655 +3,1290 @@ package main
 import (
 	"context"
 	"crypto/tls"
-	"encoding/json"
+	"crypto/x509"
+	"flag"
 	"fmt"
+	"math/rand/v2"
 	"net"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
 	"strings"
-	"sync"
+	"syscall"
+	"text/template"
 	"time"
+
+	"github.com/cheolhuikim/egress-probe/pkg/probe"
 )
 
 const (
-	defaultPort    = 443
-	defaultTimeout = 5 * time.Second
+	defaultInterval       = 60 * time.Second
+	fastProfileTimeout    = 2 * time.Second
+	defaultDNSCacheMaxTTL = 5 * time.Minute
+	defaultRetryDelay     = time.Second
+	// defaultConcurrency bounds the targets in flight, and so the goroutines
+	// and sockets, when CONCURRENCY is not set. Runs of a few hundred targets
+	// are not limited by it.
+	defaultConcurrency = 256
 )
 
+// Exit codes. exitIncomplete is distinct so that callers (and Job status) can
+// tell "egress is broken" apart from "the run was cut short" by RUN_TIMEOUT
+// or a termination signal.
 const (
-	colorReset  = "\033[0m"
-	colorGreen  = "\033[32m"
-	colorRed    = "\033[31m"
-	colorYellow = "\033[33m"
-	colorCyan   = "\033[36m"
-	colorBold   = "\033[1m"
-	colorDim    = "\033[2m"
+	exitFailed     = 1
+	exitIncomplete = 3
 )
 
-type Target struct {
-	Host      string
-	Port      int
-	SkipTLS   bool // true = skip TLS phase (e.g. http:// or port 80)
-	ExpectErr bool // true = this target should be blocked (DENY)
-}
+// Config holds the settings read from the environment.
+type Config struct {
+	Mode          string // "" (one-shot), "daemon", "sidecar", "operator", "aggregator", "agent" or "soak"
+	Output        string // "" (table), "json", "ndjson", "live", "gha", "azdo" or "template"
+	Profile       string // "" (standard), "fast" or "deep"
+	Interval      time.Duration
+	Schedule      *cronSchedule // daemon mode: run on cron slots instead of Interval
+	Targets       []probe.Target
+	Canaries      map[string]bool // host:port of the Targets that came from CANARY
+	RootCAs       *x509.CertPool  // replaces the system roots when set (PRESET=cluster-core, CA_FILE, CA_DIR)
+	FIPSTLS       bool            // restrict TLS to FIPS-approved parameters
+	IPv6          bool            // resolve AAAA records: IPv6-only Pod, or IP_FAMILY=ipv6
+	DualStack     bool            // IP_FAMILY=dual: probe named targets over IPv4 and IPv6 apart
+	Proxy         string          // "" (direct), "env" or an http:// proxy URL to probe through
+	DNSQueries    int             // DNS_CONSISTENCY: queries per nameserver and target; 0 = off
+	DNSTrace      bool            // DNS_TRACE: record each lookup query by query, like dig
+	DataCheck     bool            // DATA_CHECK: after TLS, a request must get an answer
+	Retries       int             // RETRIES: reruns of a failing phase of an allow target
+	RetryDelay    time.Duration   // RETRY_DELAY: pause before each rerun
+	Timeout       time.Duration
+	LatencySLO    time.Duration // a passing target slower than this loses health points
+	RunTimeout    time.Duration // overall deadline for the whole run (0 = none)
+	TargetTimeout time.Duration // deadline for each target, all its phases and retries (0 = none)
+	StartJitter   time.Duration // random delay (0..StartJitter) before the first probe
+	Stagger       time.Duration // fixed delay between successive target probe starts
+	Concurrency   int           // max targets probed at once (0 = unlimited)
+	Shuffle       bool          // probe targets in a random order each run
+	ShuffleSeed   uint64        // fixed seed for Shuffle (0 = new seed every run)
+
+	ExitMode string // "always-zero": exit 0 whatever the verdict
+
+	OnFailureCmd     string // command run once per failing target
+	OnFailureTimeout time.Duration
+
+	AggregatorURL   string // push each report here, tagged with NodeName
+	AggregatorToken string // bearer token the aggregator requires of reports
+
+	GrafanaURL       string         // annotate runs on this Grafana ("" = don't)
+	GrafanaToken     string         // service account token for GrafanaURL
+	GrafanaDashboard string         // dashboard UID to annotate ("" = organization-wide)
+	GrafanaTags      []string       // extra annotation tags
+	GrafanaWindow    *grafanaWindow // daemon mode: the failure window, shared across cycles
+
+	ResultsBucket *bucketRef // upload each report to this bucket (RESULTS_BUCKET)
+
+	PagerDutyKey string      // PagerDuty Events API v2 routing key ("" = don't page)
+	OpsgenieKey  string      // Opsgenie API key ("" = don't alert)
+	OpsgenieURL  string      // Opsgenie API, e.g. https://api.eu.opsgenie.com
+	Alerts       *alertState // daemon mode: the open incidents, shared across cycles
+
+	StatsDAddr   string   // send metrics to this StatsD / DogStatsD agent ("" = don't)
+	StatsDFlavor string   // "dogstatsd" (tags) or "statsd" (names only)
+	StatsDPrefix string   // metric name prefix
+	StatsDTags   []string // extra DogStatsD tags, e.g. "env:prod"
+
+	CloudEventsSink string        // send each run as CloudEvents to this URL ("" = don't)
+	TargetStates    *targetStates // daemon mode: whether each target passed last cycle
+
+	OutputTemplate *template.Template // OUTPUT=template: prints the report
+
+	TextfileDir  string // write each run as Prometheus metrics into this directory ("" = don't)
+	TextfileName string // the file name in TextfileDir
+
+	LogAnalyticsEndpoint string // send each run to this data collection endpoint ("" = don't)
+	LogAnalyticsDCR      string // immutable ID of the data collection rule
+	LogAnalyticsStream   string // stream of the rule the records go to
+
+	CloudWatchMetrics   bool   // publish per-target metrics to CloudWatch
+	CloudWatchNamespace string // namespace of those metrics
+	CloudWatchLogGroup  string // write each run into this CloudWatch Logs group ("" = don't)
+
+	PublishConfigMap   string // write each report into this ConfigMap ("namespace/name")
+	PublishEgressProbe string // write each report into this EgressProbe's status
+	TargetsEgressProbe string // the EgressProbe the targets came from, if any
+	NodeName           string
+	ListenAddr         string // aggregator, agent and sidecar modes: HTTP listen address
+	ReadinessGate      string // sidecar mode: Pod condition to set once egress checks pass
+	NetNS              string // probe from this network namespace (NETNS) instead of our own
+
+	Agents     []agentRef // coordinator: run Targets on these agents instead of locally
+	AgentToken string     // shared bearer token between coordinator and agents
+
+	MatrixNamespaces []matrixNamespace // run Targets from a short-lived Pod in each of these namespaces instead of locally
+	MatrixImage      string            // image of those Pods ("" = our own)
+	MatrixLabels     map[string]string // labels of those Pods, for NetworkPolicies to select them by
+
+	Repeat int // probe every target this many times and report success rates
+
+	SoakDuration time.Duration // soak mode: how long to hold connections
+	SoakInterval time.Duration // soak mode: time between requests on a connection
+
+	NetpolCheck bool // compare results with the Pod's NetworkPolicies
+	CiliumCheck bool // compare results with the Pod's Cilium policies
+
+	MeshCompare   bool // with a sidecar: probe again bypassing the mesh
+	MeshBypassUID int  // UID the mesh exempts from outbound capture
+
+	ConntrackCheck bool     // on failed or ~5s DNS lookups, gather conntrack evidence
+	DropTrace      bool     // on failed connections, report packets dropped in the node's stack
+	PcapDir        string   // retry failing targets under packet capture, writing pcaps here
+	Preflight      bool     // check the Pod's route, interface and gateway before probing
+	ASNLookup      string   // annotate resolved addresses with their owner: "rdap" or an ASN table
+	GeoIPDB        string   // locate resolved addresses with this MMDB file
+	GeoIPCountries []string // fail allow targets located outside these ISO country codes
+
+	EgressEchoURL  string       // discover the public source address here ("" = don't)
+	ExpectEgressIP []*net.IPNet // the source address must lie in one of these
+
+	DNSFresh       bool            // daemon mode: resolve every target on every cycle
+	DNSCacheMaxTTL time.Duration   // daemon mode: cap on how long DNS answers are reused
+	DNSCache       *probe.DNSCache // shared across daemon cycles; nil = no caching
+
+	CertExpiryWarn int  // CERT_EXPIRY_WARN: flag server certificates expiring within this many days; 0 = off
+	CertExpiryFail bool // CERT_EXPIRY_ACTION=fail: such targets fail rather than only being flagged
 
-type PhaseResult struct {
-	Success  bool
-	Duration time.Duration
-	Detail   string
-}
+	CertWatch   bool         // daemon mode: report unexpected server certificate changes
+	CertHistory *certHistory // the certificates seen so far, shared across cycles
+
+	LeaderElection string        // daemon mode: Lease ("namespace/name") that elects the replica which probes
+	LeaseDuration  time.Duration // how long a Lease holds without renewal
+	ShardTargets   bool          // with LeaderElection: split the targets among all replicas instead
+
+	FailFast string // "critical" or "any": stop the run at the first such target that fails ("" = never)
 
-type TestResult struct {
-	Target  Target
-	DNS     PhaseResult
-	TCP     PhaseResult
-	TLS     PhaseResult
-	Passed  bool // true = outcome matches expectation
-	Blocked bool // true = connectivity failed at some phase
+	LogLevel   string // "info" or "debug"
+	TuningFile string // daemon mode: overrides of TIMEOUT, CONCURRENCY, INTERVAL and LOG_LEVEL, re-read on SIGHUP
+	AdminAddr  string // daemon mode: listen address of the tuning endpoint ("" = none)
+	AdminToken string // bearer token the tuning endpoint requires, if set
+
+	MetricsAddr string         // daemon mode: serve Prometheus metrics on this address ("" = don't)
+	Metrics     *metricsServer // daemon mode: the metrics served, shared across cycles
+
+	ClientCert *tls.Certificate // CLIENT_CERT, CLIENT_KEY: presented to servers that ask for one
+
+	// Baseline holds the results of a previous run (--retry-failed). Targets
+	// then lists only its failures, and the new results are merged back in.
+	Baseline []probe.Result
 }
 
 func main() {
-	targets, timeout := parseConfig()
+	retryFailed := flag.String("retry-failed", "", "re-probe only the targets that failed in `results.json` (written with OUTPUT=json) and merge the outcome back into it")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags]          probe the targets configured in the environment\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s check <target>  check a single target step by step\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s serve-mock      serve mock targets that fail in every known way\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s reflect         serve callers their source address, TLS session and headers, for EGRESS_ECHO_URL\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s merge <file>... compare OUTPUT=json reports from several clusters\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s compare <file>.. report only where OUTPUT=json reports diverge, in outcome or latency\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s gate <change>.. check a proposed policy change before it is deployed\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s kubectl <pod>   probe from inside a running pod (as kubectl plugin: kubectl egress-probe <pod>)\n\nFlags:\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	// Installed as kubectl-egress_probe, the binary is a kubectl plugin.
+	if strings.HasPrefix(filepath.Base(os.Args[0]), "kubectl-") {
+		os.Args = append([]string{os.Args[0], "kubectl"}, os.Args[1:]...)
+	}
+	showVersion := flag.Bool("version", false, "print version and build information and exit")
+	selfTest := flag.Bool("self-test", false, "check the probe's own machinery on loopback and against well-known internet endpoints, then exit")
+	flag.Parse()
+	enableConsoleColors()
+	if err := setTableStyle(os.Getenv("TABLE_STYLE")); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(exitFailed)
+	}
+	if err := setStatusGlyphs(os.Getenv("STATUS_GLYPHS")); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(exitFailed)
+	}
+	if *showVersion {
+		fmt.Printf("egress-probe %s\n", currentBuild())
+		return
+	}
+
+	// The root context is cancelled on SIGINT/SIGTERM so that an interrupted
+	// run still prints a complete report. A second signal kills the process.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	switch flag.Arg(0) {
+	case "":
+	case "check":
+		os.Exit(runCheck(ctx, flag.Args()[1:]))
+	case "serve-mock":
+		os.Exit(runMock(ctx, flag.Args()[1:]))
+	case "kubectl":
+		os.Exit(runPlugin(ctx, flag.Args()[1:]))
+	case "reflect":
+		os.Exit(runReflect(ctx, flag.Args()[1:]))
+	case "merge":
+		os.Exit(runMerge(flag.Args()[1:]))
+	case "compare":
+		os.Exit(runCompare(flag.Args()[1:]))
+	case "gate":
+		os.Exit(runGate(ctx, flag.Args()[1:]))
+	case "mesh-bypass": // internal: the second half of MESH_COMPARE
+		os.Exit(runMeshBypass(ctx))
+	default:
+		fmt.Fprintf(os.Stderr, "Error: unknown command %q\n", flag.Arg(0))
+		flag.Usage()
+		os.Exit(exitFailed)
+	}
+
+	cfg, err := parseConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(exitFailed)
+	}
+	if cfg.NetNS != "" {
+		if code, entered := enterNetNS(ctx, cfg); !entered {
+			os.Exit(code)
+		}
+	}
+	if *selfTest {
+		os.Exit(runSelfTest(ctx, cfg))
+	}
+	debugLogging.Store(cfg.LogLevel == "debug")
+
+	switch cfg.Mode {
+	case "daemon":
+		runDaemon(ctx, cfg)
+		return
+	case "operator":
+		runOperator(ctx, cfg)
+		return
+	case "aggregator":
+		runAggregator(ctx, cfg)
+		return
+	case "agent":
+		runAgent(ctx, cfg)
+		return
+	case "sidecar":
+		runSidecar(ctx, cfg)
+		return
+	}
+
+	if *retryFailed != "" {
+		baseline, err := loadBaseline(*retryFailed, cfg.Targets)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(exitFailed)
+		}
+		cfg.Baseline = baseline
+		cfg.Targets = retryTargets(baseline)
+	}
 
-	if len(targets) == 0 {
+	if len(cfg.Targets) == 0 && cfg.Baseline == nil {
 		fmt.Fprintf(os.Stderr, "Error: no targets specified.\n")
 		fmt.Fprintf(os.Stderr, "Set ALLOW_TARGETS and/or DENY_TARGETS environment variables.\n")
 		fmt.Fprintf(os.Stderr, "Example: ALLOW_TARGETS=\"mcr.microsoft.com:443\" DENY_TARGETS=\"google.com\" %s\n", os.Args[0])
-		os.Exit(1)
+		os.Exit(exitFailed)
 	}
 
-	jsonMode := os.Getenv("OUTPUT") == "json"
+	if len(cfg.Agents) > 0 {
+		os.Exit(verdictExit(cfg, runCoordinator(ctx, cfg)))
+	}
+	if len(cfg.MatrixNamespaces) > 0 {
+		os.Exit(verdictExit(cfg, runNamespaceMatrix(ctx, cfg)))
+	}
+	if cfg.Mode == "soak" {
+		os.Exit(verdictExit(cfg, runSoak(ctx, cfg)))
+	}
+	if cfg.Repeat > 1 {
+		os.Exit(verdictExit(cfg, runRepeat(ctx, cfg)))
+	}
+
+	results, egress := runOnce(ctx, cfg)
+	code := exitCode(results)
+	if code == exitIncomplete && stoppedFast(cfg, results) {
+		code = exitFailed // the failure is the answer, whatever was left unprobed
+	}
+	if code == 0 && egress != nil && !egress.OK {
+		code = exitFailed
+	}
+	os.Exit(verdictExit(cfg, code))
+}
+
+// runOnce performs a single probe run over cfg.Targets and prints the report.
+// The run stops early when ctx is cancelled or cfg.RunTimeout expires. The
+// egress IP check is returned separately, nil unless it is configured.
+func runOnce(ctx context.Context, cfg Config) ([]probe.Result, *egressIPCheck) {
+	targets, timeout := cfg.Targets, cfg.Timeout
+	// The template, like JSON, is all that is printed.
+	jsonMode := machineOutput(cfg) || cfg.OutputTemplate != nil
+	env := currentEnvironment(ctx)
 
 	if !jsonMode {
-		printHeader(targets, timeout)
+		printHeader(cfg, env)
+		if cfg.Baseline != nil {
+			fmt.Printf("  %sRetrying %d of %d targets that failed previously%s\n\n",
+				colorDim, len(targets), len(cfg.Baseline), colorReset)
+		}
 	}
 
-	warmupDur := warmupDNS(timeout)
+	targets = expandServiceTargets(ctx, targets)
+
+	start := time.Now()
+	runCtx := ctx
+	if cfg.RunTimeout > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, cfg.RunTimeout)
+		defer cancel()
+	}
+
+	if cfg.StartJitter > 0 {
+		jitter := time.Duration(rand.Int64N(int64(cfg.StartJitter)))
+		if !jsonMode {
+			fmt.Printf("  %sStart jitter: %s%s\n\n", colorDim, jitter.Round(time.Millisecond), colorReset)
+		}
+		sleepCtx(runCtx, jitter)
+	}
+
+	sidecar := env.Sidecar
+	switch {
+	case sidecar != "" && !cfg.MeshCompare:
+		logf("%s detected: outbound traffic goes through the mesh, where blocking shows up as a TLS failure after a successful connect; set MESH_COMPARE=true to tell it apart from the network", sidecar)
+	case sidecar != "":
+		logf("%s detected", sidecar)
+	case cfg.MeshCompare:
+		logf("MESH_COMPARE: no sidecar detected; nothing to compare")
+	}
+	for _, w := range proxyWarnings(cfg, env) {
+		logf("%s", w)
+	}
+
+	var pre *preflight
+	if cfg.Preflight {
+		pre = runPreflight(runCtx)
+		if !jsonMode {
+			printPreflight(pre)
+		}
+	}
+
+	// Counted before the warm-up, whose first packet is the likeliest to be
+	// dropped.
+	var ctBefore conntrackCounters
+	var ctErr error
+	if cfg.ConntrackCheck {
+		ctBefore, ctErr = readConntrackCounters()
+	}
+
+	warmupDur := probe.WarmupDNS(runCtx, timeout)
 	if !jsonMode && warmupDur > time.Second {
 		fmt.Printf("  %sDNS warm-up: %dms (first-packet penalty absorbed)%s\n\n",
 			colorDim, warmupDur.Milliseconds(), colorReset)
 	}
 
-	start := time.Now()
-	results := runTests(targets, timeout)
-	elapsed := time.Since(start)
+	// Started after the warm-up, whose first packet may be dropped anyway.
+	var tracer *dropTracer
+	var traceErr error
+	if cfg.DropTrace {
+		tracer, traceErr = startDropTrace()
+	}
 
-	for i := range results {
-		blocked := !results[i].DNS.Success || !results[i].TCP.Success ||
-			(!results[i].TLS.Success && !results[i].Target.SkipTLS)
-		results[i].Blocked = blocked
-		if results[i].Target.ExpectErr {
-			results[i].Passed = blocked // DENY target: pass if blocked
+	opts := probeOptions(cfg)
+	var live *liveView
+	switch cfg.Output {
+	case "ndjson":
+		opts.OnResult = func(_ int, r probe.Result) { printNDJSONResult(r) }
+	case "live":
+		if isTerminal(os.Stdout) {
+			live = newLiveView(targets, opts)
+			live.attach(&opts)
+			live.run()
 		} else {
-			results[i].Passed = !blocked // ALLOW target: pass if reachable
+			logf("OUTPUT=live needs a terminal; printing the table when the run completes")
 		}
 	}
+	results, _ := probe.Run(runCtx, targets, opts)
+	elapsed := time.Since(start)
+	var drops *dropTrace
+	if cfg.DropTrace {
+		drops = finishDropTrace(results, tracer, traceErr)
+	}
+	if live != nil {
+		live.finish()
+	}
+	if cfg.Baseline != nil {
+		results = mergeResults(cfg.Baseline, results)
+	}
 
-	if jsonMode {
-		printJSON(results, timeout, elapsed)
-	} else {
-		printResults(results, elapsed)
+	var locations [][]geoLocation
+	if cfg.GeoIPDB != "" {
+		locations = locateResults(cfg, results)
 	}
 
-	for _, r := range results {
-		if !r.Passed {
-			os.Exit(1)
+	var verdicts, ciliumVerdicts []policyVerdict
+	if cfg.NetpolCheck {
+		verdicts = checkNetworkPolicies(ctx, results)
+	}
+	if cfg.CiliumCheck {
+		ciliumVerdicts = checkCiliumPolicies(ctx, results)
+	}
+	var bypass []jsonResult
+	if sidecar != "" && cfg.MeshCompare {
+		var err error
+		if bypass, err = runBypass(runCtx, cfg, targets, cfg.MeshBypassUID); err != nil {
+			logf("mesh comparison skipped: %v", err)
 		}
 	}
-}
+	var conntrack *conntrackCheck
+	if cfg.ConntrackCheck {
+		conntrack = checkConntrack(results, ctBefore, ctErr)
+	}
+	var egress *egressIPCheck
+	if cfg.EgressEchoURL != "" {
+		c := checkEgressIP(runCtx, cfg.EgressEchoURL, cfg.ExpectEgressIP, timeout)
+		egress = &c
+	}
+	var captures []capture
+	if cfg.PcapDir != "" {
+		captures = captureFailures(ctx, cfg, results)
+	}
+	out := buildJSON(results, timeout, elapsed)
+	out.Environment = env
+	for i, l := range locations {
+		out.Results[i].Locations = l
+	}
+	out.Conntrack = conntrack
+	out.DropTrace = drops
+	out.Captures = captures
+	out.Preflight = pre
+	if egress != nil {
+		out.EgressIP = egress
+		out.Summary.OK = out.Summary.OK && egress.OK
+	}
+	markCanaries(out.Results, cfg.Canaries)
+	addPolicyVerdicts(out.Results, verdicts, ciliumVerdicts)
+	addMeshComparison(out.Results, sidecar, bypass)
+	if cfg.ASNLookup != "" {
+		addOwners(ctx, cfg.ASNLookup, out.Results)
+	}
+	scoreHealth(out.Results, cfg.LatencySLO)
+	out.Diagnoses = diagnose(out)
+	if cfg.CertHistory != nil {
+		out.CertChanges = cfg.CertHistory.observe(results, start)
+	}
+
+	switch {
+	case cfg.Output == "ndjson":
+		printNDJSONSummary(results, timeout, elapsed)
+	case cfg.OutputTemplate != nil:
+		printTemplate(cfg, out)
+	case jsonMode:
+		printJSON(out)
+	default:
+		printResults(results, elapsed)
+		printCanaries(out.Results)
+		printHealth(out.Results)
+		printOwners(out.Results)
+		printLocations(out.Results, cfg.GeoIPCountries)
+		printPolicyCheck("NetworkPolicy check", results, verdicts)
+		printPolicyCheck("Cilium policy check", results, ciliumVerdicts)
+		printMeshComparison(sidecar, cfg.MeshBypassUID, results, bypass)
+		printConntrack(conntrack)
+		printDropTrace(drops)
+		printCaptures(captures)
+		printEgressIP(egress)
+		printDiagnoses(out.Diagnoses)
+		printCertChanges(out.CertChanges)
+	}
+	if ciOutput(cfg) {
+		printCIReport(cfg, out)
+	}
 
-func parseConfig() ([]Target, time.Duration) {
-	timeout := defaultTimeout
-	if t := os.Getenv("TIMEOUT"); t != "" {
-		if sec, err := strconv.Atoi(t); err == nil && sec > 0 {
-			timeout = time.Duration(sec) * time.Second
+	if cfg.AggregatorURL != "" {
+		report := nodeReport{Node: cfg.NodeName, Time: time.Now(), Summary: out.Summary, Environment: env, Results: out.Results}
+		if err := pushReport(ctx, cfg.AggregatorURL, cfg.AggregatorToken, report); err != nil {
+			logf("pushing report to aggregator: %v", err)
 		}
 	}
+	publishResults(ctx, cfg, out)
+	archiveResults(ctx, cfg, out, start)
+	annotateGrafana(ctx, cfg, out, start, start.Add(elapsed))
+	sendAlerts(ctx, cfg, out)
+	emitStatsD(cfg, out)
+	emitCloudEvents(ctx, cfg, out)
+	writeTextfile(cfg, out, start.Add(elapsed))
+	cfg.Metrics.record(cfg, out, start.Add(elapsed))
+	sendLogAnalytics(ctx, cfg, out, start.Add(elapsed))
+	sendCloudWatch(ctx, cfg, out, start.Add(elapsed))
+
+	// Hooks run after the report and are not bound by RUN_TIMEOUT, so a run
+	// that used up its budget can still page someone.
+	if cfg.OnFailureCmd != "" {
+		runFailureHooks(ctx, cfg.OnFailureCmd, cfg.OnFailureTimeout, results)
+	}
+	return results, egress
+}
 
-	var targets []Target
+// verdictExit returns the exit code for a run's verdict code, which
+// EXIT_MODE=always-zero turns into 0: the report, hooks and published
+// results carry the verdict instead, and a restarting Pod doesn't
+// crash-loop on a persistent failure.
+func verdictExit(cfg Config, code int) int {
+	if code != 0 && cfg.ExitMode == "always-zero" {
+		logf("EXIT_MODE=always-zero: exiting 0 instead of %d", code)
+		return 0
+	}
+	return code
+}
 
-	if raw := os.Getenv("ALLOW_TARGETS"); raw != "" {
-		targets = append(targets, parseTargetList(raw, false)...)
+func exitCode(results []probe.Result) int {
+	for _, r := range results {
+		if r.Incomplete {
+			return exitIncomplete
+		}
 	}
-	if raw := os.Getenv("DENY_TARGETS"); raw != "" {
-		targets = append(targets, parseTargetList(raw, true)...)
+	for _, r := range results {
+		if !r.Passed {
+			return exitFailed
+		}
 	}
+	return 0
+}
 
-	// Backwards compatibility: TARGETS treated as ALLOW_TARGETS
-	if raw := os.Getenv("TARGETS"); raw != "" && len(targets) == 0 {
-		targets = append(targets, parseTargetList(raw, false)...)
+// failsFast reports whether r is a failure FAIL_FAST stops the run for.
+func failsFast(cfg Config, r probe.Result) bool {
+	if r.Passed || r.Incomplete {
+		return false
 	}
-
-	return targets, timeout
+	return cfg.FailFast == "any" || (cfg.FailFast == "critical" && isCritical(r.Target.Metadata))
 }
 
-func parseTargetList(raw string, expectErr bool) []Target {
-	var targets []Target
-	for _, entry := range strings.Split(raw, ",") {
-		entry = strings.TrimSpace(entry)
-		if entry == "" {
-			continue
+// stoppedFast reports whether FAIL_FAST stopped the run of results.
+func stoppedFast(cfg Config, results []probe.Result) bool {
+	for _, r := range results {
+		if cfg.FailFast != "" && failsFast(cfg, r) {
+			return true
 		}
-		t := parseTarget(entry)
-		t.ExpectErr = expectErr
-		targets = append(targets, t)
 	}
-	return targets
+	return false
 }
 
-func parseTarget(s string) Target {
-	inferredPort := defaultPort
-	skipTLS := false
-	if idx := strings.Index(s, "://"); idx != -1 {
-		scheme := strings.ToLower(s[:idx])
-		s = s[idx+3:]
-		switch scheme {
-		case "http":
-			inferredPort = 80
-			skipTLS = true
-		case "https":
-			inferredPort = 443
-		case "tcp", "tls":
-			// keep defaultPort (443)
+// probeOptions translates cfg, including its profile, into probe options for
+// one run. With shuffling enabled, the run's seed is logged so that its order
+// can be reproduced with SHUFFLE_SEED.
+func probeOptions(cfg Config) probe.Options {
+	opts := probe.Options{Timeout: cfg.Timeout, Stagger: cfg.Stagger, Concurrency: cfg.Concurrency, DNSCache: cfg.DNSCache, RootCAs: cfg.RootCAs, ClientCert: cfg.ClientCert, FIPS: cfg.FIPSTLS, IPv6: cfg.IPv6, Proxy: proxyFunc(cfg.Proxy), DNSQueries: cfg.DNSQueries, DNSTrace: cfg.DNSTrace, DataCheck: cfg.DataCheck, Retries: cfg.Retries, RetryDelay: cfg.RetryDelay, TargetTimeout: cfg.TargetTimeout}
+	if cfg.FailFast != "" {
+		opts.StopOn = func(r probe.Result) bool {
+			if !failsFast(cfg, r) {
+				return false
+			}
+			logf("FAIL_FAST: %s failed (%s); stopping the run", targetKey(r.Target), failureReason(r))
+			return true
 		}
 	}
-
-	if idx := strings.Index(s, "/"); idx != -1 {
-		s = s[:idx]
+	if cfg.Shuffle {
+		opts.Shuffle = true
+		opts.Seed = cfg.ShuffleSeed
+		if opts.Seed == 0 {
+			opts.Seed = rand.Uint64()
+		}
+		logf("shuffling target order (seed %d)", opts.Seed)
 	}
-
-	host, portStr, err := net.SplitHostPort(s)
-	if err != nil {
-		return Target{Host: s, Port: inferredPort, SkipTLS: skipTLS}
+	switch cfg.Profile {
+	case "fast":
+		opts.NoTLS = true
+	case "deep":
+		opts.HTTP = true
+		opts.CertInfo = true
 	}
-	port, err := strconv.Atoi(portStr)
-	if err != nil || port <= 0 || port > 65535 {
-		port = inferredPort
+	if cfg.CertWatch {
+		opts.CertInfo = true
 	}
-	if port == 80 {
-		skipTLS = true
+	if cfg.CertExpiryWarn > 0 {
+		opts.CertInfo = true
+		opts.CertExpiryWarn = time.Duration(cfg.CertExpiryWarn) * 24 * time.Hour
+		opts.CertExpiryFail = cfg.CertExpiryFail
 	}
-	return Target{Host: host, Port: port, SkipTLS: skipTLS}
+	return opts
 }
 
-// warmupDNS sends a throwaway DNS query to absorb the first-packet latency
-// penalty caused by network path initialization (conntrack, DNAT, etc.).
-// In many Kubernetes clusters, the very first UDP packet from a new Pod is
-// dropped, causing a ~5s retry delay. This warm-up absorbs that penalty so
-// actual test results are not affected.
-func warmupDNS(timeout time.Duration) time.Duration {
-	resolver := &net.Resolver{PreferGo: true}
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
-
-	start := time.Now()
-	resolver.LookupIP(ctx, "ip4", "kubernetes.default.svc.cluster.local.")
-	return time.Since(start)
+func validProfile(p string) bool {
+	return p == "" || p == "fast" || p == "deep"
 }
 
-// runTests runs DNS lookups sequentially to avoid the Kubernetes conntrack
-// race condition on concurrent UDP queries, then runs TCP/TLS in parallel.
-func runTests(targets []Target, timeout time.Duration) []TestResult {
-	results := make([]TestResult, len(targets))
-
-	for i, t := range targets {
-		results[i] = TestResult{Target: t}
-		results[i].DNS = testDNS(t, timeout)
+func parseConfig() (Config, error) {
+	file, err := loadConfigFile(os.Getenv("CONFIG_FILE"))
+	if err != nil {
+		return Config{}, err
 	}
+	configSettings = file.settings
 
-	var wg sync.WaitGroup
-	for i := range results {
-		if !results[i].DNS.Success {
-			results[i].TCP = PhaseResult{Detail: "skipped (DNS failed)"}
-			results[i].TLS = PhaseResult{Detail: "skipped (DNS failed)"}
-			continue
-		}
-		wg.Add(1)
-		go func(idx int) {
-			defer wg.Done()
-			results[idx].TCP = testTCP(targets[idx], timeout)
-			if !results[idx].TCP.Success {
-				results[idx].TLS = PhaseResult{Detail: "skipped (TCP failed)"}
-				return
-			}
-			if targets[idx].SkipTLS {
-				results[idx].TLS = PhaseResult{Success: true, Detail: "skipped (non-TLS)"}
-			} else {
-				results[idx].TLS = testTLS(targets[idx], timeout)
-			}
-		}(i)
+	profile := strings.ToLower(getenv("PROFILE"))
+	if !validProfile(profile) {
+		return Config{}, fmt.Errorf("invalid PROFILE %q: expected fast or deep", profile)
+	}
+	defaultTimeout := probe.DefaultTimeout
+	if profile == "fast" {
+		defaultTimeout = fastProfileTimeout
 	}
 
-	wg.Wait()
-	return results
-}
+	cfg := Config{
+		Mode:          strings.ToLower(getenv("MODE")),
+		Output:        getenv("OUTPUT"),
+		Profile:       profile,
+		Interval:      envDuration("INTERVAL", defaultInterval),
+		Timeout:       envDuration("TIMEOUT", defaultTimeout),
+		LatencySLO:    envDuration("LATENCY_SLO", defaultLatencySLO),
+		RunTimeout:    envDuration("RUN_TIMEOUT", 0),
+		TargetTimeout: envDuration("TARGET_TIMEOUT", 0),
+		StartJitter:   envDuration("START_JITTER", 0),
+		Stagger:       envDuration("STAGGER", 0),
+		Concurrency:   defaultConcurrency,
 
-func testDNS(target Target, timeout time.Duration) PhaseResult {
-	if net.ParseIP(target.Host) != nil {
-		return PhaseResult{
-			Success:  true,
-			Duration: 0,
-			Detail:   target.Host + " (literal)",
-		}
-	}
+		OnFailureCmd:     getenv("ON_FAILURE_CMD"),
+		OnFailureTimeout: envDuration("ON_FAILURE_TIMEOUT", defaultHookTimeout),
 
-	resolver := &net.Resolver{PreferGo: true}
+		AggregatorURL:    getenv("AGGREGATOR_URL"),
+		AggregatorToken:  getenv("AGGREGATOR_TOKEN"),
+		GrafanaURL:       getenv("GRAFANA_URL"),
+		GrafanaToken:     getenv("GRAFANA_TOKEN"),
+		GrafanaDashboard: getenv("GRAFANA_DASHBOARD_UID"),
 
-	lookupHost := target.Host
-	if !strings.HasSuffix(lookupHost, ".") {
-		lookupHost = lookupHost + "."
-	}
+		PagerDutyKey: getenv("PAGERDUTY_ROUTING_KEY"),
+		OpsgenieKey:  getenv("OPSGENIE_API_KEY"),
+		OpsgenieURL:  strings.TrimRight(getenv("OPSGENIE_API_URL"), "/"),
 
-	start := time.Now()
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
+		StatsDAddr:   getenv("STATSD_ADDR"),
+		StatsDPrefix: getenv("STATSD_PREFIX"),
 
-	ips, err := resolver.LookupIP(ctx, "ip4", lookupHost)
-	elapsed := time.Since(start)
+		CloudEventsSink: getenv("CLOUDEVENTS_SINK"),
 
-	if err != nil {
-		return PhaseResult{
-			Success:  false,
-			Duration: elapsed,
-			Detail:   simplifyError(err),
-		}
-	}
+		TextfileDir:  getenv("TEXTFILE_DIR"),
+		TextfileName: getenv("TEXTFILE_NAME"),
 
-	addrs := make([]string, len(ips))
-	for i, ip := range ips {
-		addrs[i] = ip.String()
-	}
+		LogAnalyticsEndpoint: getenv("LOG_ANALYTICS_ENDPOINT"),
+		LogAnalyticsDCR:      getenv("LOG_ANALYTICS_DCR"),
+		LogAnalyticsStream:   getenv("LOG_ANALYTICS_STREAM"),
 
-	return PhaseResult{
-		Success:  true,
-		Duration: elapsed,
-		Detail:   strings.Join(addrs, ", "),
-	}
-}
+		CloudWatchNamespace: getenv("CLOUDWATCH_NAMESPACE"),
+		CloudWatchLogGroup:  getenv("CLOUDWATCH_LOG_GROUP"),
 
-func testTCP(target Target, timeout time.Duration) PhaseResult {
-	addr := net.JoinHostPort(target.Host, strconv.Itoa(target.Port))
+		PublishConfigMap:   getenv("PUBLISH_CONFIGMAP"),
+		PublishEgressProbe: getenv("PUBLISH_EGRESSPROBE"),
+		TargetsEgressProbe: getenv("TARGETS_EGRESSPROBE"),
+		NodeName:           getenv("NODE_NAME"),
+		ListenAddr:         getenv("LISTEN_ADDR"),
+		ReadinessGate:      getenv("READINESS_GATE"),
+		NetNS:              getenv("NETNS"),
 
-	start := time.Now()
-	conn, err := net.DialTimeout("tcp", addr, timeout)
-	elapsed := time.Since(start)
+		AgentToken: getenv("AGENT_TOKEN"),
 
-	if err != nil {
-		return PhaseResult{
-			Success:  false,
-			Duration: elapsed,
-			Detail:   simplifyError(err),
-		}
-	}
-	conn.Close()
+		SoakDuration: envDuration("SOAK_DURATION", defaultSoakDuration),
+		SoakInterval: envDuration("SOAK_INTERVAL", defaultSoakInterval),
 
-	return PhaseResult{
-		Success:  true,
-		Duration: elapsed,
-		Detail:   "connected",
-	}
-}
+		DNSCacheMaxTTL: envDuration("DNS_CACHE_MAX_TTL", defaultDNSCacheMaxTTL),
 
-func testTLS(target Target, timeout time.Duration) PhaseResult {
-	addr := net.JoinHostPort(target.Host, strconv.Itoa(target.Port))
+		LeaderElection: getenv("LEADER_ELECTION"),
+		LeaseDuration:  envDuration("LEASE_DURATION", defaultLeaseDuration).Truncate(time.Second),
 
-	start := time.Now()
-	dialer := &net.Dialer{Timeout: timeout}
-	conn, err := tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{
-		ServerName:         target.Host,
-		InsecureSkipVerify: false,
-	})
-	elapsed := time.Since(start)
+		FailFast: getenv("FAIL_FAST"),
 
+		LogLevel:   getenv("LOG_LEVEL"),
+		TuningFile: getenv("TUNING_FILE"),
+		AdminAddr:  getenv("ADMIN_ADDR"),
+		AdminToken: getenv("ADMIN_TOKEN"),
+
+		MetricsAddr: getenv("METRICS_ADDR"),
+	}
+	switch cfg.FailFast {
+	case "", "critical", "any":
+	default:
+		return cfg, fmt.Errorf("invalid FAIL_FAST %q: expected critical or any", cfg.FailFast)
+	}
+	switch cfg.LogLevel {
+	case "":
+		cfg.LogLevel = "info"
+	case "info", "debug":
+	default:
+		return cfg, fmt.Errorf("invalid LOG_LEVEL %q: expected info or debug", cfg.LogLevel)
+	}
+	if cfg.NodeName == "" {
+		cfg.NodeName, _ = os.Hostname()
+	}
+	if cfg.Output == "template" {
+		t, err := parseOutputTemplate()
+		if err != nil {
+			return cfg, err
+		}
+		cfg.OutputTemplate = t
+	}
+	if cfg.OpsgenieURL == "" {
+		cfg.OpsgenieURL = defaultOpsgenieURL
+	}
+	if cfg.StatsDPrefix == "" {
+		cfg.StatsDPrefix = "egress_probe"
+	}
+	if cfg.TextfileName == "" {
+		cfg.TextfileName = defaultTextfileName
+	}
+	if !strings.HasSuffix(cfg.TextfileName, ".prom") || strings.ContainsRune(cfg.TextfileName, '/') {
+		return cfg, fmt.Errorf("invalid TEXTFILE_NAME %q: expected a file name ending in .prom", cfg.TextfileName)
+	}
+	if cfg.LogAnalyticsEndpoint != "" && cfg.LogAnalyticsDCR == "" {
+		return cfg, fmt.Errorf("LOG_ANALYTICS_ENDPOINT requires LOG_ANALYTICS_DCR, the immutable ID of the data collection rule")
+	}
+	if cfg.LogAnalyticsStream == "" {
+		cfg.LogAnalyticsStream = defaultLogAnalyticsStream
+	}
+	if raw := getenv("CLOUDWATCH_METRICS"); raw != "" {
+		on, err := strconv.ParseBool(raw)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid CLOUDWATCH_METRICS %q: expected true or false", raw)
+		}
+		cfg.CloudWatchMetrics = on
+	}
+	if cfg.CloudWatchNamespace == "" {
+		cfg.CloudWatchNamespace = defaultCloudWatchNamespace
+	}
+	if cfg.CloudEventsSink == "" {
+		// Injected by a Knative SinkBinding or set by a ContainerSource.
+		cfg.CloudEventsSink = getenv("K_SINK")
+	}
+	if u := cfg.CloudEventsSink; u != "" && !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
+		return cfg, fmt.Errorf("invalid CLOUDEVENTS_SINK %q: expected an http:// or https:// URL", u)
+	}
+	if cfg.ListenAddr == "" {
+		cfg.ListenAddr = defaultListenAddr
+		if cfg.Mode == "sidecar" {
+			cfg.ListenAddr = defaultSidecarListenAddr
+		}
+	}
+	if raw := getenv("CONCURRENCY"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			return cfg, fmt.Errorf("invalid CONCURRENCY %q: expected a non-negative integer", raw)
+		}
+		cfg.Concurrency = n
+	}
+	if raw := getenv("SHUFFLE"); raw != "" {
+		on, err := strconv.ParseBool(raw)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid SHUFFLE %q: expected true or false", raw)
+		}
+		cfg.Shuffle = on
+	}
+	if raw := getenv("SHUFFLE_SEED"); raw != "" {
+		seed, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid SHUFFLE_SEED %q: expected a non-negative integer", raw)
+		}
+		cfg.Shuffle = true
+		cfg.ShuffleSeed = seed
+	}
+	if raw := getenv("NETPOL_CHECK"); raw != "" {
+		on, err := strconv.ParseBool(raw)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid NETPOL_CHECK %q: expected true or false", raw)
+		}
+		cfg.NetpolCheck = on
+	}
+	if raw := getenv("CILIUM_CHECK"); raw != "" {
+		on, err := strconv.ParseBool(raw)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid CILIUM_CHECK %q: expected true or false", raw)
+		}
+		cfg.CiliumCheck = on
+	}
+	if raw := getenv("CONNTRACK_CHECK"); raw != "" {
+		on, err := strconv.ParseBool(raw)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid CONNTRACK_CHECK %q: expected true or false", raw)
+		}
+		cfg.ConntrackCheck = on
+	}
+	if raw := getenv("DROP_TRACE"); raw != "" {
+		on, err := strconv.ParseBool(raw)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid DROP_TRACE %q: expected true or false", raw)
+		}
+		cfg.DropTrace = on
+	}
+	if dir := getenv("PCAP_ON_FAILURE"); dir != "" {
+		if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+			return cfg, fmt.Errorf("invalid PCAP_ON_FAILURE %q: expected a directory", dir)
+		}
+		cfg.PcapDir = dir
+	}
+	if raw := getenv("PREFLIGHT"); raw != "" {
+		on, err := strconv.ParseBool(raw)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid PREFLIGHT %q: expected true or false", raw)
+		}
+		cfg.Preflight = on
+	}
+	if source := getenv("ASN_LOOKUP"); source != "" {
+		if source != "rdap" {
+			if _, err := os.Stat(source); err != nil {
+				return cfg, fmt.Errorf("invalid ASN_LOOKUP %q: expected rdap or the path of an ASN table", source)
+			}
+		}
+		cfg.ASNLookup = source
+	}
+	cfg.GeoIPDB = getenv("GEOIP_DB")
+	if cfg.GeoIPDB != "" {
+		if _, err := os.Stat(cfg.GeoIPDB); err != nil {
+			return cfg, fmt.Errorf("invalid GEOIP_DB: %w", err)
+		}
+	}
+	if raw := getenv("GEOIP_COUNTRIES"); raw != "" {
+		if cfg.GeoIPDB == "" {
+			return cfg, fmt.Errorf("GEOIP_COUNTRIES requires GEOIP_DB")
+		}
+		for _, c := range strings.Split(raw, ",") {
+			c = strings.ToUpper(strings.TrimSpace(c))
+			if len(c) != 2 {
+				return cfg, fmt.Errorf("invalid GEOIP_COUNTRIES %q: expected ISO 3166-1 country codes, e.g. DE,FR", raw)
+			}
+			cfg.GeoIPCountries = append(cfg.GeoIPCountries, c)
+		}
+	}
+	ipv6, dual, err := resolveIPFamily(strings.ToLower(getenv("IP_FAMILY")))
 	if err != nil {
-		return PhaseResult{
-			Success:  false,
-			Duration: elapsed,
-			Detail:   simplifyError(err),
+		return cfg, err
+	}
+	cfg.IPv6, cfg.DualStack = ipv6, dual
+	switch mode := strings.ToLower(getenv("EXIT_MODE")); mode {
+	case "", "default":
+	case "always-zero":
+		cfg.ExitMode = mode
+	default:
+		return cfg, fmt.Errorf("invalid EXIT_MODE %q: expected default or always-zero", mode)
+	}
+	if raw := getenv("FIPS_TLS"); raw != "" {
+		on, err := strconv.ParseBool(raw)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid FIPS_TLS %q: expected true or false", raw)
 		}
+		cfg.FIPSTLS = on
 	}
-	defer conn.Close()
-
-	state := conn.ConnectionState()
-	tlsVersion := tlsVersionString(state.Version)
-	detail := fmt.Sprintf("%s, %s", tlsVersion, tls.CipherSuiteName(state.CipherSuite))
-
-	return PhaseResult{
-		Success:  true,
-		Duration: elapsed,
-		Detail:   detail,
+	if certFile, keyFile := getenv("CLIENT_CERT"), getenv("CLIENT_KEY"); certFile != "" {
+		if keyFile == "" {
+			keyFile = certFile
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid CLIENT_CERT %q: %v", certFile, err)
+		}
+		cfg.ClientCert = &cert
+	} else if keyFile != "" {
+		return cfg, fmt.Errorf("CLIENT_KEY is set without CLIENT_CERT")
 	}
-}
-
-func simplifyError(err error) string {
-	msg := err.Error()
-
-	if strings.Contains(msg, "no such host") {
-		return "NXDOMAIN"
+	for _, name := range []string{"PROXY", "PROXY_URL"} {
+		raw := getenv(name)
+		if raw == "" {
+			continue
+		}
+		if err := parseProxy(name, raw); err != nil {
+			return cfg, err
+		}
+		if cfg.Proxy != "" && cfg.Proxy != raw {
+			return cfg, fmt.Errorf("PROXY and PROXY_URL disagree: set only one")
+		}
+		cfg.Proxy = raw
 	}
-	if strings.Contains(msg, "i/o timeout") || strings.Contains(msg, "deadline exceeded") {
-		return "timeout"
+	if raw := getenv("RETRIES"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			return cfg, fmt.Errorf("invalid RETRIES %q: expected a non-negative integer", raw)
+		}
+		cfg.Retries = n
 	}
-	if strings.Contains(msg, "connection refused") {
-		return "connection refused"
+	cfg.RetryDelay = envDuration("RETRY_DELAY", defaultRetryDelay)
+	if raw := getenv("DATA_CHECK"); raw != "" {
+		on, err := strconv.ParseBool(raw)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid DATA_CHECK %q: expected true or false", raw)
+		}
+		cfg.DataCheck = on
 	}
-	if strings.Contains(msg, "connection reset") {
-		return "connection reset"
+	if raw := getenv("DNS_CONSISTENCY"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			return cfg, fmt.Errorf("invalid DNS_CONSISTENCY %q: expected a non-negative integer", raw)
+		}
+		cfg.DNSQueries = n
 	}
-	if strings.Contains(msg, "certificate") {
-		if strings.Contains(msg, "unknown authority") {
-			return "cert: unknown authority"
+	if raw := getenv("DNS_TRACE"); raw != "" {
+		on, err := strconv.ParseBool(raw)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid DNS_TRACE %q: expected true or false", raw)
 		}
-		if strings.Contains(msg, "expired") {
-			return "cert: expired"
+		cfg.DNSTrace = on
+	}
+	if raw := getenv("MESH_COMPARE"); raw != "" {
+		on, err := strconv.ParseBool(raw)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid MESH_COMPARE %q: expected true or false", raw)
 		}
-		return "cert error"
+		cfg.MeshCompare = on
 	}
-	if strings.Contains(msg, "handshake failure") {
-		return "TLS handshake failure"
+	cfg.MeshBypassUID = defaultMeshBypassUID
+	if raw := getenv("MESH_BYPASS_UID"); raw != "" {
+		uid, err := strconv.Atoi(raw)
+		if err != nil || uid <= 0 {
+			return cfg, fmt.Errorf("invalid MESH_BYPASS_UID %q: expected a positive integer", raw)
+		}
+		cfg.MeshBypassUID = uid
 	}
-
-	if idx := strings.LastIndex(msg, ": "); idx != -1 {
-		return msg[idx+2:]
+	cfg.EgressEchoURL = getenv("EGRESS_ECHO_URL")
+	if raw := getenv("EXPECT_EGRESS_CIDR"); raw != "" {
+		nets, err := parseCIDRList(raw)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid EXPECT_EGRESS_CIDR: %w", err)
+		}
+		cfg.ExpectEgressIP = nets
+		if cfg.EgressEchoURL == "" {
+			cfg.EgressEchoURL = defaultEgressEchoURL
+		}
 	}
-
-	return msg
-}
-
-func tlsVersionString(version uint16) string {
-	switch version {
-	case tls.VersionTLS10:
-		return "TLS 1.0"
-	case tls.VersionTLS11:
-		return "TLS 1.1"
-	case tls.VersionTLS12:
-		return "TLS 1.2"
-	case tls.VersionTLS13:
-		return "TLS 1.3"
+	if raw := getenv("DNS_FRESH"); raw != "" {
+		on, err := strconv.ParseBool(raw)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid DNS_FRESH %q: expected true or false", raw)
+		}
+		cfg.DNSFresh = on
+	}
+	if raw := getenv("RESULTS_BUCKET"); raw != "" {
+		b, err := parseBucket(raw)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.ResultsBucket = b
+	}
+	if raw := getenv("CERT_EXPIRY_WARN"); raw != "" {
+		days, err := strconv.Atoi(strings.TrimSuffix(raw, "d"))
+		if err != nil || days <= 0 {
+			return cfg, fmt.Errorf("invalid CERT_EXPIRY_WARN %q: expected a number of days", raw)
+		}
+		cfg.CertExpiryWarn = days
+	}
+	switch action := strings.ToLower(getenv("CERT_EXPIRY_ACTION")); action {
+	case "", "fail":
+		cfg.CertExpiryFail = true
+	case "warn":
 	default:
-		return fmt.Sprintf("TLS 0x%04x", version)
+		return cfg, fmt.Errorf("invalid CERT_EXPIRY_ACTION %q: expected fail or warn", action)
 	}
-}
-
-type jsonOutput struct {
-	Summary jsonSummary `json:"summary"`
-	Results []jsonResult `json:"results"`
-}
-
-type jsonSummary struct {
-	Total   int    `json:"total"`
-	Allow   int    `json:"allow"`
-	Deny    int    `json:"deny"`
-	Passed  int    `json:"passed"`
-	Failed  int    `json:"failed"`
-	OK      bool   `json:"ok"`
-	Timeout string `json:"timeout"`
-	Elapsed string `json:"elapsed"`
-}
-
-type jsonPhase struct {
-	Success    bool   `json:"success"`
-	DurationMs int64  `json:"duration_ms"`
-	Detail     string `json:"detail"`
-}
-
-type jsonResult struct {
-	Host    string    `json:"host"`
-	Port    int       `json:"port"`
-	Type    string    `json:"type"`
-	SkipTLS bool      `json:"skip_tls"`
-	DNS     jsonPhase `json:"dns"`
-	TCP     jsonPhase `json:"tcp"`
-	TLS     jsonPhase `json:"tls"`
-	Passed  bool      `json:"passed"`
-	Blocked bool      `json:"blocked"`
-}
-
-func toJSONPhase(p PhaseResult) jsonPhase {
-	return jsonPhase{
-		Success:    p.Success,
-		DurationMs: p.Duration.Milliseconds(),
-		Detail:     p.Detail,
+	if raw := getenv("CERT_WATCH"); raw != "" {
+		on, err := strconv.ParseBool(raw)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid CERT_WATCH %q: expected true or false", raw)
+		}
+		cfg.CertWatch = on
 	}
-}
-
-func printJSON(results []TestResult, timeout, elapsed time.Duration) {
-	var allowCount, denyCount, passed, failed int
-	jResults := make([]jsonResult, len(results))
-
-	for i, r := range results {
-		typ := "allow"
-		if r.Target.ExpectErr {
-			typ = "deny"
-			denyCount++
-		} else {
-			allowCount++
+	if cfg.CertWatch && cfg.Mode != "daemon" {
+		return cfg, fmt.Errorf("CERT_WATCH requires MODE=daemon")
+	}
+	if cfg.NetNS != "" {
+		if _, _, err := parseNetNS(cfg.NetNS); err != nil {
+			return cfg, err
 		}
-		if r.Passed {
-			passed++
-		} else {
-			failed++
-		}
-		jResults[i] = jsonResult{
-			Host:    r.Target.Host,
-			Port:    r.Target.Port,
-			Type:    typ,
-			SkipTLS: r.Target.SkipTLS,
-			DNS:     toJSONPhase(r.DNS),
-			TCP:     toJSONPhase(r.TCP),
-			TLS:     toJSONPhase(r.TLS),
-			Passed:  r.Passed,
-			Blocked: r.Blocked,
-		}
-	}
-
-	out := jsonOutput{
-		Summary: jsonSummary{
-			Total:   len(results),
-			Allow:   allowCount,
-			Deny:    denyCount,
-			Passed:  passed,
-			Failed:  failed,
-			OK:      failed == 0,
-			Timeout: timeout.String(),
-			Elapsed: elapsed.Round(time.Millisecond).String(),
-		},
-		Results: jResults,
-	}
-
-	enc := json.NewEncoder(os.Stdout)
-	enc.SetIndent("", "  ")
-	enc.Encode(out)
-}
-
-func printHeader(targets []Target, timeout time.Duration) {
-	allowCount := 0
-	denyCount := 0
-	for _, t := range targets {
-		if t.ExpectErr {
-			denyCount++
-		} else {
-			allowCount++
+	}
+	if raw := getenv("SHARD_TARGETS"); raw != "" {
+		on, err := strconv.ParseBool(raw)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid SHARD_TARGETS %q: expected true or false", raw)
 		}
+		cfg.ShardTargets = on
 	}
-
-	fmt.Printf("\n%s%s╔══════════════════════════════════════════════════════════╗%s\n", colorBold, colorCyan, colorReset)
-	fmt.Printf("%s%s║            Egress Probe — Egress Validation              ║%s\n", colorBold, colorCyan, colorReset)
-	fmt.Printf("%s%s╚══════════════════════════════════════════════════════════╝%s\n", colorBold, colorCyan, colorReset)
-	fmt.Printf("\n  Targets:  %d (%s%d allow%s / %s%d deny%s)\n", len(targets),
-		colorGreen, allowCount, colorReset,
-		colorYellow, denyCount, colorReset)
-	fmt.Printf("  Timeout:  %s per phase\n", timeout)
-	fmt.Printf("  Phases:   DNS → TCP → TLS/SNI\n\n")
-}
-
-func printResults(results []TestResult, elapsed time.Duration) {
-	var allow, deny []TestResult
-	for _, r := range results {
-		if r.Target.ExpectErr {
-			deny = append(deny, r)
-		} else {
-			allow = append(allow, r)
+	if cfg.ShardTargets && cfg.LeaderElection == "" {
+		return cfg, fmt.Errorf("SHARD_TARGETS requires LEADER_ELECTION to name the group")
+	}
+	if cfg.LeaderElection != "" && cfg.Mode != "daemon" {
+		return cfg, fmt.Errorf("LEADER_ELECTION requires MODE=daemon")
+	}
+	if cfg.LeaseDuration < 3*time.Second {
+		return cfg, fmt.Errorf("invalid LEASE_DURATION %q: expected at least 3s", getenv("LEASE_DURATION"))
+	}
+	if raw := getenv("REPEAT"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 {
+			return cfg, fmt.Errorf("invalid REPEAT %q: expected a positive integer", raw)
 		}
+		cfg.Repeat = n
 	}
-
-	maxHostLen := 4
-	for _, r := range results {
-		if len(r.Target.Host) > maxHostLen {
-			maxHostLen = len(r.Target.Host)
+	if raw := getenv("AGENTS"); raw != "" {
+		agents, err := parseAgents(raw)
+		if err != nil {
+			return cfg, err
 		}
+		cfg.Agents = agents
 	}
-	if maxHostLen > 40 {
-		maxHostLen = 40
+	if raw := getenv("MATRIX_NAMESPACES"); raw != "" {
+		namespaces, err := parseMatrixNamespaces(raw)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.MatrixNamespaces = namespaces
+	}
+	cfg.MatrixImage = getenv("MATRIX_IMAGE")
+	if raw := getenv("MATRIX_LABELS"); raw != "" {
+		labels, err := parseLabels(raw)
+		if err != nil {
+			return cfg, fmt.Errorf("MATRIX_LABELS: %w", err)
+		}
+		cfg.MatrixLabels = labels
+	}
+	if len(cfg.MatrixNamespaces) > 0 && len(cfg.Agents) > 0 {
+		return cfg, fmt.Errorf("MATRIX_NAMESPACES and AGENTS can't be combined")
+	}
+	if len(cfg.MatrixNamespaces) > 0 && cfg.Mode != "" {
+		return cfg, fmt.Errorf("MATRIX_NAMESPACES runs once and can't be combined with MODE=%s", cfg.Mode)
 	}
 
-	hostCol := maxHostLen + 2
-	portCol := 6
-	dnsCol := 16
-	tcpCol := 16
-	tlsCol := 16
-	resultCol := 8
-	cols := []int{hostCol, portCol, dnsCol, tcpCol, tlsCol, resultCol}
-
-	totalWidth := 0
-	for _, w := range cols {
-		totalWidth += w + 1
+	for _, tag := range strings.Split(getenv("GRAFANA_TAGS"), ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			cfg.GrafanaTags = append(cfg.GrafanaTags, tag)
+		}
+	}
+	flavor, err := parseStatsDFlavor(getenv("STATSD_FLAVOR"))
+	if err != nil {
+		return cfg, err
+	}
+	cfg.StatsDFlavor = flavor
+	for _, tag := range strings.Split(getenv("STATSD_TAGS"), ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			cfg.StatsDTags = append(cfg.StatsDTags, tag)
+		}
 	}
-	totalWidth += 5
 
-	printSeparator(cols, "┌", "┬", "┐")
-	fmt.Printf("│ %-*s│ %-*s│ %-*s│ %-*s│ %-*s│ %-*s│\n",
-		hostCol, " FQDN",
-		portCol, " PORT",
-		dnsCol, " DNS",
-		tcpCol, " TCP",
-		tlsCol, " TLS/SNI",
-		resultCol, " RESULT",
-	)
+	if expr := getenv("SCHEDULE"); expr != "" {
+		sched, err := parseCron(expr)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.Schedule = sched
+	}
 
-	ok := 0
-	ng := 0
+	var targets []probe.Target
 
-	printRow := func(r TestResult) {
-		host := r.Target.Host
-		if len(host) > maxHostLen {
-			host = host[:maxHostLen-1] + "…"
+	if raw := getenv("ALLOW_TARGETS"); raw != "" {
+		targets = append(targets, probe.ParseTargetList(raw, false)...)
+	}
+	if raw := getenv("DENY_TARGETS"); raw != "" {
+		targets = append(targets, probe.ParseTargetList(raw, true)...)
+	}
+	if path := getenv("ALLOW_TARGETS_FILE"); path != "" {
+		raw, err := readTargetsFile(path)
+		if err != nil {
+			return cfg, err
 		}
-		if r.Passed {
-			ok++
-		} else {
-			ng++
+		targets = append(targets, probe.ParseTargetList(raw, false)...)
+	}
+	if path := getenv("DENY_TARGETS_FILE"); path != "" {
+		raw, err := readTargetsFile(path)
+		if err != nil {
+			return cfg, err
 		}
+		targets = append(targets, probe.ParseTargetList(raw, true)...)
+	}
+	targets = append(targets, file.targets...)
 
-		dnsCell := formatPhaseCell(r.DNS)
-		tcpCell := formatPhaseCell(r.TCP)
-		tlsCell := formatPhaseCell(r.TLS)
-
-		var resultCell string
-		if r.Passed {
-			resultCell = fmt.Sprintf(" %s%sOK%s", colorBold, colorGreen, colorReset)
-		} else {
-			resultCell = fmt.Sprintf(" %s%sFAIL%s", colorBold, colorRed, colorReset)
+	if ref := getenv("TARGETS_CONFIGMAP"); ref != "" {
+		cmTargets, err := loadConfigMapTargets(ref)
+		if err != nil {
+			return cfg, err
+		}
+		targets = append(targets, cmTargets...)
+	}
+	if ref := cfg.TargetsEgressProbe; ref != "" {
+		epTargets, err := loadEgressProbeTargets(ref)
+		if err != nil {
+			return cfg, err
 		}
+		targets = append(targets, epTargets...)
+	}
 
-		fmt.Printf("│ %-*s│ %-*s│ %s│ %s│ %s│ %s│\n",
-			hostCol, " "+host,
-			portCol, fmt.Sprintf(" %d", r.Target.Port),
-			padRight(dnsCell, dnsCol),
-			padRight(tcpCell, tcpCol),
-			padRight(tlsCell, tlsCol),
-			padRight(resultCell, resultCol),
-		)
+	// Backwards compatibility: TARGETS treated as ALLOW_TARGETS
+	if raw := getenv("TARGETS"); raw != "" && len(targets) == 0 {
+		targets = append(targets, probe.ParseTargetList(raw, false)...)
 	}
 
-	if len(allow) > 0 {
-		printSeparator(cols, "├", "┴", "┤")
-		label := fmt.Sprintf("  %s%sALLOW%s — should be reachable", colorBold, colorGreen, colorReset)
-		printSectionLabel(label, totalWidth)
-		printSeparator(cols, "├", "┬", "┤")
-		for _, r := range allow {
-			printRow(r)
+	// Preset targets are expected to be reachable, unless listed explicitly
+	// above, e.g. to assert that the metadata service is blocked. PRESET
+	// takes several names separated by commas.
+	if raw := strings.ToLower(getenv("PRESET")); raw != "" {
+		listed := make(map[string]bool, len(targets))
+		for _, t := range targets {
+			listed[net.JoinHostPort(t.Host, strconv.Itoa(t.Port))] = true
+		}
+		for _, name := range strings.Split(raw, ",") {
+			name = strings.TrimSpace(name)
+			preset, err := presetTargets(name)
+			if err != nil {
+				return cfg, err
+			}
+			for _, t := range preset {
+				key := net.JoinHostPort(t.Host, strconv.Itoa(t.Port))
+				if !listed[key] {
+					targets = append(targets, t)
+					listed[key] = true
+				}
+			}
+			if name == "cluster-core" {
+				cfg.RootCAs = clusterRootCAs()
+			}
 		}
 	}
-
-	if len(deny) > 0 {
-		printSeparator(cols, "├", "┴", "┤")
-		label := fmt.Sprintf("  %s%sDENY%s  — should be blocked", colorBold, colorYellow, colorReset)
-		printSectionLabel(label, totalWidth)
-		printSeparator(cols, "├", "┬", "┤")
-		for _, r := range deny {
-			printRow(r)
+	if file, dir := getenv("CA_FILE"), getenv("CA_DIR"); file != "" || dir != "" {
+		pool, err := customRootCAs(cfg.RootCAs, file, dir)
+		if err != nil {
+			return cfg, err
 		}
+		cfg.RootCAs = pool
 	}
 
-	printSeparator(cols, "└", "┴", "┘")
-
-	total := ok + ng
-	fmt.Printf("\n  Results: %s%d/%d OK%s", colorGreen, ok, total, colorReset)
-	if ng > 0 {
-		fmt.Printf(" | %s%d/%d FAIL%s", colorRed, ng, total, colorReset)
+	// Canaries are deny targets too, unless listed explicitly above.
+	if raw := getenv("CANARY"); raw != "" {
+		canaries, err := canaryTargets(raw)
+		if err != nil {
+			return cfg, err
+		}
+		listed := make(map[string]bool, len(targets))
+		for _, t := range targets {
+			listed[canaryKey(t.Host, t.Port)] = true
+		}
+		cfg.Canaries = make(map[string]bool, len(canaries))
+		for _, t := range canaries {
+			if key := canaryKey(t.Host, t.Port); !listed[key] {
+				targets = append(targets, t)
+				cfg.Canaries[key] = true
+			}
+		}
 	}
-	fmt.Printf("\n  Elapsed: %s\n\n", elapsed.Round(time.Millisecond))
-}
 
-func printSectionLabel(text string, totalWidth int) {
-	fmt.Printf("│%s│\n", padRight(text, totalWidth))
+	if cfg.DualStack {
+		targets = splitFamilies(targets)
+	}
+	for i, t := range targets {
+		if err := validateTarget(t); err != nil {
+			return cfg, err
+		}
+		// Failing fast on critical targets wants them probed first.
+		if cfg.FailFast == "critical" && t.Priority == 0 && isCritical(t.Metadata) {
+			targets[i].Priority = 1
+		}
+	}
+	cfg.Targets = targets
+	return cfg, nil
 }
 
-func formatPhaseCell(p PhaseResult) string {
-	if !p.Success && (p.Detail == "" || strings.HasPrefix(p.Detail, "skipped")) {
-		return fmt.Sprintf(" %s—%s", colorDim, colorReset)
+// validateTarget rejects a target ParseTarget couldn't make sense of: an
+// empty host, or options whose values didn't parse and were left in its
+// Metadata.
+func validateTarget(t probe.Target) error {
+	if t.Host == "" {
+		return fmt.Errorf("invalid target: expected host[:port], a URL, or svc://name.namespace[:port]")
 	}
-	if p.Success && strings.HasPrefix(p.Detail, "skipped") {
-		return fmt.Sprintf(" %s—%s", colorDim, colorReset)
+	if err := probe.ValidatePhases(t.Phases); err != nil {
+		return fmt.Errorf("invalid phases for target %s:%d: %v", t.Host, t.Port, err)
 	}
-
-	if p.Success {
-		return fmt.Sprintf(" %s✅ %dms%s", colorGreen, p.Duration.Milliseconds(), colorReset)
+	if err := probe.ValidateExpect(t.Expect); err != nil {
+		return fmt.Errorf("invalid expect for target %s:%d: %v", t.Host, t.Port, err)
 	}
-	return fmt.Sprintf(" %s❌ %s%s", colorRed, p.Detail, colorReset)
-}
-
-func printSeparator(widths []int, left, mid, right string) {
-	fmt.Print(left)
-	for i, w := range widths {
-		for j := 0; j < w+1; j++ {
-			fmt.Print("─")
+	if v, ok := t.Metadata["priority"]; ok {
+		return fmt.Errorf("invalid priority %q for target %s:%d: expected an integer", v, t.Host, t.Port)
+	}
+	if v, ok := t.Metadata["method"]; ok {
+		return fmt.Errorf("invalid method %q for target %s:%d: expected GET or HEAD", v, t.Host, t.Port)
+	}
+	if v, ok := t.Metadata["path"]; ok {
+		return fmt.Errorf("invalid path %q for target %s:%d: expected a path starting with /", v, t.Host, t.Port)
+	}
+	if v, ok := t.Metadata["timeout"]; ok {
+		return fmt.Errorf("invalid timeout %q for target %s:%d: expected seconds or a Go duration", v, t.Host, t.Port)
+	}
+	if v, ok := t.Metadata["family"]; ok {
+		return fmt.Errorf("invalid family %q for target %s:%d: expected ipv4 or ipv6", v, t.Host, t.Port)
+	}
+	if t.ClientKey != "" && t.ClientCert == "" {
+		return fmt.Errorf("invalid client_key for target %s:%d: expected client_cert with it", t.Host, t.Port)
+	}
+	if t.ClientCert != "" {
+		keyFile := t.ClientKey
+		if keyFile == "" {
+			keyFile = t.ClientCert
 		}
-		if i < len(widths)-1 {
-			fmt.Print(mid)
+		if _, err := tls.LoadX509KeyPair(t.ClientCert, keyFile); err != nil {
+			return fmt.Errorf("invalid client_cert %q for target %s:%d: %v", t.ClientCert, t.Host, t.Port, err)
 		}
 	}
-	fmt.Println(right)
+	if ip := net.ParseIP(t.Host); ip != nil && t.Family != "" && (ip.To4() != nil) != (t.Family == "ipv4") {
+		return fmt.Errorf("invalid family %q for target %s:%d: the address is of the other family", t.Family, t.Host, t.Port)
+	}
+	return nil
 }
 
-func padRight(s string, width int) string {
-	visible := visibleLen(s)
-	if visible >= width {
-		return s
+// readTargetsFile reads a target list from a file, e.g. a key of a mounted
+// ConfigMap. Targets may be separated by commas or newlines; lines starting
+// with '#' are comments. The result uses the same syntax as ALLOW_TARGETS.
+func readTargetsFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("reading targets file: %w", err)
 	}
-	return s + strings.Repeat(" ", width-visible)
+	return parseTargetsText(string(data)), nil
 }
 
-func visibleLen(s string) int {
-	length := 0
-	inEscape := false
-	for _, r := range s {
-		if r == '\033' {
-			inEscape = true
-			continue
-		}
-		if inEscape {
-			if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') {
-				inEscape = false
-			}
+// parseTargetsText converts a target list in the targets file format into
+// the comma-separated ALLOW_TARGETS syntax.
+func parseTargetsText(text string) string {
+	var entries []string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
 			continue
 		}
-		if r == '✅' || r == '❌' {
-			length += 2
-		} else {
-			length++
+		entries = append(entries, line)
+	}
+	return strings.Join(entries, ",")
+}
+
+// envDuration reads a duration from the environment. Plain integers are
+// treated as seconds (TIMEOUT=10) for backwards compatibility; anything else
+// is parsed as a Go duration (500ms, 1m30s). Invalid or non-positive values
+// fall back to def.
+func envDuration(name string, def time.Duration) time.Duration {
+	raw := getenv(name)
+	if raw == "" {
+		return def
+	}
+	if sec, err := strconv.Atoi(raw); err == nil {
+		if sec > 0 {
+			return time.Duration(sec) * time.Second
 		}
+		return def
+	}
+	if d, err := time.ParseDuration(raw); err == nil && d > 0 {
+		return d
+	}
+	return def
+}
+
+// sleepCtx sleeps for d or until ctx is done, whichever comes first. It
+// reports whether the full duration elapsed.
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
 	}
-	return length
 }
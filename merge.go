@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// mergeOutput is the JSON form of "egress-probe merge".
+type mergeOutput struct {
+	Clusters []mergeCluster `json:"clusters"`
+	Matrix   matrix         `json:"matrix"`
+}
+
+type mergeCluster struct {
+	Name        string       `json:"name"`
+	File        string       `json:"file"`
+	OK          bool         `json:"ok"`
+	Build       buildInfo    `json:"build"`
+	Environment *environment `json:"environment,omitempty"`
+}
+
+// runMerge implements "egress-probe merge": it reads OUTPUT=json reports
+// taken in different clusters or environments and prints one matrix with a
+// column per report, so that targets which behave differently stand out.
+// It returns exitFailed if any target differs between reports.
+func runMerge(args []string) int {
+	fs := flag.NewFlagSet("merge", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the matrix as JSON")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s merge [flags] [name=]results.json...\n\nEach report becomes a column, named after its file unless given as name=file, e.g.\n  %s merge dev=dev.json stage=stage.json prod=prod.json\n\nFlags:\n", os.Args[0], os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() < 2 {
+		fs.Usage()
+		return exitFailed
+	}
+
+	clusters, reports, err := readLabeledReports(fs.Args())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitFailed
+	}
+
+	m := buildMatrix(reports)
+	code := 0
+	for _, row := range m.Targets {
+		if !row.Consistent {
+			code = exitFailed
+		}
+	}
+	if *asJSON {
+		writeJSON(Config{}, mergeOutput{Clusters: clusters, Matrix: m})
+		return code
+	}
+
+	writeMatrix(os.Stdout, m, "clusters")
+	fmt.Println()
+	for _, c := range clusters {
+		fmt.Printf("  %s: %s", c.Name, c.File)
+		if c.Build.Version != "" {
+			fmt.Printf(", egress-probe %s", c.Build.Version)
+		}
+		if c.Environment != nil {
+			fmt.Printf(", CNI %s", c.Environment.CNI)
+		}
+		fmt.Println()
+	}
+	fmt.Println()
+	printDivergence(m, reports)
+	return code
+}
+
+// readLabeledReports loads the reports given as [name=]file arguments,
+// naming each after its file unless a name is given.
+func readLabeledReports(args []string) ([]mergeCluster, []nodeReport, error) {
+	var clusters []mergeCluster
+	var reports []nodeReport
+	seen := make(map[string]bool)
+	for _, arg := range args {
+		name, path, ok := strings.Cut(arg, "=")
+		if !ok {
+			path = arg
+			name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		}
+		if seen[name] {
+			return nil, nil, fmt.Errorf("two reports are named %q; name them with name=file", name)
+		}
+		seen[name] = true
+
+		out, err := readReport(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		rep := nodeReport{Node: name, Summary: out.Summary, Environment: out.Environment, Results: out.Results}
+		if fi, err := os.Stat(path); err == nil {
+			rep.Time = fi.ModTime()
+		}
+		reports = append(reports, rep)
+		clusters = append(clusters, mergeCluster{Name: name, File: path, OK: out.Summary.OK, Build: out.Summary.Build, Environment: out.Environment})
+	}
+	return clusters, reports, nil
+}
+
+// readReport loads an OUTPUT=json report.
+func readReport(path string) (jsonOutput, error) {
+	var out jsonOutput
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return out, err
+	}
+	if err := json.Unmarshal(data, &out); err != nil {
+		return out, fmt.Errorf("%s: not an OUTPUT=json report: %w", path, err)
+	}
+	if out.Results == nil {
+		return out, fmt.Errorf("%s: not an OUTPUT=json report: no results", path)
+	}
+	return out, nil
+}
+
+// printDivergence explains each target that behaves differently between
+// reports: how it fared in every report, and why it failed where it did.
+func printDivergence(m matrix, reports []nodeReport) {
+	var differ []matrixRow
+	for _, row := range m.Targets {
+		if !row.Consistent {
+			differ = append(differ, row)
+		}
+	}
+	if len(differ) == 0 {
+		fmt.Fprintf(tableOut, "  %s%s✓ Every target behaves the same in all %d clusters%s\n\n", colorBold, colorGreen, len(reports), colorReset)
+		return
+	}
+
+	width := 0
+	for _, rep := range reports {
+		width = max(width, len(rep.Node))
+	}
+	fmt.Printf("  %sDiffering targets%s\n", colorBold, colorReset)
+	for _, row := range differ {
+		fmt.Printf("\n  %s\n", row.Target)
+		for _, rep := range reports {
+			r, ok := findResult(rep.Results, row)
+			switch {
+			case !ok:
+				fmt.Printf("    %s%-*s  not probed%s\n", colorDim, width, rep.Node, colorReset)
+			case r.Incomplete:
+				fmt.Printf("    %s%-*s  SKIP%s\n", colorDim, width, rep.Node, colorReset)
+			case r.Passed:
+				fmt.Printf("    %s%-*s  PASS%s\n", colorGreen, width, rep.Node, colorReset)
+			default:
+				fmt.Printf("    %s%-*s  FAIL  %s%s\n", colorRed, width, rep.Node, failureDetail(r), colorReset)
+			}
+		}
+	}
+	fmt.Println()
+}
+
+// findResult returns the result for row's target.
+func findResult(results []jsonResult, row matrixRow) (jsonResult, bool) {
+	for _, r := range results {
+		if r.Type == row.Type && r.Host == row.Host && r.Port == row.Port && r.Family == row.Family && r.Method == row.Method && r.Path == row.Path {
+			return r, true
+		}
+	}
+	return jsonResult{}, false
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/cheolhuikim/egress-probe/pkg/probe"
+)
+
+// Istio's sidecar captures outbound TCP with iptables and hands it to Envoy's
+// outbound listener; its admin interface serves on loopback.
+const (
+	envoyOutboundAddr = "127.0.0.1:15001"
+	envoyAdminURL     = "http://127.0.0.1:15000"
+
+	defaultMeshBypassUID = 1337 // Istio's proxy UID; Linkerd uses 2102
+)
+
+// detectSidecar reports whether an Envoy sidecar intercepts this Pod's
+// outbound traffic, with a description of it.
+func detectSidecar(ctx context.Context) (string, bool) {
+	d := net.Dialer{Timeout: 500 * time.Millisecond}
+	conn, err := d.DialContext(ctx, "tcp", envoyOutboundAddr)
+	if err != nil {
+		return "", false
+	}
+	conn.Close()
+
+	desc := "Envoy sidecar (outbound capture on :15001)"
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, envoyAdminURL+"/server_info", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return desc, true
+	}
+	defer resp.Body.Close()
+	var info struct {
+		Version string `json:"version"`
+	}
+	// The version reads "<commit>/<version>/<status>/<build type>/<TLS library>".
+	if json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&info) == nil {
+		if parts := strings.Split(info.Version, "/"); len(parts) > 1 {
+			desc += ", Envoy " + parts[1]
+		}
+	}
+	return desc, true
+}
+
+// runBypass probes targets a second time from a child process running as
+// uid, which the mesh exempts from outbound capture, and returns its
+// results. It needs CAP_SETUID and CAP_SETGID, i.e. root in the container.
+func runBypass(ctx context.Context, cfg Config, targets []probe.Target, uid int) ([]jsonResult, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	req, err := json.Marshal(runRequest{Targets: toRunTargets(targets), Timeout: cfg.Timeout.String(), Profile: cfg.Profile})
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.CommandContext(ctx, self, "mesh-bypass")
+	cmd.Stdin = bytes.NewReader(req)
+	cmd.Stderr = os.Stderr
+	if err := runAsUID(cmd, uid); err != nil {
+		return nil, err
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("running as UID %d: %w", uid, err)
+	}
+	var report nodeReport
+	if err := json.Unmarshal(out, &report); err != nil {
+		return nil, fmt.Errorf("reading bypass results: %w", err)
+	}
+	if len(report.Results) != len(targets) {
+		return nil, fmt.Errorf("bypass run returned %d results for %d targets", len(report.Results), len(targets))
+	}
+	return report.Results, nil
+}
+
+// runMeshBypass implements the internal "mesh-bypass" command: it reads a
+// runRequest on stdin, probes its targets and writes a nodeReport to stdout.
+func runMeshBypass(ctx context.Context) int {
+	var req runRequest
+	if err := json.NewDecoder(io.LimitReader(os.Stdin, maxReportBytes)).Decode(&req); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: invalid request: %v\n", err)
+		return exitFailed
+	}
+	targets, err := req.probeTargets()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: invalid request: %v\n", err)
+		return exitFailed
+	}
+	cfg := Config{Profile: req.Profile, Timeout: 5 * time.Second}
+	if d, err := time.ParseDuration(req.Timeout); err == nil && d > 0 {
+		cfg.Timeout = d
+	}
+
+	start := time.Now()
+	probe.WarmupDNS(ctx, cfg.Timeout)
+	results, _ := probe.Run(ctx, targets, probeOptions(cfg))
+	out := buildJSON(results, cfg.Timeout, time.Since(start))
+	json.NewEncoder(os.Stdout).Encode(nodeReport{Time: start, Summary: out.Summary, Results: out.Results})
+	return 0
+}
+
+// jsonMesh is the outcome of the same target probed around the mesh
+// (MESH_COMPARE).
+type jsonMesh struct {
+	Sidecar       string `json:"sidecar"`
+	BypassBlocked bool   `json:"bypass_blocked"`
+	BypassDetail  string `json:"bypass_detail,omitempty"`
+	Differs       bool   `json:"differs"`
+}
+
+// addMeshComparison attaches the bypass outcome, if any, to the matching
+// results.
+func addMeshComparison(results []jsonResult, sidecar string, bypass []jsonResult) {
+	for i, b := range bypass {
+		m := &jsonMesh{Sidecar: sidecar, BypassBlocked: b.Blocked, Differs: b.Blocked != results[i].Blocked}
+		if b.Blocked {
+			b.Type = "allow"
+			m.BypassDetail = failureDetail(b)
+		}
+		results[i].Mesh = m
+	}
+}
+
+// printMeshComparison lists each target's outcome through the mesh next to
+// its outcome bypassing it, and explains the differences.
+func printMeshComparison(sidecar string, uid int, results []probe.Result, bypass []jsonResult) {
+	if bypass == nil {
+		return
+	}
+	differences := 0
+	for i, r := range results {
+		if r.Blocked != bypass[i].Blocked {
+			differences++
+		}
+	}
+	fmt.Printf("  %sMesh comparison%s %s(%s; bypass as UID %d)%s", colorBold, colorReset, colorDim, sidecar, uid, colorReset)
+	if differences > 0 {
+		fmt.Fprintf(tableOut, " — %s%d difference(s)%s\n", colorYellow, differences, colorReset)
+	} else {
+		fmt.Fprintf(tableOut, " — %ssame outcome both ways%s\n", colorGreen, colorReset)
+	}
+	for i, r := range results {
+		// Describe where each side was blocked, whatever the target's type.
+		b := bypass[i]
+		b.Type = "allow"
+		asAllow := r
+		asAllow.Target.ExpectErr = false
+		label := fmt.Sprintf("%s:%d", r.Target.Host, r.Target.Port)
+		switch {
+		case r.Incomplete || b.Incomplete:
+			fmt.Printf("    %s? %s  interrupted%s\n", colorDim, label, colorReset)
+		case r.Blocked == b.Blocked && r.Blocked:
+			fmt.Fprintf(tableOut, "    %s✓ %s  blocked both ways — not the mesh%s\n", colorDim, label, colorReset)
+		case r.Blocked == b.Blocked:
+			fmt.Fprintf(tableOut, "    %s✓ %s  reachable both ways%s\n", colorDim, label, colorReset)
+		case r.Blocked:
+			fmt.Fprintf(tableOut, "    %s✗ %s  blocked by the mesh (%s), reachable bypassing it — check outboundTrafficPolicy REGISTRY_ONLY and ServiceEntries%s\n",
+				colorYellow, label, failureReason(asAllow), colorReset)
+		default:
+			fmt.Fprintf(tableOut, "    %s✗ %s  reachable only through the mesh (bypass: %s) — an egress gateway or mesh route carries it%s\n",
+				colorYellow, label, failureDetail(b), colorReset)
+		}
+	}
+	fmt.Println()
+}
@@ -0,0 +1,12 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"os/exec"
+)
+
+func runAsUID(cmd *exec.Cmd, uid int) error {
+	return errors.New("running as another UID is not supported on this platform")
+}
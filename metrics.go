@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metricsServer serves the daemon's last cycle as Prometheus metrics on
+// METRICS_ADDR, with the metrics of TEXTFILE_DIR, plus counters that add up
+// across cycles so that failures between two scrapes aren't lost.
+type metricsServer struct {
+	mu       sync.Mutex
+	last     string         // the last cycle, as promText renders it
+	runs     int            // cycles recorded
+	failures map[string]int // target labels → cycles in which the target failed
+}
+
+func newMetricsServer() *metricsServer {
+	return &metricsServer{failures: make(map[string]int)}
+}
+
+// record keeps a cycle for the next scrape. A nil m records nothing.
+func (m *metricsServer) record(cfg Config, out jsonOutput, end time.Time) {
+	if m == nil {
+		return
+	}
+	text := promText(cfg, out, end)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.last = text
+	m.runs++
+	for _, r := range out.Results {
+		if r.Incomplete {
+			continue
+		}
+		labels := promLabels(cfg, r)
+		if !r.Passed {
+			m.failures[labels]++
+		} else if _, ok := m.failures[labels]; !ok {
+			m.failures[labels] = 0 // a counter starts at zero, not at the first failure
+		}
+	}
+}
+
+// render returns the metrics as they are now.
+func (m *metricsServer) render() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var b strings.Builder
+	b.WriteString(m.last)
+	fmt.Fprintf(&b, "# HELP egress_probe_runs_total Cycles run since the probe started.\n# TYPE egress_probe_runs_total counter\n")
+	fmt.Fprintf(&b, "egress_probe_runs_total %d\n", m.runs)
+	fmt.Fprintf(&b, "# HELP egress_probe_target_failures_total Cycles in which the target didn't meet its expectation.\n# TYPE egress_probe_target_failures_total counter\n")
+	for _, labels := range sortedKeys(m.failures) {
+		fmt.Fprintf(&b, "egress_probe_target_failures_total{%s} %d\n", labels, m.failures[labels])
+	}
+	return b.String()
+}
+
+// serve serves GET /metrics on addr until ctx is done.
+func (m *metricsServer) serve(ctx context.Context, addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		fmt.Fprint(w, m.render())
+	})
+	srv := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	go func() {
+		logf("metrics on http://%s/metrics", addr)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logf("METRICS_ADDR: %v", err)
+		}
+	}()
+}
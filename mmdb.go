@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"os"
+)
+
+// mmdbMetadataMarker precedes the metadata at the end of a MaxMind DB file.
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// mmdb reads MaxMind DB files (GeoLite2, GeoIP2 and compatible), as
+// specified at https://maxmind.github.io/MaxMind-DB/. Only what a lookup
+// needs is implemented.
+type mmdb struct {
+	data       []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	dataStart  uint // offset of the data section
+	ipv4Start  uint // node of ::/96, where IPv4 lookups start in an IPv6 tree
+}
+
+func openMMDB(path string) (*mmdb, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	i := bytes.LastIndex(data, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, fmt.Errorf("%s is not a MaxMind DB file", path)
+	}
+	metaStart := uint(i + len(mmdbMetadataMarker))
+	db := &mmdb{data: data}
+	// Pointers in the metadata are relative to its own start.
+	db.dataStart = metaStart
+	v, _, err := db.decode(metaStart)
+	if err != nil {
+		return nil, fmt.Errorf("%s: metadata: %w", path, err)
+	}
+	meta, _ := v.(map[string]any)
+	nodeCount, _ := meta["node_count"].(uint64)
+	recordSize, _ := meta["record_size"].(uint64)
+	ipVersion, _ := meta["ip_version"].(uint64)
+	if recordSize != 24 && recordSize != 28 && recordSize != 32 {
+		return nil, fmt.Errorf("%s: unsupported record size %d", path, recordSize)
+	}
+	db.nodeCount, db.recordSize, db.ipVersion = uint(nodeCount), uint(recordSize), uint(ipVersion)
+	treeSize := db.recordSize * 2 / 8 * db.nodeCount
+	if treeSize+16 > uint(i) {
+		return nil, fmt.Errorf("%s: search tree exceeds the file", path)
+	}
+	db.dataStart = treeSize + 16
+
+	if db.ipVersion == 6 {
+		node := uint(0)
+		for range 96 {
+			if node >= db.nodeCount {
+				break
+			}
+			node = db.record(node, 0)
+		}
+		db.ipv4Start = node
+	}
+	return db, nil
+}
+
+// lookup returns the record for addr, or nil if the database has none.
+func (db *mmdb) lookup(addr netip.Addr) (any, error) {
+	addr = addr.Unmap()
+	node, bits := uint(0), addr.AsSlice()
+	switch {
+	case addr.Is4() && db.ipVersion == 6:
+		node = db.ipv4Start
+	case addr.Is6() && db.ipVersion == 4:
+		return nil, nil
+	}
+	for i := 0; i < len(bits)*8 && node < db.nodeCount; i++ {
+		node = db.record(node, uint(bits[i/8]>>(7-i%8)&1))
+	}
+	if node <= db.nodeCount {
+		return nil, nil
+	}
+	offset := node - db.nodeCount - 16 + db.dataStart
+	v, _, err := db.decode(offset)
+	return v, err
+}
+
+// record returns the left (bit 0) or right (bit 1) record of node.
+func (db *mmdb) record(node, bit uint) uint {
+	b := db.data
+	switch db.recordSize {
+	case 24:
+		off := node*6 + bit*3
+		return uint(b[off])<<16 | uint(b[off+1])<<8 | uint(b[off+2])
+	case 28:
+		off := node * 7
+		if bit == 0 {
+			return uint(b[off+3]&0xf0)<<20 | uint(b[off])<<16 | uint(b[off+1])<<8 | uint(b[off+2])
+		}
+		return uint(b[off+3]&0x0f)<<24 | uint(b[off+4])<<16 | uint(b[off+5])<<8 | uint(b[off+6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[node*8+bit*4:]))
+	}
+}
+
+var errMMDBCorrupt = errors.New("corrupt data section")
+
+// decode decodes the value at offset and returns it with the offset that
+// follows it.
+func (db *mmdb) decode(offset uint) (any, uint, error) {
+	b := db.data
+	if offset >= uint(len(b)) {
+		return nil, 0, errMMDBCorrupt
+	}
+	ctrl := b[offset]
+	offset++
+	typ := uint(ctrl >> 5)
+	if typ == 1 { // pointer
+		ss, vvv := uint(ctrl>>3&3), uint(ctrl&7)
+		if offset+ss+1 > uint(len(b)) {
+			return nil, 0, errMMDBCorrupt
+		}
+		var ptr uint
+		switch ss {
+		case 0:
+			ptr = vvv<<8 | uint(b[offset])
+		case 1:
+			ptr = (vvv<<16 | uint(b[offset])<<8 | uint(b[offset+1])) + 2048
+		case 2:
+			ptr = (vvv<<24 | uint(b[offset])<<16 | uint(b[offset+1])<<8 | uint(b[offset+2])) + 526336
+		case 3:
+			ptr = uint(binary.BigEndian.Uint32(b[offset:]))
+		}
+		v, _, err := db.decode(db.dataStart + ptr)
+		return v, offset + ss + 1, err
+	}
+	if typ == 0 { // extended
+		if offset >= uint(len(b)) {
+			return nil, 0, errMMDBCorrupt
+		}
+		typ = 7 + uint(b[offset])
+		offset++
+	}
+
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if offset+n > uint(len(b)) {
+			return nil, 0, errMMDBCorrupt
+		}
+		extra := uint(0)
+		for _, c := range b[offset : offset+n] {
+			extra = extra<<8 | uint(c)
+		}
+		size = []uint{29, 285, 65821}[n-1] + extra
+		offset += n
+	}
+
+	switch typ {
+	case 7: // map
+		m := make(map[string]any, size)
+		for range size {
+			k, next, err := db.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			v, next, err := db.decode(next)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, _ := k.(string)
+			m[key], offset = v, next
+		}
+		return m, offset, nil
+	case 11: // array
+		a := make([]any, 0, size)
+		for range size {
+			v, next, err := db.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			a, offset = append(a, v), next
+		}
+		return a, offset, nil
+	case 14: // boolean: the value is the size
+		return size != 0, offset, nil
+	}
+
+	if offset+size > uint(len(b)) {
+		return nil, 0, errMMDBCorrupt
+	}
+	raw := b[offset : offset+size]
+	offset += size
+	switch typ {
+	case 2: // UTF-8 string
+		return string(raw), offset, nil
+	case 3: // double
+		if size != 8 {
+			return nil, 0, errMMDBCorrupt
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(raw)), offset, nil
+	case 15: // float
+		if size != 4 {
+			return nil, 0, errMMDBCorrupt
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(raw))), offset, nil
+	case 4: // bytes
+		return raw, offset, nil
+	case 5, 6, 9: // uint16, uint32, uint64
+		n := uint64(0)
+		for _, c := range raw {
+			n = n<<8 | uint64(c)
+		}
+		return n, offset, nil
+	case 8: // int32
+		n := uint32(0)
+		for _, c := range raw {
+			n = n<<8 | uint32(c)
+		}
+		if size == 4 {
+			return int64(int32(n)), offset, nil
+		}
+		return int64(n), offset, nil
+	case 10: // uint128: too wide, and no location field uses it
+		return nil, offset, nil
+	}
+	return nil, 0, fmt.Errorf("unknown data type %d", typ)
+}
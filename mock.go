@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// mockBehavior is one kind of mock target served by "egress-probe serve-mock".
+type mockBehavior struct {
+	name   string
+	desc   string
+	expect string // what a probe of it reports
+}
+
+var mockBehaviors = []mockBehavior{
+	{"ok", "TLS + HTTP with a certificate from -ca-file", "OK"},
+	{"http", "plain HTTP (probe as http://)", "OK"},
+	{"reset", "accepts, then resets the connection", "TLS: connection reset"},
+	{"eof", "accepts, then closes without a TLS handshake", "TLS: EOF"},
+	{"slow", "accepts, then stalls for -delay", "TLS: timeout"},
+	{"bad-cert", "TLS with an untrusted self-signed certificate", "TLS: cert: unknown authority"},
+	{"expired", "TLS with an expired certificate from -ca-file", "TLS: cert: expired"},
+	{"wrong-sni", "TLS with a certificate for another name", "TLS: cert error"},
+	{"data-reset", "TLS handshake, then resets on the first request", "OK; with DATA_CHECK and phases=+http, TLS: data blocked"},
+}
+
+// runMock implements "egress-probe serve-mock": it serves one listener per
+// behavior on consecutive ports so that every failure classification can be
+// exercised without depending on a real network. It blocks until ctx is
+// cancelled and returns the process exit code.
+func runMock(ctx context.Context, args []string) int {
+	fs := flag.NewFlagSet("serve-mock", flag.ExitOnError)
+	host := fs.String("host", "127.0.0.1", "address to listen on; also the name the certificates are issued for")
+	port := fs.Int("port", 9440, "port of the first behavior; the others follow consecutively")
+	delay := fs.Duration("delay", 30*time.Second, "how long the slow behavior stalls")
+	caFile := fs.String("ca-file", filepath.Join(os.TempDir(), "egress-probe-mock-ca.pem"), "where to write the certificates to trust (use with SSL_CERT_FILE)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s serve-mock [flags] [behavior...]\n\nBehaviors (default: all):\n", os.Args[0])
+		for _, b := range mockBehaviors {
+			fmt.Fprintf(fs.Output(), "  %-10s %s\n", b.name, b.desc)
+		}
+		fmt.Fprintf(fs.Output(), "\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	behaviors := mockBehaviors
+	if fs.NArg() > 0 {
+		behaviors = nil
+		for _, name := range fs.Args() {
+			i := mockBehaviorIndex(name)
+			if i < 0 {
+				fmt.Fprintf(os.Stderr, "Error: unknown behavior %q\n", name)
+				fs.Usage()
+				return exitFailed
+			}
+			behaviors = append(behaviors, mockBehaviors[i])
+		}
+	}
+
+	certs, err := newMockCerts(*host)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: generating certificates: %v\n", err)
+		return exitFailed
+	}
+	if err := os.WriteFile(*caFile, certs.caPEM, 0o644); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: writing CA file: %v\n", err)
+		return exitFailed
+	}
+
+	var targets []string
+	fmt.Printf("\n  %sMock targets%s (Ctrl-C to stop)\n\n", colorBold, colorReset)
+	for i, b := range behaviors {
+		addr := net.JoinHostPort(*host, strconv.Itoa(*port+i))
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return exitFailed
+		}
+		defer ln.Close()
+		go serveMock(ctx, ln, b.name, certs, *delay)
+
+		target := addr
+		if b.name == "http" {
+			target = "http://" + addr
+		}
+		targets = append(targets, target)
+		fmt.Fprintf(tableOut, "    %-10s %-22s %s%s → %s%s\n", b.name, addr, colorDim, b.desc, b.expect, colorReset)
+	}
+	fmt.Printf("\n  Try:\n    SSL_CERT_FILE=%s ALLOW_TARGETS=%q %s\n\n", *caFile, strings.Join(targets, ","), os.Args[0])
+
+	<-ctx.Done()
+	logf("shutting down")
+	return 0
+}
+
+func mockBehaviorIndex(name string) int {
+	for i, b := range mockBehaviors {
+		if b.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// mockCerts are the certificates the mock TLS behaviors present. All but the
+// untrusted one are written to -ca-file, so that each behavior fails only for
+// the reason it is meant to.
+type mockCerts struct {
+	good, expired, wrongName, untrusted tls.Certificate
+	caPEM                               []byte
+}
+
+func newMockCerts(host string) (*mockCerts, error) {
+	now := time.Now()
+	var c mockCerts
+	var err error
+	if c.good, _, err = selfSignedCert("egress-probe mock", []string{host, "localhost"}, now.Add(-time.Hour), now.AddDate(1, 0, 0)); err != nil {
+		return nil, err
+	}
+	if c.expired, _, err = selfSignedCert("egress-probe mock (expired)", []string{host, "localhost"}, now.Add(-48*time.Hour), now.Add(-24*time.Hour)); err != nil {
+		return nil, err
+	}
+	if c.wrongName, _, err = selfSignedCert("egress-probe mock (wrong name)", []string{"wrong-sni.invalid"}, now.Add(-time.Hour), now.AddDate(1, 0, 0)); err != nil {
+		return nil, err
+	}
+	if c.untrusted, _, err = selfSignedCert("egress-probe mock (untrusted)", []string{host, "localhost"}, now.Add(-time.Hour), now.AddDate(1, 0, 0)); err != nil {
+		return nil, err
+	}
+	for _, cert := range []tls.Certificate{c.good, c.expired, c.wrongName} {
+		c.caPEM = append(c.caPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})...)
+	}
+	return &c, nil
+}
+
+// serveMock serves one behavior on ln until ctx is cancelled.
+func serveMock(ctx context.Context, ln net.Listener, behavior string, certs *mockCerts, delay time.Duration) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "egress-probe mock: "+behavior+"\n")
+	})
+	srv := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+		ErrorLog:          log.New(io.Discard, "", 0), // handshake failures are the point
+	}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	var cert *tls.Certificate
+	switch behavior {
+	case "http":
+		srv.Serve(ln)
+		return
+	case "ok":
+		cert = &certs.good
+	case "bad-cert":
+		cert = &certs.untrusted
+	case "expired":
+		cert = &certs.expired
+	case "wrong-sni":
+		cert = &certs.wrongName
+	}
+	if cert != nil {
+		srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{*cert}}
+		srv.ServeTLS(ln, "", "")
+		return
+	}
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logf("serve-mock %s: %v", behavior, err)
+			}
+			return
+		}
+		go func() {
+			switch behavior {
+			case "reset":
+				// Closing with a zero linger time sends a RST instead of a FIN.
+				if tc, ok := conn.(*net.TCPConn); ok {
+					tc.SetLinger(0)
+				}
+			case "eof":
+				// Read the ClientHello first, like a firewall inspecting SNI;
+				// closing with unread data would send a RST instead.
+				conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+				conn.Read(make([]byte, 4096))
+			case "slow":
+				sleepCtx(ctx, delay)
+			case "data-reset":
+				// Like a firewall that lets the handshake through and
+				// inspects what follows.
+				conn.SetDeadline(time.Now().Add(10 * time.Second))
+				tc := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{certs.good}})
+				if tc.Handshake() == nil {
+					tc.Read(make([]byte, 4096))
+				}
+				if c, ok := conn.(*net.TCPConn); ok {
+					c.SetLinger(0)
+				}
+			}
+			conn.Close()
+		}()
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// netnsPIDEnv carries the PID whose network namespace the re-executed probe
+// enters.
+const netnsPIDEnv = "EGRESS_PROBE_NETNS_PID"
+
+// parseNetNS validates a NETNS value: "host", "pid:<pid>",
+// "container:<id>" or "pod:<namespace>/<name>".
+func parseNetNS(raw string) (kind, value string, err error) {
+	if raw == "host" {
+		return "pid", "1", nil
+	}
+	kind, value, ok := strings.Cut(raw, ":")
+	switch {
+	case !ok || value == "":
+	case kind == "pid":
+		if n, err := strconv.Atoi(value); err == nil && n > 0 {
+			return kind, value, nil
+		}
+	case kind == "container", kind == "pod":
+		return kind, value, nil
+	}
+	return "", "", fmt.Errorf("invalid NETNS %q: expected host, pid:<pid>, container:<id> or pod:<namespace>/<name>", raw)
+}
+
+// enterNetNS moves the probe into the network namespace NETNS names. The
+// first call, in the process the user started, resolves it to a PID and
+// runs the probe again as a child that enters it; the parent then exits
+// with the child's code and entered is false. In the child, it enters the
+// namespace and reports entered, so that the run continues there.
+func enterNetNS(ctx context.Context, cfg Config) (code int, entered bool) {
+	if raw := os.Getenv(netnsPIDEnv); raw != "" {
+		pid, _ := strconv.Atoi(raw)
+		if err := joinNetNS(pid); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: NETNS: %v\n", err)
+			return exitFailed, false
+		}
+		return 0, true
+	}
+
+	pid, err := resolveNetNS(ctx, cfg.NetNS)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: NETNS: %v\n", err)
+		return exitFailed, false
+	}
+	return runInNetNS(ctx, pid), false
+}
+
+// resolveNetNS finds a process in the network namespace spec names. Other
+// pods' processes are only visible with hostPID.
+func resolveNetNS(ctx context.Context, spec string) (int, error) {
+	kind, value, err := parseNetNS(spec)
+	if err != nil {
+		return 0, err
+	}
+	switch kind {
+	case "pid":
+		pid, _ := strconv.Atoi(value)
+		if _, err := os.Stat(fmt.Sprintf("/proc/%d/ns/net", pid)); err != nil {
+			return 0, fmt.Errorf("no process %d (is hostPID set?): %w", pid, err)
+		}
+		return pid, nil
+	case "pod":
+		id, err := podContainerID(ctx, value)
+		if err != nil {
+			return 0, err
+		}
+		value = id
+	}
+	return containerPID(value)
+}
+
+// podContainerID returns the ID of the first running container of the pod
+// ref ("namespace/name"), which must be scheduled on this node.
+func podContainerID(ctx context.Context, ref string) (string, error) {
+	client, err := newInClusterClient()
+	if err != nil {
+		return "", err
+	}
+	ns, name, err := splitNamespacedName(ref, client.namespace)
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(ctx, clusterTargetsTimeout)
+	defer cancel()
+	var pod struct {
+		Spec struct {
+			NodeName string `json:"nodeName"`
+		} `json:"spec"`
+		Status struct {
+			ContainerStatuses []struct {
+				Name        string `json:"name"`
+				ContainerID string `json:"containerID"`
+				State       struct {
+					Running *struct{} `json:"running"`
+				} `json:"state"`
+			} `json:"containerStatuses"`
+		} `json:"status"`
+	}
+	if err := client.get(ctx, "/api/v1/namespaces/"+ns+"/pods/"+name, &pod); err != nil {
+		return "", fmt.Errorf("reading pod %s/%s: %w", ns, name, err)
+	}
+	if node := os.Getenv("NODE_NAME"); node != "" && pod.Spec.NodeName != node {
+		return "", fmt.Errorf("pod %s/%s runs on node %s, not on %s; run the probe there", ns, name, pod.Spec.NodeName, node)
+	}
+	for _, c := range pod.Status.ContainerStatuses {
+		if c.State.Running != nil && c.ContainerID != "" {
+			return c.ContainerID, nil
+		}
+	}
+	return "", fmt.Errorf("pod %s/%s has no running container", ns, name)
+}
+
+// containerPID finds a process of the container id, as reported by the
+// runtime ("containerd://<id>") or bare, by its cgroup. Every cgroup layout
+// the common runtimes use names the container ID.
+func containerPID(id string) (int, error) {
+	if _, after, ok := strings.Cut(id, "://"); ok {
+		id = after
+	}
+	if len(id) < 12 {
+		return 0, fmt.Errorf("container ID %q is too short to be unique", id)
+	}
+	paths, _ := filepath.Glob("/proc/[0-9]*/cgroup")
+	var pids []int
+	for _, p := range paths {
+		data, err := os.ReadFile(p)
+		if err != nil || !strings.Contains(string(data), id) {
+			continue
+		}
+		if pid, err := strconv.Atoi(filepath.Base(filepath.Dir(p))); err == nil {
+			pids = append(pids, pid)
+		}
+	}
+	if len(pids) == 0 {
+		return 0, fmt.Errorf("no process of container %s on this node (is hostPID set?)", id)
+	}
+	sort.Ints(pids)
+	return pids[0], nil
+}
+
+// netnsDescription describes the namespace entered, for the environment
+// fingerprint, e.g. "pid 4242 (nginx)".
+func netnsDescription() string {
+	raw := os.Getenv(netnsPIDEnv)
+	if raw == "" {
+		return ""
+	}
+	comm, _ := os.ReadFile("/proc/" + raw + "/comm")
+	if c := strings.TrimSpace(string(comm)); c != "" {
+		return fmt.Sprintf("pid %s (%s)", raw, c)
+	}
+	return "pid " + raw
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// setnsTrap is the number of the setns system call, which package syscall
+// doesn't define.
+var setnsTrap = map[string]uintptr{
+	"amd64": 308, "arm64": 268, "riscv64": 268, "386": 346, "arm": 375, "ppc64le": 350, "s390x": 339,
+}[runtime.GOARCH]
+
+// runInNetNS runs the probe again, with the same arguments and environment,
+// in a private mount namespace, where joinNetNS can swap in pid's DNS
+// configuration without affecting the rest of the node. It returns the
+// child's exit code.
+func runInNetNS(ctx context.Context, pid int) int {
+	self, err := os.Executable()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitFailed
+	}
+	cmd := exec.CommandContext(ctx, self, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), netnsPIDEnv+"="+strconv.Itoa(pid))
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Unshareflags: syscall.CLONE_NEWNS}
+	// Let the child print its partial report, as the signal asks.
+	cmd.Cancel = func() error { return cmd.Process.Signal(syscall.SIGTERM) }
+	cmd.WaitDelay = 30 * time.Second
+
+	err = cmd.Run()
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &exitErr) && exitErr.ExitCode() >= 0:
+		return exitErr.ExitCode()
+	case errors.Is(err, syscall.EPERM):
+		fmt.Fprintf(os.Stderr, "Error: NETNS needs a privileged container (CAP_SYS_ADMIN): %v\n", err)
+	default:
+		fmt.Fprintf(os.Stderr, "Error: NETNS: %v\n", err)
+	}
+	return exitFailed
+}
+
+// joinNetNS moves every thread of the process into pid's network namespace,
+// and mounts copies of its resolv.conf and hosts over ours so that names
+// resolve as they do for pid. setns applies per thread, and Go schedules
+// goroutines on all of them, so AllThreadsSyscall is the only way to move the
+// whole process; it needs a build without cgo.
+func joinNetNS(pid int) error {
+	for _, name := range []string{"/etc/resolv.conf", "/etc/hosts"} {
+		if err := overlayFile(name, fmt.Sprintf("/proc/%d/root%s", pid, name)); err != nil {
+			logf("NETNS: keeping this container's %s: %v", name, err)
+		}
+	}
+
+	if setnsTrap == 0 {
+		return fmt.Errorf("not supported on %s", runtime.GOARCH)
+	}
+	f, err := os.Open(fmt.Sprintf("/proc/%d/ns/net", pid))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, _, errno := syscall.AllThreadsSyscall(setnsTrap, f.Fd(), syscall.CLONE_NEWNET, 0)
+	switch errno {
+	case 0:
+	case syscall.ENOTSUP:
+		return errors.New("this build uses cgo; rebuild with CGO_ENABLED=0")
+	default:
+		return fmt.Errorf("entering the network namespace of pid %d: %w", pid, errno)
+	}
+	logf("probing from the network namespace of %s", netnsDescription())
+	return nil
+}
+
+// overlayFile bind-mounts a copy of src over name. A file can't be
+// bind-mounted from another mount namespace directly.
+func overlayFile(name, src string) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp("", "egress-probe-netns-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // the mount keeps the file alive
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return syscall.Mount(tmp.Name(), name, "", syscall.MS_BIND, "")
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+)
+
+func runInNetNS(ctx context.Context, pid int) int {
+	fmt.Fprintln(os.Stderr, "Error: NETNS is only supported on Linux")
+	return exitFailed
+}
+
+func joinNetNS(pid int) error {
+	return errors.New("only supported on Linux")
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/cheolhuikim/egress-probe/pkg/probe"
+)
+
+// Kubernetes NetworkPolicy (networking.k8s.io/v1), reduced to the egress side.
+type networkPolicy struct {
+	Metadata objectMeta `json:"metadata"`
+	Spec     struct {
+		PodSelector labelSelector       `json:"podSelector"`
+		PolicyTypes []string            `json:"policyTypes"`
+		Egress      []networkPolicyRule `json:"egress"`
+	} `json:"spec"`
+}
+
+type networkPolicyList struct {
+	Items []networkPolicy `json:"items"`
+}
+
+type networkPolicyRule struct {
+	To    []networkPolicyPeer `json:"to"`
+	Ports []networkPolicyPort `json:"ports"`
+}
+
+type networkPolicyPeer struct {
+	IPBlock *struct {
+		CIDR   string   `json:"cidr"`
+		Except []string `json:"except"`
+	} `json:"ipBlock"`
+	PodSelector       *labelSelector `json:"podSelector"`
+	NamespaceSelector *labelSelector `json:"namespaceSelector"`
+}
+
+type networkPolicyPort struct {
+	Protocol string          `json:"protocol"`
+	Port     json.RawMessage `json:"port"` // number or named port
+	EndPort  int             `json:"endPort"`
+}
+
+type labelSelector struct {
+	MatchLabels      map[string]string `json:"matchLabels"`
+	MatchExpressions []struct {
+		Key      string   `json:"key"`
+		Operator string   `json:"operator"`
+		Values   []string `json:"values"`
+	} `json:"matchExpressions"`
+}
+
+// matches reports whether labels satisfy the selector. An empty selector
+// matches everything.
+func (s labelSelector) matches(labels map[string]string) bool {
+	for k, v := range s.MatchLabels {
+		if labels[k] != v {
+			return false
+		}
+	}
+	for _, e := range s.MatchExpressions {
+		v, ok := labels[e.Key]
+		in := false
+		for _, want := range e.Values {
+			in = in || v == want
+		}
+		switch e.Operator {
+		case "In":
+			if !ok || !in {
+				return false
+			}
+		case "NotIn":
+			if ok && in {
+				return false
+			}
+		case "Exists":
+			if !ok {
+				return false
+			}
+		case "DoesNotExist":
+			if ok {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// restrictsEgress reports whether the policy isolates selected Pods for
+// egress: explicitly via policyTypes, or implicitly by having egress rules.
+func (p networkPolicy) restrictsEgress() bool {
+	if len(p.Spec.PolicyTypes) == 0 {
+		return len(p.Spec.Egress) > 0
+	}
+	for _, t := range p.Spec.PolicyTypes {
+		if t == "Egress" {
+			return true
+		}
+	}
+	return false
+}
+
+// allows reports whether the rule admits a TCP connection to ip:port.
+// Pod and namespace selectors only match Pods, so they never admit the
+// external addresses egress-probe is about.
+func (r networkPolicyRule) allows(ip net.IP, port int) bool {
+	if len(r.Ports) > 0 {
+		ok := false
+		for _, p := range r.Ports {
+			ok = ok || p.matches(port)
+		}
+		if !ok {
+			return false
+		}
+	}
+	if len(r.To) == 0 {
+		return true
+	}
+	for _, peer := range r.To {
+		if peer.IPBlock == nil {
+			continue
+		}
+		if _, cidr, err := net.ParseCIDR(peer.IPBlock.CIDR); err != nil || !cidr.Contains(ip) {
+			continue
+		}
+		excluded := false
+		for _, ex := range peer.IPBlock.Except {
+			if _, cidr, err := net.ParseCIDR(ex); err == nil && cidr.Contains(ip) {
+				excluded = true
+			}
+		}
+		if !excluded {
+			return true
+		}
+	}
+	return false
+}
+
+func (p networkPolicyPort) matches(port int) bool {
+	if p.Protocol != "" && p.Protocol != "TCP" {
+		return false
+	}
+	if len(p.Port) == 0 {
+		return true
+	}
+	n, err := strconv.Atoi(string(p.Port))
+	if err != nil {
+		return false // named ports only resolve against Pods
+	}
+	if p.EndPort > 0 {
+		return port >= n && port <= p.EndPort
+	}
+	return port == n
+}
+
+// policyVerdict is what a policy engine says should happen to a target,
+// next to what the probe observed.
+type policyVerdict struct {
+	Expected string // "allow", "deny" or "unknown"
+	Reason   string // the deciding policy and rule, or why there is no verdict
+	Observed string // "allow" or "deny" at the TCP level, "" if incomplete
+	Mismatch bool
+}
+
+// podNetworkPolicies holds the NetworkPolicies that apply to the probe's own Pod.
+type podNetworkPolicies struct {
+	pod      string // namespace/name
+	policies []networkPolicy
+}
+
+// ownPodRef identifies the probe's Pod by POD_NAME/POD_NAMESPACE (downward
+// API), falling back to the hostname and the service account's namespace.
+func ownPodRef(client *kubeClient) (ns, name string) {
+	ns = os.Getenv("POD_NAMESPACE")
+	if ns == "" {
+		ns = client.namespace
+	}
+	name = os.Getenv("POD_NAME")
+	if name == "" {
+		name, _ = os.Hostname()
+	}
+	return ns, name
+}
+
+// ownPod reads the labels of the probe's Pod.
+func ownPod(ctx context.Context, client *kubeClient) (objectMeta, error) {
+	ns, name := ownPodRef(client)
+	var pod struct {
+		Metadata objectMeta `json:"metadata"`
+	}
+	if err := client.get(ctx, "/api/v1/namespaces/"+ns+"/pods/"+name, &pod); err != nil {
+		return objectMeta{}, fmt.Errorf("reading own pod %s/%s (set POD_NAME via the downward API): %w", ns, name, err)
+	}
+	pod.Metadata.Name, pod.Metadata.Namespace = name, ns
+	return pod.Metadata, nil
+}
+
+// loadNetworkPolicies reads the NetworkPolicies of the probe's namespace
+// and keeps those that select its Pod for egress.
+func loadNetworkPolicies(ctx context.Context) (*podNetworkPolicies, error) {
+	client, err := newInClusterClient()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, clusterTargetsTimeout)
+	defer cancel()
+	pod, err := ownPod(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	ns := pod.Namespace
+	var list networkPolicyList
+	if err := client.get(ctx, "/apis/networking.k8s.io/v1/namespaces/"+ns+"/networkpolicies", &list); err != nil {
+		return nil, fmt.Errorf("listing networkpolicies in %s: %w", ns, err)
+	}
+	return selectNetworkPolicies(pod, list.Items), nil
+}
+
+// selectNetworkPolicies keeps the policies of the Pod's namespace that
+// select it for egress.
+func selectNetworkPolicies(pod objectMeta, policies []networkPolicy) *podNetworkPolicies {
+	np := &podNetworkPolicies{pod: pod.Namespace + "/" + pod.Name}
+	for _, p := range policies {
+		if p.restrictsEgress() && p.Spec.PodSelector.matches(pod.Labels) {
+			np.policies = append(np.policies, p)
+		}
+	}
+	return np
+}
+
+// evaluate computes the expected outcome of r under the policies and
+// compares it with the TCP phase. The address the TCP phase connected to is
+// used when known, otherwise the first resolved address.
+func (np *podNetworkPolicies) evaluate(r probe.Result) policyVerdict {
+	v := policyVerdict{Expected: "unknown", Observed: observedVerdict(r)}
+
+	ip := resultIP(r)
+	switch {
+	case len(np.policies) == 0:
+		v.Expected, v.Reason = "allow", "no NetworkPolicy restricts egress from this Pod"
+	case ip == nil:
+		v.Reason = "target did not resolve"
+	default:
+		v.Expected = "deny"
+		names := make([]string, len(np.policies))
+		for i, p := range np.policies {
+			names[i] = p.Metadata.Name
+		}
+		v.Reason = fmt.Sprintf("no egress rule of %s allows %s", strings.Join(names, ", "), net.JoinHostPort(ip.String(), strconv.Itoa(r.Target.Port)))
+	policies:
+		for _, p := range np.policies {
+			for i, rule := range p.Spec.Egress {
+				if rule.allows(ip, r.Target.Port) {
+					v.Expected, v.Reason = "allow", fmt.Sprintf("%s egress[%d]", p.Metadata.Name, i)
+					break policies
+				}
+			}
+		}
+	}
+	v.Mismatch = v.Expected != "unknown" && v.Observed != "" && v.Expected != v.Observed
+	return v
+}
+
+// observedVerdict is "allow" or "deny" by the TCP phase of r, or "" if it
+// didn't get that far.
+func observedVerdict(r probe.Result) string {
+	switch {
+	case r.Incomplete:
+		return ""
+	case r.TCP.Success:
+		return "allow"
+	case r.TCP.Detail != "" && !strings.HasPrefix(r.TCP.Detail, "skipped"):
+		return "deny"
+	}
+	return ""
+}
+
+// resultIP returns the address r's TCP phase connected to, or else the first
+// address its DNS phase resolved.
+func resultIP(r probe.Result) net.IP {
+	if host, _, err := net.SplitHostPort(r.TCP.Addr); err == nil {
+		return net.ParseIP(host)
+	}
+	if !r.DNS.Success || len(r.DNS.Addrs) == 0 {
+		return nil
+	}
+	return net.ParseIP(r.DNS.Addrs[0])
+}
+
+// checkNetworkPolicies evaluates every result against the Pod's
+// NetworkPolicies. It returns nil, after logging why, if they can't be read.
+func checkNetworkPolicies(ctx context.Context, results []probe.Result) []policyVerdict {
+	np, err := loadNetworkPolicies(ctx)
+	if err != nil {
+		logf("NetworkPolicy check skipped: %v", err)
+		return nil
+	}
+	logf("NetworkPolicy check: %d policies restrict egress from pod %s", len(np.policies), np.pod)
+	verdicts := make([]policyVerdict, len(results))
+	for i, r := range results {
+		verdicts[i] = np.evaluate(r)
+	}
+	return verdicts
+}
+
+// printPolicyCheck lists the policy verdicts below the results table,
+// flagging each target where the policy and the network disagree.
+func printPolicyCheck(title string, results []probe.Result, verdicts []policyVerdict) {
+	if verdicts == nil {
+		return
+	}
+	mismatches := 0
+	for _, v := range verdicts {
+		if v.Mismatch {
+			mismatches++
+		}
+	}
+	fmt.Printf("  %s%s%s", colorBold, title, colorReset)
+	if mismatches > 0 {
+		fmt.Fprintf(tableOut, " — %s%d mismatch(es)%s\n", colorRed, mismatches, colorReset)
+	} else {
+		fmt.Fprintf(tableOut, " — %sconsistent%s\n", colorGreen, colorReset)
+	}
+	for i, r := range results {
+		v := verdicts[i]
+		mark, color := "✓", colorDim
+		note := ""
+		switch {
+		case v.Mismatch && v.Expected == "deny":
+			mark, color, note = "✗", colorRed, " — policy should block this but it is reachable"
+		case v.Mismatch:
+			mark, color, note = "✗", colorYellow, " — policy allows this; blocked elsewhere"
+		case v.Expected == "unknown" || v.Observed == "":
+			mark = "?"
+		}
+		observed := v.Observed
+		if observed == "" {
+			observed = "n/a"
+		}
+		fmt.Fprintf(tableOut, "    %s%s %s:%d  expected %s, observed %s (%s)%s%s\n", color, mark,
+			r.Target.Host, r.Target.Port, v.Expected, observed, v.Reason, note, colorReset)
+	}
+	fmt.Println()
+}
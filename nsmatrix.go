@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cheolhuikim/egress-probe/pkg/probe"
+)
+
+const (
+	// nsMatrixLabel marks the probe Pods of one MATRIX_NAMESPACES run.
+	nsMatrixLabel = "egress-probe.io/matrix"
+
+	// nsMatrixPodTimeout bounds how long a probe Pod may take to be
+	// scheduled, pull its image and finish, on top of RUN_TIMEOUT.
+	nsMatrixPodTimeout = 5 * time.Minute
+
+	// nsMatrixPoll is how often a probe Pod's status is checked.
+	nsMatrixPoll = 2 * time.Second
+
+	// namespacePlaceholder in a target's host stands for a namespace of the
+	// matrix; see namespaceTargets.
+	namespacePlaceholder = "{namespace}"
+)
+
+// matrixNamespace is one entry of MATRIX_NAMESPACES.
+type matrixNamespace struct {
+	Namespace      string
+	ServiceAccount string // "" = the namespace's default
+}
+
+// name is the entry's column in the matrix.
+func (n matrixNamespace) name() string {
+	if n.ServiceAccount == "" {
+		return n.Namespace
+	}
+	return n.Namespace + "/" + n.ServiceAccount
+}
+
+// parseMatrixNamespaces parses MATRIX_NAMESPACES: a comma-separated list of
+// namespaces, each optionally with the service account to probe as
+// ("namespace/serviceaccount").
+func parseMatrixNamespaces(raw string) ([]matrixNamespace, error) {
+	var out []matrixNamespace
+	seen := make(map[string]bool)
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		ns, sa, _ := strings.Cut(entry, "/")
+		if ns == "" || strings.Contains(sa, "/") {
+			return nil, fmt.Errorf("MATRIX_NAMESPACES: invalid entry %q: expected namespace or namespace/serviceaccount", entry)
+		}
+		n := matrixNamespace{Namespace: ns, ServiceAccount: sa}
+		if seen[n.name()] {
+			return nil, fmt.Errorf("MATRIX_NAMESPACES: %s is listed twice", n.name())
+		}
+		seen[n.name()] = true
+		out = append(out, n)
+	}
+	return out, nil
+}
+
+// parseLabels parses "key=value,key=value".
+func parseLabels(raw string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(entry, "=")
+		if !ok || k == "" {
+			return nil, fmt.Errorf("invalid label %q: expected key=value", entry)
+		}
+		labels[k] = v
+	}
+	return labels, nil
+}
+
+// namespaceOutcome is one namespace's part of a matrix run.
+type namespaceOutcome struct {
+	Name           string      `json:"name"`
+	Namespace      string      `json:"namespace"`
+	ServiceAccount string      `json:"service_account,omitempty"`
+	Pod            string      `json:"pod,omitempty"`
+	Error          string      `json:"error,omitempty"`
+	Report         *nodeReport `json:"report,omitempty"`
+}
+
+type namespaceMatrixOutput struct {
+	Namespaces []namespaceOutcome `json:"namespaces"`
+	Matrix     matrix             `json:"matrix"`
+}
+
+// runNamespaceMatrix probes cfg.Targets from a short-lived Pod in each of
+// cfg.MatrixNamespaces, in parallel, and prints one merged report with a
+// column per namespace. Each namespace's NetworkPolicies and service
+// account apply to its Pod, so the matrix shows what every tenant can reach.
+// It returns the exit code for the run.
+func runNamespaceMatrix(ctx context.Context, cfg Config) int {
+	client, err := newInClusterClient()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: MATRIX_NAMESPACES: %v\n", err)
+		return exitFailed
+	}
+	image := cfg.MatrixImage
+	if image == "" {
+		if image, err = ownImage(ctx, client); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: MATRIX_NAMESPACES: %v\n", err)
+			return exitFailed
+		}
+	}
+
+	jsonMode := machineOutput(cfg)
+	if !jsonMode {
+		printHeader(cfg, nil)
+		fmt.Printf("  Namespaces: %d (image %s)\n\n", len(cfg.MatrixNamespaces), image)
+	}
+	for _, t := range cfg.Targets {
+		if t.Exec != "" {
+			logf("%s: exec plugins only run locally and are not sent to probe Pods", targetKey(t))
+		}
+	}
+
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	run := hex.EncodeToString(suffix)
+
+	var all []string
+	for _, n := range cfg.MatrixNamespaces {
+		if !slices.Contains(all, n.Namespace) {
+			all = append(all, n.Namespace)
+		}
+	}
+	outcomes := make([]namespaceOutcome, len(cfg.MatrixNamespaces))
+	var wg sync.WaitGroup
+	for i, n := range cfg.MatrixNamespaces {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			outcomes[i] = namespaceOutcome{Name: n.name(), Namespace: n.Namespace, ServiceAccount: n.ServiceAccount}
+			targets := namespaceTargets(cfg.Targets, n.Namespace, all)
+			report, pod, err := probeFromNamespace(ctx, client, cfg, n, image, run, targets)
+			outcomes[i].Pod = pod
+			if err != nil {
+				outcomes[i].Error = err.Error()
+				return
+			}
+			report.Node = n.name()
+			outcomes[i].Report = report
+		}()
+	}
+	wg.Wait()
+
+	// As with agents: an incomplete run takes precedence over failures, and
+	// a namespace without a report counts as a failure.
+	var reports []nodeReport
+	failed, incomplete := false, false
+	for _, o := range outcomes {
+		if o.Report == nil {
+			failed = true
+			continue
+		}
+		reports = append(reports, *o.Report)
+		incomplete = incomplete || o.Report.Summary.Incomplete > 0
+		failed = failed || o.Report.Summary.Failed > 0
+	}
+	code := 0
+	switch {
+	case incomplete:
+		code = exitIncomplete
+	case failed:
+		code = exitFailed
+	}
+	m := buildMatrix(reports)
+
+	if jsonMode {
+		writeJSON(cfg, namespaceMatrixOutput{Namespaces: outcomes, Matrix: m})
+		return code
+	}
+
+	if len(reports) > 0 {
+		writeMatrix(os.Stdout, m, "namespaces")
+		fmt.Println()
+	}
+	for _, o := range outcomes {
+		if o.Report == nil {
+			fmt.Fprintf(tableOut, "  %s✗ %s: %s%s\n", colorRed, o.Name, o.Error, colorReset)
+			continue
+		}
+		for _, r := range o.Report.Results {
+			if !r.Passed && !r.Incomplete {
+				fmt.Fprintf(tableOut, "  %s✗ %s: %s %s:%d — %s%s\n", colorRed, o.Name, r.Type, r.Host, r.Port, failureDetail(r), colorReset)
+			}
+		}
+	}
+	if code == 0 {
+		fmt.Fprintf(tableOut, "  %s%s✓ All targets behave as expected in all %d namespaces%s\n\n", colorBold, colorGreen, len(outcomes), colorReset)
+	} else {
+		fmt.Println()
+	}
+	return code
+}
+
+// namespaceTargets returns the targets to probe from ns. A target whose host
+// contains {namespace} stands for one target per namespace of the matrix:
+// an allowed one is probed from each namespace against that namespace, a
+// denied one against every other namespace. Listing
+// "api.{namespace}.svc.cluster.local:8080" in both ALLOW_TARGETS and
+// DENY_TARGETS thus checks that each tenant reaches its own API and none of
+// the others'.
+func namespaceTargets(targets []probe.Target, ns string, all []string) []probe.Target {
+	var out []probe.Target
+	for _, t := range targets {
+		if t.Exec != "" {
+			continue
+		}
+		if !strings.Contains(t.Host, namespacePlaceholder) {
+			out = append(out, t)
+			continue
+		}
+		for _, other := range all {
+			if (other == ns) != t.ExpectErr {
+				e := t
+				e.Host = strings.ReplaceAll(t.Host, namespacePlaceholder, other)
+				out = append(out, e)
+			}
+		}
+	}
+	return out
+}
+
+// targetSpec formats t in the ALLOW_TARGETS syntax, with its per-target
+// options, so that the Pod probes it as it would be probed here. Phases
+// comes last: its value has commas, which only a last option may have.
+func targetSpec(t probe.Target) string {
+	addr := net.JoinHostPort(t.Host, strconv.Itoa(t.Port))
+	if t.SkipTLS && t.Port != 80 {
+		addr = "http://" + addr
+	}
+	opts := []string{addr}
+	add := func(key, value string) {
+		if value != "" {
+			opts = append(opts, key+"="+value)
+		}
+	}
+	add("expect", t.Expect)
+	add("issuer", t.Issuer)
+	add("method", t.Method)
+	add("path", t.Path)
+	add("family", t.Family)
+	add("client_cert", t.ClientCert)
+	add("client_key", t.ClientKey)
+	if t.Timeout > 0 {
+		add("timeout", t.Timeout.String())
+	}
+	if t.Priority != 0 {
+		add("priority", strconv.Itoa(t.Priority))
+	}
+	for _, key := range slices.Sorted(maps.Keys(t.Metadata)) {
+		opts = append(opts, key+"="+t.Metadata[key])
+	}
+	add("phases", t.Phases)
+	return strings.Join(opts, ";")
+}
+
+// ownImage returns the image of the probe's own container, for the probe
+// Pods to run.
+func ownImage(ctx context.Context, client *kubeClient) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, clusterTargetsTimeout)
+	defer cancel()
+	ns, name := ownPodRef(client)
+	var pod struct {
+		Spec struct {
+			Containers []struct {
+				Image string `json:"image"`
+			} `json:"containers"`
+		} `json:"spec"`
+	}
+	if err := client.get(ctx, "/api/v1/namespaces/"+ns+"/pods/"+name, &pod); err != nil {
+		return "", fmt.Errorf("reading own pod %s/%s to find the image (or set MATRIX_IMAGE): %w", ns, name, err)
+	}
+	for _, c := range pod.Spec.Containers {
+		if strings.Contains(c.Image, "egress-probe") {
+			return c.Image, nil
+		}
+	}
+	return "", fmt.Errorf("no container of pod %s/%s runs an egress-probe image; set MATRIX_IMAGE", ns, name)
+}
+
+// probeFromNamespace runs targets in a new Pod in n's namespace, waits for
+// it to finish, reads its report from the log and deletes it. It returns
+// the report and the Pod's name.
+func probeFromNamespace(ctx context.Context, client *kubeClient, cfg Config, n matrixNamespace, image, run string, targets []probe.Target) (*nodeReport, string, error) {
+	if len(targets) == 0 {
+		return nil, "", fmt.Errorf("no targets to probe from %s", n.Namespace)
+	}
+	var allow, deny []string
+	for _, t := range targets {
+		if t.ExpectErr {
+			deny = append(deny, targetSpec(t))
+		} else {
+			allow = append(allow, targetSpec(t))
+		}
+	}
+	env := []map[string]string{
+		{"name": "ALLOW_TARGETS", "value": strings.Join(allow, ",")},
+		{"name": "DENY_TARGETS", "value": strings.Join(deny, ",")},
+		{"name": "OUTPUT", "value": "ndjson"},
+		{"name": "TIMEOUT", "value": cfg.Timeout.String()},
+	}
+	if cfg.Profile != "" {
+		env = append(env, map[string]string{"name": "PROFILE", "value": cfg.Profile})
+	}
+	if cfg.RunTimeout > 0 {
+		env = append(env, map[string]string{"name": "RUN_TIMEOUT", "value": cfg.RunTimeout.String()})
+	}
+
+	deadline := nsMatrixPodTimeout + cfg.RunTimeout
+	labels := map[string]string{nsMatrixLabel: run}
+	if len(cfg.MatrixLabels) == 0 {
+		labels["app.kubernetes.io/name"] = "egress-probe"
+	}
+	for k, v := range cfg.MatrixLabels {
+		labels[k] = v
+	}
+	spec := map[string]any{
+		"restartPolicy":                 "Never",
+		"activeDeadlineSeconds":         int(deadline.Seconds()),
+		"automountServiceAccountToken":  false,
+		"terminationGracePeriodSeconds": 5,
+		"securityContext": map[string]any{
+			"runAsNonRoot":   true,
+			"seccompProfile": map[string]string{"type": "RuntimeDefault"},
+		},
+		"containers": []map[string]any{{
+			"name":  "egress-probe",
+			"image": image,
+			"env":   env,
+			"securityContext": map[string]any{
+				"allowPrivilegeEscalation": false,
+				"readOnlyRootFilesystem":   true,
+				"capabilities":             map[string]any{"drop": []string{"ALL"}},
+			},
+		}},
+	}
+	if n.ServiceAccount != "" {
+		spec["serviceAccountName"] = n.ServiceAccount
+	}
+	pod := map[string]any{
+		"apiVersion": "v1",
+		"kind":       "Pod",
+		"metadata":   map[string]any{"generateName": "egress-probe-matrix-", "labels": labels},
+		"spec":       spec,
+	}
+
+	pods := "/api/v1/namespaces/" + n.Namespace + "/pods"
+	var created struct {
+		Metadata objectMeta `json:"metadata"`
+	}
+	createCtx, cancel := context.WithTimeout(ctx, clusterTargetsTimeout)
+	err := client.do(createCtx, http.MethodPost, pods, "application/json", pod, &created)
+	cancel()
+	if err != nil {
+		return nil, "", fmt.Errorf("creating probe pod: %w", err)
+	}
+	name := created.Metadata.Name
+	logf("%s: probing %d targets from pod %s/%s", n.name(), len(targets), n.Namespace, name)
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), clusterTargetsTimeout)
+		defer cancel()
+		if err := client.do(ctx, http.MethodDelete, pods+"/"+name, "", nil, nil); err != nil && !isNotFound(err) {
+			logf("%s: deleting probe pod %s: %v", n.name(), name, err)
+		}
+	}()
+
+	if err := waitProbePod(ctx, client, pods+"/"+name, deadline); err != nil {
+		return nil, name, err
+	}
+	var logs []byte
+	logCtx, cancel := context.WithTimeout(ctx, clusterTargetsTimeout)
+	defer cancel()
+	if err := client.do(logCtx, http.MethodGet, pods+"/"+name+"/log", "", nil, &logs); err != nil {
+		return nil, name, fmt.Errorf("reading the log of pod %s: %w", name, err)
+	}
+	report, err := parseNDJSONReport(logs)
+	if err != nil {
+		return nil, name, fmt.Errorf("pod %s: %w", name, err)
+	}
+	return report, name, nil
+}
+
+// waitProbePod waits until the Pod at path has terminated. It gives up early
+// if the Pod can't start, e.g. because its image can't be pulled.
+func waitProbePod(ctx context.Context, client *kubeClient, path string, deadline time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, deadline)
+	defer cancel()
+	var pod struct {
+		Status struct {
+			Phase      string          `json:"phase"`
+			Conditions []kubeCondition `json:"conditions"`
+			Statuses   []struct {
+				State struct {
+					Waiting *struct {
+						Reason  string `json:"reason"`
+						Message string `json:"message"`
+					} `json:"waiting"`
+				} `json:"state"`
+			} `json:"containerStatuses"`
+		} `json:"status"`
+	}
+	for {
+		if err := client.get(ctx, path, &pod); err != nil && ctx.Err() == nil {
+			return fmt.Errorf("reading probe pod: %w", err)
+		}
+		switch pod.Status.Phase {
+		case "Succeeded", "Failed":
+			return nil
+		}
+		for _, s := range pod.Status.Statuses {
+			if w := s.State.Waiting; w != nil {
+				switch w.Reason {
+				case "ErrImagePull", "ImagePullBackOff", "InvalidImageName", "CreateContainerConfigError", "CreateContainerError":
+					return fmt.Errorf("probe pod can't start: %s: %s", w.Reason, w.Message)
+				}
+			}
+		}
+		if !sleepCtx(ctx, nsMatrixPoll) {
+			why := "phase " + pod.Status.Phase
+			for _, c := range pod.Status.Conditions {
+				if c.Status == "False" && c.Message != "" {
+					why += ": " + c.Message
+				}
+			}
+			if ctx.Err() == context.DeadlineExceeded {
+				return fmt.Errorf("probe pod did not finish within %s (%s)", deadline, why)
+			}
+			return fmt.Errorf("interrupted waiting for the probe pod (%s)", why)
+		}
+	}
+}
+
+// parseNDJSONReport reads the OUTPUT=ndjson report in a probe Pod's log,
+// skipping the diagnostics interleaved with it.
+func parseNDJSONReport(logs []byte) (*nodeReport, error) {
+	report := &nodeReport{Time: time.Now()}
+	gotSummary := false
+	for _, line := range bytes.Split(logs, []byte("\n")) {
+		if !bytes.HasPrefix(line, []byte("{")) {
+			continue
+		}
+		var summary struct {
+			Summary *jsonSummary `json:"summary"`
+		}
+		if json.Unmarshal(line, &summary) == nil && summary.Summary != nil {
+			report.Summary = *summary.Summary
+			gotSummary = true
+			continue
+		}
+		var r jsonResult
+		if json.Unmarshal(line, &r) == nil && r.Host != "" {
+			report.Results = append(report.Results, r)
+		}
+	}
+	if !gotSummary {
+		return nil, fmt.Errorf("no report in the log (last line: %q)", lastLine(logs))
+	}
+	return report, nil
+}
+
+func lastLine(data []byte) string {
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	return lines[len(lines)-1]
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cheolhuikim/egress-probe/pkg/probe"
+)
+
+const (
+	egressProbeAPI       = "/apis/egressprobe.io/v1alpha1"
+	operatorPollInterval = 15 * time.Second
+	conditionHealthy     = "EgressHealthy"
+)
+
+// egressProbe is the EgressProbe custom resource (egressprobe.io/v1alpha1).
+type egressProbe struct {
+	Metadata objectMeta        `json:"metadata"`
+	Spec     egressProbeSpec   `json:"spec"`
+	Status   egressProbeStatus `json:"status"`
+}
+
+type egressProbeSpec struct {
+	Allow    []string `json:"allow,omitempty"`    // targets that should be reachable
+	Deny     []string `json:"deny,omitempty"`     // targets that should be blocked
+	Interval string   `json:"interval,omitempty"` // e.g. "5m"; defaults to INTERVAL
+	Schedule string   `json:"schedule,omitempty"` // cron expression; overrides Interval
+	Timeout  string   `json:"timeout,omitempty"`  // per-phase timeout; defaults to TIMEOUT
+}
+
+type egressProbeStatus struct {
+	ObservedGeneration int64           `json:"observedGeneration,omitempty"`
+	LastRunTime        string          `json:"lastRunTime,omitempty"`
+	Summary            *jsonSummary    `json:"summary,omitempty"`
+	Results            []jsonResult    `json:"results,omitempty"`
+	Conditions         []kubeCondition `json:"conditions,omitempty"`
+}
+
+type egressProbeList struct {
+	Items []egressProbe `json:"items"`
+}
+
+// runOperator polls EgressProbe resources (in WATCH_NAMESPACE, or cluster-wide
+// when unset), probes each one when it is due, and writes the results and an
+// EgressHealthy condition into its status. A resource is due when its spec
+// changed or its interval/schedule has elapsed since the last run.
+//
+// Resources are listed periodically rather than watched: probing is far
+// slower than the poll interval anyway, and a plain list survives API server
+// restarts without any resume bookkeeping.
+func runOperator(ctx context.Context, cfg Config) {
+	client, err := newInClusterClient()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(exitFailed)
+	}
+
+	listPath := egressProbeAPI + "/egressprobes"
+	if ns := os.Getenv("WATCH_NAMESPACE"); ns != "" {
+		listPath = egressProbeAPI + "/namespaces/" + ns + "/egressprobes"
+		logf("operator mode: watching EgressProbes in namespace %s", ns)
+	} else {
+		logf("operator mode: watching EgressProbes in all namespaces")
+	}
+
+	for {
+		var list egressProbeList
+		if err := client.get(ctx, listPath, &list); err != nil {
+			if ctx.Err() == nil {
+				logf("listing EgressProbes: %v", err)
+			}
+		}
+		for _, ep := range list.Items {
+			if ctx.Err() != nil {
+				break
+			}
+			if probeDue(ep, cfg, time.Now()) {
+				reconcileProbe(ctx, client, ep, cfg)
+			}
+		}
+
+		if !sleepCtx(ctx, operatorPollInterval) {
+			logf("shutting down")
+			return
+		}
+	}
+}
+
+// probeDue reports whether ep should be probed now.
+func probeDue(ep egressProbe, cfg Config, now time.Time) bool {
+	if ep.Status.ObservedGeneration != ep.Metadata.Generation {
+		return true
+	}
+	last, err := time.Parse(time.RFC3339, ep.Status.LastRunTime)
+	if err != nil {
+		// Never run, or the last attempt was rejected as an invalid spec
+		// (which records observedGeneration but no run time).
+		return ep.Status.LastRunTime == "" && !hasReason(ep.Status.Conditions, "InvalidSpec")
+	}
+	if ep.Spec.Schedule != "" {
+		sched, err := parseCron(ep.Spec.Schedule)
+		if err != nil {
+			return false
+		}
+		next := sched.next(last)
+		return !next.IsZero() && !now.Before(next)
+	}
+	interval := cfg.Interval
+	if d, err := time.ParseDuration(ep.Spec.Interval); err == nil && d > 0 {
+		interval = d
+	}
+	return !now.Before(last.Add(interval))
+}
+
+func hasReason(conds []kubeCondition, reason string) bool {
+	for _, c := range conds {
+		if c.Type == conditionHealthy && c.Reason == reason {
+			return true
+		}
+	}
+	return false
+}
+
+// reconcileProbe runs one EgressProbe and records the outcome in its status.
+func reconcileProbe(ctx context.Context, client *kubeClient, ep egressProbe, cfg Config) {
+	ref := ep.Metadata.Namespace + "/" + ep.Metadata.Name
+	status := ep.Status
+	status.ObservedGeneration = ep.Metadata.Generation
+
+	targets, timeout, err := probeSpecTargets(ep.Spec, cfg)
+	if err != nil {
+		logf("egressprobe %s: invalid spec: %v", ref, err)
+		status.Conditions = setCondition(status.Conditions, kubeCondition{
+			Type:               conditionHealthy,
+			Status:             "Unknown",
+			ObservedGeneration: ep.Metadata.Generation,
+			LastTransitionTime: time.Now().UTC().Format(time.RFC3339),
+			Reason:             "InvalidSpec",
+			Message:            err.Error(),
+		})
+		writeProbeStatus(ctx, client, ep, status)
+		return
+	}
+
+	runCtx := ctx
+	if cfg.RunTimeout > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, cfg.RunTimeout)
+		defer cancel()
+	}
+	start := time.Now()
+	opts := probeOptions(cfg)
+	opts.Timeout = timeout
+	results, _ := probe.Run(runCtx, targets, opts)
+	report := buildJSON(results, timeout, time.Since(start))
+	scoreHealth(report.Results, cfg.LatencySLO)
+
+	status.LastRunTime = start.UTC().Format(time.RFC3339)
+	status.Summary = &report.Summary
+	status.Results = report.Results
+	status.Conditions = setCondition(status.Conditions, healthyCondition(report, ep.Metadata.Generation))
+	writeProbeStatus(ctx, client, ep, status)
+
+	logf("egressprobe %s: %d/%d passed", ref, report.Summary.Passed, report.Summary.Total)
+	if cfg.OnFailureCmd != "" {
+		runFailureHooks(ctx, cfg.OnFailureCmd, cfg.OnFailureTimeout, results)
+	}
+}
+
+// probeSpecTargets validates a spec and converts it into probe targets. The
+// targets are checked as parseConfig checks its own, and may not use the
+// options checkAPITarget rejects: the operator's Pod isn't the author's.
+func probeSpecTargets(spec egressProbeSpec, cfg Config) ([]probe.Target, time.Duration, error) {
+	var targets []probe.Target
+	for _, s := range spec.Allow {
+		targets = append(targets, probe.ParseTargetList(s, false)...)
+	}
+	for _, s := range spec.Deny {
+		targets = append(targets, probe.ParseTargetList(s, true)...)
+	}
+	if len(targets) == 0 {
+		return nil, 0, fmt.Errorf("spec.allow and spec.deny are both empty")
+	}
+	for _, t := range targets {
+		if err := checkAPITarget(t); err != nil {
+			return nil, 0, err
+		}
+		if err := validateTarget(t); err != nil {
+			return nil, 0, err
+		}
+	}
+	if spec.Schedule != "" {
+		if _, err := parseCron(spec.Schedule); err != nil {
+			return nil, 0, err
+		}
+	}
+	if spec.Interval != "" {
+		if d, err := time.ParseDuration(spec.Interval); err != nil || d <= 0 {
+			return nil, 0, fmt.Errorf("invalid interval %q", spec.Interval)
+		}
+	}
+	timeout := cfg.Timeout
+	if spec.Timeout != "" {
+		d, err := time.ParseDuration(spec.Timeout)
+		if err != nil || d <= 0 {
+			return nil, 0, fmt.Errorf("invalid timeout %q", spec.Timeout)
+		}
+		timeout = d
+	}
+	return targets, timeout, nil
+}
+
+// healthyCondition summarizes a report as the EgressHealthy condition.
+func healthyCondition(report jsonOutput, generation int64) kubeCondition {
+	c := kubeCondition{
+		Type:               conditionHealthy,
+		ObservedGeneration: generation,
+		LastTransitionTime: time.Now().UTC().Format(time.RFC3339),
+	}
+	sum := report.Summary
+	switch {
+	case sum.OK:
+		c.Status, c.Reason = "True", "AllTargetsPassed"
+		c.Message = fmt.Sprintf("%d/%d targets behave as expected", sum.Passed, sum.Total)
+	case sum.Failed == 0:
+		c.Status, c.Reason = "Unknown", "RunIncomplete"
+		c.Message = fmt.Sprintf("%d/%d targets could not be probed before the run deadline", sum.Incomplete, sum.Total)
+	default:
+		var failing []string
+		for _, r := range report.Results {
+			if !r.Passed && !r.Incomplete {
+				failing = append(failing, fmt.Sprintf("%s:%d (%s)", r.Host, r.Port, r.Type))
+			}
+		}
+		if len(failing) > 5 {
+			failing = append(failing[:5], "...")
+		}
+		c.Status, c.Reason = "False", "TargetsFailed"
+		c.Message = fmt.Sprintf("%d/%d targets failed: %s", sum.Failed, sum.Total, strings.Join(failing, ", "))
+	}
+	return c
+}
+
+func writeProbeStatus(ctx context.Context, client *kubeClient, ep egressProbe, status egressProbeStatus) {
+	path := fmt.Sprintf("%s/namespaces/%s/egressprobes/%s/status", egressProbeAPI, ep.Metadata.Namespace, ep.Metadata.Name)
+	patch := map[string]any{"status": status}
+	if err := client.mergePatch(ctx, path, patch, nil); err != nil {
+		logf("egressprobe %s/%s: updating status: %v", ep.Metadata.Namespace, ep.Metadata.Name, err)
+	}
+}
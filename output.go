@@ -0,0 +1,442 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cheolhuikim/egress-probe/pkg/probe"
+)
+
+const (
+	colorReset  = "\033[0m"
+	colorGreen  = "\033[32m"
+	colorRed    = "\033[31m"
+	colorYellow = "\033[33m"
+	colorCyan   = "\033[36m"
+	colorBold   = "\033[1m"
+	colorDim    = "\033[2m"
+)
+
+// printHeader prints the run's banner and settings, and env if it is known.
+func printHeader(cfg Config, env *environment) {
+	targets := cfg.Targets
+	allowCount := 0
+	denyCount := 0
+	for _, t := range targets {
+		if t.ExpectErr {
+			denyCount++
+		} else {
+			allowCount++
+		}
+	}
+
+	fmt.Fprintf(tableOut, "\n%s%s╔══════════════════════════════════════════════════════════╗%s\n", colorBold, colorCyan, colorReset)
+	fmt.Fprintf(tableOut, "%s%s║            Egress Probe — Egress Validation              ║%s\n", colorBold, colorCyan, colorReset)
+	fmt.Fprintf(tableOut, "%s%s╚══════════════════════════════════════════════════════════╝%s\n", colorBold, colorCyan, colorReset)
+	fmt.Fprintf(tableOut, "\n  Version:  %s\n", currentBuild())
+	fmt.Fprintf(tableOut, "  Targets:  %d (%s%d allow%s / %s%d deny%s)\n", len(targets),
+		colorGreen, allowCount, colorReset,
+		colorYellow, denyCount, colorReset)
+	fmt.Fprintf(tableOut, "  Timeout:  %s per phase\n", cfg.Timeout)
+	fmt.Fprintf(tableOut, "  Crypto:   %s\n", currentCrypto())
+	switch {
+	case cfg.DualStack:
+		fmt.Fprintf(tableOut, "  Lookups:  A and AAAA records, each family probed apart\n")
+	case cfg.IPv6:
+		fmt.Fprintf(tableOut, "  Lookups:  AAAA records\n")
+	}
+	if cfg.FIPSTLS {
+		fmt.Fprintf(tableOut, "  TLS:      FIPS-approved parameters only\n")
+	}
+	if cfg.Proxy != "" {
+		fmt.Fprintf(tableOut, "  Route:    through proxy %s\n", proxyDescription(cfg.Proxy))
+	}
+	if env != nil {
+		printEnvironment(env)
+	}
+	switch cfg.Profile {
+	case "fast":
+		fmt.Fprintf(tableOut, "  Profile:  fast\n")
+		fmt.Fprintf(tableOut, "  Phases:   DNS → TCP\n\n")
+	case "deep":
+		fmt.Fprintf(tableOut, "  Profile:  deep\n")
+		fmt.Fprintf(tableOut, "  Phases:   DNS → TCP → TLS/SNI (+cert) → HTTP\n\n")
+	default:
+		fmt.Fprintf(tableOut, "  Phases:   DNS → TCP → TLS/SNI\n\n")
+	}
+}
+
+func printResults(results []probe.Result, elapsed time.Duration) {
+	var allow, deny []probe.Result
+	for _, r := range results {
+		if r.Target.ExpectErr {
+			deny = append(deny, r)
+		} else {
+			allow = append(allow, r)
+		}
+	}
+
+	maxHostLen := 4
+	for _, r := range results {
+		maxHostLen = max(maxHostLen, displayWidth(r.Target.Host+familySuffix(r.Target.Family)))
+	}
+	if maxHostLen > 40 {
+		maxHostLen = 40
+	}
+
+	phases := tablePhases(results)
+
+	hostCol := maxHostLen + 2
+	portCol := 6
+	phaseCol := 16
+	resultCol := 8
+	cols := []int{hostCol, portCol}
+	for range phases {
+		cols = append(cols, phaseCol)
+	}
+	cols = append(cols, resultCol)
+
+	totalWidth := 0
+	for _, w := range cols {
+		totalWidth += w + 1
+	}
+	totalWidth += len(cols) - 1
+
+	printSeparator(cols, "┌", "┬", "┐")
+	fmt.Fprintf(tableOut, "│ %-*s│ %-*s│", hostCol, " FQDN", portCol, " PORT")
+	for _, ph := range phases {
+		fmt.Fprintf(tableOut, " %-*s│", phaseCol, " "+ph.title)
+	}
+	fmt.Fprintf(tableOut, " %-*s│\n", resultCol, " RESULT")
+
+	ok := 0
+	ng := 0
+	skip := 0
+
+	// Rows are rendered into one buffer and written whole, so that tables of
+	// thousands of targets don't cost a write, and a few strings, per cell.
+	var row bytes.Buffer
+	okCell := fmt.Sprintf(" %s%sOK%s", colorBold, colorGreen, colorReset)
+	failCell := fmt.Sprintf(" %s%sFAIL%s", colorBold, colorRed, colorReset)
+	skipCell := fmt.Sprintf(" %s%sSKIP%s", colorBold, colorYellow, colorReset)
+
+	printRow := func(r probe.Result) {
+		resultCell := failCell
+		switch {
+		case r.Incomplete:
+			skip++
+			resultCell = skipCell
+		case r.Passed:
+			ok++
+			resultCell = okCell
+		default:
+			ng++
+		}
+
+		row.Reset()
+		row.WriteString("│  ")
+		writePadded(&row, truncateWidth(r.Target.Host+familySuffix(r.Target.Family), maxHostLen), hostCol-1)
+		row.WriteString("│  ")
+		writePadded(&row, strconv.Itoa(r.Target.Port), portCol-1)
+		row.WriteString("│")
+		for _, ph := range phases {
+			row.WriteByte(' ')
+			writePadded(&row, formatPhaseCell(ph.get(r)), phaseCol)
+			row.WriteString("│")
+		}
+		row.WriteByte(' ')
+		writePadded(&row, resultCell, resultCol)
+		row.WriteString("│\n")
+		tableOut.Write(row.Bytes())
+	}
+
+	if len(allow) > 0 {
+		printSeparator(cols, "├", "┴", "┤")
+		label := fmt.Sprintf("  %s%sALLOW%s — should be reachable", colorBold, colorGreen, colorReset)
+		printSectionLabel(label, totalWidth)
+		printSeparator(cols, "├", "┬", "┤")
+		for _, r := range allow {
+			printRow(r)
+		}
+	}
+
+	if len(deny) > 0 {
+		printSeparator(cols, "├", "┴", "┤")
+		label := fmt.Sprintf("  %s%sDENY%s  — should be blocked", colorBold, colorYellow, colorReset)
+		printSectionLabel(label, totalWidth)
+		printSeparator(cols, "├", "┬", "┤")
+		for _, r := range deny {
+			printRow(r)
+		}
+	}
+
+	printSeparator(cols, "└", "┴", "┘")
+	printCertificates(results)
+	printInterceptions(results)
+	printAssertions(results)
+	printDNSConsistency(results)
+	printDNSTrace(results)
+
+	total := ok + ng + skip
+	fmt.Fprintf(tableOut, "\n  Results: %s%d/%d OK%s", colorGreen, ok, total, colorReset)
+	if ng > 0 {
+		fmt.Fprintf(tableOut, " | %s%d/%d FAIL%s", colorRed, ng, total, colorReset)
+	}
+	if skip > 0 {
+		fmt.Fprintf(tableOut, " | %s%d/%d SKIP (incomplete)%s", colorYellow, skip, total, colorReset)
+	}
+	fmt.Fprintf(tableOut, "\n  Elapsed: %s\n\n", elapsed.Round(time.Millisecond))
+}
+
+// tableColumn is one phase column of the results table.
+type tableColumn struct {
+	title string
+	get   func(probe.Result) probe.PhaseResult
+}
+
+// tablePhases returns the phase columns to render. DNS, TCP and TLS are
+// always shown; optional phases only get a column when some target uses them.
+func tablePhases(results []probe.Result) []tableColumn {
+	phases := []tableColumn{
+		{"DNS", func(r probe.Result) probe.PhaseResult { return r.DNS }},
+		{"TCP", func(r probe.Result) probe.PhaseResult { return r.TCP }},
+		{"TLS/SNI", func(r probe.Result) probe.PhaseResult { return r.TLS }},
+	}
+	for _, r := range results {
+		if r.HTTP.Detail != "" {
+			phases = append(phases, tableColumn{"HTTP", func(r probe.Result) probe.PhaseResult { return r.HTTP }})
+			break
+		}
+	}
+	for _, r := range results {
+		if r.Target.Exec != "" {
+			phases = append(phases, tableColumn{"EXEC", func(r probe.Result) probe.PhaseResult { return r.Exec }})
+			break
+		}
+	}
+	return phases
+}
+
+// certWarnDays is how close to expiry a certificate is flagged, besides
+// CERT_EXPIRY_WARN.
+const certWarnDays = 30
+
+// printCertificates lists the server certificates collected by the deep
+// profile, flagging ones that are self-signed or close to expiry.
+func printCertificates(results []probe.Result) {
+	header := false
+	now := time.Now()
+	for _, r := range results {
+		c := r.Cert
+		if c == nil {
+			continue
+		}
+		if !header {
+			fmt.Fprintf(tableOut, "\n  %sCertificates%s\n", colorBold, colorReset)
+			header = true
+		}
+		days := c.DaysLeft(now)
+		color := colorDim
+		note := ""
+		switch {
+		case days < 0:
+			color, note = colorRed, " — EXPIRED"
+		case days < certWarnDays || r.CertExpiring:
+			color, note = colorYellow, " — expires soon"
+		}
+		if c.SelfSigned {
+			color, note = colorYellow, note+" — self-signed"
+		}
+		fmt.Fprintf(tableOut, "    %s%s:%d  %s  (issuer: %s, expires %s, %d days)%s%s\n",
+			color, r.Target.Host, r.Target.Port, c.Subject, c.Issuer,
+			c.NotAfter.Format("2006-01-02"), days, note, colorReset)
+	}
+}
+
+// printInterceptions flags targets whose TLS handshake was answered by a
+// local mesh proxy, since their results say nothing about the destination.
+func printInterceptions(results []probe.Result) {
+	header := false
+	for _, r := range results {
+		if r.Intercepted == "" {
+			continue
+		}
+		if !header {
+			fmt.Fprintf(tableOut, "\n  %sIntercepted by the mesh%s %s(these results measured the sidecar, not the destination)%s\n",
+				colorBold, colorReset, colorDim, colorReset)
+			header = true
+		}
+		fmt.Fprintf(tableOut, "    %s%s:%d  %s%s\n", colorYellow, r.Target.Host, r.Target.Port, r.Intercepted, colorReset)
+	}
+}
+
+// printAssertions lists the assertions of expect options that failed, since
+// a target can fail one with every phase OK.
+func printAssertions(results []probe.Result) {
+	header := false
+	for _, r := range results {
+		for _, a := range r.Assertions {
+			if a.Passed || r.Incomplete {
+				continue
+			}
+			if !header {
+				fmt.Fprintf(tableOut, "\n  %sFailed expectations%s\n", colorBold, colorReset)
+				header = true
+			}
+			fmt.Fprintf(tableOut, "    %s%s:%d  %s: %s%s\n", colorRed, r.Target.Host, r.Target.Port, a.Expr, a.Detail, colorReset)
+		}
+	}
+}
+
+// printDNSConsistency lists what DNS_CONSISTENCY found for each name,
+// highlighting names whose nameservers disagree.
+func printDNSConsistency(results []probe.Result) {
+	header := false
+	printed := map[string]bool{} // names probed on several ports are listed once
+	for _, r := range results {
+		c := r.DNSCheck
+		if c == nil || printed[r.Target.Host] {
+			continue
+		}
+		printed[r.Target.Host] = true
+		if !header {
+			servers := map[string]bool{}
+			for _, a := range c.Answers {
+				servers[a.Server] = true
+			}
+			fmt.Fprintf(tableOut, "\n  %sDNS answers%s %s(%d queries to %d servers per name)%s\n",
+				colorBold, colorReset, colorDim, len(c.Answers), len(servers), colorReset)
+			header = true
+		}
+		color := colorDim
+		if c.Disagree {
+			color = colorYellow
+		}
+		fmt.Fprintf(tableOut, "    %s%s  %s%s\n", color, r.Target.Host, c, colorReset)
+		if !c.Disagree {
+			continue
+		}
+		for _, a := range distinctAnswers(c.Answers) {
+			fmt.Fprintf(tableOut, "      %s%s%s\n", colorDim, a, colorReset)
+		}
+	}
+}
+
+// printDNSTrace shows each name's DNS_TRACE lookup the way dig would: every
+// query, the response's header and its records, section by section.
+func printDNSTrace(results []probe.Result) {
+	header := false
+	printed := map[string]bool{}
+	for _, r := range results {
+		if len(r.DNSTrace) == 0 || printed[r.Target.Host] {
+			continue
+		}
+		printed[r.Target.Host] = true
+		if !header {
+			fmt.Fprintf(tableOut, "\n  %sDNS trace%s\n", colorBold, colorReset)
+			header = true
+		}
+		fmt.Fprintf(tableOut, "\n    %s\n", r.Target.Host)
+		for _, x := range r.DNSTrace {
+			color := colorDim
+			if x.Err != "" || x.Rcode != "NOERROR" {
+				color = colorYellow
+			}
+			fmt.Fprintf(tableOut, "      %s;; %s%s\n", color, x, colorReset)
+			if x.Err != "" {
+				continue
+			}
+			fmt.Fprintf(tableOut, "      %s;; flags: %s; answer: %d, authority: %d, additional: %d; %d bytes%s\n",
+				colorDim, strings.Join(x.Flags, " "), len(x.Answer), len(x.Authority), len(x.Additional), x.Size, colorReset)
+			for _, section := range []struct {
+				name    string
+				records []string
+			}{{"ANSWER", x.Answer}, {"AUTHORITY", x.Authority}, {"ADDITIONAL", x.Additional}} {
+				for _, rr := range section.records {
+					fmt.Fprintf(tableOut, "      %s%-10s %s%s\n", colorDim, section.name, rr, colorReset)
+				}
+			}
+		}
+	}
+}
+
+// distinctAnswers describes each different answer once per server, e.g.
+// "10.0.0.10:53 → 1.2.3.4, 1.2.3.5".
+func distinctAnswers(answers []probe.DNSAnswer) []string {
+	var lines []string
+	seen := map[string]bool{}
+	for _, a := range answers {
+		got := a.Err
+		if got == "" {
+			got = strings.Join(slices.Sorted(slices.Values(a.Addrs)), ", ")
+		}
+		line := a.Server + " → " + got
+		if !seen[line] {
+			seen[line] = true
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func printSectionLabel(text string, totalWidth int) {
+	fmt.Fprintf(tableOut, "│%s│\n", padRight(text, totalWidth))
+}
+
+func formatPhaseCell(p probe.PhaseResult) string {
+	if p.Aborted {
+		if strings.HasPrefix(p.Detail, "interrupted") {
+			return fmt.Sprintf(" %sinterrupted%s", colorYellow, colorReset)
+		}
+		return fmt.Sprintf(" %s—%s", colorDim, colorReset)
+	}
+	if !p.Success && (p.Detail == "" || strings.HasPrefix(p.Detail, "skipped")) {
+		return fmt.Sprintf(" %s—%s", colorDim, colorReset)
+	}
+	if p.Success && strings.HasPrefix(p.Detail, "skipped") {
+		return fmt.Sprintf(" %s—%s", colorDim, colorReset)
+	}
+
+	if p.Success && p.Retries > 0 {
+		return fmt.Sprintf(" %s%s %dms, try %d%s", colorYellow, passGlyph, p.Duration.Milliseconds(), p.Retries+1, colorReset)
+	}
+	if p.Success {
+		return fmt.Sprintf(" %s%s %dms%s", colorGreen, passGlyph, p.Duration.Milliseconds(), colorReset)
+	}
+	return fmt.Sprintf(" %s%s %s%s", colorRed, failGlyph, p.Detail, colorReset)
+}
+
+func printSeparator(widths []int, left, mid, right string) {
+	var b strings.Builder
+	b.WriteString(left)
+	for i, w := range widths {
+		b.WriteString(strings.Repeat("─", w+1))
+		if i < len(widths)-1 {
+			b.WriteString(mid)
+		}
+	}
+	b.WriteString(right)
+	b.WriteByte('\n')
+	io.WriteString(tableOut, b.String())
+}
+
+// writePadded writes s to b, padded with spaces to width columns.
+func writePadded(b *bytes.Buffer, s string, width int) {
+	b.WriteString(s)
+	for w := displayWidth(s); w < width; w++ {
+		b.WriteByte(' ')
+	}
+}
+
+func padRight(s string, width int) string {
+	visible := displayWidth(s)
+	if visible >= width {
+		return s
+	}
+	return s + strings.Repeat(" ", width-visible)
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cheolhuikim/egress-probe/pkg/probe"
+)
+
+const (
+	// maxCaptures caps how many failing targets are captured per run, so a
+	// run in which everything fails doesn't take minutes or fill the disk.
+	maxCaptures = 5
+	// maxCapturePackets caps the packets written per capture.
+	maxCapturePackets = 2000
+	// captureLinger keeps capturing after the retry, for late resets and
+	// ICMP errors.
+	captureLinger = 500 * time.Millisecond
+	// pcapSnapLen is the longest packet recorded in full.
+	pcapSnapLen = 65535
+	// linkTypeRaw is LINKTYPE_RAW: packets start with their IPv4 or IPv6
+	// header, as read from a cooked packet socket.
+	linkTypeRaw = 101
+)
+
+// capture is the packet capture of a failing target's retry.
+type capture struct {
+	Target  string `json:"target"`
+	File    string `json:"file,omitempty"`
+	Packets int    `json:"packets"`
+	Passed  bool   `json:"passed"` // the retry passed: the failure didn't reproduce
+	Error   string `json:"error,omitempty"`
+}
+
+// captureFailures probes each failing target of results once more while
+// capturing its packets to a pcap file in dir. Incomplete targets are left
+// out, and so are deny targets, whose failure is a connection that worked,
+// and targets failed for their location.
+func captureFailures(ctx context.Context, cfg Config, results []probe.Result) []capture {
+	var captures []capture
+	for _, r := range results {
+		if r.Passed || r.Incomplete || r.Target.ExpectErr || !r.Blocked {
+			continue
+		}
+		if len(captures) == maxCaptures {
+			logf("PCAP_ON_FAILURE: captured the first %d failing targets only", maxCaptures)
+			break
+		}
+		captures = append(captures, captureRetry(ctx, cfg, r.Target))
+	}
+	return captures
+}
+
+// captureRetry probes t while capturing the packets to and from its
+// addresses, and all DNS and ICMP traffic, which is where lookups and
+// rejections show up.
+func captureRetry(ctx context.Context, cfg Config, t probe.Target) capture {
+	c := capture{Target: fmt.Sprintf("%s:%d", t.Host, t.Port)}
+
+	lookupCtx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+	addrs, _ := net.DefaultResolver.LookupIPAddr(lookupCtx, t.Host)
+	cancel()
+	filter := packetFilter{port: t.Port}
+	for _, a := range addrs {
+		filter.addrs = append(filter.addrs, a.IP)
+	}
+
+	sock, err := openCaptureSocket()
+	if err != nil {
+		c.Error = fmt.Sprintf("opening a packet socket: %v (needs CAP_NET_RAW, Linux only)", err)
+		return c
+	}
+	defer sock.close()
+
+	host := strings.NewReplacer(":", "_", "/", "_").Replace(t.Host)
+	path := filepath.Join(cfg.PcapDir, fmt.Sprintf("%s_%d-%s.pcap", host, t.Port, time.Now().UTC().Format("20060102T150405Z")))
+	f, err := os.Create(path)
+	if err != nil {
+		c.Error = err.Error()
+		return c
+	}
+	defer f.Close()
+	w, err := newPcapWriter(f)
+	if err != nil {
+		c.Error = err.Error()
+		return c
+	}
+
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	go func() { done <- sock.capture(w, filter, maxCapturePackets, stop) }()
+
+	// Resolve afresh, so that the lookup is on the wire too.
+	opts := probeOptions(cfg)
+	opts.DNSCache = nil
+	retry, _ := probe.Run(ctx, []probe.Target{t}, opts)
+	sleepCtx(ctx, captureLinger)
+	close(stop)
+	err = <-done
+
+	c.File, c.Packets, c.Passed = path, w.packets, retry[0].Passed
+	if err != nil {
+		c.Error = err.Error()
+	}
+	return c
+}
+
+// packetFilter selects the packets of one target: those to or from its
+// addresses, or on its port when the addresses are unknown, and any DNS or
+// ICMP packet.
+type packetFilter struct {
+	addrs []net.IP
+	port  int
+}
+
+func (f packetFilter) match(pkt []byte) bool {
+	if len(pkt) < 1 {
+		return false
+	}
+	var src, dst net.IP
+	var proto byte
+	var transport []byte
+	switch pkt[0] >> 4 {
+	case 4:
+		ihl := int(pkt[0]&0x0f) * 4
+		if len(pkt) < 20 || len(pkt) < ihl {
+			return false
+		}
+		src, dst, proto, transport = pkt[12:16], pkt[16:20], pkt[9], pkt[ihl:]
+	case 6:
+		// Extension headers are not followed: the probe doesn't send any.
+		if len(pkt) < 40 {
+			return false
+		}
+		src, dst, proto, transport = pkt[8:24], pkt[24:40], pkt[6], pkt[40:]
+	default:
+		return false
+	}
+
+	switch proto {
+	case 1, 58: // ICMP, ICMPv6
+		return true
+	case 6, 17: // TCP, UDP
+	default:
+		return false
+	}
+	if len(transport) < 4 {
+		return false
+	}
+	sport := int(binary.BigEndian.Uint16(transport[0:2]))
+	dport := int(binary.BigEndian.Uint16(transport[2:4]))
+	if sport == 53 || dport == 53 {
+		return true
+	}
+	if len(f.addrs) == 0 {
+		return sport == f.port || dport == f.port
+	}
+	for _, a := range f.addrs {
+		if a.Equal(src) || a.Equal(dst) {
+			return true
+		}
+	}
+	return false
+}
+
+// pcapWriter writes packets in the classic pcap format, which every
+// capture tool reads.
+type pcapWriter struct {
+	w       io.Writer
+	packets int
+}
+
+func newPcapWriter(w io.Writer) (*pcapWriter, error) {
+	var hdr [24]byte
+	binary.LittleEndian.PutUint32(hdr[0:4], 0xa1b2c3d4) // microsecond timestamps
+	binary.LittleEndian.PutUint16(hdr[4:6], 2)
+	binary.LittleEndian.PutUint16(hdr[6:8], 4)
+	binary.LittleEndian.PutUint32(hdr[16:20], pcapSnapLen)
+	binary.LittleEndian.PutUint32(hdr[20:24], linkTypeRaw)
+	if _, err := w.Write(hdr[:]); err != nil {
+		return nil, err
+	}
+	return &pcapWriter{w: w}, nil
+}
+
+func (p *pcapWriter) write(ts time.Time, pkt []byte) error {
+	orig := len(pkt)
+	if len(pkt) > pcapSnapLen {
+		pkt = pkt[:pcapSnapLen]
+	}
+	var hdr [16]byte
+	binary.LittleEndian.PutUint32(hdr[0:4], uint32(ts.Unix()))
+	binary.LittleEndian.PutUint32(hdr[4:8], uint32(ts.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(hdr[8:12], uint32(len(pkt)))
+	binary.LittleEndian.PutUint32(hdr[12:16], uint32(orig))
+	if _, err := p.w.Write(hdr[:]); err != nil {
+		return err
+	}
+	if _, err := p.w.Write(pkt); err != nil {
+		return err
+	}
+	p.packets++
+	return nil
+}
+
+func printCaptures(captures []capture) {
+	if len(captures) == 0 {
+		return
+	}
+	fmt.Printf("  %sPacket captures%s %s(failing targets probed once more)%s\n", colorBold, colorReset, colorDim, colorReset)
+	for _, c := range captures {
+		switch {
+		case c.Error != "" && c.File == "":
+			fmt.Printf("    %s%s: %s%s\n", colorYellow, c.Target, c.Error, colorReset)
+			continue
+		case c.Error != "":
+			fmt.Printf("    %s  %s %s(%d packets, stopped: %s)%s\n", c.Target, c.File, colorDim, c.Packets, c.Error, colorReset)
+		default:
+			fmt.Printf("    %s  %s %s(%d packets)%s\n", c.Target, c.File, colorDim, c.Packets, colorReset)
+		}
+		if c.Passed {
+			fmt.Printf("      %sthe retry passed: the capture shows a working connection%s\n", colorYellow, colorReset)
+		}
+	}
+	fmt.Println()
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"time"
+)
+
+// captureSocket is a cooked (SOCK_DGRAM) packet socket on every interface
+// of the Pod's network namespace: packets are read without their link-layer
+// header, whatever the interface.
+type captureSocket struct {
+	fd int
+}
+
+func openCaptureSocket() (*captureSocket, error) {
+	const ethPAll = syscall.ETH_P_ALL<<8 | syscall.ETH_P_ALL>>8 // in network byte order
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, ethPAll)
+	if err != nil {
+		return nil, err
+	}
+	// Reads time out, so that capture notices when to stop.
+	tv := syscall.NsecToTimeval((100 * time.Millisecond).Nanoseconds())
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return &captureSocket{fd: fd}, nil
+}
+
+// capture writes the packets that match f to w until stop is closed or max
+// packets have been written.
+func (s *captureSocket) capture(w *pcapWriter, f packetFilter, max int, stop <-chan struct{}) error {
+	buf := make([]byte, 1<<16)
+	for {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+		n, from, err := syscall.Recvfrom(s.fd, buf, 0)
+		if errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EINTR) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		// Loopback packets are seen leaving and again arriving; keep one
+		// copy, as tcpdump does.
+		if ll, ok := from.(*syscall.SockaddrLinklayer); ok && ll.Hatype == syscall.ARPHRD_LOOPBACK && ll.Pkttype == syscall.PACKET_OUTGOING {
+			continue
+		}
+		if !f.match(buf[:n]) {
+			continue
+		}
+		if err := w.write(time.Now(), buf[:n]); err != nil {
+			return err
+		}
+		if w.packets == max {
+			return fmt.Errorf("reached %d packets", max)
+		}
+	}
+}
+
+func (s *captureSocket) close() {
+	syscall.Close(s.fd)
+}
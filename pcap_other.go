@@ -0,0 +1,17 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+type captureSocket struct{}
+
+func openCaptureSocket() (*captureSocket, error) {
+	return nil, errors.New("only supported on Linux")
+}
+
+func (s *captureSocket) capture(w *pcapWriter, f packetFilter, max int, stop <-chan struct{}) error {
+	return errors.New("only supported on Linux")
+}
+
+func (s *captureSocket) close() {}
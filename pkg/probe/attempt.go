@@ -0,0 +1,64 @@
+package probe
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Attempt is one connection attempt of a phase, as the tuple a firewall
+// logs it under.
+type Attempt struct {
+	Time     time.Time // when the connection was initiated
+	Protocol string    // "tcp"
+	Local    string    // source ip:port, or just the ip where the port can't be known
+	Remote   string    // destination ip:port
+}
+
+// attemptRecorder collects the attempts of one dial, which tries each
+// address of a name in turn, or two at once (RFC 6555), until one connects.
+type attemptRecorder struct {
+	mu       sync.Mutex
+	attempts []Attempt
+}
+
+// control is a net.Dialer Control function. It binds the socket to the
+// source address the route to the destination uses and an ephemeral port,
+// so that the local end of the attempt is known even if it never connects.
+func (r *attemptRecorder) control(network, address string, c syscall.RawConn) error {
+	a := Attempt{Protocol: "tcp", Remote: address}
+	if local := sourceIP(network, address); local != nil {
+		a.Local = local.String()
+		var port int
+		var err error
+		c.Control(func(fd uintptr) { port, err = bindLocal(fd, local) })
+		if err == nil {
+			a.Local = net.JoinHostPort(local.String(), strconv.Itoa(port))
+		}
+	}
+	a.Time = time.Now()
+	r.mu.Lock()
+	r.attempts = append(r.attempts, a)
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *attemptRecorder) list() []Attempt {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.attempts
+}
+
+// sourceIP returns the address the kernel would send from to reach address.
+// Connecting a UDP socket only looks up the route: nothing is sent.
+func sourceIP(network, address string) net.IP {
+	conn, err := net.Dial(strings.Replace(network, "tcp", "udp", 1), address)
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP
+}
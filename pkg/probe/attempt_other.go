@@ -0,0 +1,14 @@
+//go:build !unix && !windows
+
+package probe
+
+import (
+	"errors"
+	"net"
+)
+
+// bindLocal is not supported here: attempts record only their source
+// address.
+func bindLocal(fd uintptr, ip net.IP) (int, error) {
+	return 0, errors.New("not supported")
+}
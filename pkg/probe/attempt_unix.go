@@ -0,0 +1,37 @@
+//go:build unix
+
+package probe
+
+import (
+	"net"
+	"syscall"
+)
+
+// bindLocal binds the socket fd to ip and an ephemeral port, and returns the
+// port.
+func bindLocal(fd uintptr, ip net.IP) (int, error) {
+	var sa syscall.Sockaddr
+	if ip4 := ip.To4(); ip4 != nil {
+		sa4 := &syscall.SockaddrInet4{}
+		copy(sa4.Addr[:], ip4)
+		sa = sa4
+	} else {
+		sa6 := &syscall.SockaddrInet6{}
+		copy(sa6.Addr[:], ip.To16())
+		sa = sa6
+	}
+	if err := syscall.Bind(int(fd), sa); err != nil {
+		return 0, err
+	}
+	bound, err := syscall.Getsockname(int(fd))
+	if err != nil {
+		return 0, err
+	}
+	switch sa := bound.(type) {
+	case *syscall.SockaddrInet4:
+		return sa.Port, nil
+	case *syscall.SockaddrInet6:
+		return sa.Port, nil
+	}
+	return 0, syscall.EAFNOSUPPORT
+}
@@ -0,0 +1,115 @@
+package probe
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"slices"
+	"time"
+)
+
+// CertInfo summarizes the certificate a server presented.
+type CertInfo struct {
+	Subject     string // common name, or the full subject if there is none
+	Issuer      string
+	DNSNames    []string
+	NotBefore   time.Time
+	NotAfter    time.Time
+	SelfSigned  bool
+	Fingerprint string // SHA-256 of the DER encoding, in hex
+	// Chain is every certificate the server presented, the leaf first, in
+	// the order sent. A chain that differs from the one the destination
+	// serves elsewhere points at a TLS-inspecting proxy.
+	Chain []ChainCert
+}
+
+// ChainCert describes one certificate of a presented chain.
+type ChainCert struct {
+	Subject     string   // distinguished name
+	Issuer      string   // distinguished name
+	SANs        []string // DNS names, IP addresses, email addresses and URIs
+	Serial      string   // in hex
+	NotBefore   time.Time
+	NotAfter    time.Time
+	Fingerprint string // SHA-256 of the DER encoding, in hex
+}
+
+// DaysLeft returns the number of whole days until the certificate expires,
+// negative once it has.
+func (c *CertInfo) DaysLeft(now time.Time) int {
+	return int(c.NotAfter.Sub(now).Hours() / 24)
+}
+
+// newCertInfo summarizes the chain a server presented, leaf first, or
+// returns nil if there is none.
+func newCertInfo(chain []*x509.Certificate) *CertInfo {
+	if len(chain) == 0 {
+		return nil
+	}
+	leaf := chain[0]
+	sum := sha256.Sum256(leaf.Raw)
+	info := &CertInfo{
+		Subject:     leaf.Subject.CommonName,
+		Issuer:      leaf.Issuer.CommonName,
+		DNSNames:    leaf.DNSNames,
+		NotBefore:   leaf.NotBefore,
+		NotAfter:    leaf.NotAfter,
+		SelfSigned:  bytes.Equal(leaf.RawIssuer, leaf.RawSubject),
+		Fingerprint: hex.EncodeToString(sum[:]),
+	}
+	if info.Subject == "" {
+		info.Subject = leaf.Subject.String()
+	}
+	if info.Issuer == "" {
+		info.Issuer = leaf.Issuer.String()
+	}
+	for _, c := range chain {
+		sum := sha256.Sum256(c.Raw)
+		cc := ChainCert{
+			Subject:     c.Subject.String(),
+			Issuer:      c.Issuer.String(),
+			SANs:        slices.Clone(c.DNSNames),
+			Serial:      c.SerialNumber.Text(16),
+			NotBefore:   c.NotBefore,
+			NotAfter:    c.NotAfter,
+			Fingerprint: hex.EncodeToString(sum[:]),
+		}
+		for _, ip := range c.IPAddresses {
+			cc.SANs = append(cc.SANs, ip.String())
+		}
+		cc.SANs = append(cc.SANs, c.EmailAddresses...)
+		for _, u := range c.URIs {
+			cc.SANs = append(cc.SANs, u.String())
+		}
+		info.Chain = append(info.Chain, cc)
+	}
+	return info
+}
+
+// checkIssuer returns why the server certificate in state fails a target's
+// issuer assertion, or "" if it passes. pattern is a case-insensitive
+// regular expression matched against the issuer's distinguished name, e.g.
+// "DigiCert" or "O=Let's Encrypt"; one that doesn't compile is matched as
+// plain text.
+func checkIssuer(state tls.ConnectionState, pattern string) string {
+	if len(state.PeerCertificates) == 0 {
+		return "cert: no certificate to check the issuer of"
+	}
+	re, err := regexp.Compile("(?i)" + pattern)
+	if err != nil {
+		re = regexp.MustCompile("(?i)" + regexp.QuoteMeta(pattern))
+	}
+	issuer := state.PeerCertificates[0].Issuer
+	if re.MatchString(issuer.String()) {
+		return ""
+	}
+	name := issuer.CommonName
+	if name == "" {
+		name = issuer.String()
+	}
+	return fmt.Sprintf("cert: unexpected issuer %q", name)
+}
@@ -0,0 +1,42 @@
+package probe
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// checkData sends a HEAD request over conn, an established TLS connection to
+// target, and waits for the first byte of the answer. It returns why none
+// came, or "" if one did, whatever it was. Firewalls that filter on the
+// Host header or on the data itself let the handshake through and then
+// reset or stall the connection, which only shows once the application
+// talks.
+func checkData(conn net.Conn, target Target, timeout time.Duration) string {
+	host := target.Host
+	if target.Port != 443 {
+		host = net.JoinHostPort(target.Host, strconv.Itoa(target.Port))
+	} else if net.ParseIP(host) != nil && net.ParseIP(host).To4() == nil {
+		host = "[" + host + "]"
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+
+	req := "HEAD / HTTP/1.1\r\nHost: " + host + "\r\nUser-Agent: egress-probe\r\nConnection: close\r\n\r\n"
+	if _, err := io.WriteString(conn, req); err != nil {
+		return "data blocked: " + simplifyError(err) + " sending the request"
+	}
+	var b [1]byte
+	_, err := conn.Read(b[:])
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, io.EOF):
+		return "data blocked: closed without a response"
+	case simplifyError(err) == "timeout":
+		return "data blocked: no response within " + timeout.String()
+	}
+	return "data blocked: " + simplifyError(err) + " after the request"
+}
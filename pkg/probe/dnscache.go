@@ -0,0 +1,321 @@
+package probe
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DNSCache remembers DNS answers between runs for as long as their TTL
+// allows, so that a long-running prober does not query cluster DNS for every
+// target on every cycle. Pass the same cache in Options.DNSCache to each Run.
+// A cached answer shows up in the DNS phase detail with the time it has left.
+//
+// Only successful lookups are cached: failures are always retried, so that a
+// DNS outage never outlives the cycle that observed it.
+type DNSCache struct {
+	// MaxTTL caps how long an answer is kept, whatever its TTL. Zero means
+	// the record's own TTL.
+	MaxTTL time.Duration
+
+	mu      sync.Mutex
+	entries map[string]dnsEntry
+}
+
+type dnsEntry struct {
+	addrs   []string
+	expires time.Time
+}
+
+// NewDNSCache returns an empty cache whose entries live at most maxTTL.
+func NewDNSCache(maxTTL time.Duration) *DNSCache {
+	return &DNSCache{MaxTTL: maxTTL, entries: make(map[string]dnsEntry)}
+}
+
+// Flush drops every cached answer.
+func (c *DNSCache) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	clear(c.entries)
+}
+
+func (c *DNSCache) get(host string, now time.Time) (dnsEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[host]
+	if !ok || !now.Before(e.expires) {
+		delete(c.entries, host)
+		return dnsEntry{}, false
+	}
+	return e, true
+}
+
+func (c *DNSCache) put(host string, addrs []string, ttl time.Duration, now time.Time) {
+	if c.MaxTTL > 0 && ttl > c.MaxTTL {
+		ttl = c.MaxTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[host] = dnsEntry{addrs: addrs, expires: now.Add(ttl)}
+}
+
+// testDNSCached is testDNS backed by cache. Misses are resolved with a direct
+// query to the nameservers in /etc/resolv.conf, which — unlike net.Resolver —
+// reports the records' TTL. Anything that query can't handle (truncation,
+// server errors, no usable nameserver) falls back to an uncached testDNS.
+func testDNSCached(ctx context.Context, target Target, timeout time.Duration, cache *DNSCache, ipv6 bool) PhaseResult {
+	if net.ParseIP(target.Host) != nil {
+		return testDNS(ctx, target, timeout, resolver, ipv6)
+	}
+	name := lookupName(target)
+	if !strings.HasSuffix(name, ".") {
+		// A Service outside a Pod: only the resolver applies the search list.
+		return testDNS(ctx, target, timeout, resolver, ipv6)
+	}
+	host := strings.ToLower(strings.TrimSuffix(target.Host, "."))
+	key := host
+	if ipv6 {
+		key += " AAAA" // targets pinned to either family share the cache
+	}
+
+	now := time.Now()
+	if e, ok := cache.get(key, now); ok {
+		left := e.expires.Sub(now).Round(time.Second)
+		return PhaseResult{
+			Success:  true,
+			Duration: time.Since(now),
+			Detail:   strings.Join(e.addrs, ", ") + " (cached, " + left.String() + " left)",
+			Addrs:    e.addrs,
+		}
+	}
+
+	qctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	start := time.Now()
+	qtype := uint16(dnsTypeA)
+	if ipv6 {
+		qtype = dnsTypeAAAA
+	}
+	addrs, ttl, err := lookupA(qctx, name, qtype)
+	elapsed := time.Since(start)
+	switch {
+	case errors.Is(err, errNXDomain):
+		return PhaseResult{Duration: elapsed, Detail: "NXDOMAIN"}
+	case err != nil:
+		return testDNS(ctx, target, timeout, resolver, ipv6)
+	}
+	cache.put(key, addrs, ttl, now)
+	return PhaseResult{Success: true, Duration: elapsed, Detail: strings.Join(addrs, ", "), Addrs: addrs}
+}
+
+var (
+	errNXDomain  = errors.New("no such host")
+	errNoAnswer  = errors.New("no address records")
+	errTruncated = errors.New("truncated response")
+)
+
+// responseBufs holds buffers for DNS responses, up to the 1232 bytes EDNS
+// recommends, so that lookups don't each allocate one.
+var responseBufs = sync.Pool{New: func() any {
+	buf := make([]byte, 1232)
+	return &buf
+}}
+
+const (
+	dnsTypeA     = 1
+	dnsTypeCNAME = 5
+	dnsTypeAAAA  = 28
+	dnsClassIN   = 1
+)
+
+// lookupA queries the configured nameservers in turn for the A (or, with
+// qtype AAAA, AAAA) records of fqdn and returns them with the smallest TTL
+// along the answer chain.
+func lookupA(ctx context.Context, fqdn string, qtype uint16) ([]string, time.Duration, error) {
+	servers := nameservers()
+	if len(servers) == 0 {
+		return nil, 0, errors.New("no nameservers")
+	}
+	var lastErr error
+	for _, server := range servers {
+		addrs, ttl, err := queryA(ctx, server, fqdn, qtype)
+		if err == nil || errors.Is(err, errNXDomain) || errors.Is(err, errNoAnswer) {
+			return addrs, ttl, err
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, 0, lastErr
+}
+
+// nameservers returns the nameserver addresses from /etc/resolv.conf.
+func nameservers() []string {
+	data, err := os.ReadFile("/etc/resolv.conf")
+	if err != nil {
+		return nil
+	}
+	var servers []string
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "nameserver" && net.ParseIP(fields[1]) != nil {
+			servers = append(servers, net.JoinHostPort(fields[1], "53"))
+		}
+	}
+	return servers
+}
+
+func queryA(ctx context.Context, server, fqdn string, qtype uint16) ([]string, time.Duration, error) {
+	id := uint16(rand.Uint32())
+	query, err := buildQuery(id, fqdn, qtype)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", server)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+	if dl, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(dl)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, 0, err
+	}
+	bufp := responseBufs.Get().(*[]byte)
+	defer responseBufs.Put(bufp)
+	buf := *bufp
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, 0, err
+		}
+		addrs, ttl, err := parseAResponse(buf[:n], id, qtype)
+		if errors.Is(err, errMismatchedID) {
+			continue // stale or spoofed reply; keep waiting for ours
+		}
+		return addrs, ttl, err
+	}
+}
+
+// buildQuery encodes a recursive query for one record of type qtype.
+func buildQuery(id uint16, fqdn string, qtype uint16) ([]byte, error) {
+	msg := make([]byte, 12, 12+len(fqdn)+6)
+	binary.BigEndian.PutUint16(msg[0:], id)
+	binary.BigEndian.PutUint16(msg[2:], 1<<8) // RD
+	binary.BigEndian.PutUint16(msg[4:], 1)    // QDCOUNT
+	for _, label := range strings.Split(strings.TrimSuffix(fqdn, "."), ".") {
+		if label == "" || len(label) > 63 {
+			return nil, errors.New("invalid name " + fqdn)
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, qtype)
+	msg = binary.BigEndian.AppendUint16(msg, dnsClassIN)
+	return msg, nil
+}
+
+var (
+	errMismatchedID = errors.New("mismatched response id")
+	errMalformed    = errors.New("malformed response")
+)
+
+// parseAResponse extracts the records of type qtype (A or AAAA) of a
+// response to query id, with the smallest TTL among them and any CNAMEs
+// leading to them.
+func parseAResponse(msg []byte, id, qtype uint16) ([]string, time.Duration, error) {
+	if len(msg) < 12 {
+		return nil, 0, errMalformed
+	}
+	if binary.BigEndian.Uint16(msg[0:]) != id {
+		return nil, 0, errMismatchedID
+	}
+	flags := binary.BigEndian.Uint16(msg[2:])
+	if flags&(1<<15) == 0 {
+		return nil, 0, errMalformed // not a response
+	}
+	if flags&(1<<9) != 0 {
+		return nil, 0, errTruncated
+	}
+	switch rcode := flags & 0xf; rcode {
+	case 0:
+	case 3:
+		return nil, 0, errNXDomain
+	default:
+		return nil, 0, fmt.Errorf("server error (rcode %d)", rcode)
+	}
+	qd := int(binary.BigEndian.Uint16(msg[4:]))
+	an := int(binary.BigEndian.Uint16(msg[6:]))
+
+	off := 12
+	for range qd {
+		var ok bool
+		if off, ok = skipName(msg, off); !ok || off+4 > len(msg) {
+			return nil, 0, errMalformed
+		}
+		off += 4
+	}
+
+	var addrs []string
+	var minTTL uint32
+	seen := false
+	for range an {
+		var ok bool
+		if off, ok = skipName(msg, off); !ok || off+10 > len(msg) {
+			return nil, 0, errMalformed
+		}
+		typ := binary.BigEndian.Uint16(msg[off:])
+		class := binary.BigEndian.Uint16(msg[off+2:])
+		ttl := binary.BigEndian.Uint32(msg[off+4:])
+		rdlen := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+rdlen > len(msg) {
+			return nil, 0, errMalformed
+		}
+		if class == dnsClassIN && (typ == qtype || typ == dnsTypeCNAME) {
+			if !seen || ttl < minTTL {
+				minTTL, seen = ttl, true
+			}
+			if (typ == dnsTypeA && rdlen == 4) || (typ == dnsTypeAAAA && rdlen == 16) {
+				addrs = append(addrs, net.IP(msg[off:off+rdlen]).String())
+			}
+		}
+		off += rdlen
+	}
+	if len(addrs) == 0 {
+		return nil, 0, errNoAnswer
+	}
+	return addrs, time.Duration(minTTL) * time.Second, nil
+}
+
+// skipName returns the offset just past the (possibly compressed) name at
+// off.
+func skipName(msg []byte, off int) (int, bool) {
+	for off < len(msg) {
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			return off + 1, true
+		case n&0xc0 == 0xc0:
+			return off + 2, off+2 <= len(msg)
+		default:
+			off += 1 + n
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,163 @@
+package probe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+)
+
+// DNSConsistency is what repeated queries for a target's name returned from
+// each nameserver in /etc/resolv.conf. Load-balanced names legitimately
+// rotate their addresses, or return a subset of a pool, but nameservers that
+// disagree about the set of addresses point at stale caches or a broken
+// upstream feeding some Pods addresses others don't get.
+type DNSConsistency struct {
+	Answers []DNSAnswer
+	// MinAddrs and MaxAddrs are the fewest and most addresses in one
+	// successful answer.
+	MinAddrs, MaxAddrs int
+	// Sets is the number of distinct answers, ignoring order. A failure,
+	// such as NXDOMAIN from one server, counts as an answer of its own.
+	Sets int
+	// Rotated is true if the same addresses came back in different orders.
+	Rotated bool
+	// Disagree is true if the nameservers returned different addresses,
+	// over all their answers, or if some failed where others answered.
+	Disagree bool
+}
+
+// DNSAnswer is one query's answer.
+type DNSAnswer struct {
+	Server string   // nameserver queried, host:port
+	Addrs  []string // in the order the server returned them
+	Err    string   // the failure, if the query got no addresses
+}
+
+// String summarizes c in a few words, e.g. "3 addresses, rotating" or
+// "servers disagree: 2 different answers, 1 address".
+func (c *DNSConsistency) String() string {
+	if c.MaxAddrs == 0 {
+		if c.Sets == 1 && len(c.Answers) > 0 {
+			return c.Answers[0].Err + " from every server"
+		}
+		return "no addresses"
+	}
+	s := fmt.Sprintf("%d–%d addresses", c.MinAddrs, c.MaxAddrs)
+	switch {
+	case c.MinAddrs != c.MaxAddrs:
+	case c.MaxAddrs == 1:
+		s = "1 address"
+	default:
+		s = fmt.Sprintf("%d addresses", c.MaxAddrs)
+	}
+	switch {
+	case c.Disagree:
+		s = fmt.Sprintf("servers disagree: %d different answers, %s", c.Sets, s)
+	case c.Sets > 1:
+		s += fmt.Sprintf(", %d different subsets", c.Sets)
+	}
+	if c.Rotated {
+		s += ", rotating"
+	}
+	return s
+}
+
+// checkDNS queries every nameserver for host rounds times, one query at a
+// time, each bounded by timeout. It returns nil if there is nothing to
+// compare: host is an IP address, or no nameserver is configured.
+func checkDNS(ctx context.Context, host string, rounds int, timeout time.Duration, ipv6 bool) *DNSConsistency {
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+	servers := nameservers()
+	if len(servers) == 0 {
+		return nil
+	}
+	fqdn := strings.TrimSuffix(host, ".") + "."
+	qtype := uint16(dnsTypeA)
+	if ipv6 {
+		qtype = dnsTypeAAAA
+	}
+
+	c := &DNSConsistency{}
+	for range rounds {
+		for _, server := range servers {
+			if ctx.Err() != nil {
+				break
+			}
+			qctx, cancel := context.WithTimeout(ctx, timeout)
+			addrs, _, err := queryA(qctx, server, fqdn, qtype)
+			cancel()
+			a := DNSAnswer{Server: server, Addrs: addrs}
+			if err != nil {
+				a.Addrs = nil
+				a.Err = simplifyError(err)
+				if errors.Is(err, errNoAnswer) {
+					a.Err = "no records"
+				}
+			}
+			c.Answers = append(c.Answers, a)
+		}
+	}
+	c.summarize()
+	return c
+}
+
+// summarize computes c's counts and flags from its answers.
+func (c *DNSConsistency) summarize() {
+	sets := map[string]bool{}
+	orders := map[string]string{} // sorted set -> first order seen
+	perServer := map[string]map[string]bool{}
+	for _, a := range c.Answers {
+		key := "error: " + a.Err
+		if a.Err == "" {
+			n := len(a.Addrs)
+			if c.MaxAddrs == 0 || n < c.MinAddrs {
+				c.MinAddrs = n
+			}
+			c.MaxAddrs = max(c.MaxAddrs, n)
+
+			sorted := slices.Sorted(slices.Values(a.Addrs))
+			key = strings.Join(sorted, ",")
+			order := strings.Join(a.Addrs, ",")
+			if first, ok := orders[key]; !ok {
+				orders[key] = order
+			} else if first != order {
+				c.Rotated = true
+			}
+		}
+		sets[key] = true
+		if perServer[a.Server] == nil {
+			perServer[a.Server] = map[string]bool{}
+		}
+		if a.Err != "" {
+			perServer[a.Server][key] = true
+		}
+		for _, addr := range a.Addrs {
+			perServer[a.Server][addr] = true
+		}
+	}
+	c.Sets = len(sets)
+
+	var first map[string]bool
+	for _, seen := range perServer {
+		if first == nil {
+			first = seen
+			continue
+		}
+		if len(seen) != len(first) {
+			c.Disagree = true
+			break
+		}
+		for k := range seen {
+			if !first[k] {
+				c.Disagree = true
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,381 @@
+package probe
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DNSExchange is one query of a traced lookup, and the response to it as
+// dig would show it.
+type DNSExchange struct {
+	Server    string // nameserver queried, host:port
+	Transport string // "udp", or "tcp" after a truncated answer
+	Name      string // the name queried, fully qualified
+	Type      string // "A" or "AAAA"
+	Duration  time.Duration
+	Err       string // no usable response, e.g. "i/o timeout"
+	Rcode     string // NOERROR, NXDOMAIN, SERVFAIL, ...
+	Flags     []string
+	Size      int // bytes in the response
+	// Answer, Authority and Additional are the records of the response's
+	// sections, e.g. "example.com. 300 IN A 93.184.216.34". The EDNS OPT
+	// record is left out.
+	Answer, Authority, Additional []string
+}
+
+// String summarizes x on one line, e.g. "github.com. A @10.96.0.10:53
+// (udp): NXDOMAIN in 2ms".
+func (x DNSExchange) String() string {
+	got := x.Rcode
+	if x.Err != "" {
+		got = x.Err
+	}
+	return fmt.Sprintf("%s %s @%s (%s): %s in %s", x.Name, x.Type, x.Server, x.Transport, got, x.Duration.Round(10*time.Microsecond))
+}
+
+// traceDNS looks host up the way the system resolver does — each name of
+// the search list in turn, each nameserver until one answers — and records
+// every query and response. Each query is bounded by timeout.
+func traceDNS(ctx context.Context, host string, timeout time.Duration, ipv6 bool) []DNSExchange {
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+	servers := nameservers()
+	if len(servers) == 0 {
+		return nil
+	}
+	qtype := uint16(dnsTypeA)
+	if ipv6 {
+		qtype = dnsTypeAAAA
+	}
+
+	var trace []DNSExchange
+	for _, name := range searchNames(host) {
+		answered := false
+		for _, server := range servers {
+			if ctx.Err() != nil {
+				return trace
+			}
+			x := exchangeTraced(ctx, server, "udp", name, qtype, timeout)
+			if slices.Contains(x.Flags, "tc") {
+				trace = append(trace, x)
+				x = exchangeTraced(ctx, server, "tcp", name, qtype, timeout)
+			}
+			trace = append(trace, x)
+			if x.Err == "" && x.Rcode != "SERVFAIL" && x.Rcode != "REFUSED" {
+				answered = x.Rcode == "NOERROR" && len(x.Answer) > 0
+				break
+			}
+		}
+		if answered {
+			break
+		}
+	}
+	return trace
+}
+
+// searchNames lists the names the resolver tries for host, in order,
+// following the search and ndots settings of /etc/resolv.conf.
+func searchNames(host string) []string {
+	if strings.HasSuffix(host, ".") {
+		return []string{host}
+	}
+	search, ndots := resolvSearch()
+	var names []string
+	for _, s := range search {
+		names = append(names, host+"."+strings.TrimSuffix(s, ".")+".")
+	}
+	if strings.Count(host, ".") >= ndots {
+		return append([]string{host + "."}, names...)
+	}
+	return append(names, host+".")
+}
+
+// resolvSearch returns the search list and ndots setting of
+// /etc/resolv.conf.
+func resolvSearch() (search []string, ndots int) {
+	ndots = 1
+	data, err := os.ReadFile("/etc/resolv.conf")
+	if err != nil {
+		return nil, ndots
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 0:
+		case fields[0] == "search" || fields[0] == "domain":
+			search = fields[1:]
+		case fields[0] == "options":
+			for _, o := range fields[1:] {
+				if n, err := strconv.Atoi(strings.TrimPrefix(o, "ndots:")); err == nil && strings.HasPrefix(o, "ndots:") {
+					ndots = min(n, 15)
+				}
+			}
+		}
+	}
+	return search, ndots
+}
+
+// clusterDomain is the cluster's DNS domain, e.g. "cluster.local", from the
+// "svc.<domain>" entry the kubelet puts in a Pod's search list, or "" outside
+// a Pod.
+var clusterDomain = sync.OnceValue(func() string {
+	search, _ := resolvSearch()
+	for _, s := range search {
+		if d, ok := strings.CutPrefix(strings.TrimSuffix(s, "."), "svc."); ok && d != "" {
+			return d
+		}
+	}
+	return ""
+})
+
+// exchangeTraced sends one query for name, with an EDNS OPT record as Go's
+// resolver does, and decodes the response.
+func exchangeTraced(ctx context.Context, server, network, name string, qtype uint16, timeout time.Duration) DNSExchange {
+	x := DNSExchange{Server: server, Transport: network, Name: name, Type: dnsTypeName(qtype)}
+	id := uint16(rand.Uint32())
+	query, err := buildQuery(id, name, qtype)
+	if err != nil {
+		x.Err = err.Error()
+		return x
+	}
+	binary.BigEndian.PutUint16(query[10:], 1)                     // ARCOUNT
+	query = append(query, 0, 0, 41, 0x04, 0xd0, 0, 0, 0, 0, 0, 0) // OPT, 1232-byte payload
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	start := time.Now()
+	msg, err := exchange(ctx, server, network, query, id)
+	x.Duration = time.Since(start)
+	if err != nil {
+		x.Err = simplifyError(err)
+		return x
+	}
+	x.Size = len(msg)
+	if err := x.decode(msg); err != nil {
+		x.Err = err.Error()
+	}
+	return x
+}
+
+// exchange sends query over network and returns the response to it.
+func exchange(ctx context.Context, server, network string, query []byte, id uint16) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if dl, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(dl)
+	}
+	if network == "tcp" {
+		if _, err := conn.Write(binary.BigEndian.AppendUint16(nil, uint16(len(query)))); err != nil {
+			return nil, err
+		}
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		var size [2]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return nil, err
+		}
+		msg := make([]byte, binary.BigEndian.Uint16(size[:]))
+		if _, err := io.ReadFull(conn, msg); err != nil {
+			return nil, err
+		}
+		return msg, nil
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 1232)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		if n >= 2 && binary.BigEndian.Uint16(buf) == id {
+			return buf[:n], nil
+		}
+	}
+}
+
+// decode fills x's header fields and sections from msg.
+func (x *DNSExchange) decode(msg []byte) error {
+	if len(msg) < 12 {
+		return errMalformed
+	}
+	flags := binary.BigEndian.Uint16(msg[2:])
+	for _, f := range []struct {
+		bit  uint16
+		name string
+	}{{15, "qr"}, {10, "aa"}, {9, "tc"}, {8, "rd"}, {7, "ra"}, {5, "ad"}, {4, "cd"}} {
+		if flags&(1<<f.bit) != 0 {
+			x.Flags = append(x.Flags, f.name)
+		}
+	}
+	x.Rcode = rcodeNames[flags&0xf]
+	if x.Rcode == "" {
+		x.Rcode = "RCODE" + strconv.Itoa(int(flags&0xf))
+	}
+
+	off := 12
+	for range binary.BigEndian.Uint16(msg[4:]) {
+		var ok bool
+		if off, ok = skipName(msg, off); !ok || off+4 > len(msg) {
+			return errMalformed
+		}
+		off += 4
+	}
+	for i, section := range []*[]string{&x.Answer, &x.Authority, &x.Additional} {
+		for range binary.BigEndian.Uint16(msg[6+2*i:]) {
+			rr, next, err := readRecord(msg, off)
+			if err != nil {
+				return err
+			}
+			if rr != "" {
+				*section = append(*section, rr)
+			}
+			off = next
+		}
+	}
+	return nil
+}
+
+var rcodeNames = map[uint16]string{0: "NOERROR", 1: "FORMERR", 2: "SERVFAIL", 3: "NXDOMAIN", 4: "NOTIMP", 5: "REFUSED"}
+
+var dnsTypeNames = map[uint16]string{
+	dnsTypeA: "A", 2: "NS", dnsTypeCNAME: "CNAME", 6: "SOA", 12: "PTR", 15: "MX",
+	16: "TXT", dnsTypeAAAA: "AAAA", 33: "SRV", 41: "OPT", 65: "HTTPS",
+}
+
+func dnsTypeName(t uint16) string {
+	if name, ok := dnsTypeNames[t]; ok {
+		return name
+	}
+	return "TYPE" + strconv.Itoa(int(t))
+}
+
+// readRecord returns the resource record at off in presentation format,
+// or "" for an OPT record, and the offset past it.
+func readRecord(msg []byte, off int) (string, int, error) {
+	owner, off, ok := readName(msg, off)
+	if !ok || off+10 > len(msg) {
+		return "", 0, errMalformed
+	}
+	typ := binary.BigEndian.Uint16(msg[off:])
+	class := binary.BigEndian.Uint16(msg[off+2:])
+	ttl := binary.BigEndian.Uint32(msg[off+4:])
+	rdlen := int(binary.BigEndian.Uint16(msg[off+8:]))
+	off += 10
+	end := off + rdlen
+	if end > len(msg) {
+		return "", 0, errMalformed
+	}
+	if typ == 41 {
+		return "", end, nil
+	}
+	classText := "IN"
+	if class != dnsClassIN {
+		classText = "CLASS" + strconv.Itoa(int(class))
+	}
+	return fmt.Sprintf("%s %d %s %s %s", owner, ttl, classText, dnsTypeName(typ), rdata(msg, off, end, typ)), end, nil
+}
+
+// rdata formats the data of a record of type typ, msg[off:end].
+func rdata(msg []byte, off, end int, typ uint16) string {
+	data := msg[off:end]
+	names := func(off int, n int) ([]string, int, bool) {
+		var out []string
+		for range n {
+			name, next, ok := readName(msg, off)
+			if !ok || next > end {
+				return nil, 0, false
+			}
+			out, off = append(out, name), next
+		}
+		return out, off, true
+	}
+	switch {
+	case typ == dnsTypeA && len(data) == 4, typ == dnsTypeAAAA && len(data) == 16:
+		return net.IP(data).String()
+	case typ == 2 || typ == dnsTypeCNAME || typ == 12:
+		if n, _, ok := names(off, 1); ok {
+			return n[0]
+		}
+	case typ == 15 && len(data) > 2:
+		if n, _, ok := names(off+2, 1); ok {
+			return strconv.Itoa(int(binary.BigEndian.Uint16(data))) + " " + n[0]
+		}
+	case typ == 33 && len(data) > 6:
+		if n, _, ok := names(off+6, 1); ok {
+			return fmt.Sprintf("%d %d %d %s", binary.BigEndian.Uint16(data), binary.BigEndian.Uint16(data[2:]), binary.BigEndian.Uint16(data[4:]), n[0])
+		}
+	case typ == 6:
+		if n, next, ok := names(off, 2); ok && next+20 == end {
+			v := msg[next:end]
+			return fmt.Sprintf("%s %s %d %d %d %d %d", n[0], n[1], binary.BigEndian.Uint32(v), binary.BigEndian.Uint32(v[4:]),
+				binary.BigEndian.Uint32(v[8:]), binary.BigEndian.Uint32(v[12:]), binary.BigEndian.Uint32(v[16:]))
+		}
+	case typ == 16:
+		var parts []string
+		for len(data) > 0 && int(data[0]) < len(data) {
+			parts = append(parts, strconv.Quote(string(data[1:1+data[0]])))
+			data = data[1+data[0]:]
+		}
+		if len(data) == 0 {
+			return strings.Join(parts, " ")
+		}
+		data = msg[off:end]
+	}
+	return fmt.Sprintf(`\# %d %s`, len(data), hex.EncodeToString(data)) // RFC 3597
+}
+
+// readName decodes the possibly compressed name at off and returns it with
+// the offset just past it.
+func readName(msg []byte, off int) (string, int, bool) {
+	var b strings.Builder
+	next := -1
+	for hops := 0; off < len(msg); {
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			if b.Len() == 0 {
+				return ".", next, true
+			}
+			return b.String(), next, true
+		case n&0xc0 == 0xc0:
+			if off+2 > len(msg) || hops > 32 {
+				return "", 0, false
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+			hops++
+		default:
+			if off+1+n > len(msg) {
+				return "", 0, false
+			}
+			b.Write(msg[off+1 : off+1+n])
+			b.WriteByte('.')
+			off += 1 + n
+		}
+	}
+	return "", 0, false
+}
@@ -0,0 +1,98 @@
+package probe
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// winsockErrors maps the messages of Winsock errors to the details the
+// same errors get elsewhere.
+var winsockErrors = []struct{ text, detail string }{
+	{"actively refused it", "connection refused"},                                         // WSAECONNREFUSED
+	{"forcibly closed by the remote host", "connection reset"},                            // WSAECONNRESET
+	{"established connection was aborted", "connection reset"},                            // WSAECONNABORTED
+	{"did not properly respond after a period of time", "timeout"},                        // WSAETIMEDOUT
+	{"attempted to an unreachable network", "network is unreachable"},                     // WSAENETUNREACH
+	{"attempted to an unreachable host", "no route to host"},                              // WSAEHOSTUNREACH
+	{"requested address is not valid in its context", "cannot assign requested address"},  // WSAEADDRNOTAVAIL
+	{"access a socket in a way forbidden by its access permissions", "permission denied"}, // WSAEACCES, e.g. the Windows firewall
+	{"temporary error during hostname resolution", "server misbehaving"},                  // WSATRY_AGAIN
+}
+
+func simplifyError(err error) string {
+	msg := err.Error()
+
+	var fe *fipsError
+	if errors.As(err, &fe) {
+		return fe.Error()
+	}
+	var pd *proxyDeniedError
+	if errors.As(err, &pd) {
+		return pd.Error()
+	}
+	var pc *proxyConnError
+	if errors.As(err, &pc) {
+		return "proxy " + pc.proxy + ": " + simplifyError(pc.err)
+	}
+
+	if strings.Contains(msg, "no such host") {
+		return "NXDOMAIN"
+	}
+	if strings.Contains(msg, "i/o timeout") || strings.Contains(msg, "deadline exceeded") {
+		return "timeout"
+	}
+	if strings.Contains(msg, "connection refused") {
+		return "connection refused"
+	}
+	if strings.Contains(msg, "connection reset") {
+		return "connection reset"
+	}
+	// Winsock's messages for the same errors, on Windows nodes.
+	for _, w := range winsockErrors {
+		if strings.Contains(msg, w.text) {
+			return w.detail
+		}
+	}
+	// Alerts from the server about the certificate the probe presented.
+	if strings.Contains(msg, "remote error: tls: certificate required") {
+		return "client certificate required"
+	}
+	if strings.Contains(msg, "remote error: tls:") && strings.Contains(msg, "certificate") {
+		return "client certificate rejected"
+	}
+	if strings.Contains(msg, "certificate") {
+		if strings.Contains(msg, "unknown authority") {
+			return "cert: unknown authority"
+		}
+		if strings.Contains(msg, "expired") {
+			return "cert: expired"
+		}
+		return "cert error"
+	}
+	if strings.Contains(msg, "handshake failure") {
+		return "TLS handshake failure"
+	}
+
+	if idx := strings.LastIndex(msg, ": "); idx != -1 {
+		return msg[idx+2:]
+	}
+
+	return msg
+}
+
+func tlsVersionString(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	default:
+		return fmt.Sprintf("TLS 0x%04x", version)
+	}
+}
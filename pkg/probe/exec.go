@@ -0,0 +1,130 @@
+package probe
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PluginInput is the JSON document written to a plugin's stdin. It carries
+// the target and the results of the phases that ran before the plugin.
+type PluginInput struct {
+	Host string      `json:"host"`
+	Port int         `json:"port"`
+	Type string      `json:"type"` // "allow" or "deny"
+	DNS  PluginPhase `json:"dns"`
+	TCP  PluginPhase `json:"tcp"`
+	TLS  PluginPhase `json:"tls"`
+}
+
+type PluginPhase struct {
+	Success    bool   `json:"success"`
+	DurationMs int64  `json:"duration_ms"`
+	Detail     string `json:"detail"`
+}
+
+// PluginOutput is what a plugin prints on stdout. A plugin that prints
+// nothing parseable is judged by its exit status alone.
+type PluginOutput struct {
+	Success bool   `json:"success"`
+	Detail  string `json:"detail"`
+}
+
+// testExec runs the target's plugin command as an extra phase. The command
+// is split on whitespace and executed directly (there is no shell in the
+// container image). Besides the JSON on stdin, the plugin receives
+// EGRESS_PROBE_HOST, EGRESS_PROBE_PORT, EGRESS_PROBE_TYPE and
+// EGRESS_PROBE_ADDRS in its environment.
+func testExec(ctx context.Context, r Result, timeout time.Duration) PhaseResult {
+	args := strings.Fields(r.Target.Exec)
+	typ := targetType(r.Target)
+
+	input, _ := json.Marshal(PluginInput{
+		Host: r.Target.Host,
+		Port: r.Target.Port,
+		Type: typ,
+		DNS:  toPluginPhase(r.DNS),
+		TCP:  toPluginPhase(r.TCP),
+		TLS:  toPluginPhase(r.TLS),
+	})
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Env = append(os.Environ(),
+		"EGRESS_PROBE_HOST="+r.Target.Host,
+		"EGRESS_PROBE_PORT="+strconv.Itoa(r.Target.Port),
+		"EGRESS_PROBE_TYPE="+typ,
+		"EGRESS_PROBE_ADDRS="+r.DNS.Detail,
+	)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	start := time.Now()
+	err := cmd.Run()
+	elapsed := time.Since(start)
+
+	if ctx.Err() != nil {
+		return PhaseResult{Duration: elapsed, Detail: "timeout"}
+	}
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return PhaseResult{Duration: elapsed, Detail: "plugin: " + simplifyError(err)}
+	}
+
+	var out PluginOutput
+	if jsonErr := json.Unmarshal(stdout.Bytes(), &out); jsonErr == nil {
+		if err != nil {
+			out.Success = false
+		}
+		if out.Detail == "" {
+			out.Detail = map[bool]string{true: "ok", false: "failed"}[out.Success]
+		}
+		return PhaseResult{Success: out.Success, Duration: elapsed, Detail: out.Detail}
+	}
+
+	if err != nil {
+		detail := lastLine(stderr.String())
+		if detail == "" {
+			detail = lastLine(stdout.String())
+		}
+		if detail == "" {
+			detail = fmt.Sprintf("exit status %d", exitErr.ExitCode())
+		}
+		return PhaseResult{Duration: elapsed, Detail: detail}
+	}
+	detail := lastLine(stdout.String())
+	if detail == "" {
+		detail = "ok"
+	}
+	return PhaseResult{Success: true, Duration: elapsed, Detail: detail}
+}
+
+func toPluginPhase(p PhaseResult) PluginPhase {
+	return PluginPhase{Success: p.Success, DurationMs: p.Duration.Milliseconds(), Detail: p.Detail}
+}
+
+func targetType(t Target) string {
+	if t.ExpectErr {
+		return "deny"
+	}
+	return "allow"
+}
+
+func lastLine(s string) string {
+	s = strings.TrimSpace(s)
+	if idx := strings.LastIndex(s, "\n"); idx != -1 {
+		s = s[idx+1:]
+	}
+	return strings.TrimSpace(s)
+}
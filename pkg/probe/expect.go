@@ -0,0 +1,228 @@
+package probe
+
+import (
+	"fmt"
+	"net/netip"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Assertion is the outcome of one assertion of a target's expect option.
+type Assertion struct {
+	Expr   string // the assertion as written, e.g. "tcp<200ms"
+	Passed bool
+	Detail string // what was observed, e.g. "took 340ms"
+}
+
+// expectation is one parsed assertion of an expect option.
+type expectation struct {
+	expr  string
+	http  bool // needs the HTTP phase
+	check func(r *Result, cert *CertInfo, now time.Time) (bool, string)
+}
+
+// parseExpect parses an expect option: assertions separated by spaces, all
+// of which must hold.
+//
+//	dns=ok tcp=fail              a phase succeeded or failed (dns, tcp, tls, http, exec)
+//	tcp<200ms total<1s           a phase, or all of them, took less than that
+//	issuer~DigiCert              the server certificate's issuer matches a pattern
+//	expiry>30d                   the server certificate is valid for longer than that
+//	status=200 status=2xx|301    the HTTP response's status
+//	cidr=10.0.0.0/8|192.0.2.0/24 every resolved address is in one of the prefixes
+func parseExpect(spec string) ([]expectation, error) {
+	var exps []expectation
+	for _, expr := range strings.Fields(spec) {
+		i := strings.IndexAny(expr, "=<>~")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid assertion %q: expected name, operator (=, <, > or ~) and value", expr)
+		}
+		name, op, value := strings.ToLower(expr[:i]), expr[i], expr[i+1:]
+		e, err := newExpectation(name, op, value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid assertion %q: %v", expr, err)
+		}
+		e.expr = expr
+		exps = append(exps, e)
+	}
+	return exps, nil
+}
+
+func newExpectation(name string, op byte, value string) (expectation, error) {
+	switch {
+	case phaseNames[name] && op == '=':
+		if value != "ok" && value != "fail" {
+			return expectation{}, fmt.Errorf("expected %s=ok or %s=fail", name, name)
+		}
+		want := value == "ok"
+		return expectation{http: name == "http", check: func(r *Result, _ *CertInfo, _ time.Time) (bool, string) {
+			p := r.phase(name)
+			if !ran(p) {
+				return false, p.Detail
+			}
+			if p.Success {
+				return want, "succeeded"
+			}
+			return !want, "failed: " + p.Detail
+		}}, nil
+
+	case (phaseNames[name] || name == "total") && op == '<':
+		limit, err := time.ParseDuration(value)
+		if err != nil {
+			return expectation{}, fmt.Errorf("expected a duration such as 200ms")
+		}
+		return expectation{http: name == "http", check: func(r *Result, _ *CertInfo, _ time.Time) (bool, string) {
+			var took time.Duration
+			if name == "total" {
+				for _, p := range []PhaseResult{r.DNS, r.TCP, r.TLS, r.HTTP, r.Exec} {
+					took += p.Duration
+				}
+			} else {
+				p := r.phase(name)
+				if !ran(p) {
+					return false, p.Detail
+				}
+				took = p.Duration
+			}
+			return took < limit, "took " + took.Round(time.Millisecond).String()
+		}}, nil
+
+	case name == "issuer" && op == '~':
+		re, err := regexp.Compile("(?i)" + value)
+		if err != nil {
+			re = regexp.MustCompile("(?i)" + regexp.QuoteMeta(value))
+		}
+		return expectation{check: func(_ *Result, cert *CertInfo, _ time.Time) (bool, string) {
+			if cert == nil {
+				return false, "no certificate"
+			}
+			return re.MatchString(cert.Issuer), fmt.Sprintf("issued by %q", cert.Issuer)
+		}}, nil
+
+	case name == "expiry" && op == '>':
+		least, err := parseDays(value)
+		if err != nil {
+			return expectation{}, err
+		}
+		return expectation{check: func(_ *Result, cert *CertInfo, now time.Time) (bool, string) {
+			if cert == nil {
+				return false, "no certificate"
+			}
+			return cert.NotAfter.Sub(now) > least, fmt.Sprintf("expires in %d days", cert.DaysLeft(now))
+		}}, nil
+
+	case name == "status" && op == '=':
+		codes := strings.Split(strings.ToLower(value), "|")
+		for _, c := range codes {
+			if len(c) != 3 || strings.Trim(c[1:], "0123456789x") != "" || c[0] < '1' || c[0] > '5' {
+				return expectation{}, fmt.Errorf("expected status codes such as 200 or 2xx, separated by |")
+			}
+		}
+		return expectation{http: true, check: func(r *Result, _ *CertInfo, _ time.Time) (bool, string) {
+			if r.HTTP.Status == 0 {
+				return false, "no HTTP response"
+			}
+			got := strconv.Itoa(r.HTTP.Status)
+			for _, c := range codes {
+				if c[0] == got[0] && (c[1] == 'x' || c[1] == got[1]) && (c[2] == 'x' || c[2] == got[2]) {
+					return true, "HTTP " + got
+				}
+			}
+			return false, "HTTP " + got
+		}}, nil
+
+	case name == "cidr" && op == '=':
+		var prefixes []netip.Prefix
+		for _, s := range strings.Split(value, "|") {
+			p, err := netip.ParsePrefix(s)
+			if err != nil {
+				return expectation{}, fmt.Errorf("expected CIDR prefixes such as 10.0.0.0/8, separated by |")
+			}
+			prefixes = append(prefixes, p.Masked())
+		}
+		return expectation{check: func(r *Result, _ *CertInfo, _ time.Time) (bool, string) {
+			if len(r.DNS.Addrs) == 0 {
+				return false, "no addresses resolved"
+			}
+		addrs:
+			for _, s := range r.DNS.Addrs {
+				a, err := netip.ParseAddr(s)
+				if err != nil {
+					continue
+				}
+				for _, p := range prefixes {
+					if p.Contains(a.Unmap()) {
+						continue addrs
+					}
+				}
+				return false, "resolved " + s
+			}
+			return true, "resolved " + strings.Join(r.DNS.Addrs, ", ")
+		}}, nil
+	}
+	return expectation{}, fmt.Errorf("unknown assertion: expected dns, tcp, tls, http or exec =ok|fail or <duration, total<duration, issuer~pattern, expiry>days, status=code or cidr=prefix")
+}
+
+// phaseNames are the phases an assertion can name.
+var phaseNames = map[string]bool{"dns": true, "tcp": true, "tls": true, "http": true, "exec": true}
+
+// phase returns the result of the phase an assertion names.
+func (r *Result) phase(name string) PhaseResult {
+	switch name {
+	case "dns":
+		return r.DNS
+	case "tcp":
+		return r.TCP
+	case "tls":
+		return r.TLS
+	case "http":
+		return r.HTTP
+	}
+	return r.Exec
+}
+
+// ran reports whether p was run rather than skipped.
+func ran(p PhaseResult) bool {
+	return !p.Start.IsZero() && !strings.HasPrefix(p.Detail, "skipped")
+}
+
+// parseDays parses a minimum validity: days, "30d", or a Go duration.
+func parseDays(s string) (time.Duration, error) {
+	if n, err := strconv.Atoi(strings.TrimSuffix(s, "d")); err == nil && n >= 0 {
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("expected a number of days such as 30d")
+	}
+	return d, nil
+}
+
+// ValidateExpect reports whether spec is a valid expect option.
+func ValidateExpect(spec string) error {
+	_, err := parseExpect(spec)
+	return err
+}
+
+// expectsHTTP reports whether an assertion of exps needs the HTTP phase.
+func expectsHTTP(exps []expectation) bool {
+	for _, e := range exps {
+		if e.http {
+			return true
+		}
+	}
+	return false
+}
+
+// checkExpectations evaluates exps against r. cert is the server
+// certificate, whether or not Options.CertInfo records it.
+func checkExpectations(exps []expectation, r *Result, cert *CertInfo, now time.Time) []Assertion {
+	out := make([]Assertion, len(exps))
+	for i, e := range exps {
+		ok, detail := e.check(r, cert, now)
+		out[i] = Assertion{Expr: e.expr, Passed: ok, Detail: detail}
+	}
+	return out
+}
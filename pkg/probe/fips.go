@@ -0,0 +1,88 @@
+package probe
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"slices"
+)
+
+// FIPS-approved TLS parameters, per NIST SP 800-52r2: AES-GCM with ECDHE
+// over the NIST curves.
+var (
+	fipsCipherSuites = []uint16{
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		// TLS 1.3
+		tls.TLS_AES_128_GCM_SHA256,
+		tls.TLS_AES_256_GCM_SHA384,
+	}
+	fipsCurves = []tls.CurveID{tls.CurveP256, tls.CurveP384, tls.CurveP521}
+)
+
+// fipsError is a handshake that negotiated parameters FIPS doesn't approve.
+type fipsError struct {
+	what string
+}
+
+func (e *fipsError) Error() string {
+	return "not FIPS-approved: " + e.what
+}
+
+// restrictToFIPS limits c to FIPS-approved parameters. Go doesn't let TLS
+// 1.3 cipher suites be configured, so the handshake is also checked after
+// the fact, along with the certificate keys.
+func restrictToFIPS(c *tls.Config) {
+	c.MinVersion = tls.VersionTLS12
+	c.CipherSuites = fipsCipherSuites
+	c.CurvePreferences = fipsCurves
+	c.VerifyConnection = checkFIPS
+}
+
+// checkFIPS fails a handshake whose cipher suite, key exchange or
+// certificate keys aren't FIPS-approved.
+func checkFIPS(state tls.ConnectionState) error {
+	if !slices.Contains(fipsCipherSuites, state.CipherSuite) {
+		return &fipsError{tls.CipherSuiteName(state.CipherSuite)}
+	}
+	if state.CurveID != 0 && !slices.Contains(fipsCurves, state.CurveID) {
+		return &fipsError{"key exchange " + state.CurveID.String()}
+	}
+	for i, cert := range state.PeerCertificates {
+		if what := fipsKey(cert); what != "" {
+			if i > 0 {
+				return &fipsError{fmt.Sprintf("%s key of CA %q", what, cert.Subject.CommonName)}
+			}
+			return &fipsError{what + " key"}
+		}
+	}
+	return nil
+}
+
+// fipsKey describes the public key of cert if FIPS doesn't approve it:
+// RSA keys need 2048 bits or more, ECDSA keys a NIST curve.
+func fipsKey(cert *x509.Certificate) string {
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		if key.N.BitLen() < 2048 {
+			return fmt.Sprintf("RSA-%d", key.N.BitLen())
+		}
+	case *ecdsa.PublicKey:
+		switch key.Curve {
+		case elliptic.P256(), elliptic.P384(), elliptic.P521():
+		default:
+			return "ECDSA " + key.Curve.Params().Name
+		}
+	case ed25519.PublicKey:
+		// Approved by FIPS 186-5.
+	default:
+		return fmt.Sprintf("%T", key)
+	}
+	return ""
+}
@@ -0,0 +1,68 @@
+package probe
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// localHandshake is faster than any TLS handshake with a server beyond the
+// node can complete; only a proxy on the same host answers this quickly.
+const localHandshake = time.Millisecond
+
+// detectInterception looks for signs that a TLS handshake was answered by a
+// local mesh proxy rather than the destination, and describes them. certs is
+// the chain the server presented, verified or not; handshake is the time from
+// dialing to a completed handshake (zero if it failed).
+func detectInterception(certs []*x509.Certificate, handshake time.Duration, remote string) string {
+	if len(certs) > 0 {
+		leaf := certs[0]
+		for _, u := range leaf.URIs {
+			if u.Scheme == "spiffe" {
+				return "certificate carries the workload identity " + u.String()
+			}
+		}
+		for _, c := range certs {
+			if meshCA(c.Issuer.Organization, c.Issuer.CommonName) {
+				return "certificate issued by the mesh CA (" + c.Issuer.String() + ")"
+			}
+		}
+	}
+
+	if handshake > 0 && handshake < localHandshake {
+		host, _, _ := net.SplitHostPort(remote)
+		if ip := net.ParseIP(host); ip != nil && !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() {
+			return fmt.Sprintf("handshake with public address %s completed in %s, too fast for a remote server",
+				host, handshake.Round(time.Microsecond))
+		}
+	}
+	return ""
+}
+
+// meshCA reports whether an issuer looks like a service-mesh certificate
+// authority: Istio's (istiod, or O=cluster.local by default), Linkerd's
+// identity issuer, or Consul Connect's.
+func meshCA(org []string, cn string) bool {
+	for _, o := range org {
+		if o == "cluster.local" || strings.Contains(strings.ToLower(o), "istio") {
+			return true
+		}
+	}
+	cn = strings.ToLower(cn)
+	return strings.Contains(cn, "istio") || strings.HasPrefix(cn, "identity.linkerd.") ||
+		strings.Contains(cn, "consul ca")
+}
+
+// unverifiedCerts returns the chain a failed handshake received, if the
+// failure was in verifying it.
+func unverifiedCerts(err error) []*x509.Certificate {
+	var ve *tls.CertificateVerificationError
+	if errors.As(err, &ve) {
+		return ve.UnverifiedCertificates
+	}
+	return nil
+}
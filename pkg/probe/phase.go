@@ -0,0 +1,418 @@
+package probe
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// resolver is shared by every DNS phase without Options.Resolver. It holds
+// no per-query state.
+var resolver = &net.Resolver{PreferGo: true}
+
+// Resolver looks up the addresses of a name, like (*net.Resolver).LookupIP,
+// which it is usually backed by. A name that doesn't exist should be
+// reported as a *net.DNSError with IsNotFound set.
+type Resolver interface {
+	LookupIP(ctx context.Context, network, host string) ([]net.IP, error)
+}
+
+// DialFunc opens a connection, like (*net.Dialer).DialContext.
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// phaseDialer returns how a phase connects: with custom, bounded by
+// timeout, or without it with a net.Dialer that records its attempts in rec.
+func phaseDialer(custom DialFunc, timeout time.Duration, rec *attemptRecorder) DialFunc {
+	if custom == nil {
+		return pinnedDial((&net.Dialer{Timeout: timeout, Control: rec.control}).DialContext)
+	}
+	return pinnedDial(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		return custom(ctx, network, addr)
+	})
+}
+
+// pinnedKey is the context key of the addresses a retried phase connects to
+// instead of resolving the target's name again.
+type pinnedKey struct{}
+
+type pinnedAddrs struct {
+	host  string
+	addrs []string
+}
+
+// withPinnedAddrs returns ctx with connections to host pinned to addrs.
+func withPinnedAddrs(ctx context.Context, host string, addrs []string) context.Context {
+	return context.WithValue(ctx, pinnedKey{}, pinnedAddrs{host, addrs})
+}
+
+// pinnedDial returns dial, except that a connection to the host pinned in
+// the context tries each of its addresses in turn until one connects.
+// Connections to anything else, such as a proxy, are left alone.
+func pinnedDial(dial DialFunc) DialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		pin, ok := ctx.Value(pinnedKey{}).(pinnedAddrs)
+		host, port, err := net.SplitHostPort(addr)
+		if !ok || err != nil || host != pin.host {
+			return dial(ctx, network, addr)
+		}
+		for _, a := range pin.addrs {
+			var conn net.Conn
+			if conn, err = dial(ctx, network, net.JoinHostPort(a, port)); err == nil {
+				return conn, nil
+			}
+		}
+		return nil, err
+	}
+}
+
+// lookupName is the name the DNS phase looks up for t. It is rooted, so
+// that the search list doesn't change what is resolved, except for a
+// Service: its "name.namespace.svc" only exists with the cluster domain
+// after it, which is added if it is known and otherwise left to the search
+// list.
+func lookupName(t Target) string {
+	host := strings.TrimSuffix(t.Host, ".")
+	if t.Service == "" {
+		return host + "."
+	}
+	if d := clusterDomain(); d != "" {
+		return host + "." + d + "."
+	}
+	return host
+}
+
+// testDNS resolves the target's A records or, with ipv6, its AAAA records,
+// with res.
+func testDNS(ctx context.Context, target Target, timeout time.Duration, res Resolver, ipv6 bool) PhaseResult {
+	if net.ParseIP(target.Host) != nil {
+		return PhaseResult{
+			Success:  true,
+			Duration: 0,
+			Detail:   target.Host + " (literal)",
+			Addrs:    []string{target.Host},
+		}
+	}
+
+	lookupHost := lookupName(target)
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	network, other := "ip4", "ip6"
+	if ipv6 {
+		network, other = "ip6", "ip4"
+	}
+	ips, err := res.LookupIP(ctx, network, lookupHost)
+	elapsed := time.Since(start)
+
+	if err != nil {
+		detail := simplifyError(err)
+		// The resolver reports a name without records of the family asked
+		// for like one that doesn't exist.
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			if _, err := res.LookupIP(ctx, other, lookupHost); err == nil {
+				detail = noRecordDetail[network]
+			}
+		}
+		return PhaseResult{
+			Success:  false,
+			Duration: elapsed,
+			Detail:   detail,
+		}
+	}
+
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = ip.String()
+	}
+
+	return PhaseResult{
+		Success:  true,
+		Duration: elapsed,
+		Detail:   strings.Join(addrs, ", "),
+		Addrs:    addrs,
+	}
+}
+
+// noRecordDetail describes a name that only has addresses of the other
+// family than the one looked up.
+var noRecordDetail = map[string]string{
+	"ip4": "no A record (IPv6-only name)",
+	"ip6": "no AAAA record (IPv4-only name)",
+}
+
+// testTCP opens a connection to the target or, with proxy, has the proxy
+// open one. custom, if set, replaces the net.Dialer.
+func testTCP(ctx context.Context, target Target, timeout time.Duration, custom DialFunc, proxy *url.URL) PhaseResult {
+	addr := net.JoinHostPort(target.Host, strconv.Itoa(target.Port))
+
+	start := time.Now()
+	rec := &attemptRecorder{}
+	flow := &flowTimer{}
+	ctx = flow.with(ctx)
+	dial := phaseDialer(custom, timeout, rec)
+	var conn net.Conn
+	var err error
+	detail := "connected"
+	if proxy != nil {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		conn, err = dialProxy(ctx, dial, proxy, target, addr)
+		detail = "connected via proxy " + proxy.Host
+	} else {
+		conn, err = dial(ctx, target.network(), addr)
+	}
+	elapsed := time.Since(start)
+
+	if err != nil {
+		return PhaseResult{
+			Success:  false,
+			Duration: elapsed,
+			Detail:   simplifyError(err),
+			Attempts: rec.list(),
+		}
+	}
+	info := connTCPInfo(conn)
+	conn.Close()
+
+	return PhaseResult{
+		Success:  true,
+		Duration: elapsed,
+		Detail:   detail,
+		Addr:     conn.RemoteAddr().String(),
+		Attempts: rec.list(),
+		TCPInfo:  info,
+		timings:  flow.timings(),
+	}
+}
+
+// testTLS performs the handshake, starting from the run's base
+// configuration, and returns the server certificate, also one that failed
+// verification, and, if the handshake looks like it was answered by a local
+// mesh proxy, why. With dataCheck, a request over the connection must get
+// an answer, too. custom, if set, replaces the net.Dialer. The detail tells
+// whether the server asked for a client certificate: with TLS 1.3 it only
+// rejects one after the handshake.
+func testTLS(ctx context.Context, target Target, timeout time.Duration, base *tls.Config, custom DialFunc, proxy *url.URL, dataCheck bool) (PhaseResult, *CertInfo, string) {
+	addr := net.JoinHostPort(target.Host, strconv.Itoa(target.Port))
+
+	start := time.Now()
+	rec := &attemptRecorder{}
+	config := base.Clone()
+	config.ServerName = target.Host
+	asked := false
+	config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		asked = true
+		if len(base.Certificates) > 0 {
+			return &base.Certificates[0], nil
+		}
+		return &tls.Certificate{}, nil
+	}
+	dial := phaseDialer(custom, timeout, rec)
+	flow := &flowTimer{}
+	ctx, cancel := context.WithTimeout(flow.with(ctx), timeout)
+	defer cancel()
+	var conn *tls.Conn
+	var err error
+	if proxy != nil {
+		conn, err = dialTLSProxy(ctx, dial, config, proxy, target, addr)
+	} else {
+		conn, err = dialTLS(ctx, dial, config, target.network(), addr)
+	}
+	elapsed := time.Since(start)
+
+	if err != nil {
+		detail := simplifyError(err)
+		// Servers that asked for a certificate answer one they don't
+		// accept, or none, with a generic alert such as "handshake failure".
+		if asked && strings.Contains(err.Error(), "remote error: tls:") && !strings.HasPrefix(detail, "client certificate") {
+			detail = "client certificate rejected: " + detail
+			if len(base.Certificates) == 0 {
+				detail = "client certificate required: " + simplifyError(err)
+			}
+		}
+		return PhaseResult{
+			Success:  false,
+			Duration: elapsed,
+			Detail:   detail,
+			Attempts: rec.list(),
+		}, newCertInfo(unverifiedCerts(err)), detectInterception(unverifiedCerts(err), 0, "")
+	}
+	flow.tlsDone()
+	defer conn.Close()
+
+	state := conn.ConnectionState()
+	tlsVersion := tlsVersionString(state.Version)
+	detail := fmt.Sprintf("%s, %s", tlsVersion, tls.CipherSuiteName(state.CipherSuite))
+	if asked && len(base.Certificates) > 0 {
+		detail += ", client certificate sent"
+	} else if asked {
+		detail += ", client certificate asked for, none configured"
+	}
+	success := true
+	if target.Issuer != "" {
+		if why := checkIssuer(state, target.Issuer); why != "" {
+			detail, success = why, false
+		}
+	}
+	if success && dataCheck {
+		if why := checkData(conn, target, timeout); why != "" {
+			detail, success = why, false
+		}
+	}
+
+	return PhaseResult{
+		Success:  success,
+		Duration: elapsed,
+		Detail:   detail,
+		Addr:     conn.RemoteAddr().String(),
+		Attempts: rec.list(),
+		TCPInfo:  connTCPInfo(conn.NetConn()),
+		timings:  flow.timings(),
+	}, newCertInfo(state.PeerCertificates), detectInterception(state.PeerCertificates, elapsed, conn.RemoteAddr().String())
+}
+
+// dialTLS connects to addr with dial and completes a handshake over the
+// connection.
+func dialTLS(ctx context.Context, dial DialFunc, config *tls.Config, network, addr string) (*tls.Conn, error) {
+	raw, err := dial(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	conn := tls.Client(raw, config)
+	if err := conn.HandshakeContext(ctx); err != nil {
+		raw.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// httpPorts are the ports the HTTP phase applies to, besides plain-HTTP
+// targets (http:// URLs) on any port.
+var httpPorts = map[int]bool{80: true, 443: true, 8080: true, 8443: true}
+
+// newHTTPClient returns the client for a run's HTTP phases. Redirects are
+// not followed and proxy settings from the environment are ignored, so
+// results reflect the direct path. Connections are not reused, so every
+// phase makes its own; the dialer records them with the attemptRecorder in
+// the request's context. custom, if set, replaces the dialer.
+func newHTTPClient(tlsConfig *tls.Config, custom DialFunc) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: pinnedDial(func(ctx context.Context, network, addr string) (net.Conn, error) {
+				if n, ok := ctx.Value(networkKey{}).(string); ok {
+					network = n
+				}
+				if custom != nil {
+					return custom(ctx, network, addr)
+				}
+				var d net.Dialer
+				if rec, ok := ctx.Value(attemptKey{}).(*attemptRecorder); ok {
+					d.Control = rec.control
+				}
+				return d.DialContext(ctx, network, addr)
+			}),
+			Proxy: func(req *http.Request) (*url.URL, error) {
+				proxy, _ := req.Context().Value(proxyKey{}).(*url.URL)
+				return proxy, nil
+			},
+			TLSClientConfig:   tlsConfig,
+			DisableKeepAlives: true,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+}
+
+// attemptKey, proxyKey and networkKey are the context keys of an HTTP
+// phase's attemptRecorder, proxy, and the network of a target pinned to an
+// address family.
+type (
+	attemptKey struct{}
+	proxyKey   struct{}
+	networkKey struct{}
+)
+
+// testHTTP sends a HEAD request for "/", or the target's Method and Path,
+// with client and succeeds on any response from the server, since the
+// point is that an HTTP exchange completes, not what the server returns. A
+// proxy's error page fails it.
+func testHTTP(ctx context.Context, target Target, timeout time.Duration, client *http.Client, proxy *url.URL) PhaseResult {
+	scheme, defaultPort := "https", 443
+	if target.SkipTLS {
+		scheme, defaultPort = "http", 80
+	}
+	host := target.Host
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if target.Port != defaultPort {
+		host = net.JoinHostPort(target.Host, strconv.Itoa(target.Port))
+	}
+
+	rec := &attemptRecorder{}
+	flow := &flowTimer{}
+	ctx = context.WithValue(flow.with(ctx), attemptKey{}, rec)
+	if proxy != nil {
+		ctx = context.WithValue(ctx, proxyKey{}, proxy)
+	} else if target.Family != "" {
+		ctx = context.WithValue(ctx, networkKey{}, target.network())
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	method, path := http.MethodHead, "/"
+	if target.Method != "" {
+		method = target.Method
+	}
+	if target.Path != "" {
+		path = target.Path
+	}
+	req, err := http.NewRequestWithContext(ctx, method, scheme+"://"+host+path, nil)
+	if err != nil {
+		return PhaseResult{Detail: err.Error()}
+	}
+	req.Header.Set("User-Agent", "egress-probe")
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	elapsed := time.Since(start)
+	if err != nil {
+		return PhaseResult{
+			Success:  false,
+			Duration: elapsed,
+			Detail:   simplifyError(err),
+			Attempts: rec.list(),
+		}
+	}
+	resp.Body.Close()
+
+	// An error page from a proxy, including a transparent one, means the
+	// request never reached the server.
+	if proxyError(resp) {
+		return PhaseResult{
+			Success:  false,
+			Duration: elapsed,
+			Detail:   (&proxyDeniedError{resp.Status}).Error(),
+			Attempts: rec.list(),
+		}
+	}
+
+	return PhaseResult{
+		Success:  true,
+		Duration: elapsed,
+		Detail:   fmt.Sprintf("HTTP %d", resp.StatusCode),
+		Status:   resp.StatusCode,
+		Attempts: rec.list(),
+		timings:  flow.timings(),
+	}
+}
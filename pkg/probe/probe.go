@@ -0,0 +1,659 @@
+// Package probe implements the egress checks behind egress-probe: for each
+// target it resolves the name (DNS), opens a TCP connection (TCP) and
+// completes a TLS handshake with the target's SNI (TLS), then decides whether
+// the outcome matches the target's expectation (ALLOW = reachable,
+// DENY = blocked).
+//
+// The egress-probe binary is a thin CLI around this package; embedding it
+// gives exactly the same checks and verdicts.
+package probe
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultPort    = 443
+	DefaultTimeout = 5 * time.Second
+)
+
+type Target struct {
+	Host      string
+	Port      int
+	SkipTLS   bool   // true = skip TLS phase (e.g. http:// or port 80)
+	ExpectErr bool   // true = this target should be blocked (DENY)
+	Exec      string // optional plugin command run as an extra phase
+	Service   string // svc:// targets: the Kubernetes Service, "namespace/name"
+	Endpoints bool   // svc:// targets: also probe each ready endpoint of the Service
+	Issuer    string // if set, the TLS phase fails unless the server certificate's issuer matches this pattern
+	Phases    string // if set, the phases to run instead of the run's, "dns,tcp", or changes to them, "+http" or "-tls"
+	Expect    string // if set, assertions that must also hold for the target to pass, e.g. "tcp<200ms status=2xx"
+	// Method and Path make the HTTP phase send another request than
+	// "HEAD /", e.g. "GET /v2/", as L7 proxies may decide on the method or
+	// URL. Either runs the HTTP phase whatever the port.
+	Method string
+	Path   string
+	// Family, "ipv4" or "ipv6", pins the target to one address family: the
+	// DNS phase resolves only its records, and connections use only its
+	// addresses. Empty, Options.IPv6 picks the records, and connections
+	// may use either family.
+	Family string
+	// Timeout, if set, bounds each phase of the target instead of
+	// Options.Timeout, for an endpoint known to be slow.
+	Timeout time.Duration
+	// ClientCert and ClientKey are the PEM files of the certificate the TLS
+	// and HTTP phases present, instead of Options.ClientCert, to an endpoint
+	// that requires mutual TLS. Without ClientKey, the key is read from
+	// ClientCert.
+	ClientCert string
+	ClientKey  string
+	// Priority orders a run: every target of a higher priority is probed,
+	// and done, before any target of a lower one starts. The default is 0.
+	Priority int
+	// Metadata holds the target's options the probe doesn't use itself,
+	// such as owner and note, for reports to carry along unchanged.
+	Metadata map[string]string
+}
+
+type PhaseResult struct {
+	Success  bool
+	Start    time.Time // when the timed part of the phase began; zero if it never ran
+	Duration time.Duration
+	Detail   string
+	Aborted  bool      // true = phase never ran or was cut short (deadline or signal)
+	Addr     string    // TCP and TLS: remote address connected to, if any
+	Addrs    []string  // DNS: the addresses resolved
+	Attempts []Attempt // TCP, TLS and HTTP: each connection attempt, for finding it in firewall logs, over all tries
+	Retries  int       // how often the phase was retried after failing; the result is the last try's
+	Status   int       // HTTP: the response's status code, if the server answered
+	TCPInfo  *TCPInfo  // TCP and TLS, on Linux: the kernel's statistics of the connection made
+	timings  *Timings  // TCP, TLS and HTTP: the breakdown of the connection, if it was made
+}
+
+type Result struct {
+	Target      Target
+	DNS         PhaseResult
+	TCP         PhaseResult
+	TLS         PhaseResult
+	HTTP        PhaseResult     // zero unless Options.HTTP is set
+	Exec        PhaseResult     // zero unless Target.Exec is set
+	Cert        *CertInfo       // server certificate, with Options.CertInfo, verified or not
+	Intercepted string          // evidence that a local mesh proxy, not the destination, answered TLS
+	DNSCheck    *DNSConsistency // repeated queries for the name, with Options.DNSQueries
+	Timings     *Timings        // breakdown of the most complete connection, for reachable targets
+	Passed      bool            // true = outcome matches expectation
+	Blocked     bool            // true = connectivity failed at some phase
+	Incomplete  bool            // true = a phase was aborted, so no verdict could be reached
+	Assertions  []Assertion     // the outcome of each assertion of Target.Expect
+	DNSTrace    []DNSExchange   // the queries of the name's lookup, with Options.DNSTrace
+	// CertExpiring is true if the server certificate expires within
+	// Options.CertExpiryWarn.
+	CertExpiring bool
+	// DeadlineExceeded is true if Options.TargetTimeout cut the target
+	// short. The phases it ended have failed, and the others kept their
+	// results.
+	DeadlineExceeded bool
+}
+
+// Options tunes a Run. The zero value is usable.
+type Options struct {
+	// Timeout bounds each phase of each target. Zero means DefaultTimeout.
+	Timeout time.Duration
+	// Stagger spaces out the starts of successive targets.
+	Stagger time.Duration
+	// NoTLS skips the TLS phase for every target, leaving a DNS+TCP
+	// reachability check.
+	NoTLS bool
+	// HTTP adds an HTTP phase after TLS: a HEAD request that succeeds on any
+	// response. It only applies to http:// targets and to well-known HTTP
+	// ports (80, 443, 8080, 8443).
+	HTTP bool
+	// CertInfo records the server certificate of each TLS handshake.
+	CertInfo bool
+	// DNSCache, if set, serves DNS answers from earlier runs while their TTL
+	// lasts and caches new ones.
+	DNSCache *DNSCache
+	// RootCAs, if set, replaces the system roots for verifying server
+	// certificates in the TLS and HTTP phases.
+	RootCAs *x509.CertPool
+	// ClientCert, if set, is the certificate the TLS and HTTP phases
+	// present when a server asks for one, unless the target has its own.
+	ClientCert *tls.Certificate
+	// CertExpiryWarn, if above zero, flags the targets whose server
+	// certificate expires within it with Result.CertExpiring. With
+	// CertExpiryFail, allow targets then also fail an "expiry>" assertion.
+	CertExpiryWarn time.Duration
+	CertExpiryFail bool
+	// FIPS restricts the TLS and HTTP phases to FIPS-approved parameters:
+	// TLS 1.2 or later, AES-GCM cipher suites, NIST curves and certificates
+	// with RSA keys of 2048 bits or more, or ECDSA or Ed25519 keys. A
+	// handshake that can't meet them fails.
+	FIPS bool
+	// IPv6 makes the DNS phase resolve AAAA records instead of A records,
+	// for IPv6-only Pods. A target's Family takes precedence.
+	IPv6 bool
+	// DataCheck sends a request over the TLS connection of targets on
+	// well-known HTTP ports, or with the HTTP phase, once the handshake is
+	// done, and fails the TLS phase unless something answers: firewalls
+	// that let handshakes through may still reset or stall the data.
+	DataCheck bool
+	// DNSQueries, if above zero, queries each nameserver in /etc/resolv.conf
+	// that many times for every target's name after the DNS phase, and
+	// records in Result.DNSCheck whether the answers agree. It doesn't
+	// affect verdicts.
+	DNSQueries int
+	// DNSTrace looks every target's name up again after the DNS phase,
+	// query by query the way the system resolver does, and records each
+	// query and response in Result.DNSTrace. It doesn't affect verdicts.
+	DNSTrace bool
+	// Proxy, if set, returns the HTTP proxy to reach a target through, or
+	// nil to connect directly. The TCP phase then asks the proxy for the
+	// connection, and a proxy that refuses it, e.g. with 403, fails the
+	// phase: the target is blocked.
+	Proxy func(Target) *url.URL
+	// Shuffle probes the targets in a random order derived from Seed, so
+	// that the same targets don't always go first. Results keep the input
+	// order either way.
+	Shuffle bool
+	Seed    uint64
+	// TargetTimeout, if set, bounds each target as a whole, retries
+	// included, so that one slow target can't hold up a run.
+	TargetTimeout time.Duration
+	// Retries is how often a failing phase of an allow target is run again,
+	// RetryDelay apart, before the target fails. Only that phase is rerun:
+	// the results of the phases before it are kept.
+	Retries    int
+	RetryDelay time.Duration
+	// Concurrency caps how many targets are probed at once. Zero means no
+	// limit.
+	Concurrency int
+	// OnResult, if set, is called with each target's index and final result
+	// as soon as that target is done. Calls are serialized.
+	OnResult func(index int, r Result)
+	// OnPhase, if set, is called as each phase of a target starts, with the
+	// phase name (DNS, TCP, TLS, HTTP or EXEC) and the target's result so
+	// far. Calls are serialized together with OnResult.
+	OnPhase func(index int, phase string, partial Result)
+	// DialContext, if set, opens every connection of the TCP, TLS and HTTP
+	// phases, those to a Proxy included, instead of a net.Dialer: through a
+	// SOCKS proxy or a VPN tunnel, or over an in-memory network in tests.
+	// Phases then record no Attempts, since the dialer owns the sockets.
+	DialContext DialFunc
+	// Resolver, if set, answers the DNS phase instead of the system
+	// resolver. DNSCache is then not used, and DNSQueries and DNSTrace,
+	// which query the nameservers of /etc/resolv.conf, are ignored.
+	Resolver Resolver
+	// StopOn, if set, is called with each target's final result. Once it
+	// returns true the run stops, as if ctx had been cancelled, and Run
+	// returns ErrStopped: for a fail-fast run that wants the first
+	// failure of a critical target rather than a complete report.
+	StopOn func(Result) bool
+}
+
+// ErrStopped is returned by Run when Options.StopOn stopped the run.
+var ErrStopped = errors.New("run stopped early")
+
+// Run probes every target and returns one Result per target, in the same
+// order. Cancelling ctx (or letting its deadline pass) stops the run early:
+// unfinished targets are returned with Incomplete set, together with the
+// context's error. Results are always complete in length, so callers can
+// still report on partial runs.
+func Run(ctx context.Context, targets []Target, opts Options) ([]Result, error) {
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+
+	ctx, stop := context.WithCancelCause(ctx)
+	defer stop(nil)
+	results := runTests(ctx, targets, opts, func() { stop(ErrStopped) })
+
+	for _, r := range results {
+		if r.Incomplete {
+			if err := context.Cause(ctx); err != nil {
+				return results, err
+			}
+			return results, context.DeadlineExceeded
+		}
+	}
+	return results, nil
+}
+
+// WarmupDNS sends a throwaway DNS query to absorb the first-packet latency
+// penalty caused by network path initialization (conntrack, DNAT, etc.).
+// In many Kubernetes clusters, the very first UDP packet from a new Pod is
+// dropped, causing a ~5s retry delay. This warm-up absorbs that penalty so
+// actual test results are not affected. It returns how long the query took.
+func WarmupDNS(ctx context.Context, timeout time.Duration) time.Duration {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	resolver.LookupIP(ctx, "ip4", "kubernetes.default.svc.cluster.local.")
+	return time.Since(start)
+}
+
+// runTests probes every target as an independent DNS → TCP → TLS (→ HTTP →
+// EXEC) pipeline, so each result is final — and passed to opts.OnResult — as
+// soon as its own phases finish. DNS lookups are still serialized across
+// targets to avoid the Kubernetes conntrack race on concurrent UDP queries;
+// everything else runs in parallel, up to opts.Concurrency targets at a time.
+// A non-zero opts.Stagger spaces out the target starts so that a large list
+// does not open every connection in the same instant.
+//
+// Targets are probed in tiers of descending Target.Priority, each tier only
+// starting once the one before it is done. stop is called when
+// opts.StopOn asks for the run to end.
+//
+// Once ctx is done, phases that have not started are recorded as
+// "not attempted" and phases cut short as "interrupted"; both are Aborted.
+func runTests(ctx context.Context, targets []Target, opts Options, stop func()) []Result {
+	results := make([]Result, len(targets))
+
+	order := make([]int, len(targets))
+	for i := range order {
+		order[i] = i
+	}
+	if opts.Shuffle {
+		rng := rand.New(rand.NewPCG(opts.Seed, 0))
+		rng.Shuffle(len(order), func(i, j int) { order[i], order[j] = order[j], order[i] })
+	}
+	slices.SortStableFunc(order, func(a, b int) int { return targets[b].Priority - targets[a].Priority })
+
+	workers := opts.Concurrency
+	if workers <= 0 || workers > len(targets) {
+		workers = len(targets)
+	}
+	sem := make(chan struct{}, workers)
+	run := newRunState(opts)
+
+	var (
+		wg       sync.WaitGroup
+		resultMu sync.Mutex
+	)
+	for n, i := range order {
+		if n > 0 && targets[i].Priority != targets[order[n-1]].Priority {
+			wg.Wait() // the tier before is done
+		}
+		if opts.Stagger > 0 && n > 0 {
+			sleepCtx(ctx, opts.Stagger)
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			var onPhase func(string, Result)
+			if opts.OnPhase != nil {
+				onPhase = func(phase string, partial Result) {
+					resultMu.Lock()
+					opts.OnPhase(i, phase, partial)
+					resultMu.Unlock()
+				}
+			}
+			r := probeTarget(ctx, targets[i], opts, run, onPhase)
+			results[i] = r
+			resultMu.Lock()
+			defer resultMu.Unlock()
+			if opts.OnResult != nil {
+				opts.OnResult(i, r)
+			}
+			if opts.StopOn != nil && !r.Incomplete && opts.StopOn(r) {
+				stop()
+			}
+		}()
+	}
+
+	wg.Wait()
+	return results
+}
+
+// runState is what the targets of one run share, so that a run over
+// thousands of targets doesn't build the same configuration thousands of
+// times.
+type runState struct {
+	dnsMu    sync.Mutex
+	tls      *tls.Config  // every handshake's configuration, less the ServerName
+	http     *http.Client // one transport for every HTTP phase; keep-alives are off
+	resolver Resolver     // Options.Resolver or the system resolver
+	dial     DialFunc     // Options.DialContext
+
+	certMu  sync.Mutex
+	clients map[[2]string]*clientTLS // the targets' own client certificates, by file
+}
+
+// clientTLS is the configuration of the targets presenting one client
+// certificate, or why it couldn't be loaded.
+type clientTLS struct {
+	tls  *tls.Config
+	http *http.Client
+	err  error
+}
+
+func newRunState(opts Options) *runState {
+	base := &tls.Config{RootCAs: opts.RootCAs}
+	if opts.ClientCert != nil {
+		base.Certificates = []tls.Certificate{*opts.ClientCert}
+	}
+	if opts.FIPS {
+		restrictToFIPS(base)
+	}
+	run := &runState{tls: base, http: newHTTPClient(base, opts.DialContext), resolver: opts.Resolver, dial: opts.DialContext}
+	if run.resolver == nil {
+		run.resolver = resolver
+	}
+	return run
+}
+
+// clientFor returns the TLS configuration and HTTP client of t: the run's,
+// or, for a target with its own client certificate, ones presenting it. The
+// certificate is loaded once a run, however many targets share it; if it
+// can't be, the run's are returned with the error.
+func (run *runState) clientFor(t Target) (*tls.Config, *http.Client, error) {
+	if t.ClientCert == "" {
+		return run.tls, run.http, nil
+	}
+	key := [2]string{t.ClientCert, t.ClientKey}
+	if key[1] == "" {
+		key[1] = key[0]
+	}
+	run.certMu.Lock()
+	defer run.certMu.Unlock()
+	c, ok := run.clients[key]
+	if !ok {
+		c = &clientTLS{tls: run.tls, http: run.http}
+		cert, err := tls.LoadX509KeyPair(key[0], key[1])
+		if err != nil {
+			c.err = err
+		} else {
+			c.tls = run.tls.Clone()
+			c.tls.Certificates = []tls.Certificate{cert}
+			c.http = newHTTPClient(c.tls, run.dial)
+		}
+		if run.clients == nil {
+			run.clients = make(map[[2]string]*clientTLS)
+		}
+		run.clients[key] = c
+	}
+	return c.tls, c.http, c.err
+}
+
+// probeTarget runs every phase of one target and computes its verdict.
+// onPhase, if non-nil, is told about each phase before it runs.
+func probeTarget(ctx context.Context, t Target, opts Options, run *runState, onPhase func(string, Result)) Result {
+	timeout := opts.Timeout
+	if t.Timeout > 0 {
+		timeout = t.Timeout
+	}
+	ipv6 := opts.IPv6
+	if t.Family != "" {
+		ipv6 = t.Family == "ipv6"
+	}
+	r := Result{Target: t}
+	parent := ctx
+	if opts.TargetTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.TargetTimeout)
+		defer cancel()
+	}
+
+	// Each phase only runs if the previous one succeeded; otherwise it is
+	// skipped with the name of the phase that failed.
+	last, lastName := PhaseResult{Success: true}, ""
+	retriesCut := false // the retries of a phase were cut short
+	step := func(dst *PhaseResult, name string, fn func(context.Context) PhaseResult) {
+		if !last.Success {
+			*dst = PhaseResult{Detail: "skipped (" + lastName + " failed)"}
+			if last.Aborted {
+				*dst = notAttempted(ctx)
+			}
+			return
+		}
+		if onPhase != nil && !ctxDone(ctx) {
+			onPhase(name, r)
+		}
+		*dst = runPhase(ctx, fn)
+		// A failing phase of an allow target is retried on its own, after
+		// the phases before it succeeded. Deny targets are expected to fail.
+		// Retries connect to the addresses the DNS phase resolved rather
+		// than resolving the name again.
+		retryCtx := ctx
+		if r.DNS.Success && len(r.DNS.Addrs) > 0 {
+			retryCtx = withPinnedAddrs(ctx, t.Host, r.DNS.Addrs)
+		}
+		for try := 1; try <= opts.Retries && !dst.Success && !dst.Aborted && !t.ExpectErr; try++ {
+			if !sleepCtx(ctx, opts.RetryDelay) {
+				retriesCut = true
+				break
+			}
+			next := runPhase(retryCtx, fn)
+			if next.Aborted {
+				retriesCut = true
+				break // keep the failure that was observed
+			}
+			next.Retries = try
+			next.Attempts = append(slices.Clip(dst.Attempts), next.Attempts...)
+			*dst = next
+		}
+		last, lastName = *dst, name
+	}
+
+	ph, base := plan(t, opts)
+	exps, _ := parseExpect(t.Expect)
+	var cert *CertInfo // for the assertions, even without opts.CertInfo
+	// skipped is the result of a phase that doesn't run for t: because the
+	// target's phases leave it out, or for reason.
+	skipped := func(inBase bool, reason string) PhaseResult {
+		if inBase {
+			reason = "not in phases"
+		}
+		return PhaseResult{Success: true, Detail: "skipped (" + reason + ")"}
+	}
+
+	step(&r.DNS, "DNS", func(ctx context.Context) PhaseResult {
+		if !ph.dns {
+			return skipped(true, "")
+		}
+		run.dnsMu.Lock()
+		defer run.dnsMu.Unlock()
+		if opts.DNSCache != nil && opts.Resolver == nil {
+			return testDNSCached(ctx, t, timeout, opts.DNSCache, ipv6)
+		}
+		return testDNS(ctx, t, timeout, run.resolver, ipv6)
+	})
+	if opts.DNSQueries > 0 && opts.Resolver == nil && !ctxDone(ctx) {
+		run.dnsMu.Lock()
+		r.DNSCheck = checkDNS(ctx, lookupName(t), opts.DNSQueries, timeout, ipv6)
+		run.dnsMu.Unlock()
+	}
+	if opts.DNSTrace && opts.Resolver == nil && !ctxDone(ctx) {
+		run.dnsMu.Lock()
+		r.DNSTrace = traceDNS(ctx, t.Host, timeout, ipv6)
+		run.dnsMu.Unlock()
+	}
+	var proxy *url.URL
+	if opts.Proxy != nil {
+		proxy = opts.Proxy(t)
+	}
+	step(&r.TCP, "TCP", func(ctx context.Context) PhaseResult {
+		if !ph.tcp {
+			return skipped(true, "")
+		}
+		return testTCP(ctx, t, timeout, opts.DialContext, proxy)
+	})
+	tlsConfig, client, certErr := run.clientFor(t)
+	step(&r.TLS, "TLS", func(ctx context.Context) PhaseResult {
+		if !ph.tls {
+			return skipped(base.tls, "non-TLS")
+		}
+		if certErr != nil {
+			return PhaseResult{Detail: "client certificate: " + certErr.Error()}
+		}
+		p, c, intercepted := testTLS(ctx, t, timeout, tlsConfig, opts.DialContext, proxy, opts.DataCheck && (httpPorts[t.Port] || ph.http))
+		cert = c
+		if opts.CertInfo {
+			r.Cert = cert
+		}
+		r.Intercepted = intercepted
+		return p
+	})
+	if opts.HTTP || ph.http {
+		step(&r.HTTP, "HTTP", func(ctx context.Context) PhaseResult {
+			if !ph.http {
+				return skipped(base.http, "non-HTTP port")
+			}
+			if certErr != nil && !t.SkipTLS {
+				return PhaseResult{Detail: "client certificate: " + certErr.Error()}
+			}
+			return testHTTP(ctx, t, timeout, client, proxy)
+		})
+	}
+	if t.Exec != "" {
+		step(&r.Exec, "EXEC", func(ctx context.Context) PhaseResult { return testExec(ctx, r, timeout) })
+	}
+
+	// Phases cut short by the target's own deadline, rather than the run's,
+	// failed: the target took too long.
+	if opts.TargetTimeout > 0 && !ctxDone(parent) {
+		r.DeadlineExceeded = retriesCut
+		for _, p := range []*PhaseResult{&r.DNS, &r.TCP, &r.TLS, &r.HTTP, &r.Exec} {
+			if !p.Aborted {
+				continue
+			}
+			p.Aborted = false
+			p.Detail = "deadline exceeded"
+			if p.Start.IsZero() {
+				p.Detail = "skipped (deadline exceeded)"
+			}
+			r.DeadlineExceeded = true
+		}
+	}
+	if r.DNS.Aborted || r.TCP.Aborted || r.TLS.Aborted || r.HTTP.Aborted || r.Exec.Aborted {
+		r.Incomplete = true
+		return r
+	}
+	r.Blocked = !r.DNS.Success || !r.TCP.Success ||
+		(!r.TLS.Success && ph.tls) ||
+		(!r.HTTP.Success && ph.http) ||
+		(!r.Exec.Success && t.Exec != "")
+	if !r.Blocked {
+		for _, p := range []PhaseResult{r.HTTP, r.TLS, r.TCP} {
+			if p.timings != nil {
+				r.Timings = p.timings
+				break
+			}
+		}
+	}
+	if t.ExpectErr {
+		r.Passed = r.Blocked // DENY target: pass if blocked
+	} else {
+		r.Passed = !r.Blocked // ALLOW target: pass if reachable
+	}
+	now := time.Now()
+	if len(exps) > 0 {
+		r.Assertions = checkExpectations(exps, &r, cert, now)
+		for _, a := range r.Assertions {
+			r.Passed = r.Passed && a.Passed
+		}
+	}
+	if opts.CertExpiryWarn > 0 && cert != nil && cert.NotAfter.Sub(now) <= opts.CertExpiryWarn {
+		r.CertExpiring = true
+		if opts.CertExpiryFail && !t.ExpectErr {
+			r.Assertions = append(r.Assertions, Assertion{
+				Expr:   fmt.Sprintf("expiry>%dd", int(opts.CertExpiryWarn.Hours()/24)),
+				Detail: fmt.Sprintf("expires in %d days", cert.DaysLeft(now)),
+			})
+			r.Passed = false
+		}
+	}
+	return r
+}
+
+// plan returns the phases that run for t, and those that would without
+// t.Phases. Assertions of t.Expect on HTTP add the HTTP phase. Options that
+// don't parse are ignored here: target lists are checked with ValidatePhases
+// and ValidateExpect as they are loaded.
+func plan(t Target, opts Options) (run, base phaseSet) {
+	base = phaseSet{
+		dns:  true,
+		tcp:  true,
+		tls:  !t.SkipTLS && !opts.NoTLS,
+		http: opts.HTTP && (httpPorts[t.Port] || t.SkipTLS),
+	}
+	run, _ = parsePhases(t.Phases, base)
+	if exps, _ := parseExpect(t.Expect); expectsHTTP(exps) || t.Method != "" || t.Path != "" {
+		run.http = true
+	}
+	return run, base
+}
+
+// RunsHTTP reports whether the HTTP phase runs for t with opts, taking the
+// target's phases option into account.
+func RunsHTTP(t Target, opts Options) bool {
+	run, _ := plan(t, opts)
+	return run.http
+}
+
+// runPhase runs fn unless ctx is already done. A failure that coincides with
+// ctx ending is attributed to the deadline rather than to the network.
+func runPhase(ctx context.Context, fn func(context.Context) PhaseResult) PhaseResult {
+	if ctxDone(ctx) {
+		return notAttempted(ctx)
+	}
+	r := fn(ctx)
+	// Phases time only their own work, not e.g. waiting for a lock, so the
+	// start is counted back from when they return.
+	r.Start = time.Now().Add(-r.Duration)
+	if !r.Success && ctxDone(ctx) {
+		r.Detail = "interrupted (" + abortReason(ctx) + ")"
+		r.Aborted = true
+	}
+	return r
+}
+
+func notAttempted(ctx context.Context) PhaseResult {
+	return PhaseResult{Detail: "not attempted (" + abortReason(ctx) + ")", Aborted: true}
+}
+
+func abortReason(ctx context.Context) string {
+	if errors.Is(context.Cause(ctx), ErrStopped) {
+		return "run stopped"
+	}
+	if errors.Is(ctx.Err(), context.Canceled) {
+		return "cancelled"
+	}
+	return "deadline"
+}
+
+// ctxDone reports whether ctx is done. Dialers enforce the context deadline
+// with their own timers, so a dial can fail a moment before ctx.Err() is set;
+// checking the deadline directly avoids blaming the network for it.
+func ctxDone(ctx context.Context) bool {
+	if ctx.Err() != nil {
+		return true
+	}
+	dl, ok := ctx.Deadline()
+	return ok && !time.Now().Before(dl)
+}
+
+// sleepCtx sleeps for d or until ctx is done, whichever comes first. It
+// reports whether the full duration elapsed.
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
@@ -0,0 +1,129 @@
+package probe
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// proxyDeniedError is a proxy refusing to carry a connection. It counts as
+// the target being blocked, like a connection failure would.
+type proxyDeniedError struct {
+	status string // e.g. "403 Forbidden"
+}
+
+func (e *proxyDeniedError) Error() string {
+	return "proxy denied (" + e.status + ")"
+}
+
+// proxyConnError is a failure to talk to the proxy itself.
+type proxyConnError struct {
+	proxy string
+	err   error
+}
+
+func (e *proxyConnError) Error() string { return "proxy " + e.proxy + ": " + e.err.Error() }
+func (e *proxyConnError) Unwrap() error { return e.err }
+
+// proxyAddr returns the host:port to dial for proxy, defaulting the port.
+func proxyAddr(proxy *url.URL) string {
+	if proxy.Port() != "" {
+		return proxy.Host
+	}
+	return net.JoinHostPort(proxy.Hostname(), "80")
+}
+
+// proxyAuth returns the Proxy-Authorization header for proxy's user info,
+// or "".
+func proxyAuth(proxy *url.URL) string {
+	if proxy.User == nil {
+		return ""
+	}
+	pass, _ := proxy.User.Password()
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(proxy.User.Username()+":"+pass))
+}
+
+// dialProxy asks proxy for a connection to addr. TLS targets get a CONNECT
+// tunnel, which is returned; plain-HTTP targets, which proxies commonly
+// refuse to CONNECT to, are checked with a HEAD request that the proxy
+// forwards, and the connection to the proxy is returned once it has
+// answered. Either way a refusal by the proxy is a *proxyDeniedError.
+func dialProxy(ctx context.Context, dial DialFunc, proxy *url.URL, target Target, addr string) (net.Conn, error) {
+	conn, err := dial(ctx, "tcp", proxyAddr(proxy))
+	if err != nil {
+		return nil, &proxyConnError{proxy.Host, err}
+	}
+	if dl, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(dl)
+	}
+
+	req := &http.Request{Method: http.MethodConnect, URL: &url.URL{Opaque: addr}, Host: addr, Header: make(http.Header)}
+	if target.SkipTLS {
+		req = &http.Request{Method: http.MethodHead, URL: &url.URL{Scheme: "http", Host: addr, Path: "/"}, Host: addr, Header: make(http.Header)}
+	}
+	req.Header.Set("User-Agent", "egress-probe")
+	if auth := proxyAuth(proxy); auth != "" {
+		req.Header.Set("Proxy-Authorization", auth)
+	}
+	if target.SkipTLS {
+		err = req.WriteProxy(conn)
+	} else {
+		err = req.Write(conn)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, &proxyConnError{proxy.Host, err}
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, &proxyConnError{proxy.Host, err}
+	}
+	resp.Body.Close()
+
+	switch {
+	case target.SkipTLS && proxyError(resp):
+		conn.Close()
+		return nil, &proxyDeniedError{resp.Status}
+	case !target.SkipTLS && resp.StatusCode/100 != 2:
+		conn.Close()
+		return nil, &proxyDeniedError{resp.Status}
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// dialTLSProxy completes a TLS handshake with the target through a CONNECT
+// tunnel from proxy.
+func dialTLSProxy(ctx context.Context, dial DialFunc, config *tls.Config, proxy *url.URL, target Target, addr string) (*tls.Conn, error) {
+	tunnel, err := dialProxy(ctx, dial, proxy, Target{Host: target.Host, Port: target.Port}, addr)
+	if err != nil {
+		return nil, err
+	}
+	conn := tls.Client(tunnel, config)
+	if err := conn.HandshakeContext(ctx); err != nil {
+		tunnel.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// proxyError reports whether resp was generated by a proxy refusing or
+// failing to forward a request, rather than by the server: 407, or a
+// response carrying the Proxy-Status header (RFC 9209) or Squid's error
+// header.
+func proxyError(resp *http.Response) bool {
+	if resp.StatusCode == http.StatusProxyAuthRequired {
+		return true
+	}
+	if resp.StatusCode < 400 {
+		return false
+	}
+	return resp.Header.Get("X-Squid-Error") != "" || strings.Contains(resp.Header.Get("Proxy-Status"), "error=")
+}
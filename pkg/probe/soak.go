@@ -0,0 +1,195 @@
+package probe
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SoakOptions tunes a Soak.
+type SoakOptions struct {
+	// Duration is how long each target is soaked.
+	Duration time.Duration
+	// Interval is the time between requests on a held connection, and the
+	// delay before reconnecting after a drop.
+	Interval time.Duration
+	// Timeout bounds each dial, handshake and request. Zero means
+	// DefaultTimeout.
+	Timeout time.Duration
+	// OnEvent, if set, is called for every event as it happens. It may be
+	// called concurrently for different targets.
+	OnEvent func(Target, SoakEvent)
+	// DialContext, if set, opens the connections instead of a net.Dialer,
+	// as Options.DialContext does.
+	DialContext DialFunc
+}
+
+// SoakEvent is something that happened to a soaked connection.
+type SoakEvent struct {
+	At     time.Duration // since the soak started
+	Kind   string        // "connected", "disconnected" or "error"
+	Detail string
+	Uptime time.Duration // for "disconnected": how long the connection lived
+}
+
+// SoakResult is the outcome of soaking one target.
+type SoakResult struct {
+	Target        Target
+	Connects      int
+	Disconnects   int // established connections that dropped
+	Errors        int // failed connection attempts
+	Requests      int // requests that got a response
+	LongestUptime time.Duration
+	Events        []SoakEvent
+	Passed        bool // no disconnects and no errors
+	Incomplete    bool // ctx ended before Duration elapsed
+}
+
+// Soak holds a connection open to every target for opts.Duration, sending a
+// lightweight HTTP HEAD request every opts.Interval to keep traffic flowing.
+// Dropped connections are recorded and re-established. This catches egress
+// paths (NAT, firewalls, proxies) that pass a one-off check but cut
+// long-lived connections after minutes.
+//
+// DENY targets are not soaked and are returned as passed with no events.
+func Soak(ctx context.Context, targets []Target, opts SoakOptions) []SoakResult {
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	start := time.Now()
+	soakCtx, cancel := context.WithTimeout(ctx, opts.Duration)
+	defer cancel()
+
+	results := make([]SoakResult, len(targets))
+	var wg sync.WaitGroup
+	for i, t := range targets {
+		results[i] = SoakResult{Target: t}
+		if t.ExpectErr {
+			results[i].Passed = true
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			soakTarget(soakCtx, &results[i], start, opts)
+		}()
+	}
+	wg.Wait()
+
+	for i := range results {
+		r := &results[i]
+		if r.Target.ExpectErr {
+			continue
+		}
+		r.Passed = r.Disconnects == 0 && r.Errors == 0
+		r.Incomplete = ctx.Err() != nil
+	}
+	return results
+}
+
+func soakTarget(ctx context.Context, r *SoakResult, start time.Time, opts SoakOptions) {
+	emit := func(ev SoakEvent) {
+		ev.At = time.Since(start)
+		r.Events = append(r.Events, ev)
+		if opts.OnEvent != nil {
+			opts.OnEvent(r.Target, ev)
+		}
+	}
+
+	for ctx.Err() == nil {
+		conn, err := soakDial(ctx, r.Target, opts.Timeout, opts.DialContext)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			r.Errors++
+			emit(SoakEvent{Kind: "error", Detail: simplifyError(err)})
+			sleepCtx(ctx, opts.Interval)
+			continue
+		}
+		r.Connects++
+		connected := time.Now()
+		emit(SoakEvent{Kind: "connected", Detail: conn.RemoteAddr().String()})
+
+		err = soakHold(ctx, conn, r, opts)
+		conn.Close()
+		uptime := time.Since(connected)
+		r.LongestUptime = max(r.LongestUptime, uptime)
+		if err == nil || ctx.Err() != nil {
+			return // soak finished with the connection intact
+		}
+		r.Disconnects++
+		emit(SoakEvent{Kind: "disconnected", Detail: dropReason(err), Uptime: uptime})
+		sleepCtx(ctx, opts.Interval)
+	}
+}
+
+// soakDial connects to t with dial, or a net.Dialer if it is nil,
+// completing a TLS handshake unless t.SkipTLS.
+func soakDial(ctx context.Context, t Target, timeout time.Duration, dial DialFunc) (net.Conn, error) {
+	addr := net.JoinHostPort(t.Host, strconv.Itoa(t.Port))
+	dctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	if t.SkipTLS {
+		return dial(dctx, t.network(), addr)
+	}
+	conn, err := dialTLS(dctx, dial, &tls.Config{ServerName: t.Host}, t.network(), addr)
+	if err != nil {
+		return nil, err // not a nil *tls.Conn
+	}
+	return conn, nil
+}
+
+// soakHold sends a HEAD request every opts.Interval until ctx is done
+// (returning nil) or the connection fails.
+func soakHold(ctx context.Context, conn net.Conn, r *SoakResult, opts SoakOptions) error {
+	br := bufio.NewReader(conn)
+	req := fmt.Sprintf("HEAD / HTTP/1.1\r\nHost: %s\r\nUser-Agent: egress-probe\r\n\r\n", r.Target.Host)
+
+	for {
+		if !sleepCtx(ctx, opts.Interval) {
+			return nil
+		}
+		conn.SetDeadline(time.Now().Add(opts.Timeout))
+		if _, err := io.WriteString(conn, req); err != nil {
+			return err
+		}
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		r.Requests++
+		if resp.Close {
+			return errClosedByServer
+		}
+	}
+}
+
+var errClosedByServer = errors.New("closed by server (Connection: close)")
+
+// dropReason classifies why a held connection ended. A clean close (EOF) is
+// usually the server's own idle timeout; resets and timeouts point at
+// something on the path.
+func dropReason(err error) string {
+	switch {
+	case errors.Is(err, errClosedByServer):
+		return err.Error()
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "closed by peer (EOF)"
+	default:
+		return simplifyError(err)
+	}
+}
@@ -0,0 +1,264 @@
+package probe
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParseTargetList parses a comma-separated list of targets, as accepted by
+// ALLOW_TARGETS / DENY_TARGETS. Every target gets the given ExpectErr.
+func ParseTargetList(raw string, expectErr bool) []Target {
+	var entries []string
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		// "db.internal:5432;phases=dns,tcp" is one target, not two.
+		if n := len(entries); n > 0 && isPhaseEntry(entry) && phasesLast(entries[n-1]) {
+			entries[n-1] += "," + entry
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	var targets []Target
+	for _, entry := range entries {
+		t := ParseTarget(entry)
+		t.ExpectErr = expectErr
+		targets = append(targets, t)
+	}
+	return targets
+}
+
+// ParseTarget parses a single target such as "mcr.microsoft.com",
+// "https://github.com" or "tcp://1.1.1.1:53". The scheme, if any, only
+// selects the default port and whether the TLS phase applies; any path is
+// ignored. "svc://name.namespace:port" names a Kubernetes Service, probed
+// through its cluster DNS name without TLS.
+//
+// Per-target options may follow the address as ";key=value" pairs, e.g.
+// "github.com;exec=/opt/checks/proxy-auth", "db.internal:5432;phases=dns,tcp"
+// "api.example.com;expect=tcp<200ms status=2xx",
+// "registry.example.com;method=GET;path=/v2/", "slow.example.com;timeout=15s"
+// or "api.partner.example;client_cert=/certs/tls.crt;client_key=/certs/tls.key".
+// Other keys, such as "owner=payments-team", are kept as the target's
+// Metadata.
+func ParseTarget(s string) Target {
+	addr, opts, _ := strings.Cut(s, ";")
+	t := parseAddress(strings.TrimSpace(addr))
+	for _, opt := range strings.Split(opts, ";") {
+		key, value, _ := strings.Cut(opt, "=")
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+		switch key {
+		case "exec":
+			t.Exec = value
+		case "issuer":
+			t.Issuer = value
+		case "client_cert":
+			t.ClientCert = value
+		case "client_key":
+			t.ClientKey = value
+		case "phases":
+			t.Phases = value
+		case "expect":
+			t.Expect = value
+		case "endpoints":
+			on, err := strconv.ParseBool(value)
+			t.Endpoints = t.Service != "" && (value == "" || (err == nil && on))
+		case "":
+		case "priority":
+			if n, err := strconv.Atoi(value); err == nil {
+				t.Priority = n
+				continue
+			}
+			fallthrough // kept as Metadata, for the caller to reject
+		case "method", "path":
+			if key == "method" && (strings.EqualFold(value, "GET") || strings.EqualFold(value, "HEAD")) {
+				t.Method = strings.ToUpper(value)
+				continue
+			}
+			if key == "path" && strings.HasPrefix(value, "/") {
+				t.Path = value
+				continue
+			}
+			fallthrough
+		case "timeout":
+			if d, err := parseTimeout(value); err == nil && key == "timeout" {
+				t.Timeout = d
+				continue
+			}
+			fallthrough
+		case "family":
+			if key == "family" && (value == "ipv4" || value == "ipv6") {
+				t.Family = value
+				continue
+			}
+			fallthrough
+		default:
+			if t.Metadata == nil {
+				t.Metadata = make(map[string]string)
+			}
+			t.Metadata[key] = value
+		}
+	}
+	return t
+}
+
+// network is the network t's connections dial: "tcp", or "tcp4" or "tcp6"
+// for a target pinned to an address family.
+func (t Target) network() string {
+	switch t.Family {
+	case "ipv4":
+		return "tcp4"
+	case "ipv6":
+		return "tcp6"
+	}
+	return "tcp"
+}
+
+// parseTimeout parses a timeout option: seconds, or a Go duration, above
+// zero.
+func parseTimeout(s string) (time.Duration, error) {
+	if sec, err := strconv.Atoi(s); err == nil && sec > 0 {
+		return time.Duration(sec) * time.Second, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil && d > 0 {
+		return d, nil
+	}
+	return 0, fmt.Errorf("invalid timeout %q", s)
+}
+
+// phaseSet is which of the DNS, TCP, TLS and HTTP phases run for a target.
+type phaseSet struct {
+	dns, tcp, tls, http bool
+}
+
+func (s *phaseSet) field(name string) *bool {
+	switch name {
+	case "dns":
+		return &s.dns
+	case "tcp":
+		return &s.tcp
+	case "tls":
+		return &s.tls
+	case "http":
+		return &s.http
+	}
+	return nil
+}
+
+// parsePhases applies a phases option to base: either the phases to run,
+// e.g. "dns,tcp", or changes to base, e.g. "+http" or "-tls,+http".
+func parsePhases(spec string, base phaseSet) (phaseSet, error) {
+	if spec == "" {
+		return base, nil
+	}
+	var set phaseSet
+	relative := spec[0] == '+' || spec[0] == '-'
+	if relative {
+		set = base
+	}
+	for _, entry := range strings.Split(strings.ToLower(spec), ",") {
+		entry = strings.TrimSpace(entry)
+		on, name := true, entry
+		if entry != "" && (entry[0] == '+' || entry[0] == '-') {
+			on, name = entry[0] == '+', entry[1:]
+			if !relative {
+				return base, fmt.Errorf("%q mixes a list of phases with +/- changes", spec)
+			}
+		} else if relative {
+			return base, fmt.Errorf("%q mixes a list of phases with +/- changes", spec)
+		}
+		f := set.field(name)
+		if f == nil {
+			return base, fmt.Errorf("unknown phase %q in %q: expected dns, tcp, tls or http", name, spec)
+		}
+		*f = on
+	}
+	return set, nil
+}
+
+// ValidatePhases reports whether spec is a valid phases option.
+func ValidatePhases(spec string) error {
+	_, err := parsePhases(spec, phaseSet{})
+	return err
+}
+
+// isPhaseEntry reports whether an entry of a target list continues the
+// phases option before it: a bare word such as "tcp" or "+http". Anything
+// else that could be a phase, such as a misspelt one, counts too, so that
+// it is reported rather than probed as a host.
+func isPhaseEntry(entry string) bool {
+	name := strings.TrimLeft(entry, "+-")
+	return name != "" && strings.IndexFunc(name, func(r rune) bool { return (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') }) == -1
+}
+
+// phasesLast reports whether the last option of entry is phases.
+func phasesLast(entry string) bool {
+	i := strings.LastIndex(entry, ";")
+	return i >= 0 && strings.HasPrefix(strings.ToLower(strings.TrimSpace(entry[i+1:])), "phases=")
+}
+
+func parseAddress(s string) Target {
+	inferredPort := DefaultPort
+	skipTLS := false
+	if idx := strings.Index(s, "://"); idx != -1 {
+		scheme := strings.ToLower(s[:idx])
+		s = s[idx+3:]
+		switch scheme {
+		case "http":
+			inferredPort = 80
+			skipTLS = true
+		case "https":
+			inferredPort = 443
+		case "tcp", "tls":
+			// keep DefaultPort (443)
+		case "svc":
+			return parseService(s)
+		}
+	}
+
+	if idx := strings.Index(s, "/"); idx != -1 {
+		s = s[:idx]
+	}
+
+	host, portStr, err := net.SplitHostPort(s)
+	if err != nil {
+		return Target{Host: s, Port: inferredPort, SkipTLS: skipTLS}
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		port = inferredPort
+	}
+	if port == 80 {
+		skipTLS = true
+	}
+	return Target{Host: host, Port: port, SkipTLS: skipTLS}
+}
+
+// parseService parses the address of a svc:// target, "name.namespace" with
+// an optional port (default 80). The Service is reached by its
+// "name.namespace.svc" DNS name, which the DNS phase completes with the
+// cluster domain from the Pod's search list, and which cluster DNS resolves
+// to the ClusterIP.
+func parseService(s string) Target {
+	if idx := strings.Index(s, "/"); idx != -1 {
+		s = s[:idx]
+	}
+	port := 80
+	if host, portStr, err := net.SplitHostPort(s); err == nil {
+		s = host
+		if n, err := strconv.Atoi(portStr); err == nil && n > 0 && n <= 65535 {
+			port = n
+		}
+	}
+	name, ns, ok := strings.Cut(strings.TrimSuffix(s, ".svc"), ".")
+	if !ok || name == "" || ns == "" || strings.Contains(ns, ".") {
+		return Target{} // not name.namespace
+	}
+	return Target{Host: name + "." + ns + ".svc", Port: port, SkipTLS: true, Service: ns + "/" + name}
+}
@@ -0,0 +1,34 @@
+package probe
+
+import (
+	"net"
+	"syscall"
+	"time"
+)
+
+// TCPInfo is what the kernel knows about a connection, read just before the
+// probe closes it. A phase can succeed over a path that drops packets:
+// retransmissions show it before it fails.
+type TCPInfo struct {
+	RTT          time.Duration // smoothed round-trip time
+	RTTVar       time.Duration // its variation
+	Retransmits  uint32        // segments retransmitted over the connection's life, SYNs included
+	Lost         uint32        // segments currently considered lost
+	DeliveryRate uint64        // bytes per second, as measured for the last segments acknowledged; 0 if unknown
+}
+
+// connTCPInfo returns the statistics of conn's TCP socket, or nil where the
+// platform doesn't offer them or conn isn't TCP.
+func connTCPInfo(conn net.Conn) *TCPInfo {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	var info *TCPInfo
+	raw.Control(func(fd uintptr) { info = readTCPInfo(fd) })
+	return info
+}
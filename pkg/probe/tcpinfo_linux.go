@@ -0,0 +1,47 @@
+//go:build linux && !386
+
+package probe
+
+import (
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// linuxTCPInfo is struct tcp_info of linux/tcp.h, up to the fields read.
+// Older kernels fill in less of it.
+type linuxTCPInfo struct {
+	State, CAState, Retransmits, Probes, Backoff, Options, WScale, Flags uint8
+
+	RTO, ATO, SndMSS, RcvMSS                                                 uint32
+	Unacked, Sacked, Lost, Retrans, Fackets                                  uint32
+	LastDataSent, LastAckSent, LastDataRecv, LastAckRecv                     uint32
+	PMTU, RcvSsthresh, RTT, RTTVar, SndSsthresh, SndCwnd, AdvMSS, Reordering uint32
+	RcvRTT, RcvSpace                                                         uint32
+	TotalRetrans                                                             uint32
+	PacingRate, MaxPacingRate                                                uint64
+	BytesAcked, BytesReceived                                                uint64
+	SegsOut, SegsIn                                                          uint32
+	NotsentBytes, MinRTT, DataSegsIn, DataSegsOut                            uint32
+	DeliveryRate                                                             uint64
+}
+
+func readTCPInfo(fd uintptr) *TCPInfo {
+	var ti linuxTCPInfo
+	size := uint32(unsafe.Sizeof(ti))
+	_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.IPPROTO_TCP, syscall.TCP_INFO,
+		uintptr(unsafe.Pointer(&ti)), uintptr(unsafe.Pointer(&size)), 0)
+	if errno != 0 || size < uint32(unsafe.Offsetof(ti.PacingRate)) {
+		return nil
+	}
+	info := &TCPInfo{
+		RTT:         time.Duration(ti.RTT) * time.Microsecond,
+		RTTVar:      time.Duration(ti.RTTVar) * time.Microsecond,
+		Retransmits: ti.TotalRetrans,
+		Lost:        ti.Lost,
+	}
+	if size >= uint32(unsafe.Offsetof(ti.DeliveryRate)+unsafe.Sizeof(ti.DeliveryRate)) {
+		info.DeliveryRate = ti.DeliveryRate
+	}
+	return info
+}
@@ -0,0 +1,9 @@
+//go:build !linux || 386
+
+package probe
+
+// readTCPInfo is only implemented on Linux, where 386 lacks getsockopt(2)
+// as a system call of its own.
+func readTCPInfo(fd uintptr) *TCPInfo {
+	return nil
+}
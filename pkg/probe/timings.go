@@ -0,0 +1,95 @@
+package probe
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// Timings breaks down one connection to a target, from the name lookup to
+// the first byte of the response, like curl's -w timings. It comes from the
+// most complete phase that connected: HTTP, else TLS, else TCP. Steps the
+// flow didn't take are zero.
+type Timings struct {
+	DNS     time.Duration // name lookup by the dialer; zero for IP addresses
+	Connect time.Duration // TCP handshake, to the proxy if there is one
+	TLS     time.Duration // TLS handshake, including the CONNECT exchange through a proxy
+	TTFB    time.Duration // from the connection being ready to the first response byte
+	Total   time.Duration // from the start of the lookup to the end of the last step
+}
+
+// flowTimer collects the timestamps of one connection. The dialer reports
+// the lookup and connect through httptrace, the HTTP transport the rest;
+// phases that handshake themselves mark the TLS step with tlsDone.
+type flowTimer struct {
+	mu                       sync.Mutex
+	dnsStart, dnsDone        time.Time
+	connectStart, connectEnd time.Time
+	tlsStart, tlsEnd         time.Time
+	firstByte                time.Time
+}
+
+// with returns ctx carrying f's trace hooks.
+func (f *flowTimer) with(ctx context.Context) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { f.set(&f.dnsStart) },
+		DNSDone:  func(httptrace.DNSDoneInfo) { f.set(&f.dnsDone) },
+		// With several addresses the dialer may race connections: the
+		// step starts with the first and ends with the one that succeeds.
+		ConnectStart: func(string, string) { f.set(&f.connectStart) },
+		ConnectDone: func(_, _ string, err error) {
+			if err == nil {
+				f.set(&f.connectEnd)
+			}
+		},
+		TLSHandshakeStart:    func() { f.set(&f.tlsStart) },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { f.set(&f.tlsEnd) },
+		GotFirstResponseByte: func() { f.set(&f.firstByte) },
+	})
+}
+
+// set records now in *t unless it is already set.
+func (f *flowTimer) set(t *time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if t.IsZero() {
+		*t = time.Now()
+	}
+}
+
+// tlsDone marks the end of a TLS handshake that started as soon as the
+// connection was up.
+func (f *flowTimer) tlsDone() {
+	f.mu.Lock()
+	f.tlsStart = f.connectEnd
+	f.mu.Unlock()
+	f.set(&f.tlsEnd)
+}
+
+// timings returns the breakdown, or nil if the flow never connected.
+func (f *flowTimer) timings() *Timings {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.connectEnd.IsZero() {
+		return nil
+	}
+	t := &Timings{}
+	start, end := f.connectStart, f.connectEnd
+	if !f.dnsDone.IsZero() {
+		t.DNS = f.dnsDone.Sub(f.dnsStart)
+		start = f.dnsStart
+	}
+	t.Connect = f.connectEnd.Sub(f.connectStart)
+	if !f.tlsEnd.IsZero() && !f.tlsStart.IsZero() {
+		t.TLS = f.tlsEnd.Sub(f.connectEnd)
+		end = f.tlsEnd
+	}
+	if !f.firstByte.IsZero() {
+		t.TTFB = f.firstByte.Sub(end)
+		end = f.firstByte
+	}
+	t.Total = end.Sub(start)
+	return t
+}
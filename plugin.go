@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pluginBinaryPath is where the exec method puts the probe inside the pod.
+const pluginBinaryPath = "/tmp/egress-probe"
+
+// stringList is a flag that may be repeated.
+type stringList []string
+
+func (l *stringList) String() string     { return strings.Join(*l, ",") }
+func (l *stringList) Set(v string) error { *l = append(*l, v); return nil }
+
+// pluginOptions are the flags of "kubectl egress-probe".
+type pluginOptions struct {
+	pod       string
+	namespace string
+	kubeFlags []string // --context, --kubeconfig and --namespace, passed on to kubectl
+	container string
+	method    string
+	image     string
+	binary    string
+	env       []string // KEY=VALUE for the probe
+	kubectl   string
+}
+
+// runPlugin implements "kubectl egress-probe <pod>": it runs the probe in the
+// network namespace of a running pod and streams its report back, so that
+// egress can be tested as a particular workload sees it without touching its
+// manifest. It returns the probe's exit code.
+//
+// By default the probe runs as an ephemeral container from the published
+// image. With --method=exec a static probe binary is copied into one of the
+// pod's containers and run there, as that container's user; use it where
+// ephemeral containers are not allowed, or to be subject to the same
+// UID-based mesh capture as the application.
+func runPlugin(ctx context.Context, args []string) int {
+	opts, err := parsePluginArgs(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitFailed
+	}
+	if opts == nil {
+		return 0 // --help
+	}
+	if opts.method == "exec" {
+		return pluginExec(ctx, opts)
+	}
+	return pluginDebug(ctx, opts)
+}
+
+func parsePluginArgs(args []string) (*pluginOptions, error) {
+	opts := &pluginOptions{kubectl: os.Getenv("KUBECTL_PLUGINS_CALLER")}
+	if opts.kubectl == "" {
+		opts.kubectl = "kubectl"
+	}
+	var allow, deny, env stringList
+	var kubeContext, kubeconfig, profile, output string
+	var timeout time.Duration
+
+	fs := flag.NewFlagSet("kubectl egress-probe", flag.ContinueOnError)
+	fs.StringVar(&opts.namespace, "n", "", "namespace of the pod (shorthand)")
+	fs.StringVar(&opts.namespace, "namespace", "", "namespace of the pod")
+	fs.StringVar(&kubeContext, "context", "", "kubeconfig context to use")
+	fs.StringVar(&kubeconfig, "kubeconfig", "", "path to the kubeconfig file")
+	fs.StringVar(&opts.container, "c", "", "container to target (shorthand)")
+	fs.StringVar(&opts.container, "container", "", "container whose processes the ephemeral container shares, or to exec into with --method=exec (default: the first)")
+	fs.StringVar(&opts.method, "method", "debug", "how to enter the pod: debug (ephemeral container) or exec (copy the binary into a container)")
+	fs.StringVar(&opts.image, "image", defaultPluginImage(), "probe image for the ephemeral container")
+	fs.StringVar(&opts.binary, "binary", "", "static linux probe binary to copy with --method=exec (default: this executable, on linux)")
+	fs.Var(&allow, "allow", "targets that must be reachable, comma-separated (repeatable)")
+	fs.Var(&deny, "deny", "targets that must be blocked, comma-separated (repeatable)")
+	fs.StringVar(&profile, "profile", "", "PROFILE to probe with: fast or deep")
+	fs.DurationVar(&timeout, "timeout", 0, "timeout for each phase")
+	fs.StringVar(&output, "output", "", "OUTPUT format: json or ndjson (default: table)")
+	fs.Var(&env, "env", "any other probe setting as `KEY=VALUE`, e.g. --env PRESET=cluster-core (repeatable)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: kubectl egress-probe [flags] <pod>\n\nProbe egress from inside a running pod, e.g.\n  kubectl egress-probe -n shop checkout-7c9f-abcde --allow api.stripe.com --deny google.com\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+
+	// Accept flags before and after the pod name, as kubectl does.
+	for {
+		if err := fs.Parse(args); err != nil {
+			if errors.Is(err, flag.ErrHelp) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		if opts.pod != "" {
+			return nil, fmt.Errorf("unexpected argument %q: give one pod", fs.Arg(0))
+		}
+		opts.pod = strings.TrimPrefix(fs.Arg(0), "pod/")
+		args = fs.Args()[1:]
+	}
+	if opts.pod == "" {
+		fs.Usage()
+		return nil, errors.New("no pod given")
+	}
+	if opts.method != "debug" && opts.method != "exec" {
+		return nil, fmt.Errorf("invalid --method %q: expected debug or exec", opts.method)
+	}
+
+	if kubeContext != "" {
+		opts.kubeFlags = append(opts.kubeFlags, "--context="+kubeContext)
+	}
+	if kubeconfig != "" {
+		opts.kubeFlags = append(opts.kubeFlags, "--kubeconfig="+kubeconfig)
+	}
+	if opts.namespace != "" {
+		opts.kubeFlags = append(opts.kubeFlags, "--namespace="+opts.namespace)
+	}
+
+	if len(allow) > 0 {
+		opts.env = append(opts.env, "ALLOW_TARGETS="+allow.String())
+	}
+	if len(deny) > 0 {
+		opts.env = append(opts.env, "DENY_TARGETS="+deny.String())
+	}
+	if profile != "" {
+		opts.env = append(opts.env, "PROFILE="+profile)
+	}
+	if timeout > 0 {
+		opts.env = append(opts.env, "TIMEOUT="+timeout.String())
+	}
+	if output != "" {
+		opts.env = append(opts.env, "OUTPUT="+output)
+	}
+	for _, kv := range env {
+		key, _, ok := strings.Cut(kv, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid --env %q: expected KEY=VALUE", kv)
+		}
+		opts.env = append(opts.env, kv)
+	}
+	hasTargets := false
+	for _, kv := range opts.env {
+		switch key, _, _ := strings.Cut(kv, "="); key {
+		case "ALLOW_TARGETS", "DENY_TARGETS", "TARGETS", "PRESET", "CANARY", "TARGETS_CONFIGMAP", "TARGETS_EGRESSPROBE":
+			hasTargets = true
+		}
+	}
+	if !hasTargets {
+		return nil, errors.New("no targets given: use --allow, --deny or --env PRESET=cluster-core")
+	}
+	return opts, nil
+}
+
+var (
+	releaseVersion = regexp.MustCompile(`^v\d+\.\d+\.\d+(-[0-9A-Za-z.]+)?$`)
+	pseudoVersion  = regexp.MustCompile(`\d{14}-[0-9a-f]{12}$`)
+)
+
+// defaultPluginImage is the image matching this build, or latest for
+// development builds, whose Go pseudo-versions aren't published as tags.
+func defaultPluginImage() string {
+	tag := "latest"
+	if v := currentBuild().Version; releaseVersion.MatchString(v) && !pseudoVersion.MatchString(v) {
+		tag = v
+	}
+	return "ghcr.io/cheolhuikim/egress-probe:" + tag
+}
+
+// pluginDebug adds an ephemeral container running the probe image to the
+// pod, follows its log and returns its exit code. Ephemeral containers
+// can't be removed; it stays in the pod spec, terminated, until the pod is
+// replaced.
+func pluginDebug(ctx context.Context, opts *pluginOptions) int {
+	suffix := make([]byte, 3)
+	rand.Read(suffix)
+	name := "egress-probe-" + hex.EncodeToString(suffix)
+
+	args := append([]string{"debug", opts.pod, "--image=" + opts.image, "--container=" + name, "--quiet"}, opts.kubeFlags...)
+	if opts.container != "" {
+		args = append(args, "--target="+opts.container)
+	}
+	for _, kv := range opts.env {
+		args = append(args, "--env="+kv)
+	}
+	if err := kubectl(ctx, opts, nil, nil, os.Stderr, args...); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: adding ephemeral container: %v\n", err)
+		return exitFailed
+	}
+	fmt.Fprintf(os.Stderr, "probing from pod %s (ephemeral container %s)\n", opts.pod, name)
+
+	// kubectl logs fails until the container has started; retry until it
+	// has, then follow the log to the end.
+	logArgs := append([]string{"logs", "--follow", opts.pod, "--container=" + name}, opts.kubeFlags...)
+	for {
+		var stderr bytes.Buffer
+		err := kubectl(ctx, opts, nil, os.Stdout, &stderr, logArgs...)
+		if err == nil {
+			break
+		}
+		if ctx.Err() != nil {
+			fmt.Fprintf(os.Stderr, "interrupted; container %s keeps running until the probe finishes\n", name)
+			return exitIncomplete
+		}
+		msg := strings.TrimSpace(stderr.String())
+		if !strings.Contains(msg, "waiting to start") && !strings.Contains(msg, "ContainerCreating") {
+			fmt.Fprintf(os.Stderr, "Error: reading the probe's log: %s\n", msg)
+			return exitFailed
+		}
+		if !sleepCtx(ctx, time.Second) {
+			return exitIncomplete
+		}
+	}
+
+	// The log ends when the container exits, but its status may lag behind.
+	jsonpath := fmt.Sprintf(`jsonpath={.status.ephemeralContainerStatuses[?(@.name=="%s")].state.terminated.exitCode}`, name)
+	getArgs := append([]string{"get", "pod", opts.pod, "-o", jsonpath}, opts.kubeFlags...)
+	for range 10 {
+		var out bytes.Buffer
+		if err := kubectl(ctx, opts, nil, &out, os.Stderr, getArgs...); err != nil {
+			return exitFailed
+		}
+		if code, err := strconv.Atoi(strings.TrimSpace(out.String())); err == nil {
+			return code
+		}
+		if !sleepCtx(ctx, time.Second) {
+			break
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Error: container %s did not report an exit code\n", name)
+	return exitIncomplete
+}
+
+// pluginExec copies a probe binary into a container of the pod and runs it
+// there. The container needs a shell and a writable /tmp.
+func pluginExec(ctx context.Context, opts *pluginOptions) int {
+	binary := opts.binary
+	if binary == "" {
+		if runtime.GOOS != "linux" {
+			fmt.Fprintf(os.Stderr, "Error: --method=exec copies this executable into the pod, but it is built for %s; pass --binary with a linux build\n", runtime.GOOS)
+			return exitFailed
+		}
+		var err error
+		if binary, err = os.Executable(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return exitFailed
+		}
+	}
+	f, err := os.Open(binary)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitFailed
+	}
+	defer f.Close()
+
+	execArgs := append([]string{"exec", opts.pod}, opts.kubeFlags...)
+	if opts.container != "" {
+		execArgs = append(execArgs, "--container="+opts.container)
+	}
+	upload := append(append([]string{}, execArgs...), "-i", "--", "sh", "-c", "cat > "+pluginBinaryPath+" && chmod +x "+pluginBinaryPath)
+	if err := kubectl(ctx, opts, f, os.Stdout, os.Stderr, upload...); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: copying the probe into pod %s: %v\n", opts.pod, err)
+		return exitFailed
+	}
+
+	script := "trap 'rm -f " + pluginBinaryPath + "' EXIT; "
+	for _, kv := range opts.env {
+		key, value, _ := strings.Cut(kv, "=")
+		script += key + "=" + shellQuote(value) + " "
+	}
+	script += pluginBinaryPath
+	run := append(append([]string{}, execArgs...), "--", "sh", "-c", script)
+	err = kubectl(ctx, opts, nil, os.Stdout, os.Stderr, run...)
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &exitErr):
+		return exitErr.ExitCode()
+	default:
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitFailed
+	}
+}
+
+// kubectl runs kubectl with args and the given standard streams.
+func kubectl(ctx context.Context, opts *pluginOptions, stdin io.Reader, stdout, stderr io.Writer, args ...string) error {
+	cmd := exec.CommandContext(ctx, opts.kubectl, args...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = stdin, stdout, stderr
+	return cmd.Run()
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// minSaneMTU is IPv6's minimum MTU; less breaks IPv6 and fragments
+	// most TLS handshakes.
+	minSaneMTU = 1280
+	// maxSaneMTU is the largest jumbo frame switches commonly pass.
+	maxSaneMTU = 9216
+	// arpTimeout bounds how long the gateway has to answer ARP.
+	arpTimeout = 2 * time.Second
+)
+
+// preflightCheck is one check of the Pod's own networking.
+type preflightCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail"`
+}
+
+// preflight is what PREFLIGHT found before the targets were probed.
+type preflight struct {
+	OK     bool             `json:"ok"`
+	Checks []preflightCheck `json:"checks"`
+}
+
+// defaultRoute is the route the Pod's egress takes.
+type defaultRoute struct {
+	iface   string
+	gateway net.IP // nil for a route without a gateway
+}
+
+// runPreflight checks the basics every egress depends on: a default route,
+// an interface that is up with an address and a sane MTU, and a gateway
+// that answers ARP. Checks that need the route or the interface are skipped
+// when those fail.
+func runPreflight(ctx context.Context) *preflight {
+	if runtime.GOOS != "linux" {
+		// The checks read the kernel's tables from /proc.
+		logf("PREFLIGHT: only supported on Linux; skipped")
+		return nil
+	}
+	p := &preflight{OK: true}
+	add := func(name string, ok bool, format string, args ...any) {
+		p.Checks = append(p.Checks, preflightCheck{Name: name, OK: ok, Detail: fmt.Sprintf(format, args...)})
+		p.OK = p.OK && ok
+	}
+
+	route, err := findDefaultRoute()
+	if err != nil {
+		add("default route", false, "%v", err)
+		return p
+	}
+	via := "dev " + route.iface
+	if route.gateway != nil {
+		via = "via " + route.gateway.String() + " " + via
+	}
+	add("default route", true, "%s", via)
+
+	iface, err := net.InterfaceByName(route.iface)
+	if err != nil {
+		add("interface", false, "%s: %v", route.iface, err)
+		return p
+	}
+	addrs, _ := iface.Addrs()
+	var list []string
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.IsGlobalUnicast() {
+			list = append(list, n.String())
+		}
+	}
+	switch {
+	case iface.Flags&net.FlagUp == 0:
+		add("interface", false, "%s is down", iface.Name)
+		return p
+	case len(list) == 0:
+		add("interface", false, "%s has no address: the CNI didn't finish setting up the Pod", iface.Name)
+		return p
+	}
+	add("interface", true, "%s up, %s", iface.Name, strings.Join(list, ", "))
+
+	switch {
+	case iface.MTU < minSaneMTU:
+		add("MTU", false, "%d on %s is below %d: large packets, such as TLS certificates, are fragmented or lost", iface.MTU, iface.Name, minSaneMTU)
+	case iface.MTU > maxSaneMTU:
+		add("MTU", false, "%d on %s is above %d: the network is unlikely to carry frames this large", iface.MTU, iface.Name, maxSaneMTU)
+	default:
+		add("MTU", true, "%d on %s", iface.MTU, iface.Name)
+	}
+
+	if gw := route.gateway.To4(); gw != nil {
+		if hw, err := resolveNeighbor(ctx, gw, iface.Name); err != nil {
+			add("gateway ARP", false, "%s on %s: %v", gw, iface.Name, err)
+		} else {
+			add("gateway ARP", true, "%s is at %s", gw, hw)
+		}
+	}
+	return p
+}
+
+// findDefaultRoute returns the IPv4 default route with the lowest metric or,
+// without one, the IPv6 default route.
+func findDefaultRoute() (defaultRoute, error) {
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return defaultRoute{}, fmt.Errorf("reading the routing table: %w", err)
+	}
+	defer f.Close()
+
+	var best defaultRoute
+	bestMetric := -1
+	sc := bufio.NewScanner(f)
+	sc.Scan() // header
+	for sc.Scan() {
+		// Iface Destination Gateway Flags RefCnt Use Metric Mask ...
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 8 || fields[1] != "00000000" || fields[7] != "00000000" {
+			continue
+		}
+		flags, _ := strconv.ParseUint(fields[3], 16, 32)
+		metric, _ := strconv.Atoi(fields[6])
+		if flags&0x1 == 0 || (bestMetric >= 0 && metric >= bestMetric) { // RTF_UP
+			continue
+		}
+		r := defaultRoute{iface: fields[0]}
+		if gw, err := hex.DecodeString(fields[2]); err == nil && len(gw) == 4 && flags&0x2 != 0 { // RTF_GATEWAY
+			// The kernel prints addresses in host byte order.
+			r.gateway = make(net.IP, 4)
+			binary.BigEndian.PutUint32(r.gateway, binary.NativeEndian.Uint32(gw))
+		}
+		best, bestMetric = r, metric
+	}
+	if bestMetric >= 0 {
+		return best, nil
+	}
+	if r, ok := findDefaultRoute6(); ok {
+		return r, nil
+	}
+	return defaultRoute{}, fmt.Errorf("no default route: the Pod can only reach its own subnet")
+}
+
+func findDefaultRoute6() (defaultRoute, bool) {
+	f, err := os.Open("/proc/net/ipv6_route")
+	if err != nil {
+		return defaultRoute{}, false
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		// dest destlen src srclen nexthop metric refcnt use flags iface
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 10 || fields[1] != "00" || strings.Trim(fields[0], "0") != "" || fields[9] == "lo" {
+			continue
+		}
+		flags, _ := strconv.ParseUint(fields[8], 16, 32)
+		if flags&0x1 == 0 || flags&0x200 != 0 { // RTF_UP, RTF_REJECT
+			continue
+		}
+		r := defaultRoute{iface: fields[9]}
+		if gw, err := hex.DecodeString(fields[4]); err == nil && len(gw) == 16 && !net.IP(gw).IsUnspecified() {
+			r.gateway = net.IP(gw)
+		}
+		return r, true
+	}
+	return defaultRoute{}, false
+}
+
+// resolveNeighbor makes the kernel resolve gw, by sending it a UDP packet
+// to the discard port, and waits for its entry in the ARP table to complete.
+func resolveNeighbor(ctx context.Context, gw net.IP, iface string) (string, error) {
+	if conn, err := net.Dial("udp4", net.JoinHostPort(gw.String(), "9")); err == nil {
+		conn.Write([]byte{0})
+		conn.Close()
+	}
+	deadline := time.Now().Add(arpTimeout)
+	for {
+		data, err := os.ReadFile("/proc/net/arp")
+		if err != nil {
+			return "", fmt.Errorf("reading the ARP table: %w", err)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			// IP address, HW type, Flags, HW address, Mask, Device
+			fields := strings.Fields(line)
+			if len(fields) < 6 || fields[0] != gw.String() || fields[5] != iface {
+				continue
+			}
+			if flags, _ := strconv.ParseUint(strings.TrimPrefix(fields[2], "0x"), 16, 32); flags&0x2 != 0 { // ATF_COM
+				return fields[3], nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("no ARP reply: the CNI's veth or proxy ARP is broken")
+		}
+		if !sleepCtx(ctx, 100*time.Millisecond) {
+			return "", ctx.Err()
+		}
+	}
+}
+
+func printPreflight(p *preflight) {
+	if p == nil {
+		return
+	}
+	fmt.Printf("  %sPreflight%s\n", colorBold, colorReset)
+	for _, c := range p.Checks {
+		mark, color := "✓", colorGreen
+		if !c.OK {
+			mark, color = "✗", colorRed
+		}
+		fmt.Fprintf(tableOut, "    %s%s %-13s%s %s\n", color, mark, c.Name, colorReset, c.Detail)
+	}
+	fmt.Println()
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/cheolhuikim/egress-probe/pkg/probe"
+)
+
+// registryPresets are the package registries language toolchains download
+// from, for build clusters. Each is named after its ecosystem.
+var registryPresets = []struct {
+	name  string
+	hosts []string
+}{
+	{"go", []string{"proxy.golang.org", "sum.golang.org"}},
+	{"npm", []string{"registry.npmjs.org"}},
+	{"pypi", []string{"pypi.org", "files.pythonhosted.org"}},
+	{"crates", []string{"crates.io", "index.crates.io", "static.crates.io"}},
+	{"rubygems", []string{"rubygems.org", "index.rubygems.org"}},
+}
+
+// presetTargets returns the targets of the named PRESET. "registries" is
+// every registry preset at once.
+func presetTargets(name string) ([]probe.Target, error) {
+	if name == "cluster-core" {
+		return clusterCoreTargets(), nil
+	}
+	var targets []probe.Target
+	for _, p := range registryPresets {
+		if name == p.name || name == "registries" {
+			for _, h := range p.hosts {
+				targets = append(targets, probe.ParseTarget(h))
+			}
+		}
+	}
+	if targets == nil {
+		return nil, fmt.Errorf("invalid PRESET %q: expected cluster-core, go, npm, pypi, crates, rubygems or registries", name)
+	}
+	return targets, nil
+}
+
+// clusterCoreTargets are the endpoints every Pod implicitly depends on: the
+// API server, cluster DNS, and the cloud's metadata and identity services.
+func clusterCoreTargets() []probe.Target {
+	targets := []probe.Target{probe.ParseTarget("kubernetes.default.svc:443")}
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host != "" && port != "" {
+		targets = append(targets, probe.ParseTarget(net.JoinHostPort(host, port)))
+	}
+
+	// Cluster DNS over TCP, which resolvers fall back to for large answers.
+	_, nameservers, _ := readResolvConf()
+	for _, ns := range nameservers {
+		targets = append(targets, probe.Target{Host: ns, Port: 53, SkipTLS: true})
+	}
+
+	switch detectCloud() {
+	case "aws":
+		sts := "sts.amazonaws.com"
+		if region := os.Getenv("AWS_REGION"); region != "" {
+			sts = "sts." + region + ".amazonaws.com"
+		}
+		targets = append(targets, probe.ParseTarget("http://169.254.169.254"), probe.ParseTarget(sts))
+	case "azure":
+		targets = append(targets, probe.ParseTarget("http://169.254.169.254"), probe.ParseTarget("login.microsoftonline.com"))
+	case "gcp":
+		targets = append(targets, probe.ParseTarget("http://metadata.google.internal"),
+			probe.ParseTarget("oauth2.googleapis.com"), probe.ParseTarget("sts.googleapis.com"))
+	}
+	return targets
+}
+
+// detectCloud names the cloud the node runs in ("aws", "azure", "gcp"), or
+// returns "" if it can't tell. The node's DMI data is visible from
+// containers; workload-identity variables are the fallback.
+func detectCloud() string {
+	dmi := func(name string) string {
+		data, _ := os.ReadFile("/sys/class/dmi/id/" + name)
+		return strings.TrimSpace(string(data))
+	}
+	vendor, product := dmi("sys_vendor"), dmi("product_name")
+	switch {
+	case vendor == "Amazon EC2" || strings.HasPrefix(dmi("bios_vendor"), "Amazon"):
+		return "aws"
+	case vendor == "Microsoft Corporation" && product == "Virtual Machine":
+		return "azure"
+	case product == "Google Compute Engine" || vendor == "Google":
+		return "gcp"
+	case os.Getenv("AWS_ROLE_ARN") != "" || os.Getenv("AWS_REGION") != "":
+		return "aws"
+	case os.Getenv("AZURE_CLIENT_ID") != "" || os.Getenv("AZURE_TENANT_ID") != "":
+		return "azure"
+	}
+	return ""
+}
+
+// clusterRootCAs returns the system roots plus the cluster CA from the
+// service account, so that the API server's certificate verifies. It
+// returns nil, leaving the system roots in use, if either is unavailable.
+func clusterRootCAs() *x509.CertPool {
+	caPEM, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		return nil
+	}
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil
+	}
+	return pool
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/cheolhuikim/egress-probe/pkg/probe"
+)
+
+// parseProxy validates the value of PROXY, or its alias PROXY_URL, given as
+// name: "env", or the URL of an HTTP proxy.
+func parseProxy(name, raw string) error {
+	if raw == "env" {
+		return nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "http" || u.Host == "" {
+		return fmt.Errorf("invalid %s %q: expected env or an http:// proxy URL", name, raw)
+	}
+	return nil
+}
+
+// proxyFunc returns how targets reach the proxy configured with PROXY, or
+// nil to connect directly. With "env" the proxy variables decide per target,
+// NO_PROXY included, as they would for other workloads.
+func proxyFunc(raw string) func(probe.Target) *url.URL {
+	switch raw {
+	case "":
+		return nil
+	case "env":
+		return func(t probe.Target) *url.URL {
+			scheme := "https"
+			if t.SkipTLS {
+				scheme = "http"
+			}
+			req := &http.Request{URL: &url.URL{Scheme: scheme, Host: t.Host + ":" + strconv.Itoa(t.Port)}}
+			u, _ := http.ProxyFromEnvironment(req)
+			return u
+		}
+	}
+	u, _ := url.Parse(raw)
+	return func(probe.Target) *url.URL { return u }
+}
+
+// proxyDescription is the header line for PROXY, without credentials.
+func proxyDescription(raw string) string {
+	if raw == "env" {
+		return "from HTTPS_PROXY, HTTP_PROXY and NO_PROXY"
+	}
+	u, _ := url.Parse(raw)
+	return u.Redacted()
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// transparentProbeAddr is in TEST-NET-1 (RFC 5737), where no server
+// answers: a connection to it that completes was answered on the way.
+const transparentProbeAddr = "192.0.2.1"
+
+// detectProxyEnvironment looks for what proxy variables don't show: a
+// transparent proxy that answers connections on the way, and a proxy
+// auto-config file served through WPAD. Both checks run at once and take at
+// most a second.
+func detectProxyEnvironment(ctx context.Context, env *environment) {
+	var wg sync.WaitGroup
+	if env.Sidecar == "" { // the sidecar answers every connection, and is reported
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			env.TransparentProxy = detectTransparentProxy(ctx)
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		env.ProxyPAC = detectPAC(ctx, env.Search)
+	}()
+	wg.Wait()
+}
+
+// detectTransparentProxy returns why connections look intercepted, or "".
+func detectTransparentProxy(ctx context.Context) string {
+	d := net.Dialer{Timeout: 500 * time.Millisecond}
+	for _, port := range []string{"443", "80"} {
+		addr := net.JoinHostPort(transparentProbeAddr, port)
+		if conn, err := d.DialContext(ctx, "tcp", addr); err == nil {
+			conn.Close()
+			return fmt.Sprintf("a connection to %s, where nothing should answer, succeeded", addr)
+		}
+	}
+	return ""
+}
+
+// detectPAC returns the URL of the proxy auto-config file WPAD offers in
+// one of the search domains, or "".
+func detectPAC(ctx context.Context, search []string) string {
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	client := &http.Client{Transport: &http.Transport{}} // directly, like the probe
+	for _, domain := range search {
+		host := "wpad." + strings.TrimSuffix(domain, ".")
+		if _, err := net.DefaultResolver.LookupHost(ctx, host+"."); err != nil {
+			continue
+		}
+		u := "http://" + host + "/wpad.dat"
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			continue
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			continue
+		}
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK && strings.Contains(string(body), "FindProxyForURL") {
+			return u
+		}
+	}
+	return ""
+}
+
+// proxyWarnings returns what to tell about the proxy environment: mainly
+// that the probe connects directly where workloads would use a proxy, so
+// that its results don't describe their path.
+func proxyWarnings(cfg Config, env *environment) []string {
+	var warnings []string
+	if cfg.Proxy == "" {
+		var set string
+		for _, name := range []string{"HTTPS_PROXY", "https_proxy", "HTTP_PROXY", "http_proxy", "ALL_PROXY", "all_proxy"} {
+			if os.Getenv(name) != "" {
+				set = name
+				break
+			}
+		}
+		switch {
+		case set != "":
+			warnings = append(warnings, set+" is set, so workloads here go through a proxy, but the probe connects directly; set PROXY=env to probe the way they do")
+		case env.ProxyPAC != "":
+			warnings = append(warnings, "a proxy auto-config file is served at "+env.ProxyPAC+", so workloads may go through a proxy, but the probe connects directly; set PROXY to the proxy it names")
+		}
+	}
+	if env.TransparentProxy != "" {
+		warnings = append(warnings, env.TransparentProxy+": a transparent proxy intercepts connections, so the results show what it lets through, and TCP succeeds even for blocked destinations")
+	}
+	return warnings
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// maxConfigMapBytes is the most a ConfigMap can hold.
+const maxConfigMapBytes = 1 << 20
+
+// publishResults writes out to the ConfigMap and EgressProbe status named by
+// PUBLISH_CONFIGMAP and PUBLISH_EGRESSPROBE, so that controllers and
+// dashboards can read the current egress state from the API. Failures are
+// logged: publishing never fails a run.
+func publishResults(ctx context.Context, cfg Config, out jsonOutput) {
+	if cfg.PublishConfigMap == "" && cfg.PublishEgressProbe == "" {
+		return
+	}
+	client, err := newInClusterClient()
+	if err != nil {
+		logf("publishing results: %v", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, clusterTargetsTimeout)
+	defer cancel()
+	if cfg.PublishConfigMap != "" {
+		if err := publishConfigMap(ctx, client, cfg.PublishConfigMap, out); err != nil {
+			logf("PUBLISH_CONFIGMAP: %v", err)
+		}
+	}
+	if cfg.PublishEgressProbe != "" {
+		if err := publishEgressProbe(ctx, client, cfg.PublishEgressProbe, cfg.TargetsEgressProbe, out); err != nil {
+			logf("PUBLISH_EGRESSPROBE: %v", err)
+		}
+	}
+}
+
+// publishConfigMap stores out under the "results.json" key of the ConfigMap
+// ref, creating it if needed. Results that would overflow a ConfigMap are
+// dropped, keeping the summary.
+func publishConfigMap(ctx context.Context, client *kubeClient, ref string, out jsonOutput) error {
+	ns, name, err := splitNamespacedName(ref, client.namespace)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return err
+	}
+	if len(data) > maxConfigMapBytes-4096 {
+		logf("PUBLISH_CONFIGMAP: %d bytes of results exceed what a ConfigMap holds; publishing the summary only", len(data))
+		out.Results = nil
+		if data, err = json.MarshalIndent(out, "", "  "); err != nil {
+			return err
+		}
+	}
+	cm := configMap{
+		Metadata: objectMeta{Name: name, Namespace: ns, Labels: map[string]string{"app.kubernetes.io/managed-by": "egress-probe"}},
+		Data: map[string]string{
+			"results.json": string(data),
+			"ok":           fmt.Sprint(out.Summary.OK),
+			"lastRunTime":  time.Now().UTC().Format(time.RFC3339),
+		},
+	}
+
+	path := "/api/v1/namespaces/" + ns + "/configmaps/" + name
+	err = client.mergePatch(ctx, path, map[string]any{"data": cm.Data}, nil)
+	if isNotFound(err) {
+		err = client.do(ctx, http.MethodPost, "/api/v1/namespaces/"+ns+"/configmaps", "application/json", cm, nil)
+	}
+	if err != nil {
+		return fmt.Errorf("writing configmap %s/%s: %w", ns, name, err)
+	}
+	return nil
+}
+
+// publishEgressProbe records out in the status of the EgressProbe ref, the
+// way the operator does. When the run's targets came from the same resource
+// (TARGETS_EGRESSPROBE), its generation is recorded as observed.
+func publishEgressProbe(ctx context.Context, client *kubeClient, ref, targetsRef string, out jsonOutput) error {
+	ns, name, err := splitNamespacedName(ref, client.namespace)
+	if err != nil {
+		return err
+	}
+	var ep egressProbe
+	if err := client.get(ctx, egressProbeAPI+"/namespaces/"+ns+"/egressprobes/"+name, &ep); err != nil {
+		if isNotFound(err) {
+			return fmt.Errorf("egressprobe %s/%s not found", ns, name)
+		}
+		return fmt.Errorf("reading egressprobe %s/%s: %w", ns, name, err)
+	}
+	ep.Metadata.Namespace = ns
+
+	var generation int64
+	if tns, tname, err := splitNamespacedName(targetsRef, client.namespace); err == nil && tns == ns && tname == name {
+		generation = ep.Metadata.Generation
+	}
+	status := ep.Status
+	if generation != 0 {
+		status.ObservedGeneration = generation
+	}
+	status.LastRunTime = time.Now().UTC().Format(time.RFC3339)
+	status.Summary = &out.Summary
+	status.Results = out.Results
+	status.Conditions = setCondition(status.Conditions, healthyCondition(out, generation))
+	writeProbeStatus(ctx, client, ep, status)
+	return nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// reflection is what "egress-probe reflect" answers: how the caller's
+// request arrived. "ip" is the field EGRESS_ECHO_URL reads.
+type reflection struct {
+	IP      string              `json:"ip"`
+	Port    int                 `json:"port"`
+	TLS     *reflectedTLS       `json:"tls,omitempty"`
+	Method  string              `json:"method"`
+	Host    string              `json:"host"`
+	Path    string              `json:"path"`
+	Proto   string              `json:"proto"`
+	Headers map[string][]string `json:"headers"`
+	Time    time.Time           `json:"time"`
+}
+
+type reflectedTLS struct {
+	Version    string `json:"version"`
+	Cipher     string `json:"cipher"`
+	ServerName string `json:"sni,omitempty"`
+	ALPN       string `json:"alpn,omitempty"`
+	// CertSHA256 is the fingerprint of the certificate the reflector
+	// presented. A client that saw another one was answered by something
+	// in between, such as a TLS-inspecting proxy.
+	CertSHA256 string `json:"cert_sha256"`
+}
+
+// runReflect implements "egress-probe reflect": an HTTPS endpoint, deployed
+// outside the network under test, that tells each caller its source address,
+// the TLS session it negotiated and the headers that reached it. Probes point
+// EGRESS_ECHO_URL at it to check their egress IP, and for TLS inspection on
+// the way out.
+func runReflect(ctx context.Context, args []string) int {
+	fs := flag.NewFlagSet("reflect", flag.ExitOnError)
+	listen := fs.String("listen", ":8443", "address to listen on")
+	certFile := fs.String("cert", "", "certificate chain to serve, PEM; reloaded when it changes (default: a self-signed certificate)")
+	keyFile := fs.String("key", "", "private key of -cert, PEM")
+	hosts := fs.String("hosts", "localhost", "comma-separated names and addresses of the self-signed certificate")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s reflect [flags]\n\nServes the caller's source address, TLS session and headers as JSON.\n\nFlags:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if (*certFile == "") != (*keyFile == "") {
+		fmt.Fprintf(os.Stderr, "Error: -cert and -key go together\n")
+		return exitFailed
+	}
+
+	var certs *reflectCerts
+	if *certFile != "" {
+		certs = &reflectCerts{certFile: *certFile, keyFile: *keyFile}
+		if _, err := certs.get(nil); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return exitFailed
+		}
+	} else {
+		now := time.Now()
+		cert, _, err := selfSignedCert("egress-probe reflect", strings.Split(*hosts, ","), now.Add(-time.Hour), now.AddDate(1, 0, 0))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: generating a certificate: %v\n", err)
+			return exitFailed
+		}
+		certs = &reflectCerts{cert: &cert}
+		logf("serving a self-signed certificate for %s; give -cert and -key for one clients trust", *hosts)
+	}
+
+	ln, err := net.Listen("tcp", *listen)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitFailed
+	}
+	srv := &http.Server{
+		Handler:           reflectHandler(certs),
+		TLSConfig:         &tls.Config{GetCertificate: certs.get},
+		ReadHeaderTimeout: 10 * time.Second,
+		ErrorLog:          log.New(io.Discard, "", 0), // scanners' failed handshakes
+	}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	logf("reflecting on https://%s", ln.Addr())
+	if err := srv.ServeTLS(ln, "", ""); err != nil && err != http.ErrServerClosed {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitFailed
+	}
+	logf("shutting down")
+	return 0
+}
+
+// reflectHandler answers with how r arrived.
+func reflectHandler(certs *reflectCerts) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		host, port, _ := net.SplitHostPort(r.RemoteAddr)
+		ref := reflection{
+			IP:      host,
+			Method:  r.Method,
+			Host:    r.Host,
+			Path:    r.URL.RequestURI(),
+			Proto:   r.Proto,
+			Headers: r.Header,
+			Time:    time.Now().UTC(),
+		}
+		ref.Port, _ = strconv.Atoi(port)
+		if s := r.TLS; s != nil {
+			ref.TLS = &reflectedTLS{
+				Version:    tls.VersionName(s.Version),
+				Cipher:     tls.CipherSuiteName(s.CipherSuite),
+				ServerName: s.ServerName,
+				ALPN:       s.NegotiatedProtocol,
+				CertSHA256: certs.fingerprint(),
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(ref)
+	}
+}
+
+// reflectCerts is the certificate the reflector serves: a self-signed one,
+// or -cert and -key, read again when the files change, as when cert-manager
+// renews them.
+type reflectCerts struct {
+	certFile, keyFile string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func (c *reflectCerts) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.certFile == "" {
+		return c.cert, nil
+	}
+	fi, err := os.Stat(c.certFile)
+	if err != nil {
+		if c.cert != nil {
+			return c.cert, nil // keep serving the last one
+		}
+		return nil, err
+	}
+	if c.cert != nil && fi.ModTime().Equal(c.modTime) {
+		return c.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		if c.cert != nil {
+			logf("reflect: keeping the previous certificate: %v", err)
+			return c.cert, nil
+		}
+		return nil, err
+	}
+	c.cert, c.modTime = &cert, fi.ModTime()
+	return c.cert, nil
+}
+
+// fingerprint is the SHA-256 of the leaf certificate being served, in hex.
+func (c *reflectCerts) fingerprint() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cert == nil || len(c.cert.Certificate) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(c.cert.Certificate[0])
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cheolhuikim/egress-probe/pkg/probe"
+)
+
+// repeatStats aggregates the outcomes of one target over REPEAT runs.
+type repeatStats struct {
+	Target     probe.Target
+	Runs       int             // completed attempts
+	AsExpected int             // attempts whose outcome matched the expectation
+	Latencies  []time.Duration // total time of attempts that reached the target
+	Failures   map[string]int  // unexpected outcome → count
+	Incomplete bool            // the run was cut short before all attempts finished
+}
+
+func (s *repeatStats) rate() float64 {
+	if s.Runs == 0 {
+		return 0
+	}
+	return float64(s.AsExpected) / float64(s.Runs)
+}
+
+// verdict is "ok" when every attempt matched the expectation, "fail" when
+// none did and "flaky" in between.
+func (s *repeatStats) verdict() string {
+	switch {
+	case s.Incomplete:
+		return "incomplete"
+	case s.AsExpected == s.Runs:
+		return "ok"
+	case s.AsExpected == 0:
+		return "fail"
+	default:
+		return "flaky"
+	}
+}
+
+// spread returns the min, p50, p95 and max latency, or nil if the target was
+// never reached.
+func (s *repeatStats) spread() []time.Duration {
+	if len(s.Latencies) == 0 {
+		return nil
+	}
+	sorted := append([]time.Duration(nil), s.Latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return []time.Duration{sorted[0], percentile(sorted, 0.5), percentile(sorted, 0.95), sorted[len(sorted)-1]}
+}
+
+// percentile returns the nearest-rank percentile p (0..1) of sorted.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	idx := int(math.Ceil(p*float64(len(sorted)))) - 1
+	return sorted[max(idx, 0)]
+}
+
+// runRepeat probes every target cfg.Repeat times and reports, per target, how
+// often the outcome matched its expectation and how much latency varied.
+// It returns the exit code for the run.
+func runRepeat(ctx context.Context, cfg Config) int {
+	targets, timeout := cfg.Targets, cfg.Timeout
+	jsonMode := machineOutput(cfg)
+	env := currentEnvironment(ctx)
+
+	if !jsonMode {
+		printHeader(cfg, env)
+		fmt.Printf("  Repeat:   %d runs per target\n\n", cfg.Repeat)
+	}
+
+	start := time.Now()
+	runCtx := ctx
+	if cfg.RunTimeout > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, cfg.RunTimeout)
+		defer cancel()
+	}
+	if cfg.StartJitter > 0 {
+		sleepCtx(runCtx, time.Duration(rand.Int64N(int64(cfg.StartJitter))))
+	}
+	probe.WarmupDNS(runCtx, timeout)
+
+	stats := make([]*repeatStats, len(targets))
+	for i, t := range targets {
+		stats[i] = &repeatStats{Target: t, Failures: make(map[string]int)}
+	}
+
+	for run := 0; run < cfg.Repeat; run++ {
+		results, err := probe.Run(runCtx, targets, probeOptions(cfg))
+		for i, r := range results {
+			s := stats[i]
+			if r.Incomplete {
+				s.Incomplete = true
+				continue
+			}
+			s.Runs++
+			if r.Passed {
+				s.AsExpected++
+			} else {
+				s.Failures[failureReason(r)]++
+			}
+			if !r.Blocked {
+				s.Latencies = append(s.Latencies, r.DNS.Duration+r.TCP.Duration+r.TLS.Duration+r.HTTP.Duration+r.Exec.Duration)
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	elapsed := time.Since(start)
+
+	if jsonMode {
+		printRepeatJSON(cfg, env, stats, elapsed)
+	} else {
+		printRepeatResults(stats, elapsed)
+	}
+
+	code := 0
+	for _, s := range stats {
+		switch s.verdict() {
+		case "incomplete":
+			return exitIncomplete
+		case "fail", "flaky":
+			code = exitFailed
+		}
+	}
+	return code
+}
+
+// failureReason describes an unexpected outcome, e.g. "TCP: timeout".
+func failureReason(r probe.Result) string {
+	if r.Blocked == r.Target.ExpectErr {
+		for _, a := range r.Assertions {
+			if !a.Passed {
+				return "expect " + a.Expr + ": " + a.Detail
+			}
+		}
+	}
+	if r.Target.ExpectErr {
+		return "reachable"
+	}
+	for _, ph := range []struct {
+		name string
+		p    probe.PhaseResult
+	}{{"DNS", r.DNS}, {"TCP", r.TCP}, {"TLS", r.TLS}, {"HTTP", r.HTTP}, {"EXEC", r.Exec}} {
+		if !ph.p.Success && ph.p.Detail != "" && !strings.HasPrefix(ph.p.Detail, "skipped") {
+			return ph.name + ": " + ph.p.Detail
+		}
+	}
+	return "failed"
+}
+
+func printRepeatResults(stats []*repeatStats, elapsed time.Duration) {
+	maxHostLen := 4
+	for _, s := range stats {
+		maxHostLen = max(maxHostLen, min(displayWidth(s.Target.Host), 40))
+	}
+	cols := []int{maxHostLen + 2, 6, 7, 14, 9, 9, 9, 9, 8}
+
+	printSeparator(cols, "┌", "┬", "┐")
+	fmt.Fprintf(tableOut, "│ %-*s│ %-*s│ %-*s│ %-*s│ %-*s│ %-*s│ %-*s│ %-*s│ %-*s│\n",
+		cols[0], " FQDN", cols[1], " PORT", cols[2], " TYPE", cols[3], " AS EXPECTED",
+		cols[4], " MIN", cols[5], " P50", cols[6], " P95", cols[7], " MAX", cols[8], " RESULT")
+	printSeparator(cols, "├", "┼", "┤")
+
+	var ok, flaky, failed, incomplete int
+	for _, s := range stats {
+		host := truncateWidth(s.Target.Host, maxHostLen)
+		typ := "allow"
+		if s.Target.ExpectErr {
+			typ = "deny"
+		}
+
+		var resultCell string
+		switch s.verdict() {
+		case "ok":
+			ok++
+			resultCell = fmt.Sprintf(" %s%sOK%s", colorBold, colorGreen, colorReset)
+		case "flaky":
+			flaky++
+			resultCell = fmt.Sprintf(" %s%sFLAKY%s", colorBold, colorYellow, colorReset)
+		case "fail":
+			failed++
+			resultCell = fmt.Sprintf(" %s%sFAIL%s", colorBold, colorRed, colorReset)
+		default:
+			incomplete++
+			resultCell = fmt.Sprintf(" %s%sSKIP%s", colorBold, colorYellow, colorReset)
+		}
+
+		latency := []string{" —", " —", " —", " —"}
+		for i, d := range s.spread() {
+			latency[i] = fmt.Sprintf(" %dms", d.Milliseconds())
+		}
+
+		rate := fmt.Sprintf(" %d/%d (%.0f%%)", s.AsExpected, s.Runs, s.rate()*100)
+		fmt.Fprintf(tableOut, "│ %s│ %-*s│ %-*s│ %-*s│ %-*s│ %-*s│ %-*s│ %-*s│ %s│\n",
+			padRight(" "+host, cols[0]), cols[1], fmt.Sprintf(" %d", s.Target.Port), cols[2], " "+typ, cols[3], rate,
+			cols[4], latency[0], cols[5], latency[1], cols[6], latency[2], cols[7], latency[3],
+			padRight(resultCell, cols[8]))
+	}
+	printSeparator(cols, "└", "┴", "┘")
+
+	for _, s := range stats {
+		if len(s.Failures) == 0 {
+			continue
+		}
+		fmt.Printf("\n  %s:%d\n", s.Target.Host, s.Target.Port)
+		for _, reason := range sortedFailures(s.Failures) {
+			fmt.Fprintf(tableOut, "    %s%d× %s%s\n", colorDim, s.Failures[reason], reason, colorReset)
+		}
+	}
+
+	total := len(stats)
+	fmt.Printf("\n  Results: %s%d/%d OK%s", colorGreen, ok, total, colorReset)
+	if flaky > 0 {
+		fmt.Printf(" | %s%d/%d FLAKY%s", colorYellow, flaky, total, colorReset)
+	}
+	if failed > 0 {
+		fmt.Printf(" | %s%d/%d FAIL%s", colorRed, failed, total, colorReset)
+	}
+	if incomplete > 0 {
+		fmt.Printf(" | %s%d/%d SKIP (incomplete)%s", colorYellow, incomplete, total, colorReset)
+	}
+	fmt.Printf("\n  Elapsed: %s\n\n", elapsed.Round(time.Millisecond))
+}
+
+// sortedFailures returns the failure reasons, most frequent first.
+func sortedFailures(failures map[string]int) []string {
+	reasons := make([]string, 0, len(failures))
+	for reason := range failures {
+		reasons = append(reasons, reason)
+	}
+	sort.Slice(reasons, func(i, j int) bool {
+		if failures[reasons[i]] != failures[reasons[j]] {
+			return failures[reasons[i]] > failures[reasons[j]]
+		}
+		return reasons[i] < reasons[j]
+	})
+	return reasons
+}
+
+type jsonRepeatSummary struct {
+	Total      int       `json:"total"`
+	OK         int       `json:"ok"`
+	Flaky      int       `json:"flaky"`
+	Failed     int       `json:"failed"`
+	Incomplete int       `json:"incomplete"`
+	Repeat     int       `json:"repeat"`
+	Timeout    string    `json:"timeout"`
+	Elapsed    string    `json:"elapsed"`
+	Build      buildInfo `json:"build"`
+}
+
+type jsonLatency struct {
+	MinMs float64 `json:"min_ms"`
+	P50Ms float64 `json:"p50_ms"`
+	P95Ms float64 `json:"p95_ms"`
+	MaxMs float64 `json:"max_ms"`
+}
+
+type jsonRepeatResult struct {
+	Host        string         `json:"host"`
+	Port        int            `json:"port"`
+	Type        string         `json:"type"`
+	SkipTLS     bool           `json:"skip_tls"`
+	Runs        int            `json:"runs"`
+	AsExpected  int            `json:"as_expected"`
+	SuccessRate float64        `json:"success_rate"`
+	Latency     *jsonLatency   `json:"latency,omitempty"`
+	Failures    map[string]int `json:"failures,omitempty"`
+	Verdict     string         `json:"verdict"`
+}
+
+func printRepeatJSON(cfg Config, env *environment, stats []*repeatStats, elapsed time.Duration) {
+	ms := func(d time.Duration) float64 {
+		return math.Round(float64(d)/float64(time.Millisecond)*10) / 10
+	}
+
+	out := struct {
+		Summary     jsonRepeatSummary  `json:"summary"`
+		Environment *environment       `json:"environment,omitempty"`
+		Results     []jsonRepeatResult `json:"results"`
+	}{
+		Summary: jsonRepeatSummary{
+			Total:   len(stats),
+			Repeat:  cfg.Repeat,
+			Timeout: cfg.Timeout.String(),
+			Elapsed: elapsed.Round(time.Millisecond).String(),
+			Build:   currentBuild(),
+		},
+		Environment: env,
+		Results:     make([]jsonRepeatResult, len(stats)),
+	}
+
+	for i, s := range stats {
+		typ := "allow"
+		if s.Target.ExpectErr {
+			typ = "deny"
+		}
+		jr := jsonRepeatResult{
+			Host:        s.Target.Host,
+			Port:        s.Target.Port,
+			Type:        typ,
+			SkipTLS:     s.Target.SkipTLS,
+			Runs:        s.Runs,
+			AsExpected:  s.AsExpected,
+			SuccessRate: math.Round(s.rate()*1000) / 1000,
+			Verdict:     s.verdict(),
+		}
+		if len(s.Failures) > 0 {
+			jr.Failures = s.Failures
+		}
+		if sp := s.spread(); sp != nil {
+			jr.Latency = &jsonLatency{MinMs: ms(sp[0]), P50Ms: ms(sp[1]), P95Ms: ms(sp[2]), MaxMs: ms(sp[3])}
+		}
+		out.Results[i] = jr
+
+		switch jr.Verdict {
+		case "ok":
+			out.Summary.OK++
+		case "flaky":
+			out.Summary.Flaky++
+		case "fail":
+			out.Summary.Failed++
+		default:
+			out.Summary.Incomplete++
+		}
+	}
+
+	writeJSON(cfg, out)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/cheolhuikim/egress-probe/pkg/probe"
+)
+
+// loadBaseline reads a report written with OUTPUT=json and converts it back
+// into results. Exec commands are not part of the report, so they are taken
+// from the matching configured target, if any.
+func loadBaseline(path string, configured []probe.Target) ([]probe.Result, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading previous results: %w", err)
+	}
+	var prev jsonOutput
+	if err := json.Unmarshal(data, &prev); err != nil {
+		return nil, fmt.Errorf("parsing previous results %s: %w", path, err)
+	}
+	if len(prev.Results) == 0 {
+		return nil, fmt.Errorf("previous results %s contain no targets (expected OUTPUT=json output)", path)
+	}
+
+	byKey := make(map[string]probe.Target, len(configured))
+	for _, t := range configured {
+		byKey[targetKey(t)] = t
+	}
+
+	results := make([]probe.Result, len(prev.Results))
+	for i, jr := range prev.Results {
+		t := probe.Target{Host: jr.Host, Port: jr.Port, SkipTLS: jr.SkipTLS, ExpectErr: jr.Type == "deny", Method: jr.Method, Path: jr.Path, Family: jr.Family, Metadata: jr.Metadata}
+		t.Exec = byKey[targetKey(t)].Exec
+		t.Issuer = byKey[targetKey(t)].Issuer
+		t.Phases = byKey[targetKey(t)].Phases
+		t.Expect = byKey[targetKey(t)].Expect
+		t.Priority = byKey[targetKey(t)].Priority
+		t.Timeout = byKey[targetKey(t)].Timeout
+		t.ClientCert, t.ClientKey = byKey[targetKey(t)].ClientCert, byKey[targetKey(t)].ClientKey
+		results[i] = probe.Result{
+			Target:           t,
+			DNS:              fromJSONPhase(jr.DNS),
+			TCP:              fromJSONPhase(jr.TCP),
+			TLS:              fromJSONPhase(jr.TLS),
+			Intercepted:      jr.Intercepted,
+			Passed:           jr.Passed,
+			Blocked:          jr.Blocked,
+			Incomplete:       jr.Incomplete,
+			DeadlineExceeded: jr.DeadlineExceeded,
+		}
+		for _, a := range jr.Assertions {
+			results[i].Assertions = append(results[i].Assertions, probe.Assertion(a))
+		}
+		if jr.HTTP != nil {
+			results[i].HTTP = fromJSONPhase(*jr.HTTP)
+		}
+		if jr.Exec != nil && t.Exec != "" {
+			results[i].Exec = fromJSONPhase(*jr.Exec)
+		}
+		if c := jr.Cert; c != nil {
+			results[i].Cert = &probe.CertInfo{
+				Subject:     c.Subject,
+				Issuer:      c.Issuer,
+				DNSNames:    c.DNSNames,
+				NotBefore:   c.NotBefore,
+				NotAfter:    c.NotAfter,
+				SelfSigned:  c.SelfSigned,
+				Fingerprint: c.Fingerprint,
+			}
+			for _, cc := range c.Chain {
+				results[i].Cert.Chain = append(results[i].Cert.Chain, probe.ChainCert(cc))
+			}
+			results[i].CertExpiring = c.Expiring
+		}
+	}
+	return results, nil
+}
+
+func fromJSONPhase(p jsonPhase) probe.PhaseResult {
+	return probe.PhaseResult{
+		Success:  p.Success,
+		Duration: time.Duration(p.DurationMs) * time.Millisecond,
+		Detail:   p.Detail,
+		Status:   p.Status,
+		Retries:  p.Retries,
+	}
+}
+
+// retryTargets returns the targets of baseline that did not pass, including
+// incomplete ones, which never got a verdict.
+func retryTargets(baseline []probe.Result) []probe.Target {
+	var targets []probe.Target
+	for _, r := range baseline {
+		if !r.Passed {
+			targets = append(targets, r.Target)
+		}
+	}
+	return targets
+}
+
+// mergeResults replaces the entries of baseline that were re-probed with
+// their new results. retried must be in retryTargets order.
+func mergeResults(baseline, retried []probe.Result) []probe.Result {
+	merged := make([]probe.Result, len(baseline))
+	copy(merged, baseline)
+	j := 0
+	for i := range merged {
+		if !merged[i].Passed && j < len(retried) {
+			merged[i] = retried[j]
+			j++
+		}
+	}
+	return merged
+}
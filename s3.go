@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// uploadS3 writes an object with a SigV4-signed PUT. AWS_ENDPOINT_URL_S3 (or
+// AWS_ENDPOINT_URL) points it at an S3-compatible store, addressed path-style.
+func uploadS3(ctx context.Context, bucket, name string, data []byte) error {
+	creds, err := loadAWSCredentials(ctx)
+	if err != nil {
+		return err
+	}
+	region := awsRegion()
+
+	u := &url.URL{Scheme: "https", Host: bucket + ".s3." + region + ".amazonaws.com", Path: "/" + name}
+	endpoint := os.Getenv("AWS_ENDPOINT_URL_S3")
+	if endpoint == "" {
+		endpoint = os.Getenv("AWS_ENDPOINT_URL")
+	}
+	if endpoint != "" {
+		if u, err = url.Parse(strings.TrimRight(endpoint, "/")); err != nil {
+			return fmt.Errorf("invalid AWS_ENDPOINT_URL_S3: %w", err)
+		}
+		u.Path += "/" + bucket + "/" + name
+	}
+	u.RawPath = awsEscapePath(u.Path)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	signAWS(req, data, creds, region, "s3", time.Now())
+	return doUpload(req, "s3")
+}
+
+// awsEscapePath escapes every byte of p but the unreserved characters and
+// slashes, the way SigV4 expects S3 paths.
+func awsEscapePath(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.IndexByte("-_.~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cheolhuikim/egress-probe/pkg/probe"
+)
+
+// selfTestEndpoints are highly available internet endpoints that nearly
+// every unrestricted network can reach. They are not part of anyone's
+// allow-list on purpose: they show whether egress works at all.
+var selfTestEndpoints = []string{
+	"https://www.google.com",
+	"https://www.cloudflare.com",
+	"https://www.microsoft.com",
+}
+
+// runSelfTest implements --self-test. It first checks the probe's own
+// machinery against loopback servers it starts itself — an HTTPS server with
+// a throwaway certificate, a plain HTTP server and a closed port that must
+// read as blocked — and then probes selfTestEndpoints. A loopback failure
+// means the probe environment is broken and real results can't be trusted;
+// unreachable reference endpoints only mean that egress is restricted. It
+// returns the process exit code.
+func runSelfTest(ctx context.Context, cfg Config) int {
+	fmt.Printf("\n  %sEgress Probe self-test%s  %s%s%s\n", colorBold, colorReset, colorDim, currentBuild(), colorReset)
+
+	loopback, roots, cleanup, err := startSelfTestServers()
+	if err != nil {
+		fmt.Fprintf(tableOut, "\n  %s✗ Could not start loopback servers: %v%s\n", colorRed, err, colorReset)
+		fmt.Printf("    The probe environment is broken; results of real runs can't be trusted.\n\n")
+		return exitFailed
+	}
+	defer cleanup()
+
+	opts := probe.Options{Timeout: cfg.Timeout, HTTP: true, CertInfo: true, RootCAs: roots}
+	fmt.Printf("\n  %sProbe machinery (loopback)%s\n", colorBold, colorReset)
+	local, _ := probe.Run(ctx, loopback, opts)
+	localOK := printSelfTestResults(local)
+
+	var remote []probe.Target
+	for _, e := range selfTestEndpoints {
+		remote = append(remote, probe.ParseTarget(e))
+	}
+	opts.RootCAs = nil
+	fmt.Printf("\n  %sReference endpoints (internet)%s\n", colorBold, colorReset)
+	probe.WarmupDNS(ctx, cfg.Timeout)
+	external, _ := probe.Run(ctx, remote, opts)
+	reachable := 0
+	for _, r := range external {
+		if r.Passed {
+			reachable++
+		}
+	}
+	printSelfTestResults(external)
+
+	fmt.Println()
+	switch {
+	case ctx.Err() != nil:
+		fmt.Printf("  %s! Self-test interrupted%s\n\n", colorYellow, colorReset)
+		return exitIncomplete
+	case !localOK:
+		fmt.Fprintf(tableOut, "  %s✗ The probe environment is broken%s: loopback checks failed, so results of\n", colorRed, colorReset)
+		fmt.Printf("    real runs can't be trusted. Check the container's network stack and TLS setup.\n\n")
+		return exitFailed
+	case reachable == len(external):
+		fmt.Fprintf(tableOut, "  %s✓ Probe environment OK; internet egress works%s\n\n", colorGreen, colorReset)
+	case reachable == 0:
+		fmt.Fprintf(tableOut, "  %s✓ Probe environment OK%s; no reference endpoint is reachable, so egress is\n", colorGreen, colorReset)
+		fmt.Fprintf(tableOut, "    blocked or requires a proxy — expected in locked-down clusters.\n\n")
+	default:
+		fmt.Fprintf(tableOut, "  %s✓ Probe environment OK%s; %d of %d reference endpoints are reachable.\n\n",
+			colorGreen, colorReset, reachable, len(external))
+	}
+	return 0
+}
+
+// printSelfTestResults prints one line per result and reports whether all
+// of them passed.
+func printSelfTestResults(results []probe.Result) bool {
+	ok := true
+	for _, r := range results {
+		label := fmt.Sprintf("%s:%d", r.Target.Host, r.Target.Port)
+		if r.Target.ExpectErr {
+			label += " (closed port)"
+		}
+		switch {
+		case r.Incomplete:
+			ok = false
+			fmt.Fprintf(tableOut, "    %s—%s %-36s %sinterrupted%s\n", colorDim, colorReset, label, colorYellow, colorReset)
+		case r.Passed && r.Target.ExpectErr:
+			fmt.Fprintf(tableOut, "    %s✓%s %-36s %s%s%s\n", colorGreen, colorReset, label, colorDim, "blocked as expected ("+r.TCP.Detail+")", colorReset)
+		case r.Passed:
+			fmt.Fprintf(tableOut, "    %s✓%s %-36s %s%s%s\n", colorGreen, colorReset, label, colorDim, passDetail(r), colorReset)
+		default:
+			ok = false
+			fmt.Fprintf(tableOut, "    %s✗%s %-36s %s%s%s\n", colorRed, colorReset, label, colorRed, failureReason(r), colorReset)
+		}
+	}
+	return ok
+}
+
+// passDetail summarizes the deepest phase a passing target completed.
+func passDetail(r probe.Result) string {
+	switch {
+	case r.HTTP.Success && r.HTTP.Detail != "" && !strings.HasPrefix(r.HTTP.Detail, "skipped"):
+		return r.HTTP.Detail
+	case r.TLS.Success && !r.Target.SkipTLS:
+		return r.TLS.Detail
+	}
+	return r.TCP.Detail
+}
+
+// startSelfTestServers starts an HTTPS and a plain HTTP server on loopback
+// and reserves a closed port. It returns the targets that exercise them, a
+// pool trusting the HTTPS server's certificate, and a cleanup function.
+func startSelfTestServers() ([]probe.Target, *x509.CertPool, func(), error) {
+	cert, roots, err := selfSignedCert("egress-probe self-test", []string{"127.0.0.1"},
+		time.Now().Add(-time.Minute), time.Now().Add(time.Hour))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	plainLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	tlsLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		plainLn.Close()
+		return nil, nil, nil, err
+	}
+	// A port that was just released is the best guess at one nothing listens on.
+	closedLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		plainLn.Close()
+		tlsLn.Close()
+		return nil, nil, nil, err
+	}
+	closedPort := closedLn.Addr().(*net.TCPAddr).Port
+	closedLn.Close()
+
+	// The TLS phase hangs up right after the handshake, which the server
+	// would otherwise log as an error.
+	quiet := log.New(io.Discard, "", 0)
+	plainSrv := &http.Server{Handler: handler, ReadHeaderTimeout: 5 * time.Second, ErrorLog: quiet}
+	tlsSrv := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 5 * time.Second,
+		TLSConfig:         &tls.Config{Certificates: []tls.Certificate{cert}},
+		ErrorLog:          quiet,
+	}
+	go plainSrv.Serve(plainLn)
+	go tlsSrv.ServeTLS(tlsLn, "", "")
+
+	port := func(ln net.Listener) string { return strconv.Itoa(ln.Addr().(*net.TCPAddr).Port) }
+	targets := []probe.Target{
+		probe.ParseTarget("https://127.0.0.1:" + port(tlsLn)),
+		probe.ParseTarget("http://127.0.0.1:" + port(plainLn)),
+		{Host: "127.0.0.1", Port: closedPort, SkipTLS: true, ExpectErr: true},
+	}
+	cleanup := func() {
+		plainSrv.Close()
+		tlsSrv.Close()
+	}
+	return targets, roots, cleanup, nil
+}
+
+// selfSignedCert creates a self-signed certificate for hosts (names or IP
+// addresses), valid between notBefore and notAfter, with a pool trusting it.
+func selfSignedCert(cn string, hosts []string, notBefore, notAfter time.Time) (tls.Certificate, *x509.CertPool, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, roots, nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/cheolhuikim/egress-probe/pkg/probe"
+)
+
+// expandServiceTargets follows each svc:// target with the endpoints option
+// by one target per ready endpoint address of its Service, on the port the
+// Service forwards to, so that a Service which answers through some Pods
+// but not others stands out. Targets are returned unchanged, after logging
+// why, if the endpoints can't be listed.
+func expandServiceTargets(ctx context.Context, targets []probe.Target) []probe.Target {
+	var client *kubeClient
+	var out []probe.Target
+	for _, t := range targets {
+		out = append(out, t)
+		if !t.Endpoints {
+			continue
+		}
+		if client == nil {
+			var err error
+			if client, err = newInClusterClient(); err != nil {
+				logf("%s:%d: endpoints not probed: %v", t.Host, t.Port, err)
+				return targets
+			}
+		}
+		endpoints, err := serviceEndpoints(ctx, client, t)
+		if err != nil {
+			logf("%s:%d: endpoints not probed: %v", t.Host, t.Port, err)
+			continue
+		}
+		logf("%s:%d: probing %d ready endpoints of service %s", t.Host, t.Port, len(endpoints), t.Service)
+		out = append(out, endpoints...)
+	}
+	return out
+}
+
+// serviceEndpoints lists the ready endpoints behind port t.Port of t's
+// Service, from its EndpointSlices.
+func serviceEndpoints(ctx context.Context, client *kubeClient, t probe.Target) ([]probe.Target, error) {
+	ctx, cancel := context.WithTimeout(ctx, clusterTargetsTimeout)
+	defer cancel()
+	ns, name, _ := strings.Cut(t.Service, "/")
+
+	var svc struct {
+		Spec struct {
+			Ports []struct {
+				Name string `json:"name"`
+				Port int    `json:"port"`
+			} `json:"ports"`
+		} `json:"spec"`
+	}
+	if err := client.get(ctx, "/api/v1/namespaces/"+ns+"/services/"+name, &svc); err != nil {
+		return nil, fmt.Errorf("reading service: %w", err)
+	}
+	portName, found := "", false
+	for _, p := range svc.Spec.Ports {
+		if p.Port == t.Port {
+			portName, found = p.Name, true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("the service has no port %d", t.Port)
+	}
+
+	var slices struct {
+		Items []struct {
+			Ports []struct {
+				Name     *string `json:"name"`
+				Port     *int    `json:"port"`
+				Protocol string  `json:"protocol"`
+			} `json:"ports"`
+			Endpoints []struct {
+				Addresses  []string `json:"addresses"`
+				Conditions struct {
+					Ready *bool `json:"ready"`
+				} `json:"conditions"`
+			} `json:"endpoints"`
+		} `json:"items"`
+	}
+	query := url.Values{"labelSelector": {"kubernetes.io/service-name=" + name}}
+	if err := client.get(ctx, "/apis/discovery.k8s.io/v1/namespaces/"+ns+"/endpointslices?"+query.Encode(), &slices); err != nil {
+		return nil, fmt.Errorf("listing endpointslices: %w", err)
+	}
+
+	var endpoints []probe.Target
+	seen := make(map[string]bool)
+	for _, slice := range slices.Items {
+		// A slice's ports are the target ports, named after the Service's.
+		port := 0
+		for _, p := range slice.Ports {
+			pn := ""
+			if p.Name != nil {
+				pn = *p.Name
+			}
+			if p.Port != nil && pn == portName && (p.Protocol == "" || p.Protocol == "TCP") {
+				port = *p.Port
+			}
+		}
+		if port == 0 {
+			continue
+		}
+		for _, ep := range slice.Endpoints {
+			// A nil ready condition means ready.
+			if r := ep.Conditions.Ready; r != nil && !*r {
+				continue
+			}
+			for _, addr := range ep.Addresses {
+				key := addr + ":" + strconv.Itoa(port)
+				if seen[key] {
+					continue
+				}
+				seen[key] = true
+				endpoints = append(endpoints, probe.Target{Host: addr, Port: port, SkipTLS: t.SkipTLS, ExpectErr: t.ExpectErr, Service: t.Service, Issuer: t.Issuer, Phases: t.Phases, Expect: t.Expect, Method: t.Method, Path: t.Path, Timeout: t.Timeout, ClientCert: t.ClientCert, ClientKey: t.ClientKey, Priority: t.Priority, Metadata: t.Metadata})
+			}
+		}
+	}
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("no ready endpoints on port %d", t.Port)
+	}
+	return endpoints, nil
+}
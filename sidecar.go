@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cheolhuikim/egress-probe/pkg/probe"
+)
+
+// defaultSidecarListenAddr stays clear of the :8080 the application next to
+// the sidecar is likely to use.
+const defaultSidecarListenAddr = ":9797"
+
+// readiness is the sidecar's verdict, served on /readyz.
+type readiness struct {
+	mu      sync.Mutex
+	ready   bool
+	message string
+}
+
+func (rd *readiness) set(ready bool, message string) {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	rd.ready, rd.message = ready, message
+}
+
+func (rd *readiness) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rd.mu.Lock()
+	ready, message := rd.ready, rd.message
+	rd.mu.Unlock()
+	if !ready {
+		http.Error(w, message, http.StatusServiceUnavailable)
+		return
+	}
+	io.WriteString(w, message+"\n")
+}
+
+// runSidecar gates a workload's readiness on egress. It probes the targets
+// at startup, again every INTERVAL until they all behave as expected, and
+// serves the outcome on /readyz for the application's readinessProbe or the
+// sidecar's own startupProbe. With READINESS_GATE it also sets that
+// condition on the Pod, for a readiness gate. Once ready it stops probing:
+// the gate holds back a rollout into a broken cluster, and later egress
+// outages are for daemon mode to report.
+func runSidecar(ctx context.Context, cfg Config) {
+	if len(cfg.Targets) == 0 {
+		fmt.Fprintf(os.Stderr, "Error: no targets specified; sidecar mode has nothing to gate readiness on.\n")
+		os.Exit(exitFailed)
+	}
+
+	rd := &readiness{message: "egress checks have not completed yet"}
+	mux := http.NewServeMux()
+	mux.Handle("GET /readyz", rd)
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok\n")
+	})
+
+	srv := &http.Server{Addr: cfg.ListenAddr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+	go func() {
+		for ctx.Err() == nil {
+			results, egress := runOnce(ctx, cfg)
+			if ctx.Err() != nil {
+				return
+			}
+			ok, message := sidecarVerdict(results, egress)
+			rd.set(ok, message)
+			if cfg.ReadinessGate != "" {
+				setReadinessGate(ctx, cfg.ReadinessGate, ok, message)
+			}
+			if ok {
+				logf("egress checks passed; ready")
+				return
+			}
+			logf("not ready: %s; checking again in %s", message, cfg.Interval)
+			sleepCtx(ctx, cfg.Interval)
+		}
+	}()
+
+	logf("sidecar mode: probing %d targets, readiness on %s/readyz", len(cfg.Targets), cfg.ListenAddr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logf("sidecar: %v", err)
+		return
+	}
+	logf("shutting down")
+}
+
+// sidecarVerdict decides readiness from a run, with a message saying why.
+func sidecarVerdict(results []probe.Result, egress *egressIPCheck) (bool, string) {
+	var failing []string
+	for _, r := range results {
+		if !r.Passed {
+			failing = append(failing, targetKey(r.Target)+": "+failureReason(r))
+		}
+	}
+	if egress != nil && !egress.OK {
+		if egress.Error != "" {
+			failing = append(failing, "egress IP not discovered: "+egress.Error)
+		} else {
+			failing = append(failing, "egress IP "+egress.IP+" outside "+strings.Join(egress.Expected, ", "))
+		}
+	}
+	total := len(results)
+	if egress != nil {
+		total++
+	}
+	if n := len(failing); n > 0 {
+		if n > 5 {
+			failing = append(failing[:5], "...")
+		}
+		return false, fmt.Sprintf("%d of %d egress checks failed: %s", n, total, strings.Join(failing, "; "))
+	}
+	return true, fmt.Sprintf("%d/%d targets behave as expected", len(results), len(results))
+}
+
+// setReadinessGate sets the condition conditionType on the probe's own Pod.
+// The Pod stays unready until the condition is True if its spec lists it
+// under readinessGates.
+func setReadinessGate(ctx context.Context, conditionType string, ok bool, message string) {
+	client, err := newInClusterClient()
+	if err != nil {
+		logf("READINESS_GATE: %v", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, clusterTargetsTimeout)
+	defer cancel()
+	pod, err := ownPod(ctx, client)
+	if err != nil {
+		logf("READINESS_GATE: %v", err)
+		return
+	}
+	c := kubeCondition{
+		Type:               conditionType,
+		Status:             "False",
+		Reason:             "EgressChecksFailed",
+		Message:            message,
+		LastTransitionTime: time.Now().UTC().Format(time.RFC3339),
+	}
+	if ok {
+		c.Status, c.Reason = "True", "EgressChecksPassed"
+	}
+	// A strategic merge patch merges conditions by type; a JSON merge patch
+	// would replace the kubelet's own.
+	patch := map[string]any{"status": map[string]any{"conditions": []kubeCondition{c}}}
+	path := "/api/v1/namespaces/" + pod.Namespace + "/pods/" + pod.Name + "/status"
+	if err := client.do(ctx, http.MethodPatch, path, "application/strategic-merge-patch+json", patch, nil); err != nil {
+		logf("READINESS_GATE: setting condition %s on pod %s/%s: %v", conditionType, pod.Namespace, pod.Name, err)
+	}
+}
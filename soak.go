@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cheolhuikim/egress-probe/pkg/probe"
+)
+
+const (
+	defaultSoakDuration = 10 * time.Minute
+	defaultSoakInterval = 30 * time.Second
+)
+
+// runSoak holds connections to the ALLOW targets for cfg.SoakDuration and
+// reports every drop. It returns the exit code for the run.
+func runSoak(ctx context.Context, cfg Config) int {
+	jsonMode := machineOutput(cfg)
+	if !jsonMode {
+		printHeader(cfg, currentEnvironment(ctx))
+		fmt.Printf("  Soak:     %s, one request every %s per connection\n\n", cfg.SoakDuration, cfg.SoakInterval)
+	}
+	logf("soak mode: holding connections to %d targets for %s", len(cfg.Targets), cfg.SoakDuration)
+
+	start := time.Now()
+	results := probe.Soak(ctx, cfg.Targets, probe.SoakOptions{
+		Duration: cfg.SoakDuration,
+		Interval: cfg.SoakInterval,
+		Timeout:  cfg.Timeout,
+		OnEvent: func(t probe.Target, ev probe.SoakEvent) {
+			msg := fmt.Sprintf("%s: %s (%s)", targetKey(t), ev.Kind, ev.Detail)
+			if ev.Kind == "disconnected" {
+				msg += fmt.Sprintf(" after %s", ev.Uptime.Round(time.Second))
+			}
+			logf("%s", msg)
+		},
+	})
+	elapsed := time.Since(start)
+
+	if jsonMode {
+		printSoakJSON(results, cfg, elapsed)
+	} else {
+		printSoakResults(results, elapsed)
+	}
+
+	code := 0
+	for _, r := range results {
+		if r.Incomplete {
+			return exitIncomplete
+		}
+		if !r.Passed {
+			code = exitFailed
+		}
+	}
+	return code
+}
+
+func printSoakResults(results []probe.SoakResult, elapsed time.Duration) {
+	maxHostLen := 4
+	for _, r := range results {
+		maxHostLen = max(maxHostLen, min(displayWidth(r.Target.Host), 40))
+	}
+	cols := []int{maxHostLen + 2, 6, 10, 8, 8, 10, 10, 8}
+
+	printSeparator(cols, "┌", "┬", "┐")
+	fmt.Fprintf(tableOut, "│ %-*s│ %-*s│ %-*s│ %-*s│ %-*s│ %-*s│ %-*s│ %-*s│\n",
+		cols[0], " FQDN", cols[1], " PORT", cols[2], " CONNECTS", cols[3], " DROPS",
+		cols[4], " ERRORS", cols[5], " REQUESTS", cols[6], " LONGEST", cols[7], " RESULT")
+	printSeparator(cols, "├", "┼", "┤")
+
+	ok, failed := 0, 0
+	for _, r := range results {
+		if r.Target.ExpectErr {
+			continue
+		}
+		host := truncateWidth(r.Target.Host, maxHostLen)
+		var resultCell string
+		switch {
+		case r.Passed:
+			ok++
+			resultCell = fmt.Sprintf(" %s%sOK%s", colorBold, colorGreen, colorReset)
+		default:
+			failed++
+			resultCell = fmt.Sprintf(" %s%sFAIL%s", colorBold, colorRed, colorReset)
+		}
+		fmt.Fprintf(tableOut, "│ %s│ %-*s│ %-*s│ %-*s│ %-*s│ %-*s│ %-*s│ %s│\n",
+			padRight(" "+host, cols[0]), cols[1], fmt.Sprintf(" %d", r.Target.Port),
+			cols[2], fmt.Sprintf(" %d", r.Connects), cols[3], fmt.Sprintf(" %d", r.Disconnects),
+			cols[4], fmt.Sprintf(" %d", r.Errors), cols[5], fmt.Sprintf(" %d", r.Requests),
+			cols[6], " "+r.LongestUptime.Round(time.Second).String(),
+			padRight(resultCell, cols[7]))
+	}
+	printSeparator(cols, "└", "┴", "┘")
+
+	for _, r := range results {
+		if r.Passed {
+			continue
+		}
+		fmt.Printf("\n  %s:%d\n", r.Target.Host, r.Target.Port)
+		for _, ev := range r.Events {
+			if ev.Kind == "connected" {
+				continue
+			}
+			line := fmt.Sprintf("%8s  %s: %s", ev.At.Round(time.Second), ev.Kind, ev.Detail)
+			if ev.Kind == "disconnected" {
+				line += fmt.Sprintf(" (up %s)", ev.Uptime.Round(time.Second))
+			}
+			fmt.Printf("    %s%s%s\n", colorDim, line, colorReset)
+		}
+	}
+
+	total := ok + failed
+	fmt.Printf("\n  Results: %s%d/%d OK%s", colorGreen, ok, total, colorReset)
+	if failed > 0 {
+		fmt.Printf(" | %s%d/%d FAIL%s", colorRed, failed, total, colorReset)
+	}
+	fmt.Printf("\n  Elapsed: %s\n\n", elapsed.Round(time.Millisecond))
+}
+
+type jsonSoakEvent struct {
+	AtMs     int64  `json:"at_ms"`
+	Kind     string `json:"kind"`
+	Detail   string `json:"detail"`
+	UptimeMs int64  `json:"uptime_ms,omitempty"`
+}
+
+type jsonSoakResult struct {
+	Host            string          `json:"host"`
+	Port            int             `json:"port"`
+	SkipTLS         bool            `json:"skip_tls"`
+	Connects        int             `json:"connects"`
+	Disconnects     int             `json:"disconnects"`
+	Errors          int             `json:"errors"`
+	Requests        int             `json:"requests"`
+	LongestUptimeMs int64           `json:"longest_uptime_ms"`
+	Events          []jsonSoakEvent `json:"events"`
+	Passed          bool            `json:"passed"`
+	Incomplete      bool            `json:"incomplete"`
+}
+
+func printSoakJSON(results []probe.SoakResult, cfg Config, elapsed time.Duration) {
+	out := struct {
+		Summary struct {
+			Total    int    `json:"total"`
+			Passed   int    `json:"passed"`
+			Failed   int    `json:"failed"`
+			OK       bool   `json:"ok"`
+			Duration string `json:"duration"`
+			Interval string `json:"interval"`
+			Elapsed  string `json:"elapsed"`
+		} `json:"summary"`
+		Results []jsonSoakResult `json:"results"`
+	}{Results: []jsonSoakResult{}}
+
+	for _, r := range results {
+		if r.Target.ExpectErr {
+			continue
+		}
+		jr := jsonSoakResult{
+			Host:            r.Target.Host,
+			Port:            r.Target.Port,
+			SkipTLS:         r.Target.SkipTLS,
+			Connects:        r.Connects,
+			Disconnects:     r.Disconnects,
+			Errors:          r.Errors,
+			Requests:        r.Requests,
+			LongestUptimeMs: r.LongestUptime.Milliseconds(),
+			Events:          make([]jsonSoakEvent, len(r.Events)),
+			Passed:          r.Passed,
+			Incomplete:      r.Incomplete,
+		}
+		for i, ev := range r.Events {
+			jr.Events[i] = jsonSoakEvent{
+				AtMs:     ev.At.Milliseconds(),
+				Kind:     ev.Kind,
+				Detail:   ev.Detail,
+				UptimeMs: ev.Uptime.Milliseconds(),
+			}
+		}
+		out.Results = append(out.Results, jr)
+		if r.Passed {
+			out.Summary.Passed++
+		} else {
+			out.Summary.Failed++
+		}
+	}
+	out.Summary.Total = len(out.Results)
+	out.Summary.OK = out.Summary.Failed == 0
+	out.Summary.Duration = cfg.SoakDuration.String()
+	out.Summary.Interval = cfg.SoakInterval.String()
+	out.Summary.Elapsed = elapsed.Round(time.Millisecond).String()
+
+	writeJSON(cfg, out)
+}
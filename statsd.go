@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// maxStatsDPacket keeps datagrams under a typical MTU.
+const maxStatsDPacket = 1432
+
+// emitStatsD sends a run's per-target phase timings and success counters to
+// the StatsD or DogStatsD agent at STATSD_ADDR over UDP:
+//
+//	egress_probe.phase.duration   timer, per phase that ran
+//	egress_probe.phase.success    counter, 1 per phase that succeeded
+//	egress_probe.phase.failure    counter, 1 per phase that failed
+//	egress_probe.target.passed    counter, 1 per target that met its expectation
+//	egress_probe.target.failed    counter, 1 per target that didn't
+//	egress_probe.run.failed       gauge, failed targets in the run
+//
+// DogStatsD tags them with the target, type, phase and node. Plain StatsD
+// has no tags, so the type, target and phase go into the name instead, e.g.
+// egress_probe.allow.github_com_443.tcp.duration. Incomplete targets are
+// left out. Failures are logged: emitting never fails a run.
+func emitStatsD(cfg Config, out jsonOutput) {
+	if cfg.StatsDAddr == "" {
+		return
+	}
+	conn, err := net.Dial("udp", cfg.StatsDAddr)
+	if err != nil {
+		logf("STATSD_ADDR: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	var lines []string
+	metric := func(name, value, kind string, r *jsonResult, phase string) {
+		if cfg.StatsDFlavor == "statsd" {
+			if r != nil {
+				_, last, _ := strings.Cut(name, ".")
+				parts := []string{r.Type, statsDName(net.JoinHostPort(r.Host, strconv.Itoa(r.Port)))}
+				if phase != "" {
+					parts = append(parts, phase)
+				}
+				name = strings.Join(append(parts, last), ".")
+			}
+			lines = append(lines, cfg.StatsDPrefix+"."+name+":"+value+"|"+kind)
+			return
+		}
+		tags := append([]string(nil), cfg.StatsDTags...)
+		if cfg.NodeName != "" {
+			tags = append(tags, "node:"+cfg.NodeName)
+		}
+		if r != nil {
+			tags = append(tags, "host:"+r.Host, "port:"+strconv.Itoa(r.Port), "type:"+r.Type)
+			if owner := r.Metadata["owner"]; owner != "" {
+				tags = append(tags, "owner:"+owner)
+			}
+		}
+		if phase != "" {
+			tags = append(tags, "phase:"+phase)
+		}
+		line := cfg.StatsDPrefix + "." + name + ":" + value + "|" + kind
+		if len(tags) > 0 {
+			line += "|#" + strings.Join(tags, ",")
+		}
+		lines = append(lines, line)
+	}
+
+	for i := range out.Results {
+		r := &out.Results[i]
+		if r.Incomplete {
+			continue
+		}
+		phases := []struct {
+			name string
+			p    *jsonPhase
+		}{{"dns", &r.DNS}, {"tcp", &r.TCP}, {"tls", &r.TLS}, {"http", r.HTTP}, {"exec", r.Exec}}
+		for _, ph := range phases {
+			if ph.p == nil || ph.p.Start == nil {
+				continue
+			}
+			metric("phase.duration", strconv.FormatFloat(float64(ph.p.DurationUs)/1000, 'f', 3, 64), "ms", r, ph.name)
+			if ph.p.Success {
+				metric("phase.success", "1", "c", r, ph.name)
+			} else {
+				metric("phase.failure", "1", "c", r, ph.name)
+			}
+		}
+		if r.Passed {
+			metric("target.passed", "1", "c", r, "")
+		} else {
+			metric("target.failed", "1", "c", r, "")
+		}
+	}
+	metric("run.failed", strconv.Itoa(out.Summary.Failed), "g", nil, "")
+
+	for len(lines) > 0 {
+		var packet strings.Builder
+		for len(lines) > 0 && (packet.Len() == 0 || packet.Len()+1+len(lines[0]) <= maxStatsDPacket) {
+			if packet.Len() > 0 {
+				packet.WriteByte('\n')
+			}
+			packet.WriteString(lines[0])
+			lines = lines[1:]
+		}
+		if _, err := conn.Write([]byte(packet.String())); err != nil {
+			logf("STATSD_ADDR: %v", err)
+			return
+		}
+	}
+}
+
+// statsDName makes s usable as one component of a StatsD metric name.
+func statsDName(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// parseStatsDFlavor validates STATSD_FLAVOR.
+func parseStatsDFlavor(raw string) (string, error) {
+	switch raw = strings.ToLower(raw); raw {
+	case "":
+		return "dogstatsd", nil
+	case "dogstatsd", "statsd":
+		return raw, nil
+	}
+	return "", fmt.Errorf("invalid STATSD_FLAVOR %q: expected dogstatsd or statsd", raw)
+}
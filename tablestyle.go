@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// tableOut is where the header, the result tables and any other report line
+// with a non-ASCII glyph are written. TABLE_STYLE=ascii swaps it for an
+// asciiWriter.
+var tableOut io.Writer = os.Stdout
+
+// asciiTable maps the box-drawing and other non-ASCII characters of the
+// tables to ASCII of the same width, so that cells stay aligned.
+var asciiTable = strings.NewReplacer(
+	"┌", "+", "┬", "+", "┐", "+",
+	"├", "+", "┼", "+", "┤", "+",
+	"└", "+", "┴", "+", "┘", "+",
+	"─", "-", "│", "|",
+	"╔", "+", "╗", "+", "╚", "+", "╝", "+", "═", "=", "║", "|",
+	"—", "-", "–", "-", "…", "~", "→", ">", "·", ".", "×", "x",
+	"✓", "+", "✗", "x", "⚠", "!",
+)
+
+// asciiWriter rewrites what is written to w with asciiTable. Each print is
+// one Write, so characters are never split across calls.
+type asciiWriter struct {
+	w io.Writer
+}
+
+func (a asciiWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(a.w, asciiTable.Replace(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// setTableStyle applies a TABLE_STYLE value: "unicode", the default, or
+// "ascii" for log systems, serial consoles and ticketing tools that mangle
+// anything else. ASCII tables mark phases [OK] and [FAIL] unless
+// STATUS_GLYPHS says otherwise.
+func setTableStyle(raw string) error {
+	switch raw {
+	case "", "unicode":
+	case "ascii":
+		tableOut = asciiWriter{os.Stdout}
+		passGlyph, failGlyph = "[OK]", "[FAIL]"
+	default:
+		return fmt.Errorf("invalid TABLE_STYLE %q: expected unicode or ascii", raw)
+	}
+	return nil
+}
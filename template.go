@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// templateFuncs are the functions OUTPUT_TEMPLATE can call besides the
+// text/template builtins.
+var templateFuncs = template.FuncMap{
+	// json encodes a value, e.g. a result's metadata, on one line.
+	"json": func(v any) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+	// target names a result as "allow github.com:443".
+	"target": func(r jsonResult) string {
+		return r.Type + " " + net.JoinHostPort(r.Host, strconv.Itoa(r.Port))
+	},
+	// addr is a result's "host:port".
+	"addr": func(r jsonResult) string {
+		return net.JoinHostPort(r.Host, strconv.Itoa(r.Port))
+	},
+	// detail is why a result failed, as in alerts and CI annotations.
+	"detail": failureDetail,
+	"join":   strings.Join,
+	"upper":  strings.ToUpper,
+	"lower":  strings.ToLower,
+	// csv quotes a field of a CSV line if it needs to be.
+	"csv": func(s string) string {
+		if strings.ContainsAny(s, ",\"\r\n") {
+			return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+		}
+		return s
+	},
+}
+
+// parseOutputTemplate reads the template of OUTPUT=template: OUTPUT_TEMPLATE,
+// or the file OUTPUT_TEMPLATE_FILE, e.g. a mounted ConfigMap.
+func parseOutputTemplate() (*template.Template, error) {
+	text, name := getenv("OUTPUT_TEMPLATE"), "OUTPUT_TEMPLATE"
+	if path := getenv("OUTPUT_TEMPLATE_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading OUTPUT_TEMPLATE_FILE: %w", err)
+		}
+		text, name = string(data), "OUTPUT_TEMPLATE_FILE"
+	}
+	if text == "" {
+		return nil, fmt.Errorf("OUTPUT=template requires OUTPUT_TEMPLATE or OUTPUT_TEMPLATE_FILE")
+	}
+	t, err := template.New(name).Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return t, nil
+}
+
+// printTemplate prints a run with the template of OUTPUT=template. It sees
+// the same report as OUTPUT=json, with the Go field names: .Summary.OK,
+// .Results, .Diagnoses and so on.
+func printTemplate(cfg Config, out jsonOutput) {
+	if err := cfg.OutputTemplate.Execute(os.Stdout, out); err != nil {
+		logf("OUTPUT_TEMPLATE: %v", err)
+	}
+}
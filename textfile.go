@@ -0,0 +1,124 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultTextfileName = "egress_probe.prom"
+
+// writeTextfile writes a run as Prometheus metrics into TEXTFILE_DIR, for
+// node_exporter's textfile collector to expose, so that a Job or CronJob is
+// scraped without serving HTTP itself. The file is written to a temporary
+// name and renamed, so the collector never reads half of it. Failures are
+// logged: writing never fails a run.
+func writeTextfile(cfg Config, out jsonOutput, end time.Time) {
+	if cfg.TextfileDir == "" {
+		return
+	}
+	path := filepath.Join(cfg.TextfileDir, cfg.TextfileName)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(promText(cfg, out, end)), 0o644); err != nil {
+		logf("TEXTFILE_DIR: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		logf("TEXTFILE_DIR: %v", err)
+	}
+}
+
+// promText renders a run as Prometheus metrics in the text format.
+// Incomplete targets are left out.
+func promText(cfg Config, out jsonOutput, end time.Time) string {
+	var b strings.Builder
+	family := func(name, typ, help string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+	var runLabels string
+	if cfg.NodeName != "" {
+		runLabels = `{node="` + promEscape(cfg.NodeName) + `"}`
+	}
+
+	family("egress_probe_last_run_timestamp_seconds", "gauge", "When the last run ended.")
+	fmt.Fprintf(&b, "egress_probe_last_run_timestamp_seconds%s %d\n", runLabels, end.Unix())
+	family("egress_probe_run_ok", "gauge", "Whether every target of the last run met its expectation.")
+	fmt.Fprintf(&b, "egress_probe_run_ok%s %d\n", runLabels, promBool(out.Summary.OK))
+	family("egress_probe_targets_failed", "gauge", "Targets of the last run that didn't meet their expectation.")
+	fmt.Fprintf(&b, "egress_probe_targets_failed%s %d\n", runLabels, out.Summary.Failed)
+
+	var passed, blocked, score, duration, success, expiry strings.Builder
+	for _, r := range out.Results {
+		if r.Incomplete {
+			continue
+		}
+		labels := promLabels(cfg, r)
+		fmt.Fprintf(&passed, "egress_probe_target_passed{%s} %d\n", labels, promBool(r.Passed))
+		fmt.Fprintf(&blocked, "egress_probe_target_blocked{%s} %d\n", labels, promBool(r.Blocked))
+		if r.Health != nil {
+			fmt.Fprintf(&score, "egress_probe_target_health_score{%s} %d\n", labels, r.Health.Score)
+		}
+		if r.Cert != nil {
+			fmt.Fprintf(&expiry, "egress_probe_cert_expiry_timestamp_seconds{%s} %d\n", labels, r.Cert.NotAfter.Unix())
+		}
+		phases := []struct {
+			name string
+			p    *jsonPhase
+		}{{"dns", &r.DNS}, {"tcp", &r.TCP}, {"tls", &r.TLS}, {"http", r.HTTP}, {"exec", r.Exec}}
+		for _, ph := range phases {
+			if ph.p == nil || ph.p.Start == nil {
+				continue
+			}
+			fmt.Fprintf(&duration, "egress_probe_phase_duration_seconds{%s,phase=\"%s\"} %s\n", labels, ph.name, strconv.FormatFloat(float64(ph.p.DurationUs)/1e6, 'f', -1, 64))
+			fmt.Fprintf(&success, "egress_probe_phase_success{%s,phase=\"%s\"} %d\n", labels, ph.name, promBool(ph.p.Success))
+		}
+	}
+	family("egress_probe_target_passed", "gauge", "Whether the target met its expectation: reachable for allow targets, blocked for deny targets.")
+	b.WriteString(passed.String())
+	family("egress_probe_target_blocked", "gauge", "Whether the target was blocked.")
+	b.WriteString(blocked.String())
+	family("egress_probe_target_health_score", "gauge", "Health of the target from 0 to 100.")
+	b.WriteString(score.String())
+	family("egress_probe_phase_duration_seconds", "gauge", "Duration of each phase that ran.")
+	b.WriteString(duration.String())
+	family("egress_probe_phase_success", "gauge", "Whether each phase that ran succeeded.")
+	b.WriteString(success.String())
+	if expiry.Len() > 0 {
+		family("egress_probe_cert_expiry_timestamp_seconds", "gauge", "When the server certificate expires, for targets whose certificate was recorded.")
+		b.WriteString(expiry.String())
+	}
+	return b.String()
+}
+
+// promLabels are the labels of r's metrics, without braces.
+func promLabels(cfg Config, r jsonResult) string {
+	var node string
+	if cfg.NodeName != "" {
+		node = `node="` + promEscape(cfg.NodeName) + `",`
+	}
+	labels := fmt.Sprintf(`%shost="%s",port="%d",type="%s"`, node, promEscape(r.Host), r.Port, r.Type)
+	if r.Method != "" || r.Path != "" {
+		labels += `,method="` + cmp.Or(r.Method, "HEAD") + `",path="` + promEscape(cmp.Or(r.Path, "/")) + `"`
+	}
+	if r.Family != "" {
+		labels += `,family="` + r.Family + `"`
+	}
+	return labels
+}
+
+// promEscape escapes a Prometheus label value.
+func promEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func promBool(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// trustStore describes the CA certificates the probe verifies servers
+// against, as Go loads them: the first bundle file that exists, plus the
+// certificates in the directories. In scratch and distroless images that
+// lack the ca-certificates package it is empty, and every TLS target fails
+// with "cert: unknown authority" for reasons that have nothing to do with
+// the network.
+type trustStore struct {
+	Sources []string `json:"sources,omitempty"` // the bundle and directories roots came from
+	Roots   int      `json:"roots"`
+	Expired int      `json:"expired,omitempty"`
+	Warning string   `json:"warning,omitempty"` // the store is empty or out of date
+	// Custom are CA_FILE and CA_DIR, whose CustomRoots certificates the
+	// probe adds to the roots.
+	Custom      []string `json:"custom,omitempty"`
+	CustomRoots int      `json:"custom_roots,omitempty"`
+}
+
+// staleShare is the share of expired roots from which a CA bundle is
+// flagged as out of date. Current bundles drop roots soon after they
+// expire, so more than a few point at a package that hasn't been updated.
+const staleShare = 0.1
+
+// loadTrustStore reads the trust store the way crypto/x509 does on Unix:
+// SSL_CERT_FILE and SSL_CERT_DIR replace the default files and directories.
+func loadTrustStore(files, dirs []string) *trustStore {
+	if f := os.Getenv("SSL_CERT_FILE"); f != "" {
+		files = []string{f}
+	}
+	if d := os.Getenv("SSL_CERT_DIR"); d != "" {
+		dirs = strings.Split(d, ":")
+	}
+
+	ts := &trustStore{}
+	now := time.Now()
+	seen := make(map[[sha256.Size]byte]bool)
+	// add counts the certificates in data that weren't seen before; the
+	// directories usually hold the bundle's roots once more.
+	add := func(data []byte) int {
+		n := 0
+		for {
+			var block *pem.Block
+			block, data = pem.Decode(data)
+			if block == nil {
+				return n
+			}
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if block.Type != "CERTIFICATE" || err != nil || seen[sha256.Sum256(cert.Raw)] {
+				continue
+			}
+			seen[sha256.Sum256(cert.Raw)] = true
+			n++
+			if cert.NotAfter.Before(now) {
+				ts.Expired++
+			}
+		}
+	}
+
+	for _, f := range files {
+		if data, err := os.ReadFile(f); err == nil {
+			ts.Roots += add(data)
+			ts.Sources = append(ts.Sources, f)
+			break
+		}
+	}
+	for _, d := range dirs {
+		entries, err := os.ReadDir(d)
+		if err != nil {
+			continue
+		}
+		n := 0
+		for _, e := range entries {
+			if data, err := os.ReadFile(filepath.Join(d, e.Name())); err == nil {
+				n += add(data)
+			}
+		}
+		if n > 0 {
+			ts.Roots += n
+			ts.Sources = append(ts.Sources, d)
+		}
+	}
+
+	if file, dir := getenv("CA_FILE"), getenv("CA_DIR"); file != "" || dir != "" {
+		if certs, err := readCAs(file, dir); err == nil {
+			ts.CustomRoots = len(certs)
+			for _, src := range []string{file, dir} {
+				if src != "" {
+					ts.Custom = append(ts.Custom, src)
+				}
+			}
+		}
+	}
+
+	switch {
+	case ts.Roots == 0 && os.Getenv("SSL_CERT_FILE") != "":
+		ts.Warning = "no CA certificates in SSL_CERT_FILE=" + os.Getenv("SSL_CERT_FILE")
+	case ts.Roots == 0:
+		ts.Warning = "no CA certificates: install the ca-certificates package or copy a CA bundle into the image"
+	case float64(ts.Expired) >= staleShare*float64(ts.Roots):
+		ts.Warning = fmt.Sprintf("%d of %d roots have expired: the CA bundle is out of date", ts.Expired, ts.Roots)
+	}
+	return ts
+}
+
+// String summarizes the store for the header of the table.
+func (ts *trustStore) String() string {
+	sources := "none"
+	if len(ts.Sources) > 0 {
+		sources = strings.Join(ts.Sources, ", ")
+	}
+	s := fmt.Sprintf("%s (%d roots", sources, ts.Roots)
+	if ts.Expired > 0 {
+		s += fmt.Sprintf(", %d expired", ts.Expired)
+	}
+	s += ")"
+	if len(ts.Custom) > 0 {
+		s += fmt.Sprintf(" + %s (%d roots)", strings.Join(ts.Custom, ", "), ts.CustomRoots)
+	}
+	return s
+}
+
+// readCAs reads the certificates of CA_FILE, a PEM bundle, and CA_DIR, a
+// directory of PEM files such as a mounted ConfigMap. Files of the
+// directory without certificates are skipped, but the file and the
+// directory must each hold at least one.
+func readCAs(file, dir string) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CA_FILE: %w", err)
+		}
+		found := parseCerts(data)
+		if len(found) == 0 {
+			return nil, fmt.Errorf("invalid CA_FILE %q: no PEM certificates", file)
+		}
+		certs = append(certs, found...)
+	}
+	if dir != "" {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CA_DIR: %w", err)
+		}
+		n := len(certs)
+		for _, e := range entries {
+			// ConfigMap mounts hold their files in hidden directories, and
+			// links to them.
+			if strings.HasPrefix(e.Name(), ".") {
+				continue
+			}
+			if data, err := os.ReadFile(filepath.Join(dir, e.Name())); err == nil {
+				certs = append(certs, parseCerts(data)...)
+			}
+		}
+		if len(certs) == n {
+			return nil, fmt.Errorf("invalid CA_DIR %q: no PEM certificates", dir)
+		}
+	}
+	return certs, nil
+}
+
+// parseCerts returns the certificates of the PEM blocks in data.
+func parseCerts(data []byte) []*x509.Certificate {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return certs
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+			certs = append(certs, cert)
+		}
+	}
+}
+
+// customRootCAs returns pool, or the system roots if it is nil, plus the
+// certificates of CA_FILE and CA_DIR, for servers signed by a private CA or
+// re-signed by a TLS-inspecting proxy.
+func customRootCAs(pool *x509.CertPool, file, dir string) (*x509.CertPool, error) {
+	certs, err := readCAs(file, dir)
+	if err != nil {
+		return nil, err
+	}
+	if pool == nil {
+		if pool, err = x509.SystemCertPool(); err != nil {
+			pool = x509.NewCertPool()
+		}
+	}
+	for _, c := range certs {
+		pool.AddCert(c)
+	}
+	return pool, nil
+}
@@ -0,0 +1,23 @@
+package main
+
+// The bundle files and directories crypto/x509 loads roots from on Linux, in
+// its order.
+var (
+	certFiles = []string{
+		"/etc/ssl/certs/ca-certificates.crt",                // Debian, Ubuntu, Gentoo
+		"/etc/pki/tls/certs/ca-bundle.crt",                  // Fedora, RHEL 6
+		"/etc/ssl/ca-bundle.pem",                            // openSUSE
+		"/etc/pki/tls/cacert.pem",                           // OpenELEC
+		"/etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem", // CentOS, RHEL 7
+		"/etc/ssl/cert.pem",                                 // Alpine
+	}
+	certDirectories = []string{
+		"/etc/ssl/certs",
+		"/etc/pki/tls/certs",
+	}
+)
+
+// systemTrustStore inspects the roots TLS verification uses.
+func systemTrustStore() *trustStore {
+	return loadTrustStore(certFiles, certDirectories)
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// debugLogging is set by LOG_LEVEL=debug, and can be changed at runtime.
+var debugLogging atomic.Bool
+
+// debugf is logf for LOG_LEVEL=debug.
+func debugf(format string, args ...any) {
+	if debugLogging.Load() {
+		logf(format, args...)
+	}
+}
+
+// tunables are the daemon settings that can be changed at runtime, by the
+// name TUNING_FILE and the admin endpoint know them under.
+var tunables = []string{"TIMEOUT", "CONCURRENCY", "INTERVAL", "LOG_LEVEL"}
+
+// tuning holds the daemon settings changed at runtime, through TUNING_FILE
+// on SIGHUP or the admin endpoint, over the configured ones. Unlike a
+// restart, changing them keeps the flap, alert and certificate history, and
+// they outlive the configuration reload of each cycle.
+type tuning struct {
+	mu         sync.Mutex
+	overrides  map[string]string // tunable → value, validated
+	configured Config            // the last configuration apply saw
+	changed    chan struct{}     // signalled after every change
+}
+
+func newTuning() *tuning {
+	return &tuning{overrides: make(map[string]string), changed: make(chan struct{}, 1)}
+}
+
+// parseTunable validates value for the tunable name, e.g. "10s" for
+// TIMEOUT, returning the canonical name.
+func parseTunable(name, value string) (string, error) {
+	name = strings.ToUpper(name)
+	switch name {
+	case "TIMEOUT", "INTERVAL":
+		if _, err := parseSeconds(value); err != nil {
+			return "", fmt.Errorf("invalid %s %q: expected seconds or a Go duration", name, value)
+		}
+	case "CONCURRENCY":
+		if n, err := strconv.Atoi(value); err != nil || n < 0 {
+			return "", fmt.Errorf("invalid CONCURRENCY %q: expected a non-negative integer", value)
+		}
+	case "LOG_LEVEL":
+		if value != "info" && value != "debug" {
+			return "", fmt.Errorf("invalid LOG_LEVEL %q: expected info or debug", value)
+		}
+	default:
+		return "", fmt.Errorf("unknown setting %q: expected one of %s", name, strings.Join(tunables, ", "))
+	}
+	return name, nil
+}
+
+// parseSeconds parses a duration the way envDuration does: seconds, or a Go
+// duration, above zero.
+func parseSeconds(raw string) (time.Duration, error) {
+	if sec, err := strconv.Atoi(raw); err == nil && sec > 0 {
+		return time.Duration(sec) * time.Second, nil
+	}
+	if d, err := time.ParseDuration(raw); err == nil && d > 0 {
+		return d, nil
+	}
+	return 0, errors.New("invalid duration")
+}
+
+// apply records cfg as the configured settings and overrides them with the
+// runtime ones, including the log level.
+func (t *tuning) apply(cfg *Config) {
+	t.mu.Lock()
+	t.configured = *cfg
+	t.override(cfg)
+	t.mu.Unlock()
+	debugLogging.Store(cfg.LogLevel == "debug")
+}
+
+// current returns the last configuration apply saw, with the runtime
+// settings as they are now.
+func (t *tuning) current() Config {
+	t.mu.Lock()
+	cfg := t.configured
+	t.mu.Unlock()
+	t.apply(&cfg)
+	return cfg
+}
+
+// override sets the overridden settings of cfg. t.mu must be held.
+func (t *tuning) override(cfg *Config) {
+	for name, value := range t.overrides {
+		switch name {
+		case "TIMEOUT":
+			cfg.Timeout, _ = parseSeconds(value)
+		case "INTERVAL":
+			cfg.Interval, _ = parseSeconds(value)
+		case "CONCURRENCY":
+			cfg.Concurrency, _ = strconv.Atoi(value)
+		case "LOG_LEVEL":
+			cfg.LogLevel = value
+		}
+	}
+}
+
+// set replaces the overrides with settings, all of which must be valid.
+// With merge, the other overrides are kept. An empty value drops the
+// override.
+func (t *tuning) set(settings map[string]string, merge bool) error {
+	next := make(map[string]string)
+	if merge {
+		t.mu.Lock()
+		for k, v := range t.overrides {
+			next[k] = v
+		}
+		t.mu.Unlock()
+	}
+	for name, value := range settings {
+		if value == "" {
+			delete(next, strings.ToUpper(name))
+			continue
+		}
+		canonical, err := parseTunable(name, value)
+		if err != nil {
+			return err
+		}
+		next[canonical] = value
+	}
+	t.mu.Lock()
+	t.overrides = next
+	t.mu.Unlock()
+	select {
+	case t.changed <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// loadFile replaces the overrides with the NAME=value lines of path, which
+// may hold comments starting with #.
+func (t *tuning) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	settings := make(map[string]string)
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return fmt.Errorf("%s:%d: expected NAME=value", path, n)
+		}
+		settings[strings.TrimSpace(name)] = strings.Trim(strings.TrimSpace(value), `"'`)
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	if err := t.set(settings, false); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// tuningState is the admin endpoint's view of the settings.
+type tuningState struct {
+	Timeout     string            `json:"timeout"`
+	Concurrency int               `json:"concurrency"`
+	Interval    string            `json:"interval"`
+	LogLevel    string            `json:"log_level"`
+	Overrides   map[string]string `json:"overrides"` // the settings changed at runtime
+}
+
+// state returns the settings in effect.
+func (t *tuning) state() tuningState {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	cfg := t.configured
+	t.override(&cfg)
+	overrides := make(map[string]string, len(t.overrides))
+	for k, v := range t.overrides {
+		overrides[k] = v
+	}
+	return tuningState{
+		Timeout:     cfg.Timeout.String(),
+		Concurrency: cfg.Concurrency,
+		Interval:    cfg.Interval.String(),
+		LogLevel:    cfg.LogLevel,
+		Overrides:   overrides,
+	}
+}
+
+// String lists the overrides, e.g. "TIMEOUT=10s CONCURRENCY=8", or "none".
+func (t *tuning) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var parts []string
+	for _, name := range tunables {
+		if v, ok := t.overrides[name]; ok {
+			parts = append(parts, name+"="+v)
+		}
+	}
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, " ")
+}
+
+// watchSIGHUP re-reads path into t on every SIGHUP until ctx is done. Without
+// a path, SIGHUP is ignored rather than ending the process.
+func (t *tuning) watchSIGHUP(ctx context.Context, path string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+			}
+			if path == "" {
+				logf("SIGHUP: no TUNING_FILE to re-read")
+				continue
+			}
+			if err := t.loadFile(path); err != nil {
+				logf("SIGHUP: keeping the previous tuning: %v", err)
+				continue
+			}
+			logf("SIGHUP: tuning overrides: %s", t)
+		}
+	}()
+}
+
+// serveAdmin serves the settings on addr until ctx is done: GET /tuning
+// shows them, POST /tuning changes those given as form values, e.g.
+// timeout=10s, and DELETE /tuning drops every override. With token, every
+// request must carry it as its bearer token.
+func (t *tuning) serveAdmin(ctx context.Context, addr, token string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /tuning", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(t.state())
+	})
+	mux.HandleFunc("POST /tuning", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		settings := make(map[string]string)
+		for name, values := range r.Form {
+			settings[name] = values[len(values)-1]
+		}
+		if err := t.set(settings, true); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logf("admin: tuning overrides: %s", t)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(t.state())
+	})
+	mux.HandleFunc("DELETE /tuning", func(w http.ResponseWriter, r *http.Request) {
+		t.set(nil, false)
+		logf("admin: tuning overrides dropped")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(t.state())
+	})
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, token) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}
+	srv := &http.Server{Addr: addr, Handler: http.HandlerFunc(handler), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	if token == "" {
+		logf("ADMIN_ADDR: ADMIN_TOKEN is not set; any client that can reach %s can change the tuning", addr)
+	}
+	go func() {
+		logf("admin endpoint on http://%s/tuning", addr)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logf("ADMIN_ADDR: %v", err)
+		}
+	}()
+}
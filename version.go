@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// Build information, set at link time:
+//
+//	go build -ldflags "-X main.version=v1.2.0 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%FT%TZ)"
+//
+// Values left empty are filled in from the VCS information Go embeds when
+// building inside a git checkout.
+var (
+	version   = ""
+	commit    = ""
+	buildDate = ""
+)
+
+// buildInfo identifies the probe build that produced a report, so that
+// results collected from many clusters can be told apart by build.
+type buildInfo struct {
+	Version string     `json:"version"`
+	Commit  string     `json:"commit,omitempty"`
+	Date    string     `json:"date,omitempty"`
+	Crypto  cryptoInfo `json:"crypto"`
+}
+
+func currentBuild() buildInfo {
+	b := buildInfo{Version: version, Commit: commit, Date: buildDate, Crypto: currentCrypto()}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if b.Version == "" && info.Main.Version != "" && info.Main.Version != "(devel)" {
+			b.Version = info.Main.Version
+		}
+		dirty := false
+		for _, s := range info.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				if b.Commit == "" {
+					b.Commit = s.Value
+				}
+			case "vcs.time":
+				if b.Date == "" {
+					b.Date = s.Value
+				}
+			case "vcs.modified":
+				dirty = s.Value == "true"
+			}
+		}
+		if dirty && commit == "" && b.Commit != "" {
+			b.Commit += "-dirty"
+		}
+	}
+	if b.Version == "" {
+		b.Version = "dev"
+	}
+	return b
+}
+
+// String formats b as "v1.2.0 (commit 0123abc, built 2026-05-01)".
+func (b buildInfo) String() string {
+	s := b.Version
+	var extra string
+	if b.Commit != "" {
+		c, dirty := strings.CutSuffix(b.Commit, "-dirty")
+		if len(c) > 12 {
+			c = c[:12]
+		}
+		if dirty {
+			c += "-dirty"
+		}
+		extra = "commit " + c
+	}
+	if b.Date != "" {
+		date := b.Date
+		if t, err := time.Parse(time.RFC3339, b.Date); err == nil {
+			date = t.UTC().Format("2006-01-02")
+		}
+		if extra != "" {
+			extra += ", "
+		}
+		extra += "built " + date
+	}
+	if extra != "" {
+		s += fmt.Sprintf(" (%s)", extra)
+	}
+	return s
+}
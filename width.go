@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// Status glyphs for passed and failed phases, set with STATUS_GLYPHS.
+var passGlyph, failGlyph = "✅", "❌"
+
+var glyphPresets = map[string][2]string{
+	"emoji":   {"✅", "❌"},
+	"symbols": {"✓", "✗"},
+	"ascii":   {"+", "x"},
+}
+
+// setStatusGlyphs applies a STATUS_GLYPHS value: a preset name, or a pass
+// and a fail glyph separated by a comma. Glyphs may be up to two columns wide
+// so that they fit the tables.
+func setStatusGlyphs(raw string) error {
+	if raw == "" {
+		return nil
+	}
+	g, ok := glyphPresets[raw]
+	if !ok {
+		pass, fail, found := strings.Cut(raw, ",")
+		if !found || !glyphFits(pass) || !glyphFits(fail) {
+			return fmt.Errorf("invalid STATUS_GLYPHS %q: expected emoji, symbols, ascii or <pass>,<fail> glyphs up to two columns wide", raw)
+		}
+		g = [2]string{pass, fail}
+	}
+	passGlyph, failGlyph = g[0], g[1]
+	return nil
+}
+
+func glyphFits(s string) bool {
+	w := displayWidth(s)
+	return w >= 1 && w <= 2
+}
+
+// displayWidth is the number of terminal columns s takes up. ANSI escape
+// sequences take none. Characters the terminal joins into one glyph are
+// counted once: combining marks, zero-width joiner sequences, skin tone
+// modifiers and flag pairs. East Asian wide characters and emoji take two
+// columns, as does a narrow symbol followed by the emoji variation selector.
+func displayWidth(s string) int {
+	const (
+		text = iota
+		escape
+		csi
+	)
+	state := text
+	width := 0
+	last := 0 // width of the last character, for variation selectors
+	joined, flag := false, false
+	for _, r := range s {
+		switch state {
+		case escape:
+			state = text
+			if r == '[' {
+				state = csi
+			}
+			continue
+		case csi:
+			if r >= 0x40 && r <= 0x7e {
+				state = text
+			}
+			continue
+		}
+
+		switch {
+		case r == '\033':
+			state = escape
+		case joined:
+			// The character after a zero-width joiner merges into the one
+			// before it.
+			joined = false
+		case r == 0x200d:
+			joined = true
+		case r == 0xfe0f:
+			if last == 1 {
+				width++
+				last = 2
+			}
+		case r >= 0x1f3fb && r <= 0x1f3ff:
+			// Skin tone modifiers change the emoji before them.
+		case r >= 0x1f1e6 && r <= 0x1f1ff:
+			// Regional indicators pair up into one flag.
+			if flag {
+				flag = false
+				continue
+			}
+			flag = true
+			width += 2
+			last = 2
+			continue
+		case r < 0x20 || (r >= 0x7f && r < 0xa0),
+			r >= 0x1160 && r <= 0x11ff, // Hangul medial vowels and final consonants
+			unicode.In(r, unicode.Mn, unicode.Me, unicode.Cf):
+		default:
+			last = 1
+			if isWide(r) {
+				last = 2
+			}
+			width += last
+		}
+		flag = false
+	}
+	return width
+}
+
+// truncateWidth cuts s to at most width columns, ending it with "…" if
+// anything was cut.
+func truncateWidth(s string, width int) string {
+	if displayWidth(s) <= width {
+		return s
+	}
+	cut := 0
+	for i := range s {
+		if displayWidth(s[:i]) > width-1 {
+			break
+		}
+		cut = i
+	}
+	return s[:cut] + "…"
+}
+
+// wideRanges are the East Asian Wide and Fullwidth characters and the
+// emoji presented as emoji by default, all of which terminals draw two
+// columns wide.
+var wideRanges = [][2]rune{
+	{0x1100, 0x115f}, {0x231a, 0x231b}, {0x2329, 0x232a}, {0x23e9, 0x23ec},
+	{0x23f0, 0x23f0}, {0x23f3, 0x23f3}, {0x25fd, 0x25fe}, {0x2614, 0x2615},
+	{0x2648, 0x2653}, {0x267f, 0x267f}, {0x2693, 0x2693}, {0x26a1, 0x26a1},
+	{0x26aa, 0x26ab}, {0x26bd, 0x26be}, {0x26c4, 0x26c5}, {0x26ce, 0x26ce},
+	{0x26d4, 0x26d4}, {0x26ea, 0x26ea}, {0x26f2, 0x26f3}, {0x26f5, 0x26f5},
+	{0x26fa, 0x26fa}, {0x26fd, 0x26fd}, {0x2705, 0x2705}, {0x270a, 0x270b},
+	{0x2728, 0x2728}, {0x274c, 0x274c}, {0x274e, 0x274e}, {0x2753, 0x2755},
+	{0x2757, 0x2757}, {0x2795, 0x2797}, {0x27b0, 0x27b0}, {0x27bf, 0x27bf},
+	{0x2b1b, 0x2b1c}, {0x2b50, 0x2b50}, {0x2b55, 0x2b55}, {0x2e80, 0x303e},
+	{0x3041, 0x33ff}, {0x3400, 0x4dbf}, {0x4e00, 0x9fff}, {0xa000, 0xa4cf},
+	{0xa960, 0xa97f}, {0xac00, 0xd7a3}, {0xf900, 0xfaff}, {0xfe10, 0xfe19},
+	{0xfe30, 0xfe6f}, {0xff00, 0xff60}, {0xffe0, 0xffe6}, {0x16fe0, 0x16fe4},
+	{0x17000, 0x18aff}, {0x1b000, 0x1b2ff}, {0x1f004, 0x1f004}, {0x1f0cf, 0x1f0cf},
+	{0x1f18e, 0x1f18e}, {0x1f191, 0x1f19a}, {0x1f200, 0x1f202}, {0x1f210, 0x1f23b},
+	{0x1f240, 0x1f248}, {0x1f250, 0x1f251}, {0x1f260, 0x1f265}, {0x1f300, 0x1f320},
+	{0x1f32d, 0x1f335}, {0x1f337, 0x1f37c}, {0x1f37e, 0x1f393}, {0x1f3a0, 0x1f3ca},
+	{0x1f3cf, 0x1f3d3}, {0x1f3e0, 0x1f3f0}, {0x1f3f4, 0x1f3f4}, {0x1f3f8, 0x1f43e},
+	{0x1f440, 0x1f440}, {0x1f442, 0x1f4fc}, {0x1f4ff, 0x1f53d}, {0x1f54b, 0x1f54e},
+	{0x1f550, 0x1f567}, {0x1f57a, 0x1f57a}, {0x1f595, 0x1f596}, {0x1f5a4, 0x1f5a4},
+	{0x1f5fb, 0x1f64f}, {0x1f680, 0x1f6c5}, {0x1f6cc, 0x1f6cc}, {0x1f6d0, 0x1f6d2},
+	{0x1f6d5, 0x1f6d7}, {0x1f6dc, 0x1f6df}, {0x1f6eb, 0x1f6ec}, {0x1f6f4, 0x1f6fc},
+	{0x1f7e0, 0x1f7eb}, {0x1f7f0, 0x1f7f0}, {0x1f90c, 0x1f93a}, {0x1f93c, 0x1f945},
+	{0x1f947, 0x1f9ff}, {0x1fa70, 0x1faff}, {0x20000, 0x2fffd}, {0x30000, 0x3fffd},
+}
+
+func isWide(r rune) bool {
+	if r < wideRanges[0][0] {
+		return false
+	}
+	_, found := slices.BinarySearchFunc(wideRanges, r, func(rng [2]rune, r rune) int {
+		switch {
+		case r < rng[0]:
+			return 1
+		case r > rng[1]:
+			return -1
+		}
+		return 0
+	})
+	return found
+}